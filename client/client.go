@@ -0,0 +1,216 @@
+// Package client calls the chat server's JSON API. Its types and methods
+// follow the OpenAPI document the server publishes at /api/openapi.json.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Room is a chat room
+type Room struct {
+	ID              int64  `json:"id"`
+	Name            string `json:"name"`
+	Description     string `json:"description"`
+	SlowModeSeconds int    `json:"slowModeSeconds"`
+	Archived        bool   `json:"archived"`
+}
+
+// Chatter is a chat user
+type Chatter struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// Message is a stored chat message
+type Message struct {
+	ID          int64  `json:"id"`
+	UserID      int64  `json:"userId"`
+	RoomID      int64  `json:"roomId"`
+	Content     string `json:"content"`
+	Timestamp   string `json:"timestamp"`
+	ChatterName string `json:"chatterName"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+}
+
+// MessagePage is one page of a room's history, newest first. Pass NextBefore
+// to ListMessages for the next, older, page; it is 0 on the last page.
+type MessagePage struct {
+	Messages   []Message `json:"messages"`
+	NextBefore int64     `json:"nextBefore,omitempty"`
+}
+
+// CommandResult is what a slash command answered
+type CommandResult struct {
+	Command string `json:"command"`
+	Reply   string `json:"reply,omitempty"`
+}
+
+// Error is returned when the server answers with an error body
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// RetryAfter is how long to wait before posting again after a rate_limited error
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("chat API: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Client calls the API of one server with one token
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// New returns a client for the server at baseURL, such as http://localhost:3000
+func New(baseURL, token string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/") + "/api/v1",
+		token:      token,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// WithHTTPClient makes the client send its requests with hc
+func (c *Client) WithHTTPClient(hc *http.Client) *Client {
+	c.httpClient = hc
+	return c
+}
+
+// Me returns the chatter the token belongs to
+func (c *Client) Me(ctx context.Context) (*Chatter, error) {
+	var chatter Chatter
+	return &chatter, c.do(ctx, http.MethodGet, "/me", nil, &chatter)
+}
+
+// ListRooms returns the rooms that haven't been archived
+func (c *Client) ListRooms(ctx context.Context) ([]Room, error) {
+	var list struct {
+		Rooms []Room `json:"rooms"`
+	}
+	return list.Rooms, c.do(ctx, http.MethodGet, "/rooms", nil, &list)
+}
+
+// CreateRoom creates a room, which only admins can do
+func (c *Client) CreateRoom(ctx context.Context, name, description string) (*Room, error) {
+	body := map[string]string{"name": name, "description": description}
+	var room Room
+	return &room, c.do(ctx, http.MethodPost, "/rooms", body, &room)
+}
+
+// GetRoom returns a room, archived or not
+func (c *Client) GetRoom(ctx context.Context, roomID int64) (*Room, error) {
+	var room Room
+	return &room, c.do(ctx, http.MethodGet, fmt.Sprintf("/rooms/%d", roomID), nil, &room)
+}
+
+// ListMessages returns up to limit messages older than before, newest first.
+// Zero for before starts at the newest message and zero for limit uses the server's default.
+func (c *Client) ListMessages(ctx context.Context, roomID, before int64, limit int) (*MessagePage, error) {
+	query := url.Values{}
+	if before > 0 {
+		query.Set("before", strconv.FormatInt(before, 10))
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	path := fmt.Sprintf("/rooms/%d/messages", roomID)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var page MessagePage
+	return &page, c.do(ctx, http.MethodGet, path, nil, &page)
+}
+
+// PostMessage posts a message to a room as the token's chatter. Content
+// starting with / is run as a slash command instead, use RunCommand for those.
+func (c *Client) PostMessage(ctx context.Context, roomID int64, content string) (*Message, error) {
+	body := map[string]string{"content": content}
+	var msg Message
+	return &msg, c.do(ctx, http.MethodPost, fmt.Sprintf("/rooms/%d/messages", roomID), body, &msg)
+}
+
+// RunCommand runs a slash command such as "/nick Ada" in a room as the token's chatter
+func (c *Client) RunCommand(ctx context.Context, roomID int64, command string) (*CommandResult, error) {
+	body := map[string]string{"content": command}
+	var result CommandResult
+	return &result, c.do(ctx, http.MethodPost, fmt.Sprintf("/rooms/%d/messages", roomID), body, &result)
+}
+
+// GetChatter returns a chatter's public profile
+func (c *Client) GetChatter(ctx context.Context, chatterID int64) (*Chatter, error) {
+	var chatter Chatter
+	return &chatter, c.do(ctx, http.MethodGet, fmt.Sprintf("/chatters/%d", chatterID), nil, &chatter)
+}
+
+// do sends a request with an optional JSON body and decodes the response into out
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return readError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("chat API: failed to decode %s %s response: %w", method, path, err)
+	}
+	return nil
+}
+
+// readError turns an error response into an *Error, even if its body isn't the usual JSON
+func readError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body); err == nil {
+		apiErr.Code = body.Error.Code
+		apiErr.Message = body.Error.Message
+	} else {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return apiErr
+}
@@ -0,0 +1,91 @@
+package bots
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Bot reacts to activity in a room it is installed in. Replies are posted to
+// the room by the Runner, an empty reply posts nothing.
+type Bot interface {
+	OnMessage(ctx context.Context, msg Message) (string, error)
+	OnJoin(ctx context.Context, join Join) (string, error)
+	OnCommand(ctx context.Context, cmd Command) (string, error)
+}
+
+// Streamer is a Bot whose message replies arrive a piece at a time. The
+// Runner posts the reply when the first piece arrives and edits that same
+// message as the rest streams in.
+type Streamer interface {
+	Bot
+	// OnMessageStream calls stream with the whole reply so far each time it grows
+	OnMessageStream(ctx context.Context, msg Message, stream func(reply string) error) error
+}
+
+// Message is a message posted in the bot's room by someone else
+type Message struct {
+	ID        int64
+	RoomID    int64
+	ChatterID int64
+	Content   string
+}
+
+// Join is a chatter opening the bot's room
+type Join struct {
+	RoomID    int64
+	ChatterID int64
+	Name      string
+}
+
+// Command is a slash command a chatter ran in the bot's room
+type Command struct {
+	RoomID    int64
+	ChatterID int64
+	Name      string
+	Args      []string
+}
+
+// Base ignores every event, embed it to handle only some of them
+type Base struct{}
+
+func (Base) OnMessage(ctx context.Context, msg Message) (string, error) { return "", nil }
+func (Base) OnJoin(ctx context.Context, join Join) (string, error)      { return "", nil }
+func (Base) OnCommand(ctx context.Context, cmd Command) (string, error) { return "", nil }
+
+const (
+	// historyKey is where a bot's recent replies are kept in its State
+	historyKey = "lastResponses"
+	// historySize is how many recent replies are kept
+	historySize = 5
+	// historyTTL is how long recent replies are kept after the last one
+	historyTTL = 24 * time.Hour
+)
+
+// history keeps a bot's most recent replies in its State
+type history struct {
+	state *State
+}
+
+// LastResponses returns the bot's recent replies, oldest first
+func (h history) LastResponses() ([]string, error) {
+	var responses []string
+	_, err := h.state.GetJSON(historyKey, &responses)
+	return responses, err
+}
+
+// remember adds a reply to the history. Failing to store it shouldn't stop
+// the reply, so errors are only logged.
+func (h history) remember(response string) {
+	responses, err := h.LastResponses()
+	if err != nil {
+		log.Printf("failed to read bot history: %v", err)
+	}
+	responses = append(responses, response)
+	if len(responses) > historySize {
+		responses = responses[len(responses)-historySize:]
+	}
+	if err := h.state.SetJSON(historyKey, responses, historyTTL); err != nil {
+		log.Printf("failed to store bot history: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package bots
+
+import (
+	"context"
+	"go-star/common"
+	"go-star/common/dal"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSarkyReply(t *testing.T) {
+	state := setupStateTest(t, "test_sarky_reply", common.DefaultConfig().Bots, time.Now)
+	bot, _ := NewSarkyBot(dal.BotInstallation{}, state)
+	reply, err := bot.OnMessage(context.Background(), Message{Content: "hello, world"})
+	if err != nil {
+		t.Fatalf("OnMessage() failed: %v", err)
+	}
+	if reply != "hElLo, WoRlD" {
+		t.Errorf("Expected alternating case, got %q", reply)
+	}
+
+	for i := 0; i < 7; i++ {
+		bot.OnMessage(context.Background(), Message{Content: "again"})
+	}
+	responses, err := bot.(*SarkyBot).LastResponses()
+	if err != nil {
+		t.Fatalf("LastResponses() failed: %v", err)
+	}
+	if len(responses) != 5 || responses[4] != "aGaIn" {
+		t.Errorf("Expected the 5 latest responses, got %q", responses)
+	}
+
+	// A new bot on the same state remembers them, like after a restart
+	restarted, _ := NewSarkyBot(dal.BotInstallation{}, state)
+	if again, _ := restarted.(*SarkyBot).LastResponses(); len(again) != 5 {
+		t.Errorf("Expected the responses to outlive the bot, got %q", again)
+	}
+}
+
+func TestPositiveBot(t *testing.T) {
+	bot, _ := NewPositiveBot(dal.BotInstallation{}, setupStateTest(t, "test_positive_bot", common.DefaultConfig().Bots, time.Now))
+	if reply, _ := bot.OnMessage(context.Background(), Message{Content: "meh"}); !strings.Contains(reply, "positive vibes") {
+		t.Errorf("Expected a cheerful reply, got %q", reply)
+	}
+	if reply, _ := bot.OnJoin(context.Background(), Join{Name: "Alice"}); !strings.Contains(reply, "Alice") {
+		t.Errorf("Expected a welcome for Alice, got %q", reply)
+	}
+	if reply, _ := bot.OnCommand(context.Background(), Command{Name: "cheer", Args: []string{"Bob"}}); !strings.Contains(reply, "Go Bob") {
+		t.Errorf("Expected a cheer for Bob, got %q", reply)
+	}
+	if reply, _ := bot.OnCommand(context.Background(), Command{Name: "help"}); reply != "" {
+		t.Errorf("Expected no reply to other commands, got %q", reply)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := DefaultRegistry()
+
+	var names []string
+	for _, kind := range r.Kinds() {
+		names = append(names, kind.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"positive", "sarky"}) {
+		t.Errorf("Expected the built-in kinds, got %v", names)
+	}
+
+	bot, err := r.New(dal.BotInstallation{Kind: "sarky"}, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	if _, ok := bot.(*SarkyBot); !ok {
+		t.Errorf("Expected a SarkyBot, got %T", bot)
+	}
+	if _, err := r.New(dal.BotInstallation{Kind: "missing"}, nil); err == nil {
+		t.Error("Expected error for an unknown kind")
+	}
+
+	commands := r.Commands([]dal.BotInstallation{{Kind: "sarky"}, {Kind: "positive"}, {Kind: "sarky"}, {Kind: "missing"}})
+	names = nil
+	for _, cmd := range commands {
+		names = append(names, cmd.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"cheer", "sarcasm"}) {
+		t.Errorf("Expected each bot command once, got %v", names)
+	}
+}
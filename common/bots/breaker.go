@@ -0,0 +1,54 @@
+package bots
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker switches a bot off after too many failed or throttled replies in
+// a row, which usually means it is stuck in a loop. After the cooldown the
+// bot gets one more try, and a single failure switches it off again.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	now       func() time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration, now func() time.Time) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown, now: now}
+}
+
+// Allow reports whether the bot may handle an event
+func (b *breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.now().Before(b.openUntil)
+}
+
+// Success resets the failure count
+func (b *breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// Failure counts a failed reply and reports whether it opened the breaker
+func (b *breaker) Failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold <= 0 {
+		return false
+	}
+
+	b.failures++
+	if b.failures < b.threshold {
+		return false
+	}
+	// Stay one failure from the threshold, so a failure after the cooldown reopens it
+	b.failures = b.threshold - 1
+	b.openUntil = b.now().Add(b.cooldown)
+	return true
+}
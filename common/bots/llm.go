@@ -0,0 +1,114 @@
+package bots
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-star/common/dal"
+	"strings"
+)
+
+// llmSettings are an llm bot's options, read from its installation config
+type llmSettings struct {
+	// SystemPrompt sets the bot's personality for its room
+	SystemPrompt string `json:"systemPrompt"`
+	// ContextMessages is how many recent room messages are sent with each request
+	ContextMessages int `json:"contextMessages"`
+	// ContextTokens is the token budget for the prompt and room messages
+	ContextTokens int `json:"contextTokens"`
+	// MaxTokens caps the length of each reply
+	MaxTokens int `json:"maxTokens"`
+	// ReplyToAll answers every message instead of only ones that @mention the bot
+	ReplyToAll bool `json:"replyToAll"`
+}
+
+// LLMBot answers chatters using a chat completion backend, sending the
+// room's recent messages along as context
+type LLMBot struct {
+	Base
+	db           *sql.DB
+	backend      CompletionBackend
+	installation dal.BotInstallation
+	settings     llmSettings
+}
+
+// NewLLMBotFactory returns a Factory for llm bots that share one backend
+func NewLLMBotFactory(db *sql.DB, backend CompletionBackend) Factory {
+	return func(installation dal.BotInstallation, state *State) (Bot, error) {
+		settings := llmSettings{
+			SystemPrompt:    fmt.Sprintf("You are %s, a friendly member of a group chat. Keep your replies short.", installation.Name),
+			ContextMessages: 20,
+			ContextTokens:   2000,
+			MaxTokens:       300,
+		}
+		if err := json.Unmarshal([]byte(installation.Config), &settings); err != nil {
+			return nil, fmt.Errorf("invalid llm bot config: %w", err)
+		}
+		return &LLMBot{db: db, backend: backend, installation: installation, settings: settings}, nil
+	}
+}
+
+func (bot *LLMBot) OnMessage(ctx context.Context, msg Message) (string, error) {
+	var reply string
+	err := bot.OnMessageStream(ctx, msg, func(text string) error {
+		reply = text
+		return nil
+	})
+	return reply, err
+}
+
+func (bot *LLMBot) OnMessageStream(ctx context.Context, msg Message, stream func(reply string) error) error {
+	if !bot.settings.ReplyToAll && !strings.Contains(strings.ToLower(msg.Content), "@"+strings.ToLower(bot.installation.Username)) {
+		return nil
+	}
+
+	req, err := bot.request(msg.RoomID)
+	if err != nil {
+		return err
+	}
+
+	var reply strings.Builder
+	return bot.backend.Complete(ctx, req, func(delta string) error {
+		reply.WriteString(delta)
+		return stream(reply.String())
+	})
+}
+
+// request builds the conversation from the system prompt and as many recent
+// room messages as fit in the token budget
+func (bot *LLMBot) request(roomID int64) (CompletionRequest, error) {
+	messages, err := dal.ListMessagesForRoom(bot.db, roomID)
+	if err != nil {
+		return CompletionRequest{}, fmt.Errorf("failed to load room context: %w", err)
+	}
+
+	budget := bot.settings.ContextTokens - estimateTokens(bot.settings.SystemPrompt)
+	var context []ChatMessage
+	// Messages come newest first, so the oldest are the ones left out
+	for i := 0; i < len(messages) && i < bot.settings.ContextMessages; i++ {
+		m := messages[i]
+		turn := ChatMessage{Role: RoleUser, Content: fmt.Sprintf("%s: %s", m.ChatterName, m.Content)}
+		if m.Username == bot.installation.Username {
+			turn = ChatMessage{Role: RoleAssistant, Content: m.Content}
+		}
+
+		budget -= estimateTokens(turn.Content)
+		if budget < 0 {
+			break
+		}
+		context = append(context, turn)
+	}
+
+	conversation := []ChatMessage{{Role: RoleSystem, Content: bot.settings.SystemPrompt}}
+	for i := len(context) - 1; i >= 0; i-- {
+		conversation = append(conversation, context[i])
+	}
+	return CompletionRequest{Messages: conversation, MaxTokens: bot.settings.MaxTokens}, nil
+}
+
+// estimateTokens roughly counts the tokens in a message, about four
+// characters each plus a few for the message's framing
+func estimateTokens(text string) int {
+	return (len(text)+3)/4 + 4
+}
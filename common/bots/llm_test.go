@@ -0,0 +1,243 @@
+package bots
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-star/common"
+	"go-star/common/dal"
+	"go-star/common/moderation"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// fakeCompletions serves an OpenAI-compatible streaming endpoint that
+// replies with the given pieces, recording the last request
+type fakeCompletions struct {
+	mu      sync.Mutex
+	pieces  []string
+	request openAIRequest
+	auth    string
+}
+
+func (f *fakeCompletions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/chat/completions" {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	f.auth = r.Header.Get("Authorization")
+	err := json.NewDecoder(r.Body).Decode(&f.request)
+	f.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, piece := range f.pieces {
+		data, _ := json.Marshal(map[string]any{
+			"choices": []map[string]any{{"delta": map[string]string{"content": piece}}},
+		})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		w.(http.Flusher).Flush()
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func (f *fakeCompletions) lastRequest() openAIRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.request
+}
+
+func newFakeBackend(t *testing.T, pieces ...string) (*fakeCompletions, *OpenAIBackend) {
+	t.Helper()
+	fake := &fakeCompletions{pieces: pieces}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, NewOpenAIBackend(common.LLMConfig{BaseURL: server.URL + "/v1/", APIKey: "secret", Model: "test-model", Timeout: 5 * time.Second})
+}
+
+func TestOpenAIBackend(t *testing.T) {
+	fake, backend := newFakeBackend(t, "Hello", " there", "!")
+
+	var deltas []string
+	err := backend.Complete(context.Background(), CompletionRequest{
+		Messages:  []ChatMessage{{Role: RoleUser, Content: "hi"}},
+		MaxTokens: 50,
+	}, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Complete() failed: %v", err)
+	}
+	if strings.Join(deltas, "|") != "Hello| there|!" {
+		t.Errorf("Expected three deltas, got %q", deltas)
+	}
+
+	req := fake.lastRequest()
+	if req.Model != "test-model" || !req.Stream || req.MaxTokens != 50 || len(req.Messages) != 1 {
+		t.Errorf("Unexpected request: %+v", req)
+	}
+	if fake.auth != "Bearer secret" {
+		t.Errorf("Expected the API key as a bearer token, got %q", fake.auth)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no credits", http.StatusPaymentRequired)
+	}))
+	defer failing.Close()
+	broken := NewOpenAIBackend(common.LLMConfig{BaseURL: failing.URL, Model: "test-model"})
+	err = broken.Complete(context.Background(), CompletionRequest{}, func(string) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "no credits") {
+		t.Errorf("Expected the error body in the error, got %v", err)
+	}
+}
+
+// recordingBackend answers with a fixed reply and records each request
+type recordingBackend struct {
+	reply    string
+	requests []CompletionRequest
+}
+
+func (b *recordingBackend) Complete(ctx context.Context, req CompletionRequest, onDelta func(string) error) error {
+	b.requests = append(b.requests, req)
+	return onDelta(b.reply)
+}
+
+func TestLLMBotContext(t *testing.T) {
+	testDBName := "test_llm_context"
+	defer os.Remove("./" + testDBName + ".db")
+	db, err := dal.SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	alice, _ := dal.InsertChatter(db, "alice", "Alice")
+	helper, _ := dal.InsertChatter(db, "helper", "Helper")
+	dal.InsertMessage(db, alice.ID, 1, strings.Repeat("old news ", 40))
+	dal.InsertMessage(db, alice.ID, 1, "what's for lunch?")
+	dal.InsertMessage(db, helper.ID, 1, "Soup!")
+	dal.InsertMessage(db, alice.ID, 1, "@Helper which soup?")
+
+	backend := &recordingBackend{reply: "Tomato."}
+	factory := NewLLMBotFactory(db, backend)
+	// The budget fits the prompt and the three newest messages, not the long old one
+	bot, err := factory(dal.BotInstallation{Kind: "llm", Name: "Helper", Username: "helper", Config: `{"systemPrompt": "Talk about soup.", "contextTokens": 60, "maxTokens": 20}`}, nil)
+	if err != nil {
+		t.Fatalf("factory failed: %v", err)
+	}
+
+	if reply, _ := bot.OnMessage(context.Background(), Message{RoomID: 1, Content: "no mention here"}); reply != "" || len(backend.requests) != 0 {
+		t.Errorf("Expected messages without a mention to be ignored, got %q", reply)
+	}
+
+	reply, err := bot.OnMessage(context.Background(), Message{RoomID: 1, Content: "@Helper which soup?"})
+	if err != nil {
+		t.Fatalf("OnMessage() failed: %v", err)
+	}
+	if reply != "Tomato." {
+		t.Errorf("Expected the backend's reply, got %q", reply)
+	}
+
+	req := backend.requests[0]
+	want := []ChatMessage{
+		{Role: RoleSystem, Content: "Talk about soup."},
+		{Role: RoleUser, Content: "Alice: what's for lunch?"},
+		{Role: RoleAssistant, Content: "Soup!"},
+		{Role: RoleUser, Content: "Alice: @Helper which soup?"},
+	}
+	if fmt.Sprint(req.Messages) != fmt.Sprint(want) {
+		t.Errorf("Unexpected context:\n got %v\nwant %v", req.Messages, want)
+	}
+	if req.MaxTokens != 20 {
+		t.Errorf("Expected max tokens 20, got %d", req.MaxTokens)
+	}
+
+	if _, err := factory(dal.BotInstallation{Config: "not json"}, nil); err == nil {
+		t.Error("Expected error for an invalid config")
+	}
+}
+
+func TestRunnerStreamsLLMReplies(t *testing.T) {
+	db, nc, room, alice := setupRunnerTest(t, "test_runner_llm")
+	_, backend := newFakeBackend(t, "Soup ", "is ", "good.")
+
+	registry := DefaultRegistry()
+	registry.Register("llm", "test", NewLLMBotFactory(db, backend))
+	dal.InstallBot(db, room.ID, "llm", "Helper", "helper", "")
+
+	// Each reading of the clock moves on a second, so every piece is patched in
+	var clockMu sync.Mutex
+	now := time.Now()
+	clock := func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		now = now.Add(time.Second)
+		return now
+	}
+
+	edits := make(chan common.MessageEditEvent, 10)
+	editSub, _ := nc.Subscribe(common.RoomEditsSubject(room.ID), func(msg *nats.Msg) {
+		var edit common.MessageEditEvent
+		json.Unmarshal(msg.Data, &edit)
+		edits <- edit
+	})
+	defer editSub.Unsubscribe()
+	events := make(chan common.MessageEvent, 10)
+	msgSub, _ := nc.Subscribe(common.RoomMessagesSubject(room.ID), func(msg *nats.Msg) {
+		var event common.MessageEvent
+		json.Unmarshal(msg.Data, &event)
+		events <- event
+	})
+	defer msgSub.Unsubscribe()
+
+	runner := NewRunner(db, nc, registry, moderation.Default(db), common.DefaultConfig().Bots).WithClock(clock)
+	startRunner(t, nc, runner)
+	say(t, db, nc, alice, room.ID, "@helper is soup good?")
+
+	if count := settle(t, db, room.ID); count != 2 {
+		t.Fatalf("Expected one streamed reply, got %d messages", count)
+	}
+	messages, _ := dal.ListMessagesForRoom(db, room.ID)
+	if messages[0].Username != "helper" || messages[0].Content != "Soup is good." {
+		t.Errorf("Expected the whole reply in one message, got %+v", messages[0])
+	}
+
+	// The chatter's message, the reply's first piece, then the finished reply
+	var published []common.MessageEvent
+	for len(published) < 3 {
+		select {
+		case event := <-events:
+			published = append(published, event)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected 3 message events, got %+v", published)
+		}
+	}
+	if !published[1].Partial || published[1].Content != "Soup " || published[2].Partial || published[2].Content != "Soup is good." {
+		t.Errorf("Unexpected message events: %+v", published)
+	}
+	if published[1].ID != messages[0].ID || published[2].ID != messages[0].ID {
+		t.Errorf("Expected every event to be for the same message, got %+v", published)
+	}
+
+	if len(edits) == 0 {
+		t.Error("Expected the reply to be patched as it streamed")
+	}
+	for len(edits) > 0 {
+		if edit := <-edits; edit.ID != messages[0].ID {
+			t.Errorf("Expected edits of message %d, got %+v", messages[0].ID, edit)
+		}
+	}
+}
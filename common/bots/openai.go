@@ -0,0 +1,127 @@
+package bots
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-star/common"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ChatMessage is one turn of a conversation sent to a completion backend
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Chat message roles
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// CompletionRequest is a conversation to continue
+type CompletionRequest struct {
+	Messages []ChatMessage
+	// MaxTokens caps the length of the reply, 0 leaves it to the backend
+	MaxTokens int
+}
+
+// CompletionBackend continues conversations, calling onDelta with each piece
+// of the reply as it arrives
+type CompletionBackend interface {
+	Complete(ctx context.Context, req CompletionRequest, onDelta func(delta string) error) error
+}
+
+// OpenAIBackend streams completions from an OpenAI-compatible
+// /chat/completions endpoint
+type OpenAIBackend struct {
+	baseURL string
+	apiKey  string
+	model   string
+	client  *http.Client
+}
+
+func NewOpenAIBackend(cfg common.LLMConfig) *OpenAIBackend {
+	return &OpenAIBackend{
+		baseURL: strings.TrimSuffix(cfg.BaseURL, "/"),
+		apiKey:  cfg.APIKey,
+		model:   cfg.Model,
+		client:  &http.Client{Timeout: cfg.Timeout},
+	}
+}
+
+type openAIRequest struct {
+	Model     string        `json:"model"`
+	Messages  []ChatMessage `json:"messages"`
+	MaxTokens int           `json:"max_tokens,omitempty"`
+	Stream    bool          `json:"stream"`
+}
+
+type openAIChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+}
+
+func (b *OpenAIBackend) Complete(ctx context.Context, req CompletionRequest, onDelta func(delta string) error) error {
+	body, err := json.Marshal(openAIRequest{Model: b.model, Messages: req.Messages, MaxTokens: req.MaxTokens, Stream: true})
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, b.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "text/event-stream")
+	if b.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+b.apiKey)
+	}
+
+	resp, err := b.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("completion failed with %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+
+	// The reply arrives as server-sent events, one JSON chunk per data line
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return nil
+		}
+
+		var chunk openAIChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("invalid completion chunk: %w", err)
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			if err := onDelta(choice.Delta.Content); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,39 @@
+package bots
+
+import (
+	"context"
+	"fmt"
+	"go-star/common/dal"
+	"strings"
+)
+
+var positiveCommands = []CommandHelp{
+	{Name: "cheer", Usage: "/cheer <name>", Help: "Cheers someone on"},
+}
+
+// PositiveBot cheers on every message and welcomes chatters to the room
+type PositiveBot struct {
+	Base
+	history
+}
+
+func NewPositiveBot(installation dal.BotInstallation, state *State) (Bot, error) {
+	return &PositiveBot{history: history{state: state}}, nil
+}
+
+func (bot *PositiveBot) OnMessage(ctx context.Context, msg Message) (string, error) {
+	response := "That's great to hear! Keep up the positive vibes!"
+	bot.remember(response)
+	return response, nil
+}
+
+func (bot *PositiveBot) OnJoin(ctx context.Context, join Join) (string, error) {
+	return fmt.Sprintf("Welcome %s, lovely to see you!", join.Name), nil
+}
+
+func (bot *PositiveBot) OnCommand(ctx context.Context, cmd Command) (string, error) {
+	if cmd.Name != "cheer" || len(cmd.Args) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("Go %s, you're doing amazing!", strings.Join(cmd.Args, " ")), nil
+}
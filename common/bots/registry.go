@@ -0,0 +1,90 @@
+package bots
+
+import (
+	"fmt"
+	"go-star/common/dal"
+	"sort"
+)
+
+// Factory creates the bot for one room installation, given the store it
+// keeps its state in
+type Factory func(installation dal.BotInstallation, state *State) (Bot, error)
+
+// CommandHelp describes a slash command a kind of bot answers
+type CommandHelp struct {
+	Name  string
+	Usage string
+	Help  string
+}
+
+// Kind is a kind of bot that can be installed in rooms
+type Kind struct {
+	Name        string
+	Description string
+	Commands    []CommandHelp
+	factory     Factory
+}
+
+// Registry holds the kinds of bot that can be installed in rooms
+type Registry struct {
+	kinds map[string]Kind
+}
+
+func NewRegistry() *Registry {
+	return &Registry{kinds: make(map[string]Kind)}
+}
+
+// DefaultRegistry returns a registry holding the built-in bots
+func DefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.Register("sarky", "Repeats every message back in aLtErNaTiNg CaSe", NewSarkyBot, sarkyCommands...)
+	r.Register("positive", "Cheers everyone on and welcomes new chatters", NewPositiveBot, positiveCommands...)
+	return r
+}
+
+// Register adds a kind of bot and the slash commands it answers, replacing
+// any kind with the same name
+func (r *Registry) Register(name, description string, factory Factory, commands ...CommandHelp) {
+	r.kinds[name] = Kind{Name: name, Description: description, Commands: commands, factory: factory}
+}
+
+// Kinds returns the registered kinds sorted by name
+func (r *Registry) Kinds() []Kind {
+	kinds := make([]Kind, 0, len(r.kinds))
+	for _, kind := range r.kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i].Name < kinds[j].Name })
+	return kinds
+}
+
+// Has reports whether a kind of bot is registered
+func (r *Registry) Has(name string) bool {
+	_, ok := r.kinds[name]
+	return ok
+}
+
+// Commands returns the slash commands answered by the installed bots
+func (r *Registry) Commands(installations []dal.BotInstallation) []CommandHelp {
+	seen := make(map[string]bool)
+	var commands []CommandHelp
+	for _, installation := range installations {
+		for _, cmd := range r.kinds[installation.Kind].Commands {
+			if !seen[cmd.Name] {
+				seen[cmd.Name] = true
+				commands = append(commands, cmd)
+			}
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+// New creates the bot for an installation
+func (r *Registry) New(installation dal.BotInstallation, state *State) (Bot, error) {
+	kind, ok := r.kinds[installation.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown bot kind '%s'", installation.Kind)
+	}
+	return kind.factory(installation, state)
+}
@@ -0,0 +1,441 @@
+package bots
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-star/common"
+	"go-star/common/dal"
+	"go-star/common/moderation"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// settings are the runner's options for one installation, read from its JSON config
+type settings struct {
+	// ListenToBots feeds other bots' messages to this bot. Bots never see their own.
+	ListenToBots bool `json:"listenToBots"`
+}
+
+// installedBot is a bot running in one room
+type installedBot struct {
+	installation dal.BotInstallation
+	settings     settings
+	chatterID    int64
+	bot          Bot
+	breaker      *breaker
+}
+
+// Runner feeds room activity to the bots installed in each room and posts
+// their replies, so bots never publish or store messages themselves.
+type Runner struct {
+	db        *sql.DB
+	nc        *nats.Conn
+	registry  *Registry
+	moderator moderation.Moderator
+	limits    common.BotLimitConfig
+	replies   *common.RateLimiter
+	now       func() time.Time
+
+	mu    sync.Mutex
+	rooms map[int64][]*installedBot
+}
+
+func NewRunner(db *sql.DB, nc *nats.Conn, registry *Registry, moderator moderation.Moderator, limits common.BotLimitConfig) *Runner {
+	var interval time.Duration
+	if limits.RepliesPerMinute > 0 {
+		interval = time.Minute / time.Duration(limits.RepliesPerMinute)
+	}
+	return &Runner{
+		db:        db,
+		nc:        nc,
+		registry:  registry,
+		moderator: moderator,
+		limits:    limits,
+		replies:   common.NewRateLimiter(limits.RepliesPerMinute, interval),
+		now:       time.Now,
+		rooms:     make(map[int64][]*installedBot),
+	}
+}
+
+// WithClock replaces the runner's time source, for tests
+func (r *Runner) WithClock(now func() time.Time) *Runner {
+	r.now = now
+	r.replies.WithClock(now)
+	return r
+}
+
+// Load reads the bot installations from the database, keeping bots that are
+// still installed so they hold on to their state
+func (r *Runner) Load() error {
+	installations, err := dal.ListBotInstallations(r.db)
+	if err != nil {
+		return err
+	}
+
+	if _, err := dal.DeleteExpiredBotState(r.db, r.now()); err != nil {
+		log.Printf("failed to delete expired bot state: %v", err)
+	}
+	if _, err := dal.DeleteStaleProcessedEvents(r.db, r.now()); err != nil {
+		log.Printf("failed to delete old processed events: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	running := make(map[int64]*installedBot)
+	for _, bots := range r.rooms {
+		for _, b := range bots {
+			running[b.installation.ID] = b
+		}
+	}
+
+	rooms := make(map[int64][]*installedBot)
+	for _, installation := range installations {
+		if b, ok := running[installation.ID]; ok {
+			rooms[installation.RoomID] = append(rooms[installation.RoomID], b)
+			continue
+		}
+
+		var s settings
+		if err := json.Unmarshal([]byte(installation.Config), &s); err != nil {
+			log.Printf("invalid config for bot %d: %v", installation.ID, err)
+			continue
+		}
+		state := NewState(r.db, installation.ID, r.limits, func() time.Time { return r.now() })
+		bot, err := r.registry.New(installation, state)
+		if err != nil {
+			log.Printf("failed to create bot %d: %v", installation.ID, err)
+			continue
+		}
+		chatterID, err := ensureBotUserExists(r.db, installation)
+		if err != nil {
+			log.Printf("failed to ensure bot user exists: %v", err)
+			continue
+		}
+		rooms[installation.RoomID] = append(rooms[installation.RoomID], &installedBot{
+			installation: installation,
+			settings:     s,
+			chatterID:    chatterID,
+			bot:          bot,
+			breaker:      newBreaker(r.limits.BreakerThreshold, r.limits.BreakerCooldown, func() time.Time { return r.now() }),
+		})
+	}
+
+	r.rooms = rooms
+	return nil
+}
+
+func ensureBotUserExists(db *sql.DB, installation dal.BotInstallation) (int64, error) {
+	chatter, err := dal.EnsureSystemChatter(db, installation.Username, installation.Name)
+	if err != nil {
+		return 0, err
+	}
+	return chatter.ID, nil
+}
+
+// Consumer is the name of the runner's durable consumer of the CHAT stream
+const Consumer = "bots"
+
+// Name makes the runner a common.Worker, so only one instance in a cluster
+// hands events to bots
+func (r *Runner) Name() string {
+	return Consumer
+}
+
+// Run delivers room messages, joins and commands to bots until the context
+// is cancelled. Events wait in the CHAT stream while the runner is slow or
+// down, so bots never miss one.
+func (r *Runner) Run(ctx context.Context) error {
+	if err := r.Load(); err != nil {
+		return err
+	}
+
+	sub, err := r.nc.Subscribe(common.BotsChangedSubject, func(*nats.Msg) {
+		if err := r.Load(); err != nil {
+			log.Printf("failed to reload bots: %v", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	log.Println("bot runner listening")
+	err = common.ConsumeChatStream(ctx, r.nc, Consumer, common.ChatStreamSubjects, func(event common.StreamEvent) error {
+		return r.handle(ctx, event)
+	})
+	log.Println("bot runner stopped")
+	return err
+}
+
+// handle passes one event to the room's bots, unless they already had it
+// before a redelivery
+func (r *Runner) handle(ctx context.Context, event common.StreamEvent) error {
+	key := eventKey(event)
+	done, err := dal.IsEventProcessed(r.db, Consumer, key)
+	if err != nil || done {
+		return err
+	}
+
+	r.dispatch(ctx, event)
+
+	_, err = dal.MarkEventProcessed(r.db, Consumer, key)
+	return err
+}
+
+// eventKey is what an event is remembered by once handled. Complete messages
+// go by their ID, so bots answer a message published twice only once.
+func eventKey(event common.StreamEvent) string {
+	if strings.HasSuffix(event.Subject, ".messages") {
+		var msg common.MessageEvent
+		if err := json.Unmarshal(event.Data, &msg); err == nil && msg.ID != 0 && !msg.Partial {
+			return fmt.Sprintf("message-%d", msg.ID)
+		}
+	}
+	return event.Key
+}
+
+func (r *Runner) dispatch(ctx context.Context, event common.StreamEvent) {
+	switch {
+	case strings.HasSuffix(event.Subject, ".messages"):
+		var msg common.MessageEvent
+		if err := json.Unmarshal(event.Data, &msg); err != nil {
+			log.Printf("failed to decode message event: %v", err)
+			return
+		}
+		// Streaming replies are handed to bots once they are complete
+		if msg.Content == "" || msg.Partial {
+			return
+		}
+		message := Message{
+			ID:        msg.ID,
+			RoomID:    msg.RoomID,
+			ChatterID: msg.ChatterID,
+			Content:   msg.Content,
+		}
+		r.each(ctx, msg.RoomID, msg.BotID, &message, func(b Bot) (string, error) { return b.OnMessage(ctx, message) })
+
+	case strings.HasSuffix(event.Subject, ".joins"):
+		var join common.JoinEvent
+		if err := json.Unmarshal(event.Data, &join); err != nil {
+			log.Printf("failed to decode join event: %v", err)
+			return
+		}
+		j := Join{RoomID: join.RoomID, ChatterID: join.ChatterID, Name: join.Name}
+		r.each(ctx, join.RoomID, 0, nil, func(b Bot) (string, error) { return b.OnJoin(ctx, j) })
+
+	case strings.HasSuffix(event.Subject, ".commands"):
+		var command common.CommandEvent
+		if err := json.Unmarshal(event.Data, &command); err != nil {
+			log.Printf("failed to decode command event: %v", err)
+			return
+		}
+		cmd := Command{RoomID: command.RoomID, ChatterID: command.ChatterID, Name: command.Name, Args: command.Args}
+		r.each(ctx, command.RoomID, 0, nil, func(b Bot) (string, error) { return b.OnCommand(ctx, cmd) })
+	}
+}
+
+// each calls every bot in the room and posts their replies. fromBot is the
+// installation that caused the event, 0 when it came from a chatter. msg is
+// set for message events, which Streamers answer a piece at a time.
+func (r *Runner) each(ctx context.Context, roomID, fromBot int64, msg *Message, call func(Bot) (string, error)) {
+	r.mu.Lock()
+	bots := r.rooms[roomID]
+	r.mu.Unlock()
+
+	for _, b := range bots {
+		if fromBot != 0 && (fromBot == b.installation.ID || !b.settings.ListenToBots) {
+			continue
+		}
+		if !b.breaker.Allow() {
+			continue
+		}
+
+		if streamer, ok := b.bot.(Streamer); ok && msg != nil {
+			r.stream(ctx, b, streamer, *msg)
+			continue
+		}
+
+		reply, err := call(b.bot)
+		if err != nil {
+			log.Printf("bot %s failed: %v", b.installation.Username, err)
+			r.failure(b)
+			continue
+		}
+		if reply == "" || !r.allowReply(b) {
+			continue
+		}
+		if _, _, err := r.post(ctx, b, reply, false); err != nil {
+			r.failure(b)
+		} else {
+			b.breaker.Success()
+		}
+	}
+}
+
+// streamPatchInterval is the shortest time between edits of a streaming reply
+const streamPatchInterval = 250 * time.Millisecond
+
+// stream posts a Streamer's reply when its first piece arrives and edits
+// that message as the rest comes in
+func (r *Runner) stream(ctx context.Context, b *installedBot, streamer Streamer, msg Message) {
+	var (
+		stored   *dal.Message
+		decision moderation.Decision
+		reply    string
+		patched  time.Time
+	)
+	err := streamer.OnMessageStream(ctx, msg, func(text string) error {
+		reply = text
+		if stored == nil {
+			if !r.allowReply(b) {
+				return errThrottled
+			}
+			var err error
+			stored, decision, err = r.post(ctx, b, text, true)
+			patched = r.now()
+			return err
+		}
+		if r.now().Sub(patched) < streamPatchInterval {
+			return nil
+		}
+		patched = r.now()
+		_, err := r.edit(ctx, b, stored, text)
+		return err
+	})
+	if stored == nil {
+		if err != nil && !errors.Is(err, errThrottled) {
+			log.Printf("bot %s failed: %v", b.installation.Username, err)
+			r.failure(b)
+		}
+		return
+	}
+	if errors.Is(err, moderation.ErrRejected) {
+		r.failure(b)
+		return
+	}
+
+	// Finish the message with whatever arrived, even if the stream broke off
+	final, editErr := r.edit(ctx, b, stored, reply)
+	if editErr != nil {
+		r.failure(b)
+		return
+	}
+	if final.Action == moderation.Flag && decision.Action != moderation.Flag {
+		if err := dal.FlagMessage(r.db, stored.ID, final.Reason); err != nil {
+			log.Printf("failed to flag bot reply: %v", err)
+		}
+	}
+	stored.Content = reply
+	if final.Content != "" {
+		stored.Content = final.Content
+	}
+	r.publish(b, stored, false)
+
+	if err != nil {
+		log.Printf("bot %s stream failed: %v", b.installation.Username, err)
+		r.failure(b)
+		return
+	}
+	b.breaker.Success()
+}
+
+// errThrottled stops a streaming reply from a bot that is replying too often
+var errThrottled = errors.New("bot reply throttled")
+
+// allowReply reports whether the bot may reply in its room now
+func (r *Runner) allowReply(b *installedBot) bool {
+	if ok, _ := r.replies.Allow(strconv.FormatInt(b.installation.ID, 10)); !ok {
+		log.Printf("bot %s is replying too often in room %d, dropping reply", b.installation.Username, b.installation.RoomID)
+		r.failure(b)
+		return false
+	}
+	return true
+}
+
+func (r *Runner) failure(b *installedBot) {
+	if b.breaker.Failure() {
+		log.Printf("bot %s switched off in room %d for %v", b.installation.Username, b.installation.RoomID, r.limits.BreakerCooldown)
+	}
+}
+
+// post stores a bot reply, passing it through the moderator like any
+// chatter's message, and publishes it to the room
+func (r *Runner) post(ctx context.Context, b *installedBot, reply string, partial bool) (*dal.Message, moderation.Decision, error) {
+	stored, decision, err := moderation.Post(ctx, r.db, r.moderator, r.moderationMessage(b, reply))
+	if errors.Is(err, moderation.ErrRejected) {
+		log.Printf("bot %s reply rejected by moderation: %s", b.installation.Username, decision.Reason)
+		return nil, decision, err
+	}
+	if err != nil {
+		log.Printf("failed to insert bot reply: %v", err)
+		return nil, decision, err
+	}
+
+	r.publish(b, stored, partial)
+	return stored, decision, nil
+}
+
+// edit replaces a streaming reply's content once it passes moderation. A
+// rejected reply is removed from the room.
+func (r *Runner) edit(ctx context.Context, b *installedBot, stored *dal.Message, reply string) (moderation.Decision, error) {
+	decision, err := r.moderator.Moderate(ctx, r.moderationMessage(b, reply))
+	if err != nil {
+		log.Printf("failed to moderate bot reply: %v", err)
+		return decision, err
+	}
+
+	if decision.Action == moderation.Reject {
+		log.Printf("bot %s reply rejected by moderation: %s", b.installation.Username, decision.Reason)
+		if err := dal.RemoveMessage(r.db, stored.ID); err != nil {
+			log.Printf("failed to remove rejected bot reply: %v", err)
+		}
+		if err := common.PublishBotRemoval(r.nc, common.BotRemovalEvent{MessageID: stored.ID}); err != nil {
+			log.Printf("failed to publish bot removal: %v", err)
+		}
+		return decision, moderation.ErrRejected
+	}
+
+	content := reply
+	if decision.Content != "" {
+		content = decision.Content
+	}
+	if err := dal.UpdateMessageContent(r.db, stored.ID, content); err != nil {
+		log.Printf("failed to update bot reply: %v", err)
+		return decision, err
+	}
+	if err := common.PublishMessageEdit(r.nc, common.MessageEditEvent{ID: stored.ID, RoomID: stored.RoomID}); err != nil {
+		log.Printf("failed to publish message edit: %v", err)
+	}
+	return decision, nil
+}
+
+func (r *Runner) moderationMessage(b *installedBot, content string) moderation.Message {
+	return moderation.Message{
+		ChatterID: b.chatterID,
+		RoomID:    b.installation.RoomID,
+		Content:   content,
+		IsBot:     true,
+	}
+}
+
+func (r *Runner) publish(b *installedBot, stored *dal.Message, partial bool) {
+	if err := common.PublishMessageEvent(r.nc, common.MessageEvent{
+		ID:        stored.ID,
+		RoomID:    stored.RoomID,
+		ChatterID: b.chatterID,
+		Content:   stored.Content,
+		BotID:     b.installation.ID,
+		Partial:   partial,
+	}); err != nil {
+		log.Printf("failed to publish message: %v", err)
+	}
+}
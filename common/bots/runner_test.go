@@ -0,0 +1,306 @@
+package bots
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"go-star/common"
+	"go-star/common/dal"
+	"go-star/common/moderation"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// startNATS runs an embedded NATS server with the CHAT stream on a random port for one test
+func startNATS(t *testing.T) *nats.Conn {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("failed to create NATS server: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(4 * time.Second) {
+		t.Fatal("NATS server not ready in time")
+	}
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		ns.Shutdown()
+		t.Fatalf("failed to connect to NATS: %v", err)
+	}
+	t.Cleanup(func() {
+		nc.Close()
+		ns.Shutdown()
+	})
+	if err := common.EnsureChatStream(context.Background(), nc, common.DefaultConfig().NATS.JetStream); err != nil {
+		t.Fatalf("EnsureChatStream() failed: %v", err)
+	}
+	return nc
+}
+
+// startRunner runs a bot runner until the test ends, or until the returned
+// stop is called, returning once its consumer is there to keep its events
+func startRunner(t *testing.T, nc *nats.Conn, runner *Runner) (stop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := runner.Run(ctx); err != nil {
+			t.Errorf("Run() failed: %v", err)
+		}
+	}()
+	stop = func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+
+	js, _ := jetstream.New(nc)
+	for deadline := time.Now().Add(4 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := js.Consumer(ctx, common.ChatStream, Consumer); err == nil {
+			return stop
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bot runner never created its consumer")
+		}
+	}
+}
+
+// say posts a chatter's message the way the handlers do
+func say(t *testing.T, db *sql.DB, nc *nats.Conn, chatter *dal.Chatter, roomID int64, content string) {
+	t.Helper()
+	msg, err := dal.InsertMessage(db, chatter.ID, roomID, content)
+	if err != nil {
+		t.Fatalf("InsertMessage() failed: %v", err)
+	}
+	err = common.PublishMessageEvent(nc, common.MessageEvent{
+		ID: msg.ID, RoomID: roomID, ChatterID: chatter.ID, Content: content,
+	})
+	if err != nil {
+		t.Fatalf("PublishMessageEvent() failed: %v", err)
+	}
+}
+
+// settle waits until the room has stopped changing and returns its message count
+func settle(t *testing.T, db *sql.DB, roomID int64) int {
+	t.Helper()
+	count, stableSince := -1, time.Now()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		messages, err := dal.ListMessagesForRoom(db, roomID)
+		if err != nil {
+			// The runner may be writing, try again
+			continue
+		}
+		if len(messages) != count {
+			count, stableSince = len(messages), time.Now()
+		} else if time.Since(stableSince) > 300*time.Millisecond {
+			return count
+		}
+	}
+	t.Fatalf("room %d never settled, %d messages", roomID, count)
+	return count
+}
+
+func setupRunnerTest(t *testing.T, name string) (*sql.DB, *nats.Conn, *dal.Room, *dal.Chatter) {
+	t.Helper()
+	t.Cleanup(func() { os.Remove("./" + name + ".db") })
+	db, err := dal.SetupDB(name)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	room, err := dal.InsertRoom(db, "Bots", "bot testing")
+	if err != nil {
+		t.Fatalf("InsertRoom() failed: %v", err)
+	}
+	alice, err := dal.InsertChatter(db, "alice", "Alice Smith")
+	if err != nil {
+		t.Fatalf("InsertChatter() failed: %v", err)
+	}
+	nc := startNATS(t)
+	return db, nc, room, alice
+}
+
+func TestRunnerKeepsBotsFromAnsweringEachOther(t *testing.T) {
+	db, nc, room, alice := setupRunnerTest(t, "test_runner_bots")
+
+	dal.InstallBot(db, room.ID, "sarky", "Sarky", "sarky", "")
+	dal.InstallBot(db, room.ID, "positive", "Cheerleader", "cheer", "")
+
+	startRunner(t, nc, NewRunner(db, nc, DefaultRegistry(), moderation.Default(db), common.DefaultConfig().Bots))
+	say(t, db, nc, alice, room.ID, "hello bots")
+
+	// Alice's message plus one reply from each bot, and nothing more
+	if count := settle(t, db, room.ID); count != 3 {
+		t.Errorf("Expected 3 messages, got %d", count)
+	}
+}
+
+func TestRunnerBreaksBotLoops(t *testing.T) {
+	db, nc, room, alice := setupRunnerTest(t, "test_runner_loops")
+
+	// Both bots are allowed to hear each other, so they would reply forever
+	sarky, _ := dal.InstallBot(db, room.ID, "sarky", "Sarky", "sarky", `{"listenToBots": true}`)
+	cheer, _ := dal.InstallBot(db, room.ID, "positive", "Cheerleader", "cheer", `{"listenToBots": true}`)
+
+	now := time.Now()
+	limits := common.BotLimitConfig{RepliesPerMinute: 3, BreakerThreshold: 1, BreakerCooldown: time.Minute}
+	runner := NewRunner(db, nc, DefaultRegistry(), moderation.Default(db), limits).WithClock(func() time.Time { return now })
+	startRunner(t, nc, runner)
+	say(t, db, nc, alice, room.ID, "hello bots")
+
+	// Each bot gets three replies before it is throttled and switched off
+	if count := settle(t, db, room.ID); count != 7 {
+		t.Errorf("Expected 7 messages, got %d", count)
+	}
+
+	runner.mu.Lock()
+	for _, b := range runner.rooms[room.ID] {
+		if b.breaker.Allow() {
+			t.Errorf("Expected bot %d to be switched off", b.installation.ID)
+		}
+	}
+	runner.mu.Unlock()
+
+	// Switched off bots ignore chatters too
+	say(t, db, nc, alice, room.ID, "anyone there?")
+	if count := settle(t, db, room.ID); count != 8 {
+		t.Errorf("Expected switched off bots to stay quiet, got %d messages", count)
+	}
+
+	messages, _ := dal.ListMessagesForRoom(db, room.ID)
+	replies := map[string]int{}
+	for _, m := range messages {
+		replies[m.Username]++
+	}
+	if replies[sarky.Username] != 3 || replies[cheer.Username] != 3 {
+		t.Errorf("Expected 3 replies from each bot, got %v", replies)
+	}
+}
+
+// slowBot stalls on its first message until released, then counts the rest
+type slowBot struct {
+	release chan struct{}
+	seen    chan int64
+}
+
+func (b *slowBot) OnMessage(ctx context.Context, msg Message) (string, error) {
+	<-b.release
+	b.seen <- msg.ID
+	return "", nil
+}
+
+func (b *slowBot) OnJoin(ctx context.Context, join Join) (string, error)      { return "", nil }
+func (b *slowBot) OnCommand(ctx context.Context, cmd Command) (string, error) { return "", nil }
+
+func TestRunnerNeverDropsEventsForSlowBots(t *testing.T) {
+	db, nc, room, alice := setupRunnerTest(t, "test_runner_slow")
+
+	const messages = 500
+	bot := &slowBot{release: make(chan struct{}), seen: make(chan int64, messages)}
+	registry := NewRegistry()
+	registry.Register("slow", "Takes its time", func(dal.BotInstallation, *State) (Bot, error) { return bot, nil })
+	dal.InstallBot(db, room.ID, "slow", "Slowpoke", "slow", "")
+
+	startRunner(t, nc, NewRunner(db, nc, registry, moderation.Default(db), common.DefaultConfig().Bots))
+	for i := 0; i < messages; i++ {
+		err := common.PublishMessageEvent(nc, common.MessageEvent{ID: int64(i + 1), RoomID: room.ID, ChatterID: alice.ID, Content: "hurry up"})
+		if err != nil {
+			t.Fatalf("PublishMessageEvent() failed: %v", err)
+		}
+	}
+	nc.Flush()
+	close(bot.release)
+
+	// Every message arrives, in order, however far behind the bot fell
+	for i := 0; i < messages; i++ {
+		select {
+		case id := <-bot.seen:
+			if id != int64(i+1) {
+				t.Fatalf("Expected message %d, got %d", i+1, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d messages, the bot got %d", messages, i)
+		}
+	}
+}
+
+func TestRunnerCatchesUpAfterRestart(t *testing.T) {
+	db, nc, room, alice := setupRunnerTest(t, "test_runner_restart")
+	dal.InstallBot(db, room.ID, "sarky", "Sarky", "sarky", "")
+
+	newRunner := func() *Runner {
+		return NewRunner(db, nc, DefaultRegistry(), moderation.Default(db), common.DefaultConfig().Bots)
+	}
+	stop := startRunner(t, nc, newRunner())
+	stop()
+
+	// Posted while the runner is down, and published twice
+	say(t, db, nc, alice, room.ID, "anyone home?")
+	messages, _ := dal.ListMessagesForRoom(db, room.ID)
+	common.PublishMessageEvent(nc, common.MessageEvent{ID: messages[0].ID, RoomID: room.ID, ChatterID: alice.ID, Content: "anyone home?"})
+
+	startRunner(t, nc, newRunner())
+	if count := settle(t, db, room.ID); count != 2 {
+		t.Errorf("Expected one reply to the missed message, got %d messages", count)
+	}
+}
+
+func TestRunnerSkipsRedeliveredEvents(t *testing.T) {
+	db, nc, room, alice := setupRunnerTest(t, "test_runner_redelivery")
+	dal.InstallBot(db, room.ID, "sarky", "Sarky", "sarky", "")
+	runner := NewRunner(db, nc, DefaultRegistry(), moderation.Default(db), common.DefaultConfig().Bots)
+	if err := runner.Load(); err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	data, _ := json.Marshal(common.MessageEvent{ID: 1, RoomID: room.ID, ChatterID: alice.ID, Content: "once"})
+	event := common.StreamEvent{Subject: common.RoomMessagesSubject(room.ID), Data: data, Key: "message-1"}
+	for i := 0; i < 2; i++ {
+		if err := runner.handle(context.Background(), event); err != nil {
+			t.Fatalf("handle() failed: %v", err)
+		}
+	}
+	if messages, _ := dal.ListMessagesForRoom(db, room.ID); len(messages) != 1 {
+		t.Errorf("Expected a single reply, got %d messages", len(messages))
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := newBreaker(2, time.Minute, func() time.Time { return now })
+
+	if b.Failure() {
+		t.Error("Expected the first failure to leave the breaker closed")
+	}
+	b.Success()
+	if b.Failure() || !b.Allow() {
+		t.Error("Expected success to reset the failure count")
+	}
+	if !b.Failure() || b.Allow() {
+		t.Error("Expected the second failure in a row to open the breaker")
+	}
+
+	now = now.Add(time.Minute)
+	if !b.Allow() {
+		t.Error("Expected the breaker to allow a retry after the cooldown")
+	}
+	if !b.Failure() || b.Allow() {
+		t.Error("Expected one failure after the cooldown to reopen the breaker")
+	}
+
+	never := newBreaker(0, time.Minute, time.Now)
+	for i := 0; i < 10; i++ {
+		never.Failure()
+	}
+	if !never.Allow() {
+		t.Error("Expected a zero threshold to never open")
+	}
+}
@@ -0,0 +1,54 @@
+package bots
+
+import (
+	"context"
+	"go-star/common/dal"
+	"strings"
+	"unicode"
+)
+
+var sarkyCommands = []CommandHelp{
+	{Name: "sarcasm", Usage: "/sarcasm <text>", Help: "Says the text in aLtErNaTiNg CaSe"},
+}
+
+// SarkyBot repeats every message back in alternating case
+type SarkyBot struct {
+	Base
+	history
+}
+
+func NewSarkyBot(installation dal.BotInstallation, state *State) (Bot, error) {
+	return &SarkyBot{history: history{state: state}}, nil
+}
+
+func (bot *SarkyBot) OnMessage(ctx context.Context, msg Message) (string, error) {
+	response := sarkyReply(msg.Content)
+	bot.remember(response)
+	return response, nil
+}
+
+func (bot *SarkyBot) OnCommand(ctx context.Context, cmd Command) (string, error) {
+	if cmd.Name != "sarcasm" || len(cmd.Args) == 0 {
+		return "", nil
+	}
+	return sarkyReply(strings.Join(cmd.Args, " ")), nil
+}
+
+// sarkyReply converts a string to alternating case (every other letter capitalized)
+func sarkyReply(input string) string {
+	runes := []rune(input)
+	letterCount := 0
+
+	for i, r := range runes {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			if letterCount%2 == 0 {
+				runes[i] = unicode.ToLower(r)
+			} else {
+				runes[i] = unicode.ToUpper(r)
+			}
+			letterCount++
+		}
+	}
+
+	return string(runes)
+}
@@ -0,0 +1,110 @@
+package bots
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go-star/common"
+	"go-star/common/dal"
+)
+
+var (
+	// ErrStateValueTooLarge is returned when a value is over the size cap
+	ErrStateValueTooLarge = errors.New("bot state value too large")
+	// ErrStateFull is returned when a bot already stores as many values as it may
+	ErrStateFull = errors.New("bot state full")
+)
+
+// maxStateKeyLength caps the length of state keys
+const maxStateKeyLength = 100
+
+// State is one bot installation's key/value store. Values are kept in the
+// database, so they outlive restarts and are shared by every server, until
+// their TTL runs out or the bot is uninstalled.
+type State struct {
+	db             *sql.DB
+	installationID int64
+	maxKeys        int
+	maxValueBytes  int
+	now            func() time.Time
+}
+
+// NewState returns the store for one installation, capped by the limits' StateKeys
+// and StateValueBytes, where 0 is unlimited
+func NewState(db *sql.DB, installationID int64, limits common.BotLimitConfig, now func() time.Time) *State {
+	return &State{
+		db:             db,
+		installationID: installationID,
+		maxKeys:        limits.StateKeys,
+		maxValueBytes:  limits.StateValueBytes,
+		now:            now,
+	}
+}
+
+// Get returns the value stored under key, and whether there was one
+func (s *State) Get(key string) (string, bool, error) {
+	return dal.GetBotState(s.db, s.installationID, key, s.now())
+}
+
+// Set stores a value under key. It expires after ttl, 0 keeps it until deleted.
+func (s *State) Set(key, value string, ttl time.Duration) error {
+	if key == "" || len(key) > maxStateKeyLength {
+		return fmt.Errorf("bot state key must be 1 to %d characters", maxStateKeyLength)
+	}
+	if s.maxValueBytes > 0 && len(value) > s.maxValueBytes {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrStateValueTooLarge, len(value), s.maxValueBytes)
+	}
+
+	now := s.now()
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = now.Add(ttl)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if s.maxKeys > 0 {
+		count, err := dal.CountBotState(tx, s.installationID, key, now)
+		if err != nil {
+			return err
+		}
+		if count >= s.maxKeys {
+			return fmt.Errorf("%w: %d keys stored", ErrStateFull, count)
+		}
+	}
+	if err := dal.SetBotState(tx, s.installationID, key, value, expiresAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes the value stored under key
+func (s *State) Delete(key string) error {
+	return dal.DeleteBotState(s.db, s.installationID, key)
+}
+
+// GetJSON decodes the value stored under key into v, reporting whether there was one
+func (s *State) GetJSON(key string, v any) (bool, error) {
+	value, ok, err := s.Get(key)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, json.Unmarshal([]byte(value), v)
+}
+
+// SetJSON stores v encoded as JSON under key
+func (s *State) SetJSON(key string, v any, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Set(key, string(data), ttl)
+}
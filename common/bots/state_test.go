@@ -0,0 +1,103 @@
+package bots
+
+import (
+	"errors"
+	"go-star/common"
+	"go-star/common/dal"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupStateTest returns the state of a bot installed in a fresh database
+func setupStateTest(t *testing.T, name string, limits common.BotLimitConfig, now func() time.Time) *State {
+	t.Helper()
+	t.Cleanup(func() { os.Remove("./" + name + ".db") })
+	db, err := dal.SetupDB(name)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	room, err := dal.InsertRoom(db, "Bots", "bot testing")
+	if err != nil {
+		t.Fatalf("InsertRoom() failed: %v", err)
+	}
+	installation, err := dal.InstallBot(db, room.ID, "sarky", "Sarky", "sarky", "")
+	if err != nil {
+		t.Fatalf("InstallBot() failed: %v", err)
+	}
+	return NewState(db, installation.ID, limits, now)
+}
+
+func TestState(t *testing.T) {
+	now := time.Date(2024, 1, 10, 9, 30, 0, 0, time.UTC)
+	limits := common.BotLimitConfig{StateKeys: 3, StateValueBytes: 32}
+	state := setupStateTest(t, "test_bot_state", limits, func() time.Time { return now })
+
+	if _, ok, err := state.Get("missing"); err != nil || ok {
+		t.Errorf("Get() of a missing key = %v, %v", ok, err)
+	}
+
+	if err := state.Set("greeting", "hello", 0); err != nil {
+		t.Fatalf("Set() failed: %v", err)
+	}
+	if err := state.Set("greeting", "hi", 0); err != nil {
+		t.Fatalf("Set() of an existing key failed: %v", err)
+	}
+	if value, ok, err := state.Get("greeting"); err != nil || !ok || value != "hi" {
+		t.Errorf("Get() = %q, %v, %v, want the latest value", value, ok, err)
+	}
+
+	// Values with a TTL disappear once it runs out
+	counts := map[string]int{"alice": 2}
+	if err := state.SetJSON("counts", counts, time.Hour); err != nil {
+		t.Fatalf("SetJSON() failed: %v", err)
+	}
+	var got map[string]int
+	if ok, err := state.GetJSON("counts", &got); err != nil || !ok || got["alice"] != 2 {
+		t.Errorf("GetJSON() = %v, %v, %v", got, ok, err)
+	}
+	now = now.Add(time.Hour)
+	if _, ok, err := state.Get("counts"); err != nil || ok {
+		t.Errorf("Get() of an expired key = %v, %v", ok, err)
+	}
+
+	// Size caps
+	if err := state.Set("big", strings.Repeat("x", 33), 0); !errors.Is(err, ErrStateValueTooLarge) {
+		t.Errorf("Set() of a large value = %v, want ErrStateValueTooLarge", err)
+	}
+	state.Set("a", "1", 0)
+	state.Set("b", "2", 0)
+	if err := state.Set("c", "3", 0); !errors.Is(err, ErrStateFull) {
+		t.Errorf("Set() over the key cap = %v, want ErrStateFull", err)
+	}
+	if err := state.Set("a", "updated", 0); err != nil {
+		t.Errorf("Set() of an existing key at the cap failed: %v", err)
+	}
+	if err := state.Delete("b"); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	if err := state.Set("c", "3", 0); err != nil {
+		t.Errorf("Set() after a delete failed: %v", err)
+	}
+
+	if n, err := dal.DeleteExpiredBotState(state.db, now); err != nil || n != 1 {
+		t.Errorf("DeleteExpiredBotState() = %d, %v, want the expired counts removed", n, err)
+	}
+
+	// Uninstalling the bot removes its state
+	installations, _ := dal.ListBotInstallations(state.db)
+	for _, installation := range installations {
+		if installation.ID != state.installationID {
+			continue
+		}
+		if err := dal.UninstallBot(state.db, installation.ID, installation.RoomID); err != nil {
+			t.Fatalf("UninstallBot() failed: %v", err)
+		}
+	}
+	if _, ok, _ := state.Get("greeting"); ok {
+		t.Error("Expected the state to be removed with the bot")
+	}
+}
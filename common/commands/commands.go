@@ -0,0 +1,152 @@
+// Package commands parses "/name args..." chat input and dispatches it to
+// registered slash commands.
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-star/common/dal"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ErrUnknownCommand is returned by Dispatch for commands that aren't registered
+var ErrUnknownCommand = errors.New("unknown command")
+
+// ErrNotPermitted is returned by Dispatch when the caller's role can't run the command
+var ErrNotPermitted = errors.New("not permitted")
+
+// UsageError is returned by Dispatch when a command is given the wrong arguments
+type UsageError struct {
+	Usage string
+}
+
+func (e *UsageError) Error() string {
+	return "usage: " + e.Usage
+}
+
+// Invocation is parsed slash-command input
+type Invocation struct {
+	// Name is the lower-cased command name without the slash
+	Name string
+	// Args are the whitespace-separated arguments, double quotes group words
+	Args []string
+	// Text is everything after the command name, as typed
+	Text string
+}
+
+// Call is one run of a command by a chatter in a room
+type Call struct {
+	Invocation
+	Chatter dal.Chatter
+	Room    dal.Room
+}
+
+// Func runs a command and returns the reply shown only to the caller, if any
+type Func func(ctx context.Context, call Call) (string, error)
+
+// Command is a registered slash command
+type Command struct {
+	Name  string
+	Usage string
+	Help  string
+	// MinArgs is the fewest arguments the command accepts
+	MinArgs int
+	// Moderator restricts the command to moderators and admins
+	Moderator bool
+	Run       Func
+}
+
+// Parse splits chat input starting with "/" into an Invocation
+func Parse(input string) (Invocation, bool) {
+	if !strings.HasPrefix(input, "/") {
+		return Invocation{}, false
+	}
+
+	rest := input[1:]
+	end := strings.IndexFunc(rest, unicode.IsSpace)
+	if end < 0 {
+		end = len(rest)
+	}
+	name := rest[:end]
+	if name == "" {
+		return Invocation{}, false
+	}
+
+	text := strings.TrimSpace(rest[end:])
+	return Invocation{Name: strings.ToLower(name), Args: splitArgs(text), Text: text}, true
+}
+
+// splitArgs splits on whitespace, keeping "double quoted" text together
+func splitArgs(text string) []string {
+	args := []string{}
+	var current strings.Builder
+	inQuotes, started := false, false
+	for _, r := range text {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			started = true
+		case unicode.IsSpace(r) && !inQuotes:
+			if started {
+				args = append(args, current.String())
+				current.Reset()
+				started = false
+			}
+		default:
+			current.WriteRune(r)
+			started = true
+		}
+	}
+	if started {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// Registry holds the slash commands chatters can run
+type Registry struct {
+	commands map[string]Command
+}
+
+func NewRegistry() *Registry {
+	return &Registry{commands: make(map[string]Command)}
+}
+
+// Register adds a command, replacing any command with the same name
+func (r *Registry) Register(cmd Command) {
+	r.commands[cmd.Name] = cmd
+}
+
+// Lookup returns the command with the given name
+func (r *Registry) Lookup(name string) (Command, bool) {
+	cmd, ok := r.commands[name]
+	return cmd, ok
+}
+
+// Commands returns the registered commands sorted by name
+func (r *Registry) Commands() []Command {
+	cmds := make([]Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// Dispatch checks the caller may run the command with the given arguments, then runs it
+func (r *Registry) Dispatch(ctx context.Context, call Call) (string, error) {
+	cmd, ok := r.commands[call.Name]
+	if !ok {
+		return "", fmt.Errorf("/%s: %w", call.Name, ErrUnknownCommand)
+	}
+	if cmd.Moderator && !call.Chatter.IsModerator() {
+		return "", fmt.Errorf("/%s: %w", call.Name, ErrNotPermitted)
+	}
+	if len(call.Args) < cmd.MinArgs {
+		return "", &UsageError{Usage: cmd.Usage}
+	}
+	return cmd.Run(ctx, call)
+}
@@ -0,0 +1,76 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"go-star/common/dal"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Invocation
+		ok    bool
+	}{
+		{"/Me waves hello", Invocation{Name: "me", Args: []string{"waves", "hello"}, Text: "waves hello"}, true},
+		{`/mute bob 5 "spamming links"`, Invocation{Name: "mute", Args: []string{"bob", "5", "spamming links"}, Text: `bob 5 "spamming links"`}, true},
+		{"/help", Invocation{Name: "help", Args: []string{}, Text: ""}, true},
+		{`/topic ""`, Invocation{Name: "topic", Args: []string{""}, Text: `""`}, true},
+		{"/", Invocation{}, false},
+		{"/ help", Invocation{}, false},
+		{"hello /me", Invocation{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := Parse(tt.input)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %+v, %v, want %+v, %v", tt.input, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	r := NewRegistry()
+	r.Register(Command{
+		Name: "echo", Usage: "/echo <text>", MinArgs: 1,
+		Run: func(ctx context.Context, call Call) (string, error) { return call.Text, nil },
+	})
+	r.Register(Command{
+		Name: "topic", Usage: "/topic <text>", MinArgs: 1, Moderator: true,
+		Run: func(ctx context.Context, call Call) (string, error) { return "changed", nil },
+	})
+
+	member := dal.Chatter{ID: 1, Role: dal.RoleMember}
+	moderator := dal.Chatter{ID: 2, Role: dal.RoleModerator}
+	call := func(input string, chatter dal.Chatter) Call {
+		invocation, _ := Parse(input)
+		return Call{Invocation: invocation, Chatter: chatter}
+	}
+
+	if reply, err := r.Dispatch(context.Background(), call("/echo hi there", member)); err != nil || reply != "hi there" {
+		t.Errorf("Expected echo reply, got %q, %v", reply, err)
+	}
+
+	var usage *UsageError
+	if _, err := r.Dispatch(context.Background(), call("/echo", member)); !errors.As(err, &usage) || usage.Usage != "/echo <text>" {
+		t.Errorf("Expected usage error, got %v", err)
+	}
+	if _, err := r.Dispatch(context.Background(), call("/topic lunch", member)); !errors.Is(err, ErrNotPermitted) {
+		t.Errorf("Expected members to be refused /topic, got %v", err)
+	}
+	if reply, err := r.Dispatch(context.Background(), call("/topic lunch", moderator)); err != nil || reply != "changed" {
+		t.Errorf("Expected moderators to run /topic, got %q, %v", reply, err)
+	}
+	if _, err := r.Dispatch(context.Background(), call("/nope", moderator)); !errors.Is(err, ErrUnknownCommand) {
+		t.Errorf("Expected unknown command error, got %v", err)
+	}
+
+	var names []string
+	for _, cmd := range r.Commands() {
+		names = append(names, cmd.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"echo", "topic"}) {
+		t.Errorf("Expected sorted commands, got %v", names)
+	}
+}
@@ -0,0 +1,478 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings, read from CHAT_* environment variables
+type Config struct {
+	Port   int
+	DBName string
+	// AdminID is a chatter promoted to admin at startup while there is no
+	// admin yet, 0 promotes nobody
+	AdminID    int64
+	RateLimits RateLimitConfig
+	// ReportHideThreshold is how many distinct reports hide a message
+	// until a moderator reviews it, 0 never hides
+	ReportHideThreshold int
+	// ReportMinChatterAge is how long ago a chatter must have first posted
+	// for their reports to count toward ReportHideThreshold, so fresh
+	// sessions can't gang up to hide a message
+	ReportMinChatterAge time.Duration
+	Bots                BotLimitConfig
+	LLM                 LLMConfig
+	Webhooks            WebhookConfig
+	WebSocket           WebSocketConfig
+	Streams             StreamConfig
+	NATS                NATSConfig
+}
+
+// NATSConfig controls the NATS server that rooms and background workers talk
+// through. An embedded server is started unless URL points at an external one.
+type NATSConfig struct {
+	// URL is an external server to connect to, such as nats://nats:4222.
+	// When it is set nothing is embedded, and the embedded server's settings
+	// (Host, Port, LogLevel, ServerName, Cluster, Leaf and
+	// JetStream.StoreDir) are ignored.
+	URL string
+	// Host and Port are where the embedded server listens for other clients,
+	// a Port of -1 picks a free one
+	Host string
+	Port int
+	// User and Password, Token or NKey are required from the embedded
+	// server's clients, or sent to the external server
+	User     string
+	Password string
+	Token    string
+	// NKey is a user NKey seed, such as SUAM...
+	NKey string
+	// CredsFile is a user credentials file (JWT and NKey seed) for the external server
+	CredsFile string
+	// Users gives each part of chat its own NATS user instead of the single
+	// one above, allowed only the subjects it needs
+	Users NATSUsersConfig
+	TLS   NATSTLSConfig
+	// LogLevel is how much the embedded server logs: off, info, debug or trace
+	LogLevel string
+	// ServerName names the embedded server and must be unique within a
+	// cluster, it defaults to the host name when Cluster is set
+	ServerName string
+	Cluster    NATSClusterConfig
+	Leaf       NATSLeafConfig
+	// ReadyTimeout bounds how long the embedded server may take to start, or
+	// connecting to the external one
+	ReadyTimeout time.Duration
+	JetStream    JetStreamConfig
+}
+
+// NATSUsersConfig are the NATS users of the parts of chat. On the embedded
+// server each is limited to its own subjects; an external server's operator
+// sets the same limits on the accounts behind their credentials files.
+type NATSUsersConfig struct {
+	// Web is the web server and chat service, which also runs the scheduler
+	// and webhook dispatcher and creates the CHAT stream
+	Web NATSUserConfig
+	// Bots is the bot runner
+	Bots NATSUserConfig
+	// Client is for other services and bots, which may only call the chat
+	// service. Chat never connects as it.
+	Client NATSUserConfig
+}
+
+// NATSUserConfig is one NATS user: a user and password or an NKey seed, or
+// for an external server a credentials file
+type NATSUserConfig struct {
+	User      string
+	Password  string
+	NKey      string
+	CredsFile string
+}
+
+// NATSClusterConfig joins the embedded servers of several instances into one
+// cluster, so room events and JetStream are shared between them
+type NATSClusterConfig struct {
+	// Name is the same on every server in the cluster
+	Name string
+	// Host and Port are where other servers' routes connect, a Port of 0
+	// leaves the server unclustered and -1 picks a free one
+	Host string
+	Port int
+	// Routes are the other servers' cluster addresses, such as nats-route://chat-2:6222
+	Routes []string
+}
+
+// NATSLeafConfig connects embedded servers as leaf nodes, either accepting
+// leaf nodes or joining a hub as one
+type NATSLeafConfig struct {
+	// Host and Port are where leaf nodes connect, a Port of 0 accepts none
+	// and -1 picks a free one
+	Host string
+	Port int
+	// Remotes are the hub servers to join as a leaf node, such as
+	// nats-leaf://hub:7422. A leaf node keeps no streams of its own and uses
+	// the hub's JetStream.
+	Remotes []string
+}
+
+// NATSTLSConfig secures NATS connections with TLS. For the embedded server,
+// CertFile and KeyFile are its certificate and CAFile verifies client
+// certificates. For an external server, they are the client certificate and
+// CAFile verifies the server's.
+type NATSTLSConfig struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// JetStreamConfig controls the CHAT stream, which keeps room events for
+// background workers that were down when they were published
+type JetStreamConfig struct {
+	// StoreDir is where the embedded NATS server keeps its streams
+	StoreDir string
+	// MaxAge is how long room events are kept
+	MaxAge time.Duration
+	// MaxBytes caps the stream's size, the oldest events are discarded first
+	MaxBytes int
+	// DuplicateWindow is how long a published message ID is remembered, so
+	// publishing the same message again within it is ignored
+	DuplicateWindow time.Duration
+	// Replicas is how many clustered servers keep a copy of each stream
+	Replicas int
+	// Domain names the JetStream of a hub that leaf nodes connect to. It
+	// must be set the same on the hub's servers and on the leaf nodes.
+	Domain string
+	// LeaseTTL is how long a singleton worker's leader keeps its lease
+	// without renewing it, and so how long a crashed leader's work waits
+	LeaseTTL time.Duration
+}
+
+// StreamConfig controls how live connections, SSE and WebSocket, treat slow clients
+type StreamConfig struct {
+	// WriteTimeout is how long one write may block before the client is
+	// treated as stuck and disconnected
+	WriteTimeout time.Duration
+}
+
+// WebSocketConfig controls the keepalives and buffering of /ws connections
+type WebSocketConfig struct {
+	// PingInterval is how often the server pings. A connection that sends
+	// nothing for two and a half intervals is closed.
+	PingInterval time.Duration
+	// SendBuffer is how many frames can wait for a slow client before it is disconnected
+	SendBuffer int
+}
+
+// WebhookConfig controls how outgoing webhooks are delivered
+type WebhookConfig struct {
+	// MaxAttempts is how many times a delivery is tried before it is dead-lettered
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubling after each failure
+	Backoff time.Duration
+	// Timeout bounds each attempt
+	Timeout time.Duration
+}
+
+// LLMConfig points the llm bot at an OpenAI-compatible chat completions API.
+// The llm bot can only be installed when BaseURL is set.
+type LLMConfig struct {
+	// BaseURL is the API root, such as https://api.openai.com/v1
+	BaseURL string
+	APIKey  string
+	Model   string
+	// Timeout bounds each completion, including streaming the reply
+	Timeout time.Duration
+}
+
+// RateLimitConfig configures the token buckets applied to sending messages.
+// Each bucket holds Burst tokens and regains one token every Interval.
+type RateLimitConfig struct {
+	ChatterBurst    int
+	ChatterInterval time.Duration
+	RoomBurst       int
+	RoomInterval    time.Duration
+	// HookBurst and HookInterval limit each incoming webhook
+	HookBurst    int
+	HookInterval time.Duration
+	// ReportBurst and ReportInterval limit the reports each chatter and
+	// each IP address can send
+	ReportBurst    int
+	ReportInterval time.Duration
+}
+
+// BotLimitConfig keeps bots from flooding rooms or replying to each other forever
+type BotLimitConfig struct {
+	// RepliesPerMinute caps each bot's replies in each room, 0 is unlimited
+	RepliesPerMinute int
+	// BreakerThreshold is how many failed or throttled replies in a row
+	// switch a bot off for BreakerCooldown, 0 never switches bots off
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// StateKeys caps how many values each bot can store, StateValueBytes
+	// caps each value's size
+	StateKeys       int
+	StateValueBytes int
+}
+
+// DefaultConfig returns the settings used when no environment overrides are set
+func DefaultConfig() Config {
+	return Config{
+		Port:   3000,
+		DBName: "chat-db",
+		RateLimits: RateLimitConfig{
+			ChatterBurst:    5,
+			ChatterInterval: 2 * time.Second,
+			RoomBurst:       30,
+			RoomInterval:    200 * time.Millisecond,
+			HookBurst:       10,
+			HookInterval:    6 * time.Second,
+			ReportBurst:     5,
+			ReportInterval:  time.Minute,
+		},
+		ReportHideThreshold: 3,
+		ReportMinChatterAge: time.Hour,
+		Bots: BotLimitConfig{
+			RepliesPerMinute: 10,
+			BreakerThreshold: 5,
+			BreakerCooldown:  5 * time.Minute,
+			StateKeys:        100,
+			StateValueBytes:  16 << 10,
+		},
+		LLM: LLMConfig{
+			Model:   "gpt-4o-mini",
+			Timeout: time.Minute,
+		},
+		Webhooks: WebhookConfig{
+			MaxAttempts: 6,
+			Backoff:     30 * time.Second,
+			Timeout:     10 * time.Second,
+		},
+		WebSocket: WebSocketConfig{
+			PingInterval: 30 * time.Second,
+			SendBuffer:   256,
+		},
+		Streams: StreamConfig{
+			WriteTimeout: 10 * time.Second,
+		},
+		NATS: NATSConfig{
+			Host:         "127.0.0.1",
+			Port:         4223,
+			LogLevel:     "off",
+			ReadyTimeout: 4 * time.Second,
+			JetStream: JetStreamConfig{
+				StoreDir:        "chat-jetstream",
+				MaxAge:          7 * 24 * time.Hour,
+				MaxBytes:        1 << 30,
+				DuplicateWindow: 2 * time.Minute,
+				Replicas:        1,
+				LeaseTTL:        10 * time.Second,
+			},
+		},
+	}
+}
+
+// LoadConfig returns the default config overridden by any CHAT_* environment variables
+func LoadConfig() (Config, error) {
+	cfg := DefaultConfig()
+
+	var err error
+	if cfg.Port, err = envInt("CHAT_PORT", cfg.Port); err != nil {
+		return cfg, err
+	}
+	cfg.DBName = envString("CHAT_DB_NAME", cfg.DBName)
+	adminID, err := envInt("CHAT_ADMIN_ID", int(cfg.AdminID))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.AdminID = int64(adminID)
+
+	rl := &cfg.RateLimits
+	if rl.ChatterBurst, err = envInt("CHAT_RATE_CHATTER_BURST", rl.ChatterBurst); err != nil {
+		return cfg, err
+	}
+	if rl.ChatterInterval, err = envDuration("CHAT_RATE_CHATTER_INTERVAL", rl.ChatterInterval); err != nil {
+		return cfg, err
+	}
+	if rl.RoomBurst, err = envInt("CHAT_RATE_ROOM_BURST", rl.RoomBurst); err != nil {
+		return cfg, err
+	}
+	if rl.RoomInterval, err = envDuration("CHAT_RATE_ROOM_INTERVAL", rl.RoomInterval); err != nil {
+		return cfg, err
+	}
+	if rl.HookBurst, err = envInt("CHAT_RATE_HOOK_BURST", rl.HookBurst); err != nil {
+		return cfg, err
+	}
+	if rl.HookInterval, err = envDuration("CHAT_RATE_HOOK_INTERVAL", rl.HookInterval); err != nil {
+		return cfg, err
+	}
+	if rl.ReportBurst, err = envInt("CHAT_RATE_REPORT_BURST", rl.ReportBurst); err != nil {
+		return cfg, err
+	}
+	if rl.ReportInterval, err = envDuration("CHAT_RATE_REPORT_INTERVAL", rl.ReportInterval); err != nil {
+		return cfg, err
+	}
+
+	if cfg.ReportHideThreshold, err = envInt("CHAT_REPORT_HIDE_THRESHOLD", cfg.ReportHideThreshold); err != nil {
+		return cfg, err
+	}
+	if cfg.ReportMinChatterAge, err = envDuration("CHAT_REPORT_MIN_CHATTER_AGE", cfg.ReportMinChatterAge); err != nil {
+		return cfg, err
+	}
+
+	bl := &cfg.Bots
+	if bl.RepliesPerMinute, err = envInt("CHAT_BOT_REPLIES_PER_MINUTE", bl.RepliesPerMinute); err != nil {
+		return cfg, err
+	}
+	if bl.BreakerThreshold, err = envInt("CHAT_BOT_BREAKER_THRESHOLD", bl.BreakerThreshold); err != nil {
+		return cfg, err
+	}
+	if bl.BreakerCooldown, err = envDuration("CHAT_BOT_BREAKER_COOLDOWN", bl.BreakerCooldown); err != nil {
+		return cfg, err
+	}
+	if bl.StateKeys, err = envInt("CHAT_BOT_STATE_KEYS", bl.StateKeys); err != nil {
+		return cfg, err
+	}
+	if bl.StateValueBytes, err = envInt("CHAT_BOT_STATE_VALUE_BYTES", bl.StateValueBytes); err != nil {
+		return cfg, err
+	}
+
+	cfg.LLM.BaseURL = envString("CHAT_LLM_BASE_URL", cfg.LLM.BaseURL)
+	cfg.LLM.APIKey = envString("CHAT_LLM_API_KEY", cfg.LLM.APIKey)
+	cfg.LLM.Model = envString("CHAT_LLM_MODEL", cfg.LLM.Model)
+	if cfg.LLM.Timeout, err = envDuration("CHAT_LLM_TIMEOUT", cfg.LLM.Timeout); err != nil {
+		return cfg, err
+	}
+
+	wh := &cfg.Webhooks
+	if wh.MaxAttempts, err = envInt("CHAT_WEBHOOK_MAX_ATTEMPTS", wh.MaxAttempts); err != nil {
+		return cfg, err
+	}
+	if wh.Backoff, err = envDuration("CHAT_WEBHOOK_BACKOFF", wh.Backoff); err != nil {
+		return cfg, err
+	}
+	if wh.Timeout, err = envDuration("CHAT_WEBHOOK_TIMEOUT", wh.Timeout); err != nil {
+		return cfg, err
+	}
+
+	ws := &cfg.WebSocket
+	if ws.PingInterval, err = envDuration("CHAT_WS_PING_INTERVAL", ws.PingInterval); err != nil {
+		return cfg, err
+	}
+	if ws.SendBuffer, err = envInt("CHAT_WS_SEND_BUFFER", ws.SendBuffer); err != nil {
+		return cfg, err
+	}
+	if cfg.Streams.WriteTimeout, err = envDuration("CHAT_STREAM_WRITE_TIMEOUT", cfg.Streams.WriteTimeout); err != nil {
+		return cfg, err
+	}
+
+	nc := &cfg.NATS
+	nc.URL = envString("CHAT_NATS_URL", nc.URL)
+	nc.Host = envString("CHAT_NATS_HOST", nc.Host)
+	if nc.Port, err = envInt("CHAT_NATS_PORT", nc.Port); err != nil {
+		return cfg, err
+	}
+	nc.User = envString("CHAT_NATS_USER", nc.User)
+	nc.Password = envString("CHAT_NATS_PASSWORD", nc.Password)
+	nc.Token = envString("CHAT_NATS_TOKEN", nc.Token)
+	nc.NKey = envString("CHAT_NATS_NKEY", nc.NKey)
+	nc.CredsFile = envString("CHAT_NATS_CREDS", nc.CredsFile)
+	for prefix, user := range map[string]*NATSUserConfig{
+		"CHAT_NATS_WEB_":    &nc.Users.Web,
+		"CHAT_NATS_BOTS_":   &nc.Users.Bots,
+		"CHAT_NATS_CLIENT_": &nc.Users.Client,
+	} {
+		user.User = envString(prefix+"USER", user.User)
+		user.Password = envString(prefix+"PASSWORD", user.Password)
+		user.NKey = envString(prefix+"NKEY", user.NKey)
+		user.CredsFile = envString(prefix+"CREDS", user.CredsFile)
+	}
+	nc.TLS.CertFile = envString("CHAT_NATS_TLS_CERT", nc.TLS.CertFile)
+	nc.TLS.KeyFile = envString("CHAT_NATS_TLS_KEY", nc.TLS.KeyFile)
+	nc.TLS.CAFile = envString("CHAT_NATS_TLS_CA", nc.TLS.CAFile)
+	nc.LogLevel = envString("CHAT_NATS_LOG_LEVEL", nc.LogLevel)
+	nc.ServerName = envString("CHAT_NATS_SERVER_NAME", nc.ServerName)
+	nc.Cluster.Name = envString("CHAT_NATS_CLUSTER_NAME", nc.Cluster.Name)
+	nc.Cluster.Host = envString("CHAT_NATS_CLUSTER_HOST", nc.Cluster.Host)
+	if nc.Cluster.Port, err = envInt("CHAT_NATS_CLUSTER_PORT", nc.Cluster.Port); err != nil {
+		return cfg, err
+	}
+	nc.Cluster.Routes = envList("CHAT_NATS_ROUTES", nc.Cluster.Routes)
+	nc.Leaf.Host = envString("CHAT_NATS_LEAF_HOST", nc.Leaf.Host)
+	if nc.Leaf.Port, err = envInt("CHAT_NATS_LEAF_PORT", nc.Leaf.Port); err != nil {
+		return cfg, err
+	}
+	nc.Leaf.Remotes = envList("CHAT_NATS_LEAF_REMOTES", nc.Leaf.Remotes)
+	if nc.ReadyTimeout, err = envDuration("CHAT_NATS_READY_TIMEOUT", nc.ReadyTimeout); err != nil {
+		return cfg, err
+	}
+
+	js := &nc.JetStream
+	js.StoreDir = envString("CHAT_JETSTREAM_DIR", js.StoreDir)
+	if js.MaxAge, err = envDuration("CHAT_JETSTREAM_MAX_AGE", js.MaxAge); err != nil {
+		return cfg, err
+	}
+	if js.MaxBytes, err = envInt("CHAT_JETSTREAM_MAX_BYTES", js.MaxBytes); err != nil {
+		return cfg, err
+	}
+	if js.DuplicateWindow, err = envDuration("CHAT_JETSTREAM_DUPLICATE_WINDOW", js.DuplicateWindow); err != nil {
+		return cfg, err
+	}
+	if js.Replicas, err = envInt("CHAT_JETSTREAM_REPLICAS", js.Replicas); err != nil {
+		return cfg, err
+	}
+	js.Domain = envString("CHAT_JETSTREAM_DOMAIN", js.Domain)
+	if js.LeaseTTL, err = envDuration("CHAT_LEASE_TTL", js.LeaseTTL); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+func envString(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envList splits a comma-separated setting, skipping empty entries
+func envList(key string, fallback []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func envInt(key string, fallback int) (int, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
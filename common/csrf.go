@@ -0,0 +1,75 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+const (
+	// CSRFCookieName holds the per-browser CSRF token
+	CSRFCookieName = "chat-csrf"
+	// CSRFHeaderName is the request header Datastar actions echo the token in
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+type csrfContextKey struct{}
+
+// generateCSRFToken creates a random URL safe token
+func generateCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// GetCSRFToken checks for an existing CSRF cookie or creates a new one
+func GetCSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	cookie, err := r.Cookie(CSRFCookieName)
+	if err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+
+	token, err := generateCSRFToken()
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   IsSecureRequest(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return token, nil
+}
+
+// ValidCSRFToken reports whether the submitted token matches the expected one
+func ValidCSRFToken(expected, submitted string) bool {
+	if expected == "" || submitted == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(submitted)) == 1
+}
+
+// WithCSRFToken stores the CSRF token on the context for templates to render
+func WithCSRFToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, csrfContextKey{}, token)
+}
+
+// CSRFToken returns the CSRF token stored on the context, if any
+func CSRFToken(ctx context.Context) string {
+	token, _ := ctx.Value(csrfContextKey{}).(string)
+	return token
+}
+
+// IsSecureRequest reports whether the request was served over TLS
+func IsSecureRequest(r *http.Request) bool {
+	return r.TLS != nil
+}
@@ -0,0 +1,102 @@
+package dal
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// InsertAPIToken adds an API token for a chatter
+func InsertAPIToken(db DBTX, chatterID int64, name, token string) (*APIToken, error) {
+	if name == "" || token == "" {
+		return nil, fmt.Errorf("API tokens need a name and a token")
+	}
+
+	result, err := db.Exec(`INSERT INTO api_tokens (chatterId, name, tokenHash) VALUES (?, ?, ?)`, chatterID, name, hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	var t APIToken
+	var lastUsed sql.NullString
+	query := `SELECT id, chatterId, name, createdAt, lastUsedAt FROM api_tokens WHERE id = ?`
+	if err := db.QueryRow(query, id).Scan(&t.ID, &t.ChatterID, &t.Name, &t.CreatedAt, &lastUsed); err != nil {
+		return nil, err
+	}
+	t.LastUsedAt = lastUsed.String
+
+	return &t, nil
+}
+
+// GetChatterByAPIToken returns the chatter a token belongs to and records that it was used
+func GetChatterByAPIToken(db *sql.DB, token string, now time.Time) (*Chatter, error) {
+	query := `
+		SELECT c.id, c.username, c.name, c.role, c.system
+		FROM api_tokens t
+		JOIN chatters c ON t.chatterId = c.id
+		WHERE t.tokenHash = ?`
+
+	var chatter Chatter
+	err := db.QueryRow(query, hashToken(token)).Scan(&chatter.ID, &chatter.Username, &chatter.Name, &chatter.Role, &chatter.System)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("API token not found")
+		}
+		return nil, err
+	}
+
+	if _, err := db.Exec(`UPDATE api_tokens SET lastUsedAt = ? WHERE tokenHash = ?`, formatTimestamp(now), hashToken(token)); err != nil {
+		return nil, err
+	}
+
+	return &chatter, nil
+}
+
+// ListAPITokens returns a chatter's API tokens, oldest first
+func ListAPITokens(db *sql.DB, chatterID int64) ([]APIToken, error) {
+	query := `SELECT id, chatterId, name, createdAt, lastUsedAt FROM api_tokens WHERE chatterId = ? ORDER BY id ASC`
+	rows, err := db.Query(query, chatterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		var t APIToken
+		var lastUsed sql.NullString
+		if err := rows.Scan(&t.ID, &t.ChatterID, &t.Name, &t.CreatedAt, &lastUsed); err != nil {
+			return nil, err
+		}
+		t.LastUsedAt = lastUsed.String
+		tokens = append(tokens, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// DeleteAPIToken revokes one of a chatter's API tokens
+func DeleteAPIToken(db DBTX, id, chatterID int64) error {
+	result, err := db.Exec(`DELETE FROM api_tokens WHERE id = ? AND chatterId = ?`, id, chatterID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("API token with ID %d not found", id)
+	}
+
+	return nil
+}
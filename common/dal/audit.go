@@ -0,0 +1,153 @@
+package dal
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// Audit log actions
+const (
+	AuditRoomCreate    = "room.create"
+	AuditRoomArchive   = "room.archive"
+	AuditRoomSlowMode  = "room.slowmode"
+	AuditRoomFilter    = "room.filter"
+	AuditRoomBot       = "room.bot"
+	AuditRoomTopic     = "room.topic"
+	AuditRoomWebhook   = "room.webhook"
+	AuditMessageRemove = "message.remove"
+	AuditMessageReview = "message.review"
+	AuditChatterBan    = "chatter.ban"
+	AuditChatterMute   = "chatter.mute"
+	AuditChatterKick   = "chatter.kick"
+	AuditChatterRole   = "chatter.role"
+	AuditWebhook       = "webhook.outgoing"
+)
+
+// Audit log target types
+const (
+	TargetRoom    = "room"
+	TargetMessage = "message"
+	TargetChatter = "chatter"
+	TargetWebhook = "webhook"
+)
+
+// DBTX is implemented by both *sql.DB and *sql.Tx, so writes that need
+// auditing can run inside the transaction that records them
+type DBTX interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// AuditFilter narrows ListAuditLog, zero values match everything
+type AuditFilter struct {
+	Action     string
+	ActorID    int64
+	TargetType string
+	TargetID   int64
+	Limit      int
+}
+
+// Audited runs action in a transaction and records the audit entry it returns
+// in the same transaction, so the log can never disagree with what happened
+func Audited(db *sql.DB, action func(tx DBTX) (AuditEntry, error)) (*AuditEntry, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	entry, err := action(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Action == "" || entry.ActorID == 0 {
+		return nil, fmt.Errorf("audit entry needs an action and an actor")
+	}
+
+	stmt := `INSERT INTO audit_log (actorId, action, targetType, targetId, reason) VALUES (?, ?, ?, ?, ?)`
+	result, err := tx.Exec(stmt, entry.ActorID, entry.Action, entry.TargetType, entry.TargetID, entry.Reason)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.ID, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow(`SELECT createdAt FROM audit_log WHERE id = ?`, entry.ID).Scan(&entry.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// ListAuditLog returns the newest audit entries first, with the actor's name
+func ListAuditLog(db *sql.DB, filter AuditFilter) ([]AuditEntry, error) {
+	var where []string
+	var args []any
+	if filter.Action != "" {
+		where = append(where, "a.action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.ActorID != 0 {
+		where = append(where, "a.actorId = ?")
+		args = append(args, filter.ActorID)
+	}
+	if filter.TargetType != "" {
+		where = append(where, "a.targetType = ?")
+		args = append(args, filter.TargetType)
+	}
+	if filter.TargetID != 0 {
+		where = append(where, "a.targetId = ?")
+		args = append(args, filter.TargetID)
+	}
+
+	query := `
+		SELECT a.id, a.actorId, c.name, a.action, a.targetType, a.targetId, a.reason, a.createdAt
+		FROM audit_log a
+		JOIN chatters c ON a.actorId = c.id`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY a.id DESC"
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	query += " LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		err := rows.Scan(&entry.ID, &entry.ActorID, &entry.ActorName, &entry.Action, &entry.TargetType, &entry.TargetID, &entry.Reason, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,90 @@
+package dal
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+// InstallBot installs a bot of the given kind in a room. Config is the
+// bot's JSON settings, empty for none.
+func InstallBot(db DBTX, roomID int64, kind, name, username, config string) (*BotInstallation, error) {
+	if kind == "" || username == "" {
+		return nil, fmt.Errorf("bot kind and username cannot be empty")
+	}
+	if config == "" {
+		config = "{}"
+	}
+
+	stmt := `INSERT INTO room_bots (roomId, kind, name, username, config) VALUES (?, ?, ?, ?, ?)`
+	result, err := db.Exec(stmt, roomID, kind, name, username, config)
+	if err != nil {
+		return nil, err
+	}
+
+	installationID, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &BotInstallation{
+		ID:       installationID,
+		RoomID:   roomID,
+		Kind:     kind,
+		Name:     name,
+		Username: username,
+		Config:   config,
+	}, nil
+}
+
+// UninstallBot removes a bot from its room along with its state
+func UninstallBot(db DBTX, installationID, roomID int64) error {
+	if _, err := db.Exec(`DELETE FROM bot_state WHERE installationId = (SELECT id FROM room_bots WHERE id = ? AND roomId = ?)`, installationID, roomID); err != nil {
+		return err
+	}
+	result, err := db.Exec(`DELETE FROM room_bots WHERE id = ? AND roomId = ?`, installationID, roomID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("bot with ID %d not found in room %d", installationID, roomID)
+	}
+
+	return nil
+}
+
+// ListBotInstallations returns the bots installed in every room
+func ListBotInstallations(db *sql.DB) ([]BotInstallation, error) {
+	return queryBotInstallations(db, `SELECT id, roomId, kind, name, username, config FROM room_bots ORDER BY id ASC`)
+}
+
+// ListRoomBots returns the bots installed in a room
+func ListRoomBots(db *sql.DB, roomID int64) ([]BotInstallation, error) {
+	return queryBotInstallations(db, `SELECT id, roomId, kind, name, username, config FROM room_bots WHERE roomId = ? ORDER BY id ASC`, roomID)
+}
+
+func queryBotInstallations(db *sql.DB, query string, args ...any) ([]BotInstallation, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var installations []BotInstallation
+	for rows.Next() {
+		var b BotInstallation
+		if err := rows.Scan(&b.ID, &b.RoomID, &b.Kind, &b.Name, &b.Username, &b.Config); err != nil {
+			return nil, err
+		}
+		installations = append(installations, b)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return installations, nil
+}
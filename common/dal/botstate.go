@@ -0,0 +1,60 @@
+package dal
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// GetBotState returns the value a bot stored under key, ignoring expired values
+func GetBotState(db DBTX, installationID int64, key string, now time.Time) (string, bool, error) {
+	var value string
+	query := `SELECT value FROM bot_state WHERE installationId = ? AND key = ? AND (expiresAt IS NULL OR expiresAt > ?)`
+	err := db.QueryRow(query, installationID, key, formatTimestamp(now)).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// SetBotState stores a value for a bot, replacing any value under the same key.
+// A zero expiresAt keeps the value until it is deleted.
+func SetBotState(db DBTX, installationID int64, key, value string, expiresAt time.Time) error {
+	var expires any
+	if !expiresAt.IsZero() {
+		expires = formatTimestamp(expiresAt)
+	}
+
+	stmt := `INSERT INTO bot_state (installationId, key, value, expiresAt) VALUES (?, ?, ?, ?)
+		ON CONFLICT(installationId, key) DO UPDATE SET value = excluded.value, expiresAt = excluded.expiresAt, updatedAt = datetime('now', 'subsec')`
+	_, err := db.Exec(stmt, installationID, key, value, expires)
+	return err
+}
+
+// DeleteBotState removes one of a bot's values
+func DeleteBotState(db DBTX, installationID int64, key string) error {
+	_, err := db.Exec(`DELETE FROM bot_state WHERE installationId = ? AND key = ?`, installationID, key)
+	return err
+}
+
+// CountBotState returns how many unexpired values a bot has stored, other than under key
+func CountBotState(db DBTX, installationID int64, key string, now time.Time) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM bot_state WHERE installationId = ? AND key != ? AND (expiresAt IS NULL OR expiresAt > ?)`
+	err := db.QueryRow(query, installationID, key, formatTimestamp(now)).Scan(&count)
+	return count, err
+}
+
+// DeleteExpiredBotState removes every bot value that expired by now
+func DeleteExpiredBotState(db DBTX, now time.Time) (int64, error) {
+	result, err := db.Exec(`DELETE FROM bot_state WHERE expiresAt IS NOT NULL AND expiresAt <= ?`, formatTimestamp(now))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
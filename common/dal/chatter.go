@@ -2,6 +2,7 @@ package dal
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 
 	_ "modernc.org/sqlite"
@@ -28,20 +29,51 @@ func InsertChatter(db *sql.DB, username, name string) (*Chatter, error) {
 		ID:       chatterID,
 		Username: username,
 		Name:     name,
+		Role:     RoleMember,
 	}
 
 	return chatter, nil
 }
 
+// InsertSystemChatter creates a chatter for the server to post as, such as an
+// incoming webhook's
+func InsertSystemChatter(db *sql.DB, username, name string) (*Chatter, error) {
+	chatter, err := InsertChatter(db, username, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`UPDATE chatters SET system = 1 WHERE id = ?`, chatter.ID); err != nil {
+		return nil, err
+	}
+	chatter.System = true
+	return chatter, nil
+}
+
+// EnsureSystemChatter returns the system chatter with a well-known username,
+// creating it, or marking an existing chatter with that username as one
+func EnsureSystemChatter(db *sql.DB, username, name string) (*Chatter, error) {
+	if username == "" {
+		return nil, fmt.Errorf("username cannot be empty")
+	}
+
+	stmt := `
+		INSERT INTO chatters (username, name, system) VALUES (?, ?, 1)
+		ON CONFLICT(username) DO UPDATE SET system = 1`
+	if _, err := db.Exec(stmt, username, name); err != nil {
+		return nil, err
+	}
+	return GetChatterByUsername(db, username)
+}
+
 func GetChatterByUsername(db *sql.DB, username string) (*Chatter, error) {
 
 	if username == "" {
 		return nil, fmt.Errorf("username cannot be empty")
 	}
 
-	stmt := `SELECT id, username, name FROM chatters WHERE username = ?`
+	stmt := `SELECT id, username, name, role, system FROM chatters WHERE username = ?`
 	var chatter Chatter
-	err := db.QueryRow(stmt, username).Scan(&chatter.ID, &chatter.Username, &chatter.Name)
+	err := db.QueryRow(stmt, username).Scan(&chatter.ID, &chatter.Username, &chatter.Name, &chatter.Role, &chatter.System)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("chatter with username '%s' not found", username)
@@ -63,3 +95,152 @@ func TotalChatters(db *sql.DB) (int64, error) {
 
 	return count, nil
 }
+
+func GetChatter(db *sql.DB, chatterID int64) (*Chatter, error) {
+	stmt := `SELECT id, username, name, role, system FROM chatters WHERE id = ?`
+	var chatter Chatter
+	err := db.QueryRow(stmt, chatterID).Scan(&chatter.ID, &chatter.Username, &chatter.Name, &chatter.Role, &chatter.System)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("chatter with ID %d not found: %w", chatterID, err)
+		}
+		return nil, err
+	}
+
+	return &chatter, nil
+}
+
+// SetChatterRole changes a chatter's role to member, moderator or admin
+func SetChatterRole(db DBTX, chatterID int64, role string) error {
+	switch role {
+	case RoleMember, RoleModerator, RoleAdmin:
+	default:
+		return fmt.Errorf("unknown role '%s'", role)
+	}
+
+	result, err := db.Exec(`UPDATE chatters SET role = ? WHERE id = ?`, role, chatterID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("chatter with ID %d not found", chatterID)
+	}
+
+	return nil
+}
+
+// errHasAdmin stops MakeAdmin's transaction when there is already an admin
+var errHasAdmin = errors.New("there is already an admin")
+
+// CountAdmins returns how many chatters are admins
+func CountAdmins(db DBTX) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM chatters WHERE role = ?`, RoleAdmin).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// MakeAdmin bootstraps the first admin, refusing the system chatters bots
+// and webhooks post as. Once any admin exists roles are left to /admin, so a
+// demoted chatter isn't promoted again on the next start. It reports whether
+// the chatter was promoted, which is audited with the chatter as its own actor.
+func MakeAdmin(db *sql.DB, chatterID int64) (bool, error) {
+	chatter, err := GetChatter(db, chatterID)
+	if err != nil {
+		return false, err
+	}
+	if chatter.System {
+		return false, fmt.Errorf("chatter with ID %d is a system chatter", chatterID)
+	}
+
+	_, err = Audited(db, func(tx DBTX) (AuditEntry, error) {
+		admins, err := CountAdmins(tx)
+		if err != nil {
+			return AuditEntry{}, err
+		}
+		if admins > 0 {
+			return AuditEntry{}, errHasAdmin
+		}
+		return AuditEntry{
+			ActorID:    chatterID,
+			Action:     AuditChatterRole,
+			TargetType: TargetChatter,
+			TargetID:   chatterID,
+			Reason:     RoleAdmin + ": bootstrap from CHAT_ADMIN_ID",
+		}, SetChatterRole(tx, chatterID, RoleAdmin)
+	})
+	if errors.Is(err, errHasAdmin) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetChatterName changes the name a chatter is shown as
+func SetChatterName(db DBTX, chatterID int64, name string) error {
+	if name == "" {
+		return fmt.Errorf("name cannot be empty")
+	}
+
+	result, err := db.Exec(`UPDATE chatters SET name = ? WHERE id = ?`, name, chatterID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("chatter with ID %d not found", chatterID)
+	}
+
+	return nil
+}
+
+// ListChattersByName returns the chatters shown under a name, ignoring case.
+// Names aren't unique, so there can be several.
+func ListChattersByName(db *sql.DB, name string) ([]Chatter, error) {
+	rows, err := db.Query(`SELECT id, username, name, role, system FROM chatters WHERE name = ? COLLATE NOCASE ORDER BY id`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chatters []Chatter
+	for rows.Next() {
+		var chatter Chatter
+		if err := rows.Scan(&chatter.ID, &chatter.Username, &chatter.Name, &chatter.Role, &chatter.System); err != nil {
+			return nil, err
+		}
+		chatters = append(chatters, chatter)
+	}
+	return chatters, rows.Err()
+}
+
+// ListChatters returns all chatters ordered by name
+func ListChatters(db *sql.DB) ([]Chatter, error) {
+	rows, err := db.Query(`SELECT id, username, name, role, system FROM chatters ORDER BY name ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chatters []Chatter
+	for rows.Next() {
+		var chatter Chatter
+		if err := rows.Scan(&chatter.ID, &chatter.Username, &chatter.Name, &chatter.Role, &chatter.System); err != nil {
+			return nil, err
+		}
+		chatters = append(chatters, chatter)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return chatters, nil
+}
@@ -2,13 +2,17 @@ package dal
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSetupDBActualFunction(t *testing.T) {
-	// Test the actual SetupDB function
-	// Note: This will create the main database file
+	// Test the actual SetupDB function, creating the default database in a temp dir
+	t.Chdir(t.TempDir())
 	db, err := SetupDB("")
 	if err != nil {
 		t.Fatalf("SetupDB() failed: %v", err)
@@ -37,6 +41,7 @@ func TestSetupDBActualFunction(t *testing.T) {
 
 func TestSetupDBCreatesInitialRoom(t *testing.T) {
 	// Test that SetupDB creates the initial Watercooler room
+	t.Chdir(t.TempDir())
 	db, err := SetupDB("")
 	if err != nil {
 		t.Fatalf("SetupDB() failed: %v", err)
@@ -118,6 +123,7 @@ func TestSetupDBWithCustomName(t *testing.T) {
 
 func TestSetupDBWithEmptyName(t *testing.T) {
 	// Test that SetupDB falls back to default when given empty string
+	t.Chdir(t.TempDir())
 	db, err := SetupDB("")
 	if err != nil {
 		t.Fatalf("SetupDB('') failed: %v", err)
@@ -560,9 +566,10 @@ func TestListMessagesForRoom(t *testing.T) {
 		t.Errorf("Expected %d messages in Watercooler, got %d", expectedCount, len(watercoolerMessages))
 	}
 
-	// Verify message content and chatter info
+	// Verify message content and chatter info, newest first
 	for i, msg := range watercoolerMessages {
-		expectedContent := messages[i].content
+		expected := messages[len(messages)-1-i]
+		expectedContent := expected.content
 		if msg.Content != expectedContent {
 			t.Errorf("Message %d: expected content '%s', got '%s'", i, expectedContent, msg.Content)
 		}
@@ -576,11 +583,11 @@ func TestListMessagesForRoom(t *testing.T) {
 		}
 
 		// Verify specific chatter info
-		if messages[i].userID == chatter1.ID {
+		if expected.userID == chatter1.ID {
 			if msg.ChatterName != "Alice Smith" || msg.Username != "alice" {
 				t.Errorf("Message %d: expected Alice Smith/alice, got %s/%s", i, msg.ChatterName, msg.Username)
 			}
-		} else if messages[i].userID == chatter2.ID {
+		} else if expected.userID == chatter2.ID {
 			if msg.ChatterName != "Bob Johnson" || msg.Username != "bob" {
 				t.Errorf("Message %d: expected Bob Johnson/bob, got %s/%s", i, msg.ChatterName, msg.Username)
 			}
@@ -621,6 +628,21 @@ func TestListMessagesForRoom(t *testing.T) {
 		t.Errorf("Expected 0 messages for non-existent room, got %d", len(emptyMessages))
 	}
 
+	// Messages posted within the same millisecond, like a bot's quick reply,
+	// still come back newest first
+	if _, err := db.Exec("UPDATE messages SET timestamp = '2024-01-01 12:00:00.000' WHERE roomId = ?", watercoolerID); err != nil {
+		t.Fatalf("Failed to tie message timestamps: %v", err)
+	}
+	tiedMessages, err := ListMessagesForRoom(db, watercoolerID)
+	if err != nil {
+		t.Fatalf("ListMessagesForRoom with tied timestamps failed: %v", err)
+	}
+	for i := 1; i < len(tiedMessages); i++ {
+		if tiedMessages[i-1].ID < tiedMessages[i].ID {
+			t.Errorf("Expected tied messages newest first, got ID %d before %d", tiedMessages[i-1].ID, tiedMessages[i].ID)
+		}
+	}
+
 	t.Log("ListMessagesForRoom test completed successfully")
 }
 
@@ -800,7 +822,7 @@ func TestListRooms(t *testing.T) {
 	defer emptyDB.Close()
 
 	// Create only the rooms table, no initial data
-	_, err = emptyDB.Exec("CREATE TABLE rooms (id INTEGER NOT NULL PRIMARY KEY, name TEXT, description TEXT)")
+	err = createRooms(emptyDB)
 	if err != nil {
 		t.Fatalf("Failed to create rooms table in empty database: %v", err)
 	}
@@ -816,3 +838,1272 @@ func TestListRooms(t *testing.T) {
 
 	t.Log("ListRooms test completed successfully")
 }
+
+func TestSetRoomSlowMode(t *testing.T) {
+	testDBName := "test_set_room_slow_mode"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	room, err := InsertRoom(db, "Quiet", "no spamming")
+	if err != nil {
+		t.Fatalf("InsertRoom() failed: %v", err)
+	}
+	if room.SlowModeSeconds != 0 {
+		t.Errorf("Expected slow mode off for a new room, got %d", room.SlowModeSeconds)
+	}
+
+	if err := SetRoomSlowMode(db, room.ID, 30); err != nil {
+		t.Fatalf("SetRoomSlowMode() failed: %v", err)
+	}
+	updated, err := GetRoom(db, room.ID)
+	if err != nil {
+		t.Fatalf("GetRoom() failed: %v", err)
+	}
+	if updated.SlowModeSeconds != 30 {
+		t.Errorf("Expected slow mode 30, got %d", updated.SlowModeSeconds)
+	}
+
+	if err := SetRoomSlowMode(db, room.ID, -1); err == nil {
+		t.Error("Expected error for negative slow mode")
+	}
+	if err := SetRoomSlowMode(db, 99999, 10); err == nil {
+		t.Error("Expected error for non-existent room")
+	}
+}
+
+func TestSetChatterRole(t *testing.T) {
+	testDBName := "test_set_chatter_role"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	chatter, err := InsertChatter(db, "mod", "Moderator")
+	if err != nil {
+		t.Fatalf("InsertChatter() failed: %v", err)
+	}
+	if chatter.Role != RoleMember || chatter.IsModerator() {
+		t.Errorf("Expected new chatter to be a member, got '%s'", chatter.Role)
+	}
+
+	if err := SetChatterRole(db, chatter.ID, RoleModerator); err != nil {
+		t.Fatalf("SetChatterRole() failed: %v", err)
+	}
+	updated, err := GetChatterByUsername(db, "mod")
+	if err != nil {
+		t.Fatalf("GetChatterByUsername() failed: %v", err)
+	}
+	if !updated.IsModerator() {
+		t.Errorf("Expected moderator, got '%s'", updated.Role)
+	}
+
+	if err := SetChatterRole(db, chatter.ID, "overlord"); err == nil {
+		t.Error("Expected error for unknown role")
+	}
+}
+
+func TestSystemChatters(t *testing.T) {
+	testDBName := "test_system_chatters"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	human, _ := InsertChatter(db, "human", "Human")
+	if human.System {
+		t.Error("Expected InsertChatter() to create an ordinary chatter")
+	}
+	hook, err := InsertSystemChatter(db, "webhook-ci", "CI")
+	if err != nil {
+		t.Fatalf("InsertSystemChatter() failed: %v", err)
+	}
+	if reloaded, _ := GetChatter(db, hook.ID); !reloaded.System {
+		t.Error("Expected the webhook's chatter to be a system chatter")
+	}
+
+	// A well-known username is claimed, even if a session got there first
+	taken, _ := InsertChatter(db, "reminders", "Not Reminders")
+	claimed, err := EnsureSystemChatter(db, "reminders", "Reminders")
+	if err != nil {
+		t.Fatalf("EnsureSystemChatter() failed: %v", err)
+	}
+	if claimed.ID != taken.ID || !claimed.System {
+		t.Errorf("Expected the existing chatter to become a system chatter, got %+v", claimed)
+	}
+	again, err := EnsureSystemChatter(db, "reminders", "Reminders")
+	if err != nil || again.ID != claimed.ID {
+		t.Errorf("Expected EnsureSystemChatter() to return the same chatter, got %+v, %v", again, err)
+	}
+	if reloaded, _ := GetChatterByUsername(db, "human"); reloaded.System {
+		t.Error("Expected other chatters to be left alone")
+	}
+}
+
+func TestMakeAdmin(t *testing.T) {
+	testDBName := "test_make_admin"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	// System chatters come first, so the first person isn't chatter 1
+	hook, _ := InsertSystemChatter(db, "webhook-ci", "CI")
+	human, _ := InsertChatter(db, "human", "Human")
+
+	if promoted, err := MakeAdmin(db, human.ID); err != nil || !promoted {
+		t.Fatalf("MakeAdmin() = %v, %v, expected a promotion", promoted, err)
+	}
+	if reloaded, _ := GetChatter(db, human.ID); reloaded.Role != RoleAdmin {
+		t.Errorf("Expected an admin, got '%s'", reloaded.Role)
+	}
+	entries, err := ListAuditLog(db, AuditFilter{Action: AuditChatterRole, TargetID: human.ID})
+	if err != nil {
+		t.Fatalf("ListAuditLog() failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].ActorID != human.ID || !strings.Contains(entries[0].Reason, "CHAT_ADMIN_ID") {
+		t.Errorf("Expected one audited bootstrap, got %+v", entries)
+	}
+
+	// Restarting with the same admin changes and records nothing
+	if promoted, err := MakeAdmin(db, human.ID); err != nil || promoted {
+		t.Errorf("MakeAdmin() = %v, %v, expected nothing to change", promoted, err)
+	}
+	if entries, _ := ListAuditLog(db, AuditFilter{Action: AuditChatterRole}); len(entries) != 1 {
+		t.Errorf("Expected still one audit entry, got %d", len(entries))
+	}
+
+	// Once there is another admin, a demoted bootstrap chatter stays demoted
+	other, _ := InsertChatter(db, "other", "Other")
+	SetChatterRole(db, other.ID, RoleAdmin)
+	SetChatterRole(db, human.ID, RoleMember)
+	if promoted, err := MakeAdmin(db, human.ID); err != nil || promoted {
+		t.Errorf("MakeAdmin() = %v, %v, expected no bootstrap with an admin", promoted, err)
+	}
+	if reloaded, _ := GetChatter(db, human.ID); reloaded.Role != RoleMember {
+		t.Errorf("Expected the demoted chatter to stay a member, got '%s'", reloaded.Role)
+	}
+
+	if _, err := MakeAdmin(db, hook.ID); err == nil {
+		t.Error("Expected system chatters to be refused")
+	}
+	if reloaded, _ := GetChatter(db, hook.ID); reloaded.Role != RoleMember {
+		t.Errorf("Expected the system chatter to stay a member, got '%s'", reloaded.Role)
+	}
+	if _, err := MakeAdmin(db, 99999); err == nil {
+		t.Error("Expected an error for a missing chatter")
+	}
+}
+
+func TestLastMessageTime(t *testing.T) {
+	testDBName := "test_last_message_time"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	chatter, err := InsertChatter(db, "alice", "Alice Smith")
+	if err != nil {
+		t.Fatalf("InsertChatter() failed: %v", err)
+	}
+
+	_, ok, err := LastMessageTime(db, chatter.ID, 1)
+	if err != nil {
+		t.Fatalf("LastMessageTime() failed: %v", err)
+	}
+	if ok {
+		t.Error("Expected no last message before posting")
+	}
+
+	if _, err := InsertMessage(db, chatter.ID, 1, "hello"); err != nil {
+		t.Fatalf("InsertMessage() failed: %v", err)
+	}
+	last, ok, err := LastMessageTime(db, chatter.ID, 1)
+	if err != nil {
+		t.Fatalf("LastMessageTime() failed: %v", err)
+	}
+	if !ok {
+		t.Fatal("Expected a last message after posting")
+	}
+	if since := time.Since(last); since < 0 || since > time.Minute {
+		t.Errorf("Expected last message to be recent, got %v ago", since)
+	}
+}
+
+func TestInsertMessageSlowMode(t *testing.T) {
+	testDBName := "test_insert_message_slow_mode"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	alice, _ := InsertChatter(db, "alice", "Alice Smith")
+	bob, _ := InsertChatter(db, "bob", "Bob Jones")
+
+	if _, err := InsertMessageSlowMode(db, alice.ID, 1, "first", time.Minute); err != nil {
+		t.Fatalf("InsertMessageSlowMode() failed: %v", err)
+	}
+	if _, err := InsertMessageSlowMode(db, alice.ID, 1, "too soon", time.Minute); !errors.Is(err, ErrSlowMode) {
+		t.Errorf("Expected ErrSlowMode, got %v", err)
+	}
+	if _, err := InsertMessageSlowMode(db, bob.ID, 1, "someone else", time.Minute); err != nil {
+		t.Errorf("Expected other chatters to post, got %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	msg, err := InsertMessageSlowMode(db, alice.ID, 1, "later", 10*time.Millisecond)
+	if err != nil || msg.Content != "later" {
+		t.Errorf("Expected a post after the interval, got %+v, %v", msg, err)
+	}
+}
+
+func TestSetupDBAddsColumnsToOldSchema(t *testing.T) {
+	testDBName := "test_old_schema"
+	defer os.Remove("./" + testDBName + ".db")
+
+	// Create tables as they were before slow mode and roles existed
+	old, err := sql.Open("sqlite", "./"+testDBName+".db")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE rooms (id INTEGER NOT NULL PRIMARY KEY, name TEXT, description TEXT)`,
+		`CREATE TABLE chatters (id INTEGER NOT NULL PRIMARY KEY, username TEXT UNIQUE NOT NULL, name TEXT)`,
+		`INSERT INTO chatters (username, name) VALUES ('old', 'Old Timer')`,
+	} {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatalf("Failed to create old schema: %v", err)
+		}
+	}
+	old.Close()
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed on old schema: %v", err)
+	}
+	defer db.Close()
+
+	chatter, err := GetChatterByUsername(db, "old")
+	if err != nil {
+		t.Fatalf("GetChatterByUsername() failed: %v", err)
+	}
+	if chatter.Role != RoleMember {
+		t.Errorf("Expected existing chatter to default to member, got '%s'", chatter.Role)
+	}
+
+	rooms, err := ListRooms(db)
+	if err != nil {
+		t.Fatalf("ListRooms() failed: %v", err)
+	}
+	if len(rooms) != 1 || rooms[0].SlowModeSeconds != 0 {
+		t.Errorf("Expected seeded room with slow mode off, got %+v", rooms)
+	}
+}
+
+func TestBanChatter(t *testing.T) {
+	testDBName := "test_ban_chatter"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	mod, _ := InsertChatter(db, "mod", "Moderator")
+	troll, _ := InsertChatter(db, "troll", "Troll")
+
+	banned, err := IsBanned(db, troll.ID)
+	if err != nil {
+		t.Fatalf("IsBanned() failed: %v", err)
+	}
+	if banned {
+		t.Error("Chatter should not be banned yet")
+	}
+
+	ban, err := BanChatter(db, troll.ID, mod.ID, "spam")
+	if err != nil {
+		t.Fatalf("BanChatter() failed: %v", err)
+	}
+	if ban.ChatterID != troll.ID || ban.BannedBy != mod.ID || ban.Reason != "spam" {
+		t.Errorf("Unexpected ban: %+v", ban)
+	}
+
+	// Banning again updates the existing ban
+	ban, err = BanChatter(db, troll.ID, mod.ID, "more spam")
+	if err != nil {
+		t.Fatalf("BanChatter() again failed: %v", err)
+	}
+	if ban.Reason != "more spam" {
+		t.Errorf("Expected updated reason, got '%s'", ban.Reason)
+	}
+
+	if banned, _ := IsBanned(db, troll.ID); !banned {
+		t.Error("Chatter should be banned")
+	}
+
+	if err := UnbanChatter(db, troll.ID); err != nil {
+		t.Fatalf("UnbanChatter() failed: %v", err)
+	}
+	if banned, _ := IsBanned(db, troll.ID); banned {
+		t.Error("Chatter should no longer be banned")
+	}
+}
+
+func TestMuteChatter(t *testing.T) {
+	testDBName := "test_mute_chatter"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	mod, _ := InsertChatter(db, "mod", "Moderator")
+	troll, _ := InsertChatter(db, "troll", "Troll")
+	other, _ := InsertRoom(db, "Other", "somewhere else")
+
+	until := time.Now().Add(10 * time.Minute)
+	mute, err := MuteChatter(db, troll.ID, 1, mod.ID, until, "calm down")
+	if err != nil {
+		t.Fatalf("MuteChatter() failed: %v", err)
+	}
+	if mute.ExpiresAt.Sub(until).Abs() > time.Second {
+		t.Errorf("Expected mute to expire at %v, got %v", until, mute.ExpiresAt)
+	}
+
+	expires, muted, err := MutedUntil(db, troll.ID, 1)
+	if err != nil {
+		t.Fatalf("MutedUntil() failed: %v", err)
+	}
+	if !muted || expires.Sub(until).Abs() > time.Second {
+		t.Errorf("Expected chatter muted until %v, got %v (%v)", until, expires, muted)
+	}
+
+	// Mutes only apply to their room
+	if _, muted, _ := MutedUntil(db, troll.ID, other.ID); muted {
+		t.Error("Chatter should not be muted in another room")
+	}
+
+	// Expired mutes no longer apply
+	if _, err := MuteChatter(db, troll.ID, 1, mod.ID, time.Now().Add(-time.Minute), ""); err != nil {
+		t.Fatalf("MuteChatter() with past expiry failed: %v", err)
+	}
+	if _, muted, _ := MutedUntil(db, troll.ID, 1); muted {
+		t.Error("Expired mute should not apply")
+	}
+
+	if _, err := MuteChatter(db, troll.ID, 1, mod.ID, until, ""); err != nil {
+		t.Fatalf("MuteChatter() failed: %v", err)
+	}
+	if err := UnmuteChatter(db, troll.ID, 1); err != nil {
+		t.Fatalf("UnmuteChatter() failed: %v", err)
+	}
+	if _, muted, _ := MutedUntil(db, troll.ID, 1); muted {
+		t.Error("Chatter should no longer be muted")
+	}
+}
+
+func TestRemoveMessage(t *testing.T) {
+	testDBName := "test_remove_message"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	alice, _ := InsertChatter(db, "alice", "Alice Smith")
+	keep, _ := InsertMessage(db, alice.ID, 1, "keep me")
+	remove, _ := InsertMessage(db, alice.ID, 1, "remove me")
+
+	if err := RemoveMessage(db, remove.ID); err != nil {
+		t.Fatalf("RemoveMessage() failed: %v", err)
+	}
+
+	messages, err := ListMessagesForRoom(db, 1)
+	if err != nil {
+		t.Fatalf("ListMessagesForRoom() failed: %v", err)
+	}
+	if len(messages) != 1 || messages[0].ID != keep.ID {
+		t.Errorf("Expected only the kept message, got %+v", messages)
+	}
+
+	// Removed messages are kept for the record
+	removed, err := GetMessage(db, remove.ID)
+	if err != nil {
+		t.Fatalf("GetMessage() failed for removed message: %v", err)
+	}
+	if removed.Content != "remove me" {
+		t.Errorf("Expected removed message content to be kept, got '%s'", removed.Content)
+	}
+
+	if err := RemoveMessage(db, 99999); err == nil {
+		t.Error("Expected error removing a non-existent message")
+	}
+}
+
+func TestAuditedCommitsActionAndEntryTogether(t *testing.T) {
+	testDBName := "test_audited"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	admin, _ := InsertChatter(db, "admin", "Admin")
+
+	entry, err := Audited(db, func(tx DBTX) (AuditEntry, error) {
+		room, err := InsertRoom(tx, "Audited", "created with a log entry")
+		if err != nil {
+			return AuditEntry{}, err
+		}
+		return AuditEntry{ActorID: admin.ID, Action: AuditRoomCreate, TargetType: TargetRoom, TargetID: room.ID, Reason: "testing"}, nil
+	})
+	if err != nil {
+		t.Fatalf("Audited() failed: %v", err)
+	}
+	if entry.ID == 0 || entry.CreatedAt == "" {
+		t.Errorf("Expected stored entry, got %+v", entry)
+	}
+	if _, err := GetRoom(db, entry.TargetID); err != nil {
+		t.Errorf("Expected audited room to exist: %v", err)
+	}
+
+	// A failing action records nothing
+	_, err = Audited(db, func(tx DBTX) (AuditEntry, error) {
+		return AuditEntry{ActorID: admin.ID, Action: AuditRoomArchive, TargetType: TargetRoom, TargetID: 99999}, ArchiveRoom(tx, 99999)
+	})
+	if err == nil {
+		t.Error("Expected error archiving a non-existent room")
+	}
+
+	// A failing log entry rolls back the action
+	_, err = Audited(db, func(tx DBTX) (AuditEntry, error) {
+		if err := ArchiveRoom(tx, entry.TargetID); err != nil {
+			return AuditEntry{}, err
+		}
+		return AuditEntry{Action: AuditRoomArchive, TargetType: TargetRoom, TargetID: entry.TargetID}, nil
+	})
+	if err == nil {
+		t.Error("Expected error for an entry without an actor")
+	}
+	room, err := GetRoom(db, entry.TargetID)
+	if err != nil {
+		t.Fatalf("GetRoom() failed: %v", err)
+	}
+	if room.Archived {
+		t.Error("Archive should have been rolled back with the failed log entry")
+	}
+
+	entries, err := ListAuditLog(db, AuditFilter{})
+	if err != nil {
+		t.Fatalf("ListAuditLog() failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected exactly 1 audit entry, got %d", len(entries))
+	}
+	if entries[0].ActorName != "Admin" || entries[0].Action != AuditRoomCreate || entries[0].Reason != "testing" {
+		t.Errorf("Unexpected audit entry: %+v", entries[0])
+	}
+}
+
+func TestAuditLogIsAppendOnly(t *testing.T) {
+	testDBName := "test_audit_append_only"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	admin, _ := InsertChatter(db, "admin", "Admin")
+	entry, err := Audited(db, func(tx DBTX) (AuditEntry, error) {
+		return AuditEntry{ActorID: admin.ID, Action: AuditChatterKick, TargetType: TargetChatter, TargetID: admin.ID}, nil
+	})
+	if err != nil {
+		t.Fatalf("Audited() failed: %v", err)
+	}
+
+	if _, err := db.Exec(`UPDATE audit_log SET reason = 'edited' WHERE id = ?`, entry.ID); err == nil {
+		t.Error("Expected audit log update to be rejected")
+	}
+	if _, err := db.Exec(`DELETE FROM audit_log WHERE id = ?`, entry.ID); err == nil {
+		t.Error("Expected audit log delete to be rejected")
+	}
+}
+
+func TestListAuditLogFilters(t *testing.T) {
+	testDBName := "test_audit_filters"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	mod, _ := InsertChatter(db, "mod", "Moderator")
+	admin, _ := InsertChatter(db, "admin", "Admin")
+	troll, _ := InsertChatter(db, "troll", "Troll")
+
+	record := func(actor int64, action, targetType string, target int64) {
+		_, err := Audited(db, func(tx DBTX) (AuditEntry, error) {
+			return AuditEntry{ActorID: actor, Action: action, TargetType: targetType, TargetID: target}, nil
+		})
+		if err != nil {
+			t.Fatalf("Audited() failed: %v", err)
+		}
+	}
+	record(mod.ID, AuditChatterMute, TargetChatter, troll.ID)
+	record(mod.ID, AuditChatterBan, TargetChatter, troll.ID)
+	record(admin.ID, AuditChatterRole, TargetChatter, mod.ID)
+	record(admin.ID, AuditRoomArchive, TargetRoom, 1)
+
+	tests := []struct {
+		name     string
+		filter   AuditFilter
+		expected int
+	}{
+		{"all", AuditFilter{}, 4},
+		{"by action", AuditFilter{Action: AuditChatterBan}, 1},
+		{"by actor", AuditFilter{ActorID: mod.ID}, 2},
+		{"by target", AuditFilter{TargetType: TargetChatter, TargetID: troll.ID}, 2},
+		{"by target type", AuditFilter{TargetType: TargetRoom}, 1},
+		{"with limit", AuditFilter{Limit: 3}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := ListAuditLog(db, tt.filter)
+			if err != nil {
+				t.Fatalf("ListAuditLog() failed: %v", err)
+			}
+			if len(entries) != tt.expected {
+				t.Errorf("Expected %d entries, got %d", tt.expected, len(entries))
+			}
+		})
+	}
+
+	// Newest entries come first
+	entries, _ := ListAuditLog(db, AuditFilter{})
+	if entries[0].Action != AuditRoomArchive {
+		t.Errorf("Expected newest entry first, got %s", entries[0].Action)
+	}
+}
+
+func TestArchiveRoom(t *testing.T) {
+	testDBName := "test_archive_room"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	room, _ := InsertRoom(db, "Old", "to be archived")
+	if err := ArchiveRoom(db, room.ID); err != nil {
+		t.Fatalf("ArchiveRoom() failed: %v", err)
+	}
+
+	rooms, err := ListRooms(db)
+	if err != nil {
+		t.Fatalf("ListRooms() failed: %v", err)
+	}
+	for _, r := range rooms {
+		if r.ID == room.ID {
+			t.Error("Archived room should not be listed")
+		}
+	}
+
+	archived, err := GetRoom(db, room.ID)
+	if err != nil {
+		t.Fatalf("GetRoom() failed for archived room: %v", err)
+	}
+	if !archived.Archived {
+		t.Error("Expected room to be archived")
+	}
+}
+
+func TestWordFilters(t *testing.T) {
+	testDBName := "test_word_filters"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	filter, err := InsertWordFilter(db, 1, "spam", false, FilterReject)
+	if err != nil {
+		t.Fatalf("InsertWordFilter() failed: %v", err)
+	}
+
+	if _, err := InsertWordFilter(db, 1, "(unclosed", true, FilterFlag); err == nil {
+		t.Error("Expected error for an invalid regex")
+	}
+	if _, err := InsertWordFilter(db, 1, "spam", false, "explode"); err == nil {
+		t.Error("Expected error for an unknown action")
+	}
+	if _, err := InsertWordFilter(db, 1, "", false, FilterFlag); err == nil {
+		t.Error("Expected error for an empty pattern")
+	}
+
+	filters, err := ListWordFilters(db, 1)
+	if err != nil {
+		t.Fatalf("ListWordFilters() failed: %v", err)
+	}
+	if len(filters) != 1 || filters[0].Pattern != "spam" {
+		t.Errorf("Expected the one valid filter, got %+v", filters)
+	}
+
+	if err := DeleteWordFilter(db, filter.ID, 2); err == nil {
+		t.Error("Expected error deleting a filter from the wrong room")
+	}
+	if err := DeleteWordFilter(db, filter.ID, 1); err != nil {
+		t.Fatalf("DeleteWordFilter() failed: %v", err)
+	}
+	if filters, _ := ListWordFilters(db, 1); len(filters) != 0 {
+		t.Errorf("Expected no filters after delete, got %d", len(filters))
+	}
+}
+
+func TestReviewFlaggedMessage(t *testing.T) {
+	testDBName := "test_review_flagged"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	alice, _ := InsertChatter(db, "alice", "Alice Smith")
+	mod, _ := InsertChatter(db, "mod", "Moderator")
+	msg, _ := InsertMessage(db, alice.ID, 1, "suspicious")
+
+	if err := FlagMessage(db, msg.ID, "looks odd"); err != nil {
+		t.Fatalf("FlagMessage() failed: %v", err)
+	}
+
+	pending, err := ListFlaggedMessages(db, FlagPending)
+	if err != nil {
+		t.Fatalf("ListFlaggedMessages() failed: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("Expected 1 pending flag, got %d", len(pending))
+	}
+	if pending[0].ChatterName != "Alice Smith" || pending[0].Reason != "looks odd" || pending[0].RoomID != 1 {
+		t.Errorf("Unexpected flagged message: %+v", pending[0])
+	}
+
+	if err := ReviewFlaggedMessage(db, pending[0].ID, mod.ID, FlagPending); err == nil {
+		t.Error("Expected error for a non-final review status")
+	}
+	if err := ReviewFlaggedMessage(db, pending[0].ID, mod.ID, FlagApproved); err != nil {
+		t.Fatalf("ReviewFlaggedMessage() failed: %v", err)
+	}
+	if err := ReviewFlaggedMessage(db, pending[0].ID, mod.ID, FlagRemoved); !errors.Is(err, ErrAlreadyReviewed) {
+		t.Errorf("Expected ErrAlreadyReviewed reviewing an already reviewed flag, got %v", err)
+	}
+
+	if pending, _ := ListFlaggedMessages(db, FlagPending); len(pending) != 0 {
+		t.Errorf("Expected empty queue after review, got %d", len(pending))
+	}
+	approved, _ := ListFlaggedMessages(db, FlagApproved)
+	if len(approved) != 1 {
+		t.Errorf("Expected 1 approved flag, got %d", len(approved))
+	}
+}
+
+func TestReportMessage(t *testing.T) {
+	testDBName := "test_report_message"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	troll, _ := InsertChatter(db, "troll", "Troll")
+	alice, _ := InsertChatter(db, "alice", "Alice Smith")
+	bob, _ := InsertChatter(db, "bob", "Bob Johnson")
+	msg, _ := InsertMessage(db, troll.ID, 1, "something nasty")
+	// Only chatters who have posted count toward hiding
+	other, _ := InsertRoom(db, "Other", "")
+	InsertMessage(db, alice.ID, other.ID, "hi")
+	InsertMessage(db, bob.ID, other.ID, "hi")
+
+	if _, _, _, err := ReportMessage(db, msg.ID, alice.ID, "rude", "", 2, 0); err == nil {
+		t.Error("Expected error for an unknown category")
+	}
+
+	report, created, hidden, err := ReportMessage(db, msg.ID, alice.ID, ReportHarassment, "not nice", 2, 0)
+	if err != nil {
+		t.Fatalf("ReportMessage() failed: %v", err)
+	}
+	if !created || hidden {
+		t.Errorf("Expected a new report without hiding, got created=%v hidden=%v", created, hidden)
+	}
+	if report.Category != ReportHarassment || report.Details != "not nice" || report.Status != ReportPending {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+
+	// Repeat reports from the same chatter don't count twice
+	again, created, hidden, err := ReportMessage(db, msg.ID, alice.ID, ReportSpam, "again", 2, 0)
+	if err != nil {
+		t.Fatalf("ReportMessage() repeat failed: %v", err)
+	}
+	if created || hidden || again.ID != report.ID || again.Category != ReportHarassment {
+		t.Errorf("Expected the original report back, got %+v created=%v hidden=%v", again, created, hidden)
+	}
+	if count, _ := CountPendingReports(db, msg.ID); count != 1 {
+		t.Errorf("Expected 1 pending report, got %d", count)
+	}
+
+	// Sessions that never posted can report, but don't bring hiding closer
+	sock, _ := InsertChatter(db, "sock", "Sock Puppet")
+	if _, created, hidden, err := ReportMessage(db, msg.ID, sock.ID, ReportHarassment, "", 2, 0); err != nil || !created || hidden {
+		t.Errorf("Expected a kept report that doesn't hide, got created=%v hidden=%v err=%v", created, hidden, err)
+	}
+	if count, _ := CountTrustedReports(db, msg.ID, 0); count != 1 {
+		t.Errorf("Expected 1 trusted report, got %d", count)
+	}
+
+	// The second distinct reporter reaches the threshold
+	_, created, hidden, err = ReportMessage(db, msg.ID, bob.ID, ReportHarassment, "", 2, 0)
+	if err != nil {
+		t.Fatalf("ReportMessage() second reporter failed: %v", err)
+	}
+	if !created || !hidden {
+		t.Errorf("Expected message to be hidden at the threshold, got created=%v hidden=%v", created, hidden)
+	}
+
+	messages, _ := ListMessagesForRoom(db, 1)
+	if len(messages) != 0 {
+		t.Errorf("Expected hidden message to be left out of the room, got %d messages", len(messages))
+	}
+	flagged, _ := ListFlaggedMessages(db, FlagPending)
+	if len(flagged) != 1 || flagged[0].MessageID != msg.ID {
+		t.Fatalf("Expected hidden message in the review queue, got %+v", flagged)
+	}
+
+	// Approving restores the message and clears its reports
+	if err := RestoreMessage(db, msg.ID); err != nil {
+		t.Fatalf("RestoreMessage() failed: %v", err)
+	}
+	if err := ResolveReports(db, msg.ID); err != nil {
+		t.Fatalf("ResolveReports() failed: %v", err)
+	}
+	if count, _ := CountPendingReports(db, msg.ID); count != 0 {
+		t.Errorf("Expected no pending reports after review, got %d", count)
+	}
+
+	// Nor do chatters who only just started posting
+	for _, reporter := range []*Chatter{alice, bob} {
+		if _, _, hidden, err := ReportMessage(db, msg.ID, reporter.ID, ReportSpam, "", 2, time.Hour); err != nil || hidden {
+			t.Errorf("Expected new chatters' reports not to hide, got hidden=%v err=%v", hidden, err)
+		}
+	}
+	if count, _ := CountTrustedReports(db, msg.ID, time.Hour); count != 0 {
+		t.Errorf("Expected no trusted reports from new chatters, got %d", count)
+	}
+	if messages, _ := ListMessagesForRoom(db, 1); len(messages) != 1 {
+		t.Errorf("Expected restored message to be shown, got %d messages", len(messages))
+	}
+}
+
+func TestRoomBots(t *testing.T) {
+	testDBName := "test_room_bots"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	// PosiBot is seeded into Watercooler
+	seeded, err := ListRoomBots(db, 1)
+	if err != nil {
+		t.Fatalf("ListRoomBots() failed: %v", err)
+	}
+	if len(seeded) != 1 || seeded[0].Username != "posibot" || seeded[0].Kind != "sarky" || seeded[0].Config != "{}" {
+		t.Fatalf("Expected PosiBot to be seeded, got %+v", seeded)
+	}
+
+	if _, err := InstallBot(db, 1, "", "Nameless", "nameless", ""); err == nil {
+		t.Error("Expected error for an empty kind")
+	}
+
+	room, _ := InsertRoom(db, "Bots", "bot testing")
+	cheer, err := InstallBot(db, room.ID, "positive", "Cheerleader", "cheer", `{"loud":true}`)
+	if err != nil {
+		t.Fatalf("InstallBot() failed: %v", err)
+	}
+
+	all, _ := ListBotInstallations(db)
+	if len(all) != 2 || all[1] != *cheer {
+		t.Errorf("Expected both installations, got %+v", all)
+	}
+
+	if err := UninstallBot(db, cheer.ID, 1); err == nil {
+		t.Error("Expected error uninstalling a bot from the wrong room")
+	}
+	if err := UninstallBot(db, seeded[0].ID, 1); err != nil {
+		t.Fatalf("UninstallBot() failed: %v", err)
+	}
+	db.Close()
+
+	// Reopening doesn't reinstall the removed PosiBot
+	db, err = SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() reopen failed: %v", err)
+	}
+	defer db.Close()
+	if bots, _ := ListRoomBots(db, 1); len(bots) != 0 {
+		t.Errorf("Expected PosiBot to stay uninstalled, got %+v", bots)
+	}
+}
+
+func TestSetChatterNameAndRoomDescription(t *testing.T) {
+	testDBName := "test_names_and_topics"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	alice, _ := InsertChatter(db, "alice", "Alice Smith")
+	if err := SetChatterName(db, alice.ID, ""); err == nil {
+		t.Error("Expected error for an empty name")
+	}
+	if err := SetChatterName(db, alice.ID, "Ally"); err != nil {
+		t.Fatalf("SetChatterName() failed: %v", err)
+	}
+	if got, _ := GetChatter(db, alice.ID); got.Name != "Ally" || got.Username != "alice" {
+		t.Errorf("Expected name to change and username to stay, got %+v", got)
+	}
+	if err := SetChatterName(db, 999, "Nobody"); err == nil {
+		t.Error("Expected error for an unknown chatter")
+	}
+
+	if err := SetRoomDescription(db, 1, "Friday lunch plans"); err != nil {
+		t.Fatalf("SetRoomDescription() failed: %v", err)
+	}
+	if room, _ := GetRoom(db, 1); room.Description != "Friday lunch plans" {
+		t.Errorf("Expected the new topic, got %q", room.Description)
+	}
+	if err := SetRoomDescription(db, 999, "nowhere"); err == nil {
+		t.Error("Expected error for an unknown room")
+	}
+}
+
+func TestUpdateMessageContent(t *testing.T) {
+	testDBName := "test_update_message"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	alice, _ := InsertChatter(db, "alice", "Alice Smith")
+	msg, _ := InsertMessage(db, alice.ID, 1, "Hel")
+
+	if err := UpdateMessageContent(db, msg.ID, "Hello there"); err != nil {
+		t.Fatalf("UpdateMessageContent() failed: %v", err)
+	}
+	got, err := GetMessageWithChatter(db, msg.ID)
+	if err != nil {
+		t.Fatalf("GetMessageWithChatter() failed: %v", err)
+	}
+	if got.Content != "Hello there" || got.ChatterName != "Alice Smith" || got.Username != "alice" {
+		t.Errorf("Unexpected message: %+v", got)
+	}
+
+	if err := UpdateMessageContent(db, 999, "nothing"); err == nil {
+		t.Error("Expected error for an unknown message")
+	}
+
+	RemoveMessage(db, msg.ID)
+	if _, err := GetMessageWithChatter(db, msg.ID); err == nil {
+		t.Error("Expected removed messages to be left out")
+	}
+}
+
+func TestScheduledMessages(t *testing.T) {
+	testDBName := "test_scheduled_messages"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	alice, _ := InsertChatter(db, "alice", "Alice Smith")
+	bob, _ := InsertChatter(db, "bob", "Bob Johnson")
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+
+	if _, err := InsertScheduledMessage(db, 1, alice.ID, "", now, ""); err == nil {
+		t.Error("Expected error for empty content")
+	}
+
+	lunch, err := InsertScheduledMessage(db, 1, alice.ID, "lunch", now.Add(3*time.Hour), "")
+	if err != nil {
+		t.Fatalf("InsertScheduledMessage() failed: %v", err)
+	}
+	if !lunch.RunAt.Equal(now.Add(3*time.Hour)) || lunch.Recurrence != "" {
+		t.Errorf("Unexpected scheduled message: %+v", lunch)
+	}
+	standup, _ := InsertScheduledMessage(db, 1, alice.ID, "standup", now.Add(-time.Minute), "0 9 * * 1-5")
+	InsertScheduledMessage(db, 1, bob.ID, "coffee", now, "")
+
+	due, err := ListDueScheduledMessages(db, now)
+	if err != nil {
+		t.Fatalf("ListDueScheduledMessages() failed: %v", err)
+	}
+	if len(due) != 2 || due[0].ID != standup.ID || due[1].Content != "coffee" {
+		t.Errorf("Expected standup then coffee to be due, got %+v", due)
+	}
+
+	if err := RescheduleMessage(db, standup.ID, now.Add(24*time.Hour)); err != nil {
+		t.Fatalf("RescheduleMessage() failed: %v", err)
+	}
+	mine, _ := ListChatterScheduledMessages(db, alice.ID, 1)
+	if len(mine) != 2 || mine[0].ID != lunch.ID || mine[1].ID != standup.ID {
+		t.Errorf("Expected lunch then the rescheduled standup, got %+v", mine)
+	}
+
+	if err := CancelScheduledMessage(db, lunch.ID, bob.ID); err == nil {
+		t.Error("Expected error cancelling someone else's message")
+	}
+	if err := CancelScheduledMessage(db, lunch.ID, alice.ID); err != nil {
+		t.Fatalf("CancelScheduledMessage() failed: %v", err)
+	}
+	if err := DeleteScheduledMessage(db, standup.ID); err != nil {
+		t.Fatalf("DeleteScheduledMessage() failed: %v", err)
+	}
+	if mine, _ := ListChatterScheduledMessages(db, alice.ID, 1); len(mine) != 0 {
+		t.Errorf("Expected no scheduled messages left, got %+v", mine)
+	}
+}
+
+func TestBotState(t *testing.T) {
+	testDBName := "test_bot_state"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	bot, _ := InstallBot(db, 1, "sarky", "Sarky", "sarky", "")
+	other, _ := InstallBot(db, 1, "positive", "Cheer", "cheer", "")
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+
+	if err := SetBotState(db, bot.ID, "mood", "grumpy", time.Time{}); err != nil {
+		t.Fatalf("SetBotState() failed: %v", err)
+	}
+	SetBotState(db, bot.ID, "topic", "soup", now.Add(time.Minute))
+	SetBotState(db, other.ID, "mood", "cheerful", time.Time{})
+
+	if value, ok, err := GetBotState(db, bot.ID, "mood", now); err != nil || !ok || value != "grumpy" {
+		t.Errorf("GetBotState() = %q, %v, %v", value, ok, err)
+	}
+	if value, _, _ := GetBotState(db, other.ID, "mood", now); value != "cheerful" {
+		t.Errorf("Expected bots to have separate state, got %q", value)
+	}
+	if count, err := CountBotState(db, bot.ID, "mood", now); err != nil || count != 1 {
+		t.Errorf("CountBotState() = %d, %v, want 1", count, err)
+	}
+
+	later := now.Add(time.Minute)
+	if _, ok, _ := GetBotState(db, bot.ID, "topic", later); ok {
+		t.Error("Expected expired state to be hidden")
+	}
+	if n, err := DeleteExpiredBotState(db, later); err != nil || n != 1 {
+		t.Errorf("DeleteExpiredBotState() = %d, %v, want 1", n, err)
+	}
+
+	if err := DeleteBotState(db, bot.ID, "mood"); err != nil {
+		t.Fatalf("DeleteBotState() failed: %v", err)
+	}
+	if _, ok, _ := GetBotState(db, bot.ID, "mood", now); ok {
+		t.Error("Expected deleted state to be gone")
+	}
+
+	if err := UninstallBot(db, other.ID, 1); err != nil {
+		t.Fatalf("UninstallBot() failed: %v", err)
+	}
+	if _, ok, _ := GetBotState(db, other.ID, "mood", now); ok {
+		t.Error("Expected state to be removed with its bot")
+	}
+}
+
+func TestIncomingWebhooks(t *testing.T) {
+	testDBName := "test_incoming_webhooks"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	alice, _ := InsertChatter(db, "alice", "Alice Smith")
+	ci, _ := InsertChatter(db, "webhook-ci", "CI")
+
+	if _, err := InsertIncomingWebhook(db, 1, ci.ID, alice.ID, "CI", ""); err == nil {
+		t.Error("Expected error for an empty token")
+	}
+	hook, err := InsertIncomingWebhook(db, 1, ci.ID, alice.ID, "CI", "secret")
+	if err != nil {
+		t.Fatalf("InsertIncomingWebhook() failed: %v", err)
+	}
+
+	var stored string
+	db.QueryRow(`SELECT tokenHash FROM incoming_webhooks WHERE id = ?`, hook.ID).Scan(&stored)
+	if stored == "secret" {
+		t.Error("Expected the token to be stored hashed")
+	}
+
+	found, err := GetIncomingWebhookByToken(db, "secret")
+	if err != nil || found.ID != hook.ID || found.ChatterID != ci.ID {
+		t.Errorf("GetIncomingWebhookByToken() = %+v, %v", found, err)
+	}
+	if _, err := GetIncomingWebhookByToken(db, "guess"); err == nil {
+		t.Error("Expected error for an unknown token")
+	}
+
+	// Webhook messages can be shown under another name and avatar
+	InsertMessageAs(db, ci.ID, 1, "deployed", "Deploy bot", "https://example.com/a.png")
+	messages, _ := ListMessagesForRoom(db, 1)
+	if len(messages) != 1 || messages[0].ChatterName != "Deploy bot" || messages[0].AvatarURL != "https://example.com/a.png" {
+		t.Errorf("Expected the override name and avatar, got %+v", messages)
+	}
+
+	if hooks, _ := ListIncomingWebhooks(db, 1); len(hooks) != 1 {
+		t.Errorf("Expected 1 webhook, got %d", len(hooks))
+	}
+	if err := DeleteIncomingWebhook(db, hook.ID, 2); err == nil {
+		t.Error("Expected error deleting a webhook from another room")
+	}
+	if err := DeleteIncomingWebhook(db, hook.ID, 1); err != nil {
+		t.Fatalf("DeleteIncomingWebhook() failed: %v", err)
+	}
+	if _, err := GetIncomingWebhookByToken(db, "secret"); err == nil {
+		t.Error("Expected a deleted webhook's token to stop working")
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	testDBName := "test_api_tokens"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	alice, _ := InsertChatter(db, "alice", "Alice Smith")
+	bob, _ := InsertChatter(db, "bob", "Bob Jones")
+
+	if _, err := InsertAPIToken(db, alice.ID, "script", ""); err == nil {
+		t.Error("Expected error for an empty token")
+	}
+	token, err := InsertAPIToken(db, alice.ID, "script", "secret")
+	if err != nil {
+		t.Fatalf("InsertAPIToken() failed: %v", err)
+	}
+	if token.Name != "script" || token.ChatterID != alice.ID || token.LastUsedAt != "" {
+		t.Errorf("Unexpected token: %+v", token)
+	}
+
+	var stored string
+	db.QueryRow(`SELECT tokenHash FROM api_tokens WHERE id = ?`, token.ID).Scan(&stored)
+	if stored == "secret" {
+		t.Error("Expected the token to be stored hashed")
+	}
+
+	chatter, err := GetChatterByAPIToken(db, "secret", time.Now())
+	if err != nil || chatter.ID != alice.ID {
+		t.Errorf("GetChatterByAPIToken() = %+v, %v", chatter, err)
+	}
+	if _, err := GetChatterByAPIToken(db, "guess", time.Now()); err == nil {
+		t.Error("Expected error for an unknown token")
+	}
+
+	tokens, err := ListAPITokens(db, alice.ID)
+	if err != nil || len(tokens) != 1 || tokens[0].LastUsedAt == "" {
+		t.Errorf("Expected one token marked as used, got %+v, %v", tokens, err)
+	}
+
+	// Only the owner can revoke a token
+	if err := DeleteAPIToken(db, token.ID, bob.ID); err == nil {
+		t.Error("Expected error revoking someone else's token")
+	}
+	if err := DeleteAPIToken(db, token.ID, alice.ID); err != nil {
+		t.Fatalf("DeleteAPIToken() failed: %v", err)
+	}
+	if _, err := GetChatterByAPIToken(db, "secret", time.Now()); err == nil {
+		t.Error("Expected a revoked token to stop working")
+	}
+}
+
+func TestListMessagesPage(t *testing.T) {
+	testDBName := "test_list_messages_page"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	alice, _ := InsertChatter(db, "alice", "Alice Smith")
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		msg, _ := InsertMessage(db, alice.ID, 1, fmt.Sprintf("message %d", i))
+		ids = append(ids, msg.ID)
+	}
+	InsertMessage(db, alice.ID, 2, "another room")
+	RemoveMessage(db, ids[3])
+
+	page, err := ListMessagesPage(db, 1, 0, 2)
+	if err != nil {
+		t.Fatalf("ListMessagesPage() failed: %v", err)
+	}
+	// Newest first, skipping the removed message
+	if len(page) != 2 || page[0].ID != ids[4] || page[1].ID != ids[2] {
+		t.Fatalf("Expected messages %d and %d, got %+v", ids[4], ids[2], page)
+	}
+
+	page, _ = ListMessagesPage(db, 1, page[1].ID, 2)
+	if len(page) != 2 || page[0].ID != ids[1] || page[1].ID != ids[0] {
+		t.Errorf("Expected messages %d and %d, got %+v", ids[1], ids[0], page)
+	}
+
+	page, _ = ListMessagesPage(db, 1, ids[0], 2)
+	if len(page) != 0 {
+		t.Errorf("Expected nothing before the first message, got %+v", page)
+	}
+}
+
+func TestListMessagesAfter(t *testing.T) {
+	testDBName := "test_list_messages_after"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	alice, _ := InsertChatter(db, "alice", "Alice Smith")
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		msg, _ := InsertMessage(db, alice.ID, 1, fmt.Sprintf("message %d", i))
+		ids = append(ids, msg.ID)
+	}
+	InsertMessage(db, alice.ID, 2, "another room")
+	RemoveMessage(db, ids[2])
+
+	missed, err := ListMessagesAfter(db, 1, ids[0], 10)
+	if err != nil {
+		t.Fatalf("ListMessagesAfter() failed: %v", err)
+	}
+	// Oldest first, skipping the removed message
+	if len(missed) != 3 || missed[0].ID != ids[1] || missed[1].ID != ids[3] || missed[2].ID != ids[4] {
+		t.Fatalf("Expected messages %d, %d and %d, got %+v", ids[1], ids[3], ids[4], missed)
+	}
+
+	missed, _ = ListMessagesAfter(db, 1, ids[0], 1)
+	if len(missed) != 1 || missed[0].ID != ids[1] {
+		t.Errorf("Expected only message %d, got %+v", ids[1], missed)
+	}
+
+	missed, _ = ListMessagesAfter(db, 1, ids[4], 10)
+	if len(missed) != 0 {
+		t.Errorf("Expected nothing after the newest message, got %+v", missed)
+	}
+}
+
+func TestProcessedEvents(t *testing.T) {
+	testDBName := "test_processed_events"
+	defer os.Remove("./" + testDBName + ".db")
+
+	db, err := SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+
+	first, err := MarkEventProcessed(db, "bots", "message-1")
+	if err != nil || !first {
+		t.Fatalf("Expected the first mark to count, got %v, %v", first, err)
+	}
+	if again, _ := MarkEventProcessed(db, "bots", "message-1"); again {
+		t.Error("Expected a repeat mark not to count")
+	}
+	if done, _ := IsEventProcessed(db, "webhooks", "message-1"); done {
+		t.Error("Expected consumers to be tracked separately")
+	}
+
+	// A failed action leaves the event to be processed again
+	ran := 0
+	_, err = ProcessEventOnce(db, "webhooks", "message-1", func(tx DBTX) error {
+		ran++
+		return fmt.Errorf("receiver down")
+	})
+	if err == nil {
+		t.Fatal("Expected the action's error")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := ProcessEventOnce(db, "webhooks", "message-1", func(tx DBTX) error { ran++; return nil }); err != nil {
+			t.Fatalf("ProcessEventOnce() failed: %v", err)
+		}
+	}
+	if ran != 2 {
+		t.Errorf("Expected the action to run for the failure and once more, ran %d times", ran)
+	}
+
+	if n, _ := DeleteStaleProcessedEvents(db, time.Now()); n != 0 {
+		t.Errorf("Expected recent events to be kept, deleted %d", n)
+	}
+	if n, _ := DeleteStaleProcessedEvents(db, time.Now().Add(processedEventsKept+time.Hour)); n != 2 {
+		t.Errorf("Expected both events to be forgotten, deleted %d", n)
+	}
+}
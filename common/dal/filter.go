@@ -0,0 +1,171 @@
+package dal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+
+	_ "modernc.org/sqlite"
+)
+
+// InsertWordFilter adds a word or regex rule to a room
+func InsertWordFilter(db DBTX, roomID int64, pattern string, isRegex bool, action string) (*WordFilter, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("filter pattern cannot be empty")
+	}
+	switch action {
+	case FilterFlag, FilterReject, FilterRewrite:
+	default:
+		return nil, fmt.Errorf("unknown filter action '%s'", action)
+	}
+	if isRegex {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid filter regex: %w", err)
+		}
+	}
+
+	stmt := `INSERT INTO word_filters (roomId, pattern, isRegex, action) VALUES (?, ?, ?, ?)`
+	result, err := db.Exec(stmt, roomID, pattern, isRegex, action)
+	if err != nil {
+		return nil, err
+	}
+
+	filterID, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &WordFilter{
+		ID:      filterID,
+		RoomID:  roomID,
+		Pattern: pattern,
+		IsRegex: isRegex,
+		Action:  action,
+	}, nil
+}
+
+// DeleteWordFilter removes a rule from a room
+func DeleteWordFilter(db DBTX, filterID, roomID int64) error {
+	result, err := db.Exec(`DELETE FROM word_filters WHERE id = ? AND roomId = ?`, filterID, roomID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("filter with ID %d not found in room %d", filterID, roomID)
+	}
+
+	return nil
+}
+
+// ListWordFilters returns a room's rules in the order they were added
+func ListWordFilters(db *sql.DB, roomID int64) ([]WordFilter, error) {
+	query := `SELECT id, roomId, pattern, isRegex, action FROM word_filters WHERE roomId = ? ORDER BY id ASC`
+
+	rows, err := db.Query(query, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var filters []WordFilter
+	for rows.Next() {
+		var filter WordFilter
+		if err := rows.Scan(&filter.ID, &filter.RoomID, &filter.Pattern, &filter.IsRegex, &filter.Action); err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return filters, nil
+}
+
+// FlagMessage queues a message for moderator review
+func FlagMessage(db DBTX, messageID int64, reason string) error {
+	_, err := db.Exec(`INSERT INTO flagged_messages (messageId, reason) VALUES (?, ?)`, messageID, reason)
+	return err
+}
+
+// ListFlaggedMessages returns flagged messages with the given status, oldest first
+func ListFlaggedMessages(db *sql.DB, status string) ([]FlaggedMessage, error) {
+	query := `
+		SELECT f.id, f.messageId, m.roomId, m.content, c.name, f.reason, f.status, f.createdAt
+		FROM flagged_messages f
+		JOIN messages m ON f.messageId = m.id
+		JOIN chatters c ON m.userId = c.id
+		WHERE f.status = ?
+		ORDER BY f.id ASC`
+
+	rows, err := db.Query(query, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var flagged []FlaggedMessage
+	for rows.Next() {
+		var f FlaggedMessage
+		err := rows.Scan(&f.ID, &f.MessageID, &f.RoomID, &f.Content, &f.ChatterName, &f.Reason, &f.Status, &f.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		flagged = append(flagged, f)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return flagged, nil
+}
+
+// GetFlaggedMessage returns a single flagged message
+func GetFlaggedMessage(db *sql.DB, flagID int64) (*FlaggedMessage, error) {
+	query := `
+		SELECT f.id, f.messageId, m.roomId, m.content, c.name, f.reason, f.status, f.createdAt
+		FROM flagged_messages f
+		JOIN messages m ON f.messageId = m.id
+		JOIN chatters c ON m.userId = c.id
+		WHERE f.id = ?`
+
+	var f FlaggedMessage
+	err := db.QueryRow(query, flagID).Scan(&f.ID, &f.MessageID, &f.RoomID, &f.Content, &f.ChatterName, &f.Reason, &f.Status, &f.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("flagged message with ID %d not found: %w", flagID, err)
+		}
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// ErrAlreadyReviewed is returned by ReviewFlaggedMessage when the flagged
+// message has already been reviewed, or doesn't exist
+var ErrAlreadyReviewed = errors.New("flagged message has already been reviewed")
+
+// ReviewFlaggedMessage records a moderator's decision on a pending flagged message
+func ReviewFlaggedMessage(db DBTX, flagID, reviewerID int64, status string) error {
+	if status != FlagApproved && status != FlagRemoved {
+		return fmt.Errorf("unknown review status '%s'", status)
+	}
+
+	stmt := `UPDATE flagged_messages SET status = ?, reviewedBy = ? WHERE id = ? AND status = ?`
+	result, err := db.Exec(stmt, status, reviewerID, flagID, FlagPending)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("no pending flagged message with ID %d: %w", flagID, ErrAlreadyReviewed)
+	}
+
+	return nil
+}
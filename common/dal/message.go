@@ -2,17 +2,60 @@ package dal
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
 
-func InsertMessage(db *sql.DB, userID, roomID int64, content string) (*Message, error) {
-	stmt := `INSERT INTO messages (userId, roomId, content) VALUES (?, ?, ?)`
-	result, err := db.Exec(stmt, userID, roomID, content)
+func InsertMessage(db DBTX, userID, roomID int64, content string) (*Message, error) {
+	return InsertMessageAs(db, userID, roomID, content, "", "")
+}
+
+// InsertMessageAs stores a message shown under senderName and avatarURL
+// instead of its chatter's, for webhooks that pick their own. Empty values
+// fall back to the chatter.
+func InsertMessageAs(db DBTX, userID, roomID int64, content, senderName, avatarURL string) (*Message, error) {
+	stmt := `INSERT INTO messages (userId, roomId, content, senderName, avatarUrl) VALUES (?, ?, ?, ?, ?)`
+	result, err := db.Exec(stmt, userID, roomID, content, senderName, avatarURL)
 	if err != nil {
 		return nil, err
 	}
 
+	return insertedMessage(db, result)
+}
+
+// ErrSlowMode is returned by InsertMessageSlowMode when the chatter posted
+// in the room too recently
+var ErrSlowMode = errors.New("posted again within the room's slow mode interval")
+
+// InsertMessageSlowMode stores a message unless the chatter already posted in
+// the room within interval. The check and the insert are one statement, so
+// two posts racing each other can't both get through.
+func InsertMessageSlowMode(db DBTX, userID, roomID int64, content string, interval time.Duration) (*Message, error) {
+	stmt := `
+		INSERT INTO messages (userId, roomId, content)
+		SELECT ?, ?, ?
+		WHERE NOT EXISTS (
+			SELECT 1 FROM messages
+			WHERE userId = ? AND roomId = ? AND timestamp > datetime('now', ?, 'subsec')
+		)`
+	result, err := db.Exec(stmt, userID, roomID, content, userID, roomID, ageModifier(interval))
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrSlowMode
+	}
+
+	return insertedMessage(db, result)
+}
+
+// insertedMessage reads back the message an INSERT just stored
+func insertedMessage(db DBTX, result sql.Result) (*Message, error) {
 	messageID, err := result.LastInsertId()
 	if err != nil {
 		return nil, err
@@ -27,3 +70,93 @@ func InsertMessage(db *sql.DB, userID, roomID int64, content string) (*Message,
 
 	return &msg, nil
 }
+
+// LastMessageTime returns when the chatter last posted in the room, and false if they never have
+func LastMessageTime(db *sql.DB, userID, roomID int64) (time.Time, bool, error) {
+	query := `SELECT timestamp FROM messages WHERE userId = ? AND roomId = ? ORDER BY id DESC LIMIT 1`
+
+	var timestamp time.Time
+	err := db.QueryRow(query, userID, roomID).Scan(&timestamp)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, err
+	}
+
+	return timestamp, true, nil
+}
+
+// GetMessage returns a single message, including removed ones
+func GetMessage(db *sql.DB, messageID int64) (*Message, error) {
+	query := `SELECT id, userId, roomId, content, timestamp FROM messages WHERE id = ?`
+
+	var msg Message
+	err := db.QueryRow(query, messageID).Scan(&msg.ID, &msg.UserID, &msg.RoomID, &msg.Content, &msg.Timestamp)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("message with ID %d not found: %w", messageID, err)
+		}
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// GetRemovedBotMessage returns a removed message posted by one of its room's
+// bots, or an error if the message is still shown or wasn't a bot's
+func GetRemovedBotMessage(db *sql.DB, messageID int64) (*Message, error) {
+	query := `
+		SELECT m.id, m.userId, m.roomId, m.content, m.timestamp
+		FROM messages m
+		JOIN chatters c ON m.userId = c.id
+		WHERE m.id = ? AND m.removed = 1
+			AND c.username IN (SELECT username FROM room_bots WHERE roomId = m.roomId)`
+
+	var msg Message
+	err := db.QueryRow(query, messageID).Scan(&msg.ID, &msg.UserID, &msg.RoomID, &msg.Content, &msg.Timestamp)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("removed bot message with ID %d not found", messageID)
+		}
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// UpdateMessageContent replaces a message's text, for replies that are written as they stream in
+func UpdateMessageContent(db DBTX, messageID int64, content string) error {
+	result, err := db.Exec(`UPDATE messages SET content = ? WHERE id = ?`, content, messageID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("message with ID %d not found", messageID)
+	}
+
+	return nil
+}
+
+// GetMessageWithChatter returns a message as shown in its room, or an error
+// if it has been removed or hidden
+func GetMessageWithChatter(db *sql.DB, messageID int64) (*MessageWithChatter, error) {
+	query := `
+		SELECT m.id, m.userId, m.roomId, m.content, m.timestamp, COALESCE(NULLIF(m.senderName, ''), c.name), c.username, m.avatarUrl
+		FROM messages m
+		JOIN chatters c ON m.userId = c.id
+		WHERE m.id = ? AND m.removed = 0 AND m.hidden = 0`
+
+	var msg MessageWithChatter
+	err := db.QueryRow(query, messageID).Scan(&msg.ID, &msg.UserID, &msg.RoomID, &msg.Content, &msg.Timestamp, &msg.ChatterName, &msg.Username, &msg.AvatarURL)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("message with ID %d not found: %w", messageID, err)
+		}
+		return nil, err
+	}
+
+	return &msg, nil
+}
@@ -3,6 +3,7 @@ package dal
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 
 	_ "modernc.org/sqlite"
 )
@@ -13,7 +14,9 @@ func SetupDB(dbName string) (*sql.DB, error) {
 		dbName = "chat-app"
 	}
 
-	dbPath := fmt.Sprintf("./%s.db", dbName)
+	// Several instances can share the database, so a write waits for
+	// another's to finish instead of failing straight away
+	dbPath := fmt.Sprintf("./%s.db?_pragma=busy_timeout(5000)", dbName)
 	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
 		return nil, err
@@ -37,6 +40,21 @@ func SetupDB(dbName string) (*sql.DB, error) {
 		createRooms,
 		createChatters,
 		createMessages,
+		createBans,
+		createMutes,
+		createAuditLog,
+		createWordFilters,
+		createFlaggedMessages,
+		createReports,
+		createRoomBots,
+		createScheduledMessages,
+		createBotState,
+		createIncomingWebhooks,
+		createOutgoingWebhooks,
+		createWebhookDeliveries,
+		createWebhookDeadLetters,
+		createAPITokens,
+		createProcessedEvents,
 	}
 
 	for _, createFunc := range createFuncs {
@@ -46,6 +64,20 @@ func SetupDB(dbName string) (*sql.DB, error) {
 		}
 	}
 
+	// Add columns introduced after a table was first created
+	for _, col := range addedColumns {
+		if err := ensureColumn(db, col.table, col.name, col.definition); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	// Chatters made before system was added
+	if err := markSystemChatters(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	// Seed initial data
 	if err := seedInitialData(db); err != nil {
 		db.Close()
@@ -62,17 +94,63 @@ func createTable(db *sql.DB, tableName, schema string) error {
 	return err
 }
 
+// ensureColumn adds a column to an existing table if it is missing
+func ensureColumn(db *sql.DB, tableName, columnName, definition string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", tableName)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == columnName {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec("ALTER TABLE " + tableName + " ADD COLUMN " + columnName + " " + definition)
+	return err
+}
+
+// addedColumns are columns added to tables after their original schema.
+// New databases get them from the schemas below, older ones via ALTER TABLE.
+var addedColumns = []struct {
+	table      string
+	name       string
+	definition string
+}{
+	{"rooms", "slowModeSeconds", "INTEGER NOT NULL DEFAULT 0"},
+	{"chatters", "role", "TEXT NOT NULL DEFAULT 'member'"},
+	{"messages", "removed", "INTEGER NOT NULL DEFAULT 0"},
+	{"rooms", "archived", "INTEGER NOT NULL DEFAULT 0"},
+	{"messages", "hidden", "INTEGER NOT NULL DEFAULT 0"},
+	{"messages", "senderName", "TEXT NOT NULL DEFAULT ''"},
+	{"messages", "avatarUrl", "TEXT NOT NULL DEFAULT ''"},
+	{"chatters", "system", "INTEGER NOT NULL DEFAULT 0"},
+}
+
 // Table schemas
 const (
 	roomsSchema = `
 		id INTEGER NOT NULL PRIMARY KEY, 
 		name TEXT, 
-		description TEXT`
+		description TEXT,
+		slowModeSeconds INTEGER NOT NULL DEFAULT 0,
+		archived INTEGER NOT NULL DEFAULT 0`
 
 	chattersSchema = `
 		id INTEGER NOT NULL PRIMARY KEY, 
 		username TEXT UNIQUE NOT NULL,
-		name TEXT`
+		name TEXT,
+		role TEXT NOT NULL DEFAULT 'member',
+		system INTEGER NOT NULL DEFAULT 0`
 
 	messagesSchema = `
 		id INTEGER NOT NULL PRIMARY KEY, 
@@ -80,10 +158,182 @@ const (
 		roomId INTEGER NOT NULL,
 		content TEXT,
 		timestamp DATETIME DEFAULT (datetime('now', 'subsec')),
+		removed INTEGER NOT NULL DEFAULT 0,
+		hidden INTEGER NOT NULL DEFAULT 0,
+		senderName TEXT NOT NULL DEFAULT '',
+		avatarUrl TEXT NOT NULL DEFAULT '',
 		FOREIGN KEY(userId) REFERENCES chatters(id),
 		FOREIGN KEY(roomId) REFERENCES rooms(id)`
+
+	bansSchema = `
+		id INTEGER NOT NULL PRIMARY KEY,
+		chatterId INTEGER UNIQUE NOT NULL,
+		bannedBy INTEGER NOT NULL,
+		reason TEXT,
+		createdAt DATETIME DEFAULT (datetime('now', 'subsec')),
+		FOREIGN KEY(chatterId) REFERENCES chatters(id),
+		FOREIGN KEY(bannedBy) REFERENCES chatters(id)`
+
+	mutesSchema = `
+		id INTEGER NOT NULL PRIMARY KEY,
+		chatterId INTEGER NOT NULL,
+		roomId INTEGER NOT NULL,
+		mutedBy INTEGER NOT NULL,
+		reason TEXT,
+		expiresAt DATETIME NOT NULL,
+		createdAt DATETIME DEFAULT (datetime('now', 'subsec')),
+		UNIQUE(chatterId, roomId),
+		FOREIGN KEY(chatterId) REFERENCES chatters(id),
+		FOREIGN KEY(roomId) REFERENCES rooms(id),
+		FOREIGN KEY(mutedBy) REFERENCES chatters(id)`
+
+	auditLogSchema = `
+		id INTEGER NOT NULL PRIMARY KEY,
+		actorId INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		targetType TEXT NOT NULL,
+		targetId INTEGER NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		createdAt DATETIME DEFAULT (datetime('now', 'subsec')),
+		FOREIGN KEY(actorId) REFERENCES chatters(id)`
+
+	wordFiltersSchema = `
+		id INTEGER NOT NULL PRIMARY KEY,
+		roomId INTEGER NOT NULL,
+		pattern TEXT NOT NULL,
+		isRegex INTEGER NOT NULL DEFAULT 0,
+		action TEXT NOT NULL,
+		FOREIGN KEY(roomId) REFERENCES rooms(id)`
+
+	flaggedMessagesSchema = `
+		id INTEGER NOT NULL PRIMARY KEY,
+		messageId INTEGER NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'pending',
+		reviewedBy INTEGER,
+		createdAt DATETIME DEFAULT (datetime('now', 'subsec')),
+		FOREIGN KEY(messageId) REFERENCES messages(id),
+		FOREIGN KEY(reviewedBy) REFERENCES chatters(id)`
+
+	reportsSchema = `
+		id INTEGER NOT NULL PRIMARY KEY,
+		messageId INTEGER NOT NULL,
+		reporterId INTEGER NOT NULL,
+		category TEXT NOT NULL,
+		details TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'pending',
+		createdAt DATETIME DEFAULT (datetime('now', 'subsec')),
+		UNIQUE(messageId, reporterId),
+		FOREIGN KEY(messageId) REFERENCES messages(id),
+		FOREIGN KEY(reporterId) REFERENCES chatters(id)`
+
+	roomBotsSchema = `
+		id INTEGER NOT NULL PRIMARY KEY,
+		roomId INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		name TEXT NOT NULL,
+		username TEXT NOT NULL,
+		config TEXT NOT NULL DEFAULT '{}',
+		UNIQUE(roomId, username),
+		FOREIGN KEY(roomId) REFERENCES rooms(id)`
+
+	scheduledMessagesSchema = `
+		id INTEGER NOT NULL PRIMARY KEY,
+		roomId INTEGER NOT NULL,
+		chatterId INTEGER NOT NULL,
+		content TEXT NOT NULL,
+		runAt DATETIME NOT NULL,
+		recurrence TEXT NOT NULL DEFAULT '',
+		createdAt DATETIME DEFAULT (datetime('now', 'subsec')),
+		FOREIGN KEY(roomId) REFERENCES rooms(id),
+		FOREIGN KEY(chatterId) REFERENCES chatters(id)`
+
+	botStateSchema = `
+		installationId INTEGER NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		expiresAt DATETIME,
+		updatedAt DATETIME DEFAULT (datetime('now', 'subsec')),
+		PRIMARY KEY(installationId, key),
+		FOREIGN KEY(installationId) REFERENCES room_bots(id) ON DELETE CASCADE`
+
+	incomingWebhooksSchema = `
+		id INTEGER NOT NULL PRIMARY KEY,
+		roomId INTEGER NOT NULL,
+		chatterId INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		tokenHash TEXT NOT NULL UNIQUE,
+		createdBy INTEGER NOT NULL,
+		createdAt DATETIME DEFAULT (datetime('now', 'subsec')),
+		FOREIGN KEY(roomId) REFERENCES rooms(id),
+		FOREIGN KEY(chatterId) REFERENCES chatters(id),
+		FOREIGN KEY(createdBy) REFERENCES chatters(id)`
+
+	outgoingWebhooksSchema = `
+		id INTEGER NOT NULL PRIMARY KEY,
+		roomId INTEGER NOT NULL DEFAULT 0,
+		eventType TEXT NOT NULL DEFAULT '',
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		createdBy INTEGER NOT NULL,
+		createdAt DATETIME DEFAULT (datetime('now', 'subsec')),
+		FOREIGN KEY(createdBy) REFERENCES chatters(id)`
+
+	webhookDeliveriesSchema = `
+		id INTEGER NOT NULL PRIMARY KEY,
+		webhookId INTEGER NOT NULL,
+		eventType TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		lastStatus INTEGER NOT NULL DEFAULT 0,
+		lastError TEXT NOT NULL DEFAULT '',
+		nextAttemptAt DATETIME NOT NULL,
+		createdAt DATETIME DEFAULT (datetime('now', 'subsec')),
+		FOREIGN KEY(webhookId) REFERENCES outgoing_webhooks(id) ON DELETE CASCADE`
+
+	webhookDeadLettersSchema = `
+		id INTEGER NOT NULL PRIMARY KEY,
+		deliveryId INTEGER NOT NULL,
+		webhookId INTEGER NOT NULL,
+		eventType TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL,
+		lastStatus INTEGER NOT NULL,
+		lastError TEXT NOT NULL,
+		createdAt DATETIME DEFAULT (datetime('now', 'subsec')),
+		FOREIGN KEY(deliveryId) REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+		FOREIGN KEY(webhookId) REFERENCES outgoing_webhooks(id) ON DELETE CASCADE`
+
+	apiTokensSchema = `
+		id INTEGER NOT NULL PRIMARY KEY,
+		chatterId INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		tokenHash TEXT NOT NULL UNIQUE,
+		createdAt DATETIME DEFAULT (datetime('now', 'subsec')),
+		lastUsedAt DATETIME,
+		FOREIGN KEY(chatterId) REFERENCES chatters(id)`
+
+	processedEventsSchema = `
+		id INTEGER NOT NULL PRIMARY KEY,
+		consumer TEXT NOT NULL,
+		eventKey TEXT NOT NULL,
+		processedAt DATETIME DEFAULT (datetime('now', 'subsec')),
+		UNIQUE(consumer, eventKey)`
 )
 
+// markSystemChatters marks the chatters that webhooks and bots post as,
+// which older databases created as ordinary chatters. The scheduler marks its
+// own chatter when it starts.
+func markSystemChatters(db *sql.DB) error {
+	_, err := db.Exec(`
+		UPDATE chatters SET system = 1
+		WHERE system = 0 AND (
+			id IN (SELECT chatterId FROM incoming_webhooks)
+			OR username IN (SELECT username FROM room_bots))`)
+	return err
+}
+
 // seedInitialData adds default data if it doesn't exist
 func seedInitialData(db *sql.DB) error {
 	// Check if Watercooler room already exists
@@ -101,6 +351,27 @@ func seedInitialData(db *sql.DB) error {
 		}
 	}
 
+	// PosiBot used to be hard-wired into Watercooler. Install it once, tracked with
+	// user_version, so it isn't reinstalled after an admin removes it.
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version < 1 {
+		var roomID int64
+		err := db.QueryRow("SELECT id FROM rooms WHERE name = ?", "Watercooler").Scan(&roomID)
+		if err != nil {
+			return err
+		}
+		// PosiBot has always answered in alternating case, so it keeps the sarky responder
+		if _, err := InstallBot(db, roomID, "sarky", "PosiBot", "posibot", ""); err != nil {
+			return err
+		}
+		if _, err := db.Exec("PRAGMA user_version = 1"); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -115,3 +386,80 @@ func createChatters(db *sql.DB) error {
 func createMessages(db *sql.DB) error {
 	return createTable(db, "messages", messagesSchema)
 }
+
+func createBans(db *sql.DB) error {
+	return createTable(db, "bans", bansSchema)
+}
+
+func createMutes(db *sql.DB) error {
+	return createTable(db, "mutes", mutesSchema)
+}
+
+func createWordFilters(db *sql.DB) error {
+	return createTable(db, "word_filters", wordFiltersSchema)
+}
+
+func createFlaggedMessages(db *sql.DB) error {
+	return createTable(db, "flagged_messages", flaggedMessagesSchema)
+}
+
+func createReports(db *sql.DB) error {
+	return createTable(db, "reports", reportsSchema)
+}
+
+func createRoomBots(db *sql.DB) error {
+	return createTable(db, "room_bots", roomBotsSchema)
+}
+
+func createScheduledMessages(db *sql.DB) error {
+	return createTable(db, "scheduled_messages", scheduledMessagesSchema)
+}
+
+func createBotState(db *sql.DB) error {
+	return createTable(db, "bot_state", botStateSchema)
+}
+
+func createIncomingWebhooks(db *sql.DB) error {
+	return createTable(db, "incoming_webhooks", incomingWebhooksSchema)
+}
+
+func createOutgoingWebhooks(db *sql.DB) error {
+	return createTable(db, "outgoing_webhooks", outgoingWebhooksSchema)
+}
+
+func createWebhookDeliveries(db *sql.DB) error {
+	if err := createTable(db, "webhook_deliveries", webhookDeliveriesSchema); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (status, nextAttemptAt)`)
+	return err
+}
+
+func createWebhookDeadLetters(db *sql.DB) error {
+	return createTable(db, "webhook_dead_letters", webhookDeadLettersSchema)
+}
+
+func createAPITokens(db *sql.DB) error {
+	return createTable(db, "api_tokens", apiTokensSchema)
+}
+
+func createProcessedEvents(db *sql.DB) error {
+	return createTable(db, "processed_events", processedEventsSchema)
+}
+
+// createAuditLog creates the audit log with triggers that make it append-only
+func createAuditLog(db *sql.DB) error {
+	if err := createTable(db, "audit_log", auditLogSchema); err != nil {
+		return err
+	}
+
+	for _, op := range []string{"UPDATE", "DELETE"} {
+		stmt := "CREATE TRIGGER IF NOT EXISTS audit_log_no_" + strings.ToLower(op) +
+			" BEFORE " + op + " ON audit_log BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;"
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,17 +1,38 @@
 package dal
 
+import "time"
+
+// Chatter roles, in increasing order of privilege
+const (
+	RoleMember    = "member"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
 // Room represents a chat room
 type Room struct {
-	ID          int64  `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
+	ID              int64  `json:"id"`
+	Name            string `json:"name"`
+	Description     string `json:"description"`
+	SlowModeSeconds int    `json:"slowModeSeconds"`
+	Archived        bool   `json:"archived"`
 }
 
-// Chatter represents a chat user
+// Chatter represents a chat user. A human chatter's username is their session
+// cookie, so it is left out of JSON that other chatters can see.
 type Chatter struct {
 	ID       int64  `json:"id"`
-	Username string `json:"username"`
+	Username string `json:"username,omitempty"`
 	Name     string `json:"name"`
+	Role     string `json:"role"`
+	// System is set for the chatters bots, webhooks and reminders post as,
+	// whose usernames aren't secret, so no session can sign in as them
+	System bool `json:"-"`
+}
+
+// IsModerator reports whether the chatter can moderate rooms
+func (c Chatter) IsModerator() bool {
+	return c.Role == RoleModerator || c.Role == RoleAdmin
 }
 
 // Message represents a chat message
@@ -23,7 +44,9 @@ type Message struct {
 	Timestamp string `json:"timestamp"`
 }
 
-// MessageWithChatter represents a message with the chatter's name included
+// MessageWithChatter represents a message with the chatter's name included.
+// ChatterName is the name the message was posted under, which webhooks can
+// override, and AvatarURL is only set by webhooks.
 type MessageWithChatter struct {
 	ID          int64  `json:"id"`
 	UserID      int64  `json:"userId"`
@@ -31,5 +54,184 @@ type MessageWithChatter struct {
 	Content     string `json:"content"`
 	Timestamp   string `json:"timestamp"`
 	ChatterName string `json:"chatterName"`
-	Username    string `json:"username"`
+	Username    string `json:"username,omitempty"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+}
+
+// Ban represents a chatter banned from the whole server
+type Ban struct {
+	ID        int64  `json:"id"`
+	ChatterID int64  `json:"chatterId"`
+	BannedBy  int64  `json:"bannedBy"`
+	Reason    string `json:"reason"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// Mute represents a chatter who cannot post in a room until ExpiresAt
+type Mute struct {
+	ID        int64     `json:"id"`
+	ChatterID int64     `json:"chatterId"`
+	RoomID    int64     `json:"roomId"`
+	MutedBy   int64     `json:"mutedBy"`
+	Reason    string    `json:"reason"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// AuditEntry is one append-only record of a moderation or admin action
+type AuditEntry struct {
+	ID         int64  `json:"id"`
+	ActorID    int64  `json:"actorId"`
+	ActorName  string `json:"actorName"`
+	Action     string `json:"action"`
+	TargetType string `json:"targetType"`
+	TargetID   int64  `json:"targetId"`
+	Reason     string `json:"reason"`
+	CreatedAt  string `json:"createdAt"`
+}
+
+// Word filter actions
+const (
+	FilterFlag    = "flag"
+	FilterReject  = "reject"
+	FilterRewrite = "rewrite"
+)
+
+// WordFilter is a per-room rule matching a word, or a regex, in new messages
+type WordFilter struct {
+	ID      int64  `json:"id"`
+	RoomID  int64  `json:"roomId"`
+	Pattern string `json:"pattern"`
+	IsRegex bool   `json:"isRegex"`
+	Action  string `json:"action"`
+}
+
+// Flagged message review statuses
+const (
+	FlagPending  = "pending"
+	FlagApproved = "approved"
+	FlagRemoved  = "removed"
+)
+
+// FlaggedMessage is a message waiting for, or after, moderator review
+type FlaggedMessage struct {
+	ID          int64  `json:"id"`
+	MessageID   int64  `json:"messageId"`
+	RoomID      int64  `json:"roomId"`
+	Content     string `json:"content"`
+	ChatterName string `json:"chatterName"`
+	Reason      string `json:"reason"`
+	Status      string `json:"status"`
+	CreatedAt   string `json:"createdAt"`
+}
+
+// Report categories
+const (
+	ReportSpam       = "spam"
+	ReportHarassment = "harassment"
+	ReportHate       = "hate"
+	ReportOther      = "other"
+)
+
+// ReportCategories lists the categories chatters can pick from, in display order
+var ReportCategories = []string{ReportSpam, ReportHarassment, ReportHate, ReportOther}
+
+// Report is one chatter's report of an abusive message
+type Report struct {
+	ID         int64  `json:"id"`
+	MessageID  int64  `json:"messageId"`
+	ReporterID int64  `json:"reporterId"`
+	Category   string `json:"category"`
+	Details    string `json:"details"`
+	Status     string `json:"status"`
+}
+
+// BotInstallation is a bot of a registered kind installed in a room
+type BotInstallation struct {
+	ID       int64  `json:"id"`
+	RoomID   int64  `json:"roomId"`
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	Config   string `json:"config"`
+}
+
+// ScheduledMessage is a reminder waiting to be posted in a room. Recurring
+// messages have a cron-style Recurrence and move RunAt on each time they fire.
+type ScheduledMessage struct {
+	ID         int64     `json:"id"`
+	RoomID     int64     `json:"roomId"`
+	ChatterID  int64     `json:"chatterId"`
+	Content    string    `json:"content"`
+	RunAt      time.Time `json:"runAt"`
+	Recurrence string    `json:"recurrence"`
+	CreatedAt  string    `json:"createdAt"`
+}
+
+// IncomingWebhook lets an external system post into a room as its own
+// chatter. Only a hash of the token in its URL is stored.
+type IncomingWebhook struct {
+	ID        int64  `json:"id"`
+	RoomID    int64  `json:"roomId"`
+	ChatterID int64  `json:"chatterId"`
+	Name      string `json:"name"`
+	CreatedBy int64  `json:"createdBy"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// OutgoingWebhook delivers room events to an HTTP endpoint. A zero RoomID
+// matches every room and an empty EventType every kind of event.
+type OutgoingWebhook struct {
+	ID        int64  `json:"id"`
+	RoomID    int64  `json:"roomId"`
+	EventType string `json:"eventType"`
+	URL       string `json:"url"`
+	// Secret signs each delivery so the receiver can check it came from us
+	Secret    string `json:"-"`
+	CreatedBy int64  `json:"createdBy"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is one event on its way to an outgoing webhook. Failed
+// attempts are retried at NextAttemptAt until the delivery gives up.
+type WebhookDelivery struct {
+	ID            int64     `json:"id"`
+	WebhookID     int64     `json:"webhookId"`
+	EventType     string    `json:"eventType"`
+	Payload       string    `json:"payload"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	LastStatus    int       `json:"lastStatus"`
+	LastError     string    `json:"lastError"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	CreatedAt     string    `json:"createdAt"`
+}
+
+// WebhookDeadLetter keeps a delivery that ran out of attempts
+type WebhookDeadLetter struct {
+	ID         int64  `json:"id"`
+	DeliveryID int64  `json:"deliveryId"`
+	WebhookID  int64  `json:"webhookId"`
+	EventType  string `json:"eventType"`
+	Payload    string `json:"payload"`
+	Attempts   int    `json:"attempts"`
+	LastStatus int    `json:"lastStatus"`
+	LastError  string `json:"lastError"`
+	CreatedAt  string `json:"createdAt"`
+}
+
+// APIToken lets scripts call the JSON API as a chatter. Only a hash of the
+// token itself is stored.
+type APIToken struct {
+	ID         int64  `json:"id"`
+	ChatterID  int64  `json:"chatterId"`
+	Name       string `json:"name"`
+	CreatedAt  string `json:"createdAt"`
+	LastUsedAt string `json:"lastUsedAt,omitempty"`
 }
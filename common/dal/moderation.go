@@ -0,0 +1,111 @@
+package dal
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// timestampLayout matches how SQLite's datetime('now', 'subsec') stores times,
+// so stored values compare correctly against it
+const timestampLayout = "2006-01-02 15:04:05.000"
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(timestampLayout)
+}
+
+// BanChatter bans a chatter from the whole server, replacing any earlier ban
+func BanChatter(db DBTX, chatterID, bannedBy int64, reason string) (*Ban, error) {
+	stmt := `
+		INSERT INTO bans (chatterId, bannedBy, reason) VALUES (?, ?, ?)
+		ON CONFLICT(chatterId) DO UPDATE SET bannedBy = excluded.bannedBy, reason = excluded.reason`
+	if _, err := db.Exec(stmt, chatterID, bannedBy, reason); err != nil {
+		return nil, err
+	}
+
+	var ban Ban
+	query := `SELECT id, chatterId, bannedBy, reason, createdAt FROM bans WHERE chatterId = ?`
+	err := db.QueryRow(query, chatterID).Scan(&ban.ID, &ban.ChatterID, &ban.BannedBy, &ban.Reason, &ban.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ban, nil
+}
+
+// UnbanChatter lifts a server wide ban
+func UnbanChatter(db DBTX, chatterID int64) error {
+	_, err := db.Exec(`DELETE FROM bans WHERE chatterId = ?`, chatterID)
+	return err
+}
+
+// IsBanned reports whether the chatter is banned from the server
+func IsBanned(db *sql.DB, chatterID int64) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM bans WHERE chatterId = ?`, chatterID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// MuteChatter stops a chatter posting in a room until the given time, replacing any earlier mute
+func MuteChatter(db DBTX, chatterID, roomID, mutedBy int64, until time.Time, reason string) (*Mute, error) {
+	stmt := `
+		INSERT INTO mutes (chatterId, roomId, mutedBy, reason, expiresAt) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(chatterId, roomId) DO UPDATE SET
+			mutedBy = excluded.mutedBy, reason = excluded.reason, expiresAt = excluded.expiresAt`
+	if _, err := db.Exec(stmt, chatterID, roomID, mutedBy, reason, formatTimestamp(until)); err != nil {
+		return nil, err
+	}
+
+	var mute Mute
+	query := `SELECT id, chatterId, roomId, mutedBy, reason, expiresAt FROM mutes WHERE chatterId = ? AND roomId = ?`
+	err := db.QueryRow(query, chatterID, roomID).Scan(&mute.ID, &mute.ChatterID, &mute.RoomID, &mute.MutedBy, &mute.Reason, &mute.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mute, nil
+}
+
+// UnmuteChatter lifts a mute before it expires
+func UnmuteChatter(db DBTX, chatterID, roomID int64) error {
+	_, err := db.Exec(`DELETE FROM mutes WHERE chatterId = ? AND roomId = ?`, chatterID, roomID)
+	return err
+}
+
+// MutedUntil returns when the chatter's mute in the room expires, and false if they are not muted
+func MutedUntil(db *sql.DB, chatterID, roomID int64) (time.Time, bool, error) {
+	query := `
+		SELECT expiresAt FROM mutes
+		WHERE chatterId = ? AND roomId = ? AND expiresAt > datetime('now', 'subsec')`
+
+	var expiresAt time.Time
+	err := db.QueryRow(query, chatterID, roomID).Scan(&expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, err
+	}
+
+	return expiresAt, true, nil
+}
+
+// RemoveMessage hides a message from the room, keeping it for the record
+func RemoveMessage(db DBTX, messageID int64) error {
+	result, err := db.Exec(`UPDATE messages SET removed = 1 WHERE id = ?`, messageID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("message with ID %d not found", messageID)
+	}
+
+	return nil
+}
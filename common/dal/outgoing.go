@@ -0,0 +1,228 @@
+package dal
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	outgoingWebhookColumns = `id, roomId, eventType, url, secret, createdBy, createdAt`
+	webhookDeliveryColumns = `id, webhookId, eventType, payload, status, attempts, lastStatus, lastError, nextAttemptAt, createdAt`
+)
+
+// InsertOutgoingWebhook registers an endpoint for room events. A zero roomID
+// matches every room and an empty eventType every kind of event.
+func InsertOutgoingWebhook(db DBTX, roomID int64, eventType, url, secret string, createdBy int64) (*OutgoingWebhook, error) {
+	if url == "" || secret == "" {
+		return nil, fmt.Errorf("outgoing webhooks need a URL and a secret")
+	}
+
+	stmt := `INSERT INTO outgoing_webhooks (roomId, eventType, url, secret, createdBy) VALUES (?, ?, ?, ?, ?)`
+	result, err := db.Exec(stmt, roomID, eventType, url, secret, createdBy)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	var hook OutgoingWebhook
+	query := `SELECT ` + outgoingWebhookColumns + ` FROM outgoing_webhooks WHERE id = ?`
+	err = db.QueryRow(query, id).Scan(&hook.ID, &hook.RoomID, &hook.EventType, &hook.URL, &hook.Secret, &hook.CreatedBy, &hook.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hook, nil
+}
+
+// GetOutgoingWebhook returns one outgoing webhook
+func GetOutgoingWebhook(db *sql.DB, id int64) (*OutgoingWebhook, error) {
+	var hook OutgoingWebhook
+	query := `SELECT ` + outgoingWebhookColumns + ` FROM outgoing_webhooks WHERE id = ?`
+	err := db.QueryRow(query, id).Scan(&hook.ID, &hook.RoomID, &hook.EventType, &hook.URL, &hook.Secret, &hook.CreatedBy, &hook.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("outgoing webhook with ID %d not found", id)
+		}
+		return nil, err
+	}
+
+	return &hook, nil
+}
+
+// ListOutgoingWebhooks returns every outgoing webhook, oldest first
+func ListOutgoingWebhooks(db *sql.DB) ([]OutgoingWebhook, error) {
+	return queryOutgoingWebhooks(db, `SELECT `+outgoingWebhookColumns+` FROM outgoing_webhooks ORDER BY id ASC`)
+}
+
+// ListOutgoingWebhooksFor returns the webhooks that want an event of the type from the room
+func ListOutgoingWebhooksFor(db *sql.DB, roomID int64, eventType string) ([]OutgoingWebhook, error) {
+	query := `SELECT ` + outgoingWebhookColumns + ` FROM outgoing_webhooks
+		WHERE roomId IN (0, ?) AND eventType IN ('', ?) ORDER BY id ASC`
+	return queryOutgoingWebhooks(db, query, roomID, eventType)
+}
+
+func queryOutgoingWebhooks(db *sql.DB, query string, args ...any) ([]OutgoingWebhook, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []OutgoingWebhook
+	for rows.Next() {
+		var hook OutgoingWebhook
+		if err := rows.Scan(&hook.ID, &hook.RoomID, &hook.EventType, &hook.URL, &hook.Secret, &hook.CreatedBy, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+// DeleteOutgoingWebhook removes a webhook along with its delivery log
+func DeleteOutgoingWebhook(db DBTX, id int64) error {
+	for _, stmt := range []string{
+		`DELETE FROM webhook_dead_letters WHERE webhookId = ?`,
+		`DELETE FROM webhook_deliveries WHERE webhookId = ?`,
+	} {
+		if _, err := db.Exec(stmt, id); err != nil {
+			return err
+		}
+	}
+
+	result, err := db.Exec(`DELETE FROM outgoing_webhooks WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("outgoing webhook with ID %d not found", id)
+	}
+
+	return nil
+}
+
+// InsertWebhookDelivery queues an event for a webhook, to be attempted at nextAttemptAt
+func InsertWebhookDelivery(db DBTX, webhookID int64, eventType, payload string, nextAttemptAt time.Time) (*WebhookDelivery, error) {
+	stmt := `INSERT INTO webhook_deliveries (webhookId, eventType, payload, nextAttemptAt) VALUES (?, ?, ?, ?)`
+	result, err := db.Exec(stmt, webhookID, eventType, payload, formatTimestamp(nextAttemptAt))
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	var d WebhookDelivery
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE id = ?`
+	err = db.QueryRow(query, id).Scan(&d.ID, &d.WebhookID, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &d.LastStatus, &d.LastError, &d.NextAttemptAt, &d.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// ListDueWebhookDeliveries returns up to limit pending deliveries due by now, oldest first
+func ListDueWebhookDeliveries(db *sql.DB, now time.Time, limit int) ([]WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries
+		WHERE status = ? AND nextAttemptAt <= ? ORDER BY nextAttemptAt ASC, id ASC LIMIT ?`
+	return queryWebhookDeliveries(db, query, DeliveryPending, formatTimestamp(now), limit)
+}
+
+// ListWebhookDeliveries returns a webhook's latest deliveries, newest first
+func ListWebhookDeliveries(db *sql.DB, webhookID int64, limit int) ([]WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE webhookId = ? ORDER BY id DESC LIMIT ?`
+	return queryWebhookDeliveries(db, query, webhookID, limit)
+}
+
+func queryWebhookDeliveries(db *sql.DB, query string, args ...any) ([]WebhookDelivery, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &d.LastStatus, &d.LastError, &d.NextAttemptAt, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// MarkWebhookDelivered records a successful attempt
+func MarkWebhookDelivered(db DBTX, id int64, status int) error {
+	stmt := `UPDATE webhook_deliveries SET status = ?, attempts = attempts + 1, lastStatus = ?, lastError = '' WHERE id = ?`
+	_, err := db.Exec(stmt, DeliveryDelivered, status, id)
+	return err
+}
+
+// RetryWebhookDelivery records a failed attempt and when to try again
+func RetryWebhookDelivery(db DBTX, id int64, status int, lastError string, nextAttemptAt time.Time) error {
+	stmt := `UPDATE webhook_deliveries SET attempts = attempts + 1, lastStatus = ?, lastError = ?, nextAttemptAt = ? WHERE id = ?`
+	_, err := db.Exec(stmt, status, lastError, formatTimestamp(nextAttemptAt), id)
+	return err
+}
+
+// DeadLetterWebhookDelivery records a delivery's last failed attempt and
+// moves it to the dead-letter table
+func DeadLetterWebhookDelivery(db DBTX, id int64, status int, lastError string) error {
+	stmt := `UPDATE webhook_deliveries SET status = ?, attempts = attempts + 1, lastStatus = ?, lastError = ? WHERE id = ?`
+	if _, err := db.Exec(stmt, DeliveryFailed, status, lastError, id); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`INSERT INTO webhook_dead_letters (deliveryId, webhookId, eventType, payload, attempts, lastStatus, lastError)
+		SELECT id, webhookId, eventType, payload, attempts, lastStatus, lastError FROM webhook_deliveries WHERE id = ?`, id)
+	return err
+}
+
+// ListWebhookDeadLetters returns a webhook's dead letters, newest first
+func ListWebhookDeadLetters(db *sql.DB, webhookID int64, limit int) ([]WebhookDeadLetter, error) {
+	query := `SELECT id, deliveryId, webhookId, eventType, payload, attempts, lastStatus, lastError, createdAt
+		FROM webhook_dead_letters WHERE webhookId = ? ORDER BY id DESC LIMIT ?`
+	rows, err := db.Query(query, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var letters []WebhookDeadLetter
+	for rows.Next() {
+		var l WebhookDeadLetter
+		if err := rows.Scan(&l.ID, &l.DeliveryID, &l.WebhookID, &l.EventType, &l.Payload, &l.Attempts, &l.LastStatus, &l.LastError, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		letters = append(letters, l)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return letters, nil
+}
@@ -0,0 +1,61 @@
+package dal
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Stream events can be delivered more than once, so consumers record the
+// events they have handled and skip the repeats.
+
+// MarkEventProcessed records that consumer has handled the event with the
+// given key, and reports false if it already had
+func MarkEventProcessed(db DBTX, consumer, key string) (bool, error) {
+	result, err := db.Exec(`INSERT OR IGNORE INTO processed_events (consumer, eventKey) VALUES (?, ?)`, consumer, key)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// IsEventProcessed reports whether consumer has handled the event with the given key
+func IsEventProcessed(db DBTX, consumer, key string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM processed_events WHERE consumer = ? AND eventKey = ?)`, consumer, key).Scan(&exists)
+	return exists, err
+}
+
+// ProcessEventOnce runs action in a transaction that also marks the event
+// processed, so its writes happen exactly once however often the event is
+// delivered. It reports false, without running action, for a repeat.
+func ProcessEventOnce(db *sql.DB, consumer, key string, action func(tx DBTX) error) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	first, err := MarkEventProcessed(tx, consumer, key)
+	if err != nil || !first {
+		return false, err
+	}
+	if err := action(tx); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// processedEventsKept is how long handled events are remembered, well past
+// the longest the CHAT stream is usually configured to keep them
+const processedEventsKept = 30 * 24 * time.Hour
+
+// DeleteStaleProcessedEvents forgets events handled so long ago that the
+// stream can no longer deliver them again
+func DeleteStaleProcessedEvents(db DBTX, now time.Time) (int64, error) {
+	result, err := db.Exec(`DELETE FROM processed_events WHERE processedAt < ?`, formatTimestamp(now.Add(-processedEventsKept)))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
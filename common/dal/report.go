@@ -0,0 +1,168 @@
+package dal
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Report statuses
+const (
+	ReportPending  = "pending"
+	ReportResolved = "resolved"
+)
+
+// InsertReport records a chatter's report of a message. Reporting the same
+// message twice keeps the first report and returns false.
+func InsertReport(db DBTX, messageID, reporterID int64, category, details string) (*Report, bool, error) {
+	if !slices.Contains(ReportCategories, category) {
+		return nil, false, fmt.Errorf("unknown report category '%s'", category)
+	}
+
+	stmt := `
+		INSERT INTO reports (messageId, reporterId, category, details) VALUES (?, ?, ?, ?)
+		ON CONFLICT(messageId, reporterId) DO NOTHING`
+	result, err := db.Exec(stmt, messageID, reporterID, category, details)
+	if err != nil {
+		return nil, false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var report Report
+	query := `SELECT id, messageId, reporterId, category, details, status FROM reports WHERE messageId = ? AND reporterId = ?`
+	err = db.QueryRow(query, messageID, reporterID).Scan(&report.ID, &report.MessageID, &report.ReporterID, &report.Category, &report.Details, &report.Status)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &report, n > 0, nil
+}
+
+// CountPendingReports returns how many distinct chatters have reported the message since it was last reviewed
+func CountPendingReports(db DBTX, messageID int64) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM reports WHERE messageId = ? AND status = ?`, messageID, ReportPending).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// ResolveReports marks all pending reports of a message as reviewed
+func ResolveReports(db DBTX, messageID int64) error {
+	_, err := db.Exec(`UPDATE reports SET status = ? WHERE messageId = ? AND status = ?`, ReportResolved, messageID, ReportPending)
+	return err
+}
+
+// HideMessage hides a message until a moderator reviews it
+func HideMessage(db DBTX, messageID int64) error {
+	return setMessageHidden(db, messageID, true)
+}
+
+// RestoreMessage shows a hidden message again
+func RestoreMessage(db DBTX, messageID int64) error {
+	return setMessageHidden(db, messageID, false)
+}
+
+func setMessageHidden(db DBTX, messageID int64, hidden bool) error {
+	result, err := db.Exec(`UPDATE messages SET hidden = ? WHERE id = ?`, hidden, messageID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("message with ID %d not found", messageID)
+	}
+
+	return nil
+}
+
+// CountTrustedReports returns how many distinct chatters who first posted
+// at least minAge ago have reported the message since it was last reviewed.
+// Chatters who never posted don't count.
+func CountTrustedReports(db DBTX, messageID int64, minAge time.Duration) (int, error) {
+	query := `
+		SELECT COUNT(*) FROM reports r
+		WHERE r.messageId = ? AND r.status = ?
+			AND (SELECT MIN(m.timestamp) FROM messages m WHERE m.userId = r.reporterId) <= datetime('now', ?, 'subsec')`
+
+	var count int
+	err := db.QueryRow(query, messageID, ReportPending, ageModifier(minAge)).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// isTrustedReporter reports whether the chatter first posted at least minAge ago
+func isTrustedReporter(db DBTX, chatterID int64, minAge time.Duration) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM messages WHERE userId = ? AND timestamp <= datetime('now', ?, 'subsec'))`
+
+	var trusted bool
+	err := db.QueryRow(query, chatterID, ageModifier(minAge)).Scan(&trusted)
+	if err != nil {
+		return false, err
+	}
+	return trusted, nil
+}
+
+// ageModifier is the SQLite datetime modifier going back d from now
+func ageModifier(d time.Duration) string {
+	return fmt.Sprintf("-%.3f seconds", d.Seconds())
+}
+
+// ReportMessage records a report and, when the message reaches hideThreshold
+// distinct pending reports from chatters who first posted at least
+// minReporterAge ago, hides it and queues it for moderator review.
+// It returns the report, whether it was new, and whether the message was hidden.
+func ReportMessage(db *sql.DB, messageID, reporterID int64, category, details string, hideThreshold int, minReporterAge time.Duration) (*Report, bool, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, false, false, err
+	}
+	defer tx.Rollback()
+
+	report, created, err := InsertReport(tx, messageID, reporterID, category, details)
+	if err != nil {
+		return nil, false, false, err
+	}
+
+	hidden := false
+	if created && hideThreshold > 0 {
+		trusted, err := isTrustedReporter(tx, reporterID, minReporterAge)
+		if err != nil {
+			return nil, false, false, err
+		}
+		// Reports from new chatters are kept for moderators but can't hide
+		if trusted {
+			count, err := CountTrustedReports(tx, messageID, minReporterAge)
+			if err != nil {
+				return nil, false, false, err
+			}
+			// Only the report that reaches the threshold hides, later ones are already queued
+			if count == hideThreshold {
+				if err := HideMessage(tx, messageID); err != nil {
+					return nil, false, false, err
+				}
+				if err := FlagMessage(tx, messageID, fmt.Sprintf("hidden after %d reports", count)); err != nil {
+					return nil, false, false, err
+				}
+				hidden = true
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, false, err
+	}
+
+	return report, created, hidden, nil
+}
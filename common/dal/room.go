@@ -3,17 +3,18 @@ package dal
 import (
 	"database/sql"
 	"fmt"
+	"math"
 
 	_ "modernc.org/sqlite"
 )
 
 func ListMessagesForRoom(db *sql.DB, roomId int64) ([]MessageWithChatter, error) {
 	query := `
-		SELECT m.id, m.userId, m.roomId, m.content, m.timestamp, c.name, c.username
+		SELECT m.id, m.userId, m.roomId, m.content, m.timestamp, COALESCE(NULLIF(m.senderName, ''), c.name), c.username, m.avatarUrl
 		FROM messages m
 		JOIN chatters c ON m.userId = c.id
-		WHERE m.roomId = ?
-		ORDER BY m.timestamp DESC`
+		WHERE m.roomId = ? AND m.removed = 0 AND m.hidden = 0
+		ORDER BY m.timestamp DESC, m.id DESC`
 
 	rows, err := db.Query(query, roomId)
 	if err != nil {
@@ -24,7 +25,78 @@ func ListMessagesForRoom(db *sql.DB, roomId int64) ([]MessageWithChatter, error)
 	var messages []MessageWithChatter
 	for rows.Next() {
 		var msg MessageWithChatter
-		err := rows.Scan(&msg.ID, &msg.UserID, &msg.RoomID, &msg.Content, &msg.Timestamp, &msg.ChatterName, &msg.Username)
+		err := rows.Scan(&msg.ID, &msg.UserID, &msg.RoomID, &msg.Content, &msg.Timestamp, &msg.ChatterName, &msg.Username, &msg.AvatarURL)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// ListMessagesPage returns up to limit of a room's messages older than
+// beforeID, newest first. A zero beforeID starts from the newest message.
+func ListMessagesPage(db *sql.DB, roomID, beforeID int64, limit int) ([]MessageWithChatter, error) {
+	if beforeID <= 0 {
+		beforeID = math.MaxInt64
+	}
+	query := `
+		SELECT m.id, m.userId, m.roomId, m.content, m.timestamp, COALESCE(NULLIF(m.senderName, ''), c.name), c.username, m.avatarUrl
+		FROM messages m
+		JOIN chatters c ON m.userId = c.id
+		WHERE m.roomId = ? AND m.id < ? AND m.removed = 0 AND m.hidden = 0
+		ORDER BY m.id DESC
+		LIMIT ?`
+
+	rows, err := db.Query(query, roomID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []MessageWithChatter
+	for rows.Next() {
+		var msg MessageWithChatter
+		err := rows.Scan(&msg.ID, &msg.UserID, &msg.RoomID, &msg.Content, &msg.Timestamp, &msg.ChatterName, &msg.Username, &msg.AvatarURL)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// ListMessagesAfter returns up to limit of a room's messages newer than
+// afterID, oldest first, for catching up a client that missed them
+func ListMessagesAfter(db *sql.DB, roomID, afterID int64, limit int) ([]MessageWithChatter, error) {
+	query := `
+		SELECT m.id, m.userId, m.roomId, m.content, m.timestamp, COALESCE(NULLIF(m.senderName, ''), c.name), c.username, m.avatarUrl
+		FROM messages m
+		JOIN chatters c ON m.userId = c.id
+		WHERE m.roomId = ? AND m.id > ? AND m.removed = 0 AND m.hidden = 0
+		ORDER BY m.id ASC
+		LIMIT ?`
+
+	rows, err := db.Query(query, roomID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []MessageWithChatter
+	for rows.Next() {
+		var msg MessageWithChatter
+		err := rows.Scan(&msg.ID, &msg.UserID, &msg.RoomID, &msg.Content, &msg.Timestamp, &msg.ChatterName, &msg.Username, &msg.AvatarURL)
 		if err != nil {
 			return nil, err
 		}
@@ -39,7 +111,7 @@ func ListMessagesForRoom(db *sql.DB, roomId int64) ([]MessageWithChatter, error)
 }
 
 func ListRooms(db *sql.DB) ([]Room, error) {
-	query := `SELECT id, name, description FROM rooms ORDER BY name ASC`
+	query := `SELECT id, name, description, slowModeSeconds, archived FROM rooms WHERE archived = 0 ORDER BY name ASC`
 
 	rows, err := db.Query(query)
 	if err != nil {
@@ -50,7 +122,7 @@ func ListRooms(db *sql.DB) ([]Room, error) {
 	var rooms []Room
 	for rows.Next() {
 		var room Room
-		err := rows.Scan(&room.ID, &room.Name, &room.Description)
+		err := rows.Scan(&room.ID, &room.Name, &room.Description, &room.SlowModeSeconds, &room.Archived)
 		if err != nil {
 			return nil, err
 		}
@@ -65,13 +137,13 @@ func ListRooms(db *sql.DB) ([]Room, error) {
 }
 
 func GetRoom(db *sql.DB, roomID int64) (*Room, error) {
-	query := `SELECT id, name, description FROM rooms WHERE id = ?`
+	query := `SELECT id, name, description, slowModeSeconds, archived FROM rooms WHERE id = ?`
 
 	var room Room
-	err := db.QueryRow(query, roomID).Scan(&room.ID, &room.Name, &room.Description)
+	err := db.QueryRow(query, roomID).Scan(&room.ID, &room.Name, &room.Description, &room.SlowModeSeconds, &room.Archived)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("room with ID %d not found", roomID)
+			return nil, fmt.Errorf("room with ID %d not found: %w", roomID, err)
 		}
 		return nil, err
 	}
@@ -80,7 +152,7 @@ func GetRoom(db *sql.DB, roomID int64) (*Room, error) {
 }
 
 // InsertRoom adds a new room to the rooms table
-func InsertRoom(db *sql.DB, name, description string) (*Room, error) {
+func InsertRoom(db DBTX, name, description string) (*Room, error) {
 	// Validate input
 	if name == "" {
 		return nil, fmt.Errorf("room name cannot be empty")
@@ -107,3 +179,52 @@ func InsertRoom(db *sql.DB, name, description string) (*Room, error) {
 
 	return room, nil
 }
+
+// SetRoomSlowMode sets the minimum seconds between messages from one chatter, 0 turns it off
+func SetRoomSlowMode(db DBTX, roomID int64, seconds int) error {
+	if seconds < 0 {
+		return fmt.Errorf("slow mode seconds cannot be negative")
+	}
+
+	result, err := db.Exec(`UPDATE rooms SET slowModeSeconds = ? WHERE id = ?`, seconds, roomID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("room with ID %d not found", roomID)
+	}
+
+	return nil
+}
+
+// SetRoomDescription changes the topic shown at the top of a room
+func SetRoomDescription(db DBTX, roomID int64, description string) error {
+	result, err := db.Exec(`UPDATE rooms SET description = ? WHERE id = ?`, description, roomID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("room with ID %d not found", roomID)
+	}
+
+	return nil
+}
+
+// ArchiveRoom hides a room from the room list and stops new messages, keeping its history
+func ArchiveRoom(db DBTX, roomID int64) error {
+	result, err := db.Exec(`UPDATE rooms SET archived = 1 WHERE id = ?`, roomID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("room with ID %d not found", roomID)
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package dal
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const scheduledMessageColumns = `id, roomId, chatterId, content, runAt, recurrence, createdAt`
+
+// InsertScheduledMessage schedules a message to be posted in a room at runAt.
+// Recurrence is a cron-style schedule, empty for a one-off message.
+func InsertScheduledMessage(db DBTX, roomID, chatterID int64, content string, runAt time.Time, recurrence string) (*ScheduledMessage, error) {
+	if content == "" {
+		return nil, fmt.Errorf("scheduled message content cannot be empty")
+	}
+
+	stmt := `INSERT INTO scheduled_messages (roomId, chatterId, content, runAt, recurrence) VALUES (?, ?, ?, ?, ?)`
+	result, err := db.Exec(stmt, roomID, chatterID, content, formatTimestamp(runAt), recurrence)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	var msg ScheduledMessage
+	query := `SELECT ` + scheduledMessageColumns + ` FROM scheduled_messages WHERE id = ?`
+	err = db.QueryRow(query, id).Scan(&msg.ID, &msg.RoomID, &msg.ChatterID, &msg.Content, &msg.RunAt, &msg.Recurrence, &msg.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// ListDueScheduledMessages returns the messages due at or before now, oldest first
+func ListDueScheduledMessages(db *sql.DB, now time.Time) ([]ScheduledMessage, error) {
+	query := `SELECT ` + scheduledMessageColumns + ` FROM scheduled_messages WHERE runAt <= ? ORDER BY runAt ASC, id ASC`
+	return queryScheduledMessages(db, query, formatTimestamp(now))
+}
+
+// ListChatterScheduledMessages returns a chatter's scheduled messages in a room, soonest first
+func ListChatterScheduledMessages(db *sql.DB, chatterID, roomID int64) ([]ScheduledMessage, error) {
+	query := `SELECT ` + scheduledMessageColumns + ` FROM scheduled_messages WHERE chatterId = ? AND roomId = ? ORDER BY runAt ASC, id ASC`
+	return queryScheduledMessages(db, query, chatterID, roomID)
+}
+
+func queryScheduledMessages(db *sql.DB, query string, args ...any) ([]ScheduledMessage, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []ScheduledMessage
+	for rows.Next() {
+		var msg ScheduledMessage
+		if err := rows.Scan(&msg.ID, &msg.RoomID, &msg.ChatterID, &msg.Content, &msg.RunAt, &msg.Recurrence, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// RescheduleMessage moves a recurring message to its next run
+func RescheduleMessage(db DBTX, id int64, runAt time.Time) error {
+	result, err := db.Exec(`UPDATE scheduled_messages SET runAt = ? WHERE id = ?`, formatTimestamp(runAt), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("scheduled message with ID %d not found", id)
+	}
+
+	return nil
+}
+
+// DeleteScheduledMessage removes a scheduled message once it is done
+func DeleteScheduledMessage(db DBTX, id int64) error {
+	_, err := db.Exec(`DELETE FROM scheduled_messages WHERE id = ?`, id)
+	return err
+}
+
+// CancelScheduledMessage removes one of the chatter's own scheduled messages
+func CancelScheduledMessage(db DBTX, id, chatterID int64) error {
+	result, err := db.Exec(`DELETE FROM scheduled_messages WHERE id = ? AND chatterId = ?`, id, chatterID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("scheduled message with ID %d not found: %w", id, sql.ErrNoRows)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package dal
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+const incomingWebhookColumns = `id, roomId, chatterId, name, createdBy, createdAt`
+
+// hashToken is how webhook tokens are stored, so a leaked database doesn't leak working URLs
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// InsertIncomingWebhook adds a webhook that posts into the room as the given chatter
+func InsertIncomingWebhook(db DBTX, roomID, chatterID, createdBy int64, name, token string) (*IncomingWebhook, error) {
+	if name == "" || token == "" {
+		return nil, fmt.Errorf("webhooks need a name and a token")
+	}
+
+	stmt := `INSERT INTO incoming_webhooks (roomId, chatterId, name, tokenHash, createdBy) VALUES (?, ?, ?, ?, ?)`
+	result, err := db.Exec(stmt, roomID, chatterID, name, hashToken(token), createdBy)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	var hook IncomingWebhook
+	query := `SELECT ` + incomingWebhookColumns + ` FROM incoming_webhooks WHERE id = ?`
+	err = db.QueryRow(query, id).Scan(&hook.ID, &hook.RoomID, &hook.ChatterID, &hook.Name, &hook.CreatedBy, &hook.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hook, nil
+}
+
+// GetIncomingWebhookByToken returns the webhook a token belongs to
+func GetIncomingWebhookByToken(db *sql.DB, token string) (*IncomingWebhook, error) {
+	var hook IncomingWebhook
+	query := `SELECT ` + incomingWebhookColumns + ` FROM incoming_webhooks WHERE tokenHash = ?`
+	err := db.QueryRow(query, hashToken(token)).Scan(&hook.ID, &hook.RoomID, &hook.ChatterID, &hook.Name, &hook.CreatedBy, &hook.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("webhook not found")
+		}
+		return nil, err
+	}
+
+	return &hook, nil
+}
+
+// ListIncomingWebhooks returns a room's webhooks, oldest first
+func ListIncomingWebhooks(db *sql.DB, roomID int64) ([]IncomingWebhook, error) {
+	query := `SELECT ` + incomingWebhookColumns + ` FROM incoming_webhooks WHERE roomId = ? ORDER BY id ASC`
+	rows, err := db.Query(query, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []IncomingWebhook
+	for rows.Next() {
+		var hook IncomingWebhook
+		if err := rows.Scan(&hook.ID, &hook.RoomID, &hook.ChatterID, &hook.Name, &hook.CreatedBy, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+// DeleteIncomingWebhook removes a webhook from its room, its URL stops working
+func DeleteIncomingWebhook(db DBTX, hookID, roomID int64) error {
+	result, err := db.Exec(`DELETE FROM incoming_webhooks WHERE id = ? AND roomId = ?`, hookID, roomID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("webhook with ID %d not found in room %d", hookID, roomID)
+	}
+
+	return nil
+}
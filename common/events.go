@@ -0,0 +1,247 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// AllRoomMessagesSubject matches the messages subject of every room
+const AllRoomMessagesSubject = "chat.rooms.*.messages"
+
+// AllRoomJoinsSubject matches the joins subject of every room
+const AllRoomJoinsSubject = "chat.rooms.*.joins"
+
+// AllRoomCommandsSubject matches the bot commands subject of every room
+const AllRoomCommandsSubject = "chat.rooms.*.commands"
+
+// BotsChangedSubject tells bot runners to reload their installations
+const BotsChangedSubject = "chat.bots.changed"
+
+// RoomMessagesSubject carries the MessageEvents of one room
+func RoomMessagesSubject(roomID int64) string {
+	return fmt.Sprintf("chat.rooms.%d.messages", roomID)
+}
+
+// RoomJoinsSubject carries the JoinEvents of one room
+func RoomJoinsSubject(roomID int64) string {
+	return fmt.Sprintf("chat.rooms.%d.joins", roomID)
+}
+
+// RoomCommandsSubject carries the CommandEvents for bots installed in one room
+func RoomCommandsSubject(roomID int64) string {
+	return fmt.Sprintf("chat.rooms.%d.commands", roomID)
+}
+
+// RoomEditsSubject carries the MessageEditEvents of one room
+func RoomEditsSubject(roomID int64) string {
+	return fmt.Sprintf("chat.rooms.%d.edits", roomID)
+}
+
+// RoomTypingSubject carries the TypingEvents of one room
+func RoomTypingSubject(roomID int64) string {
+	return fmt.Sprintf("chat.rooms.%d.typing", roomID)
+}
+
+// ChatterNoticesSubject carries the NoticeEvents for one chatter
+func ChatterNoticesSubject(chatterID int64) string {
+	return fmt.Sprintf("chat.chatters.%d.notices", chatterID)
+}
+
+// MessageEvent is published after a message is stored in a room
+type MessageEvent struct {
+	ID        int64  `json:"id"`
+	RoomID    int64  `json:"roomId"`
+	ChatterID int64  `json:"chatterId"`
+	Content   string `json:"content"`
+	// BotID is the installation ID of the bot that posted the message, 0 for chatters
+	BotID int64 `json:"botId,omitempty"`
+	// Partial marks the start of a reply that is still streaming in. Another
+	// event with the full content follows once it is done.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// PublishMessageEvent announces a stored message to the room's subscribers
+func PublishMessageEvent(nc *nats.Conn, event MessageEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	// No Nats-Msg-Id: the bots' NATS user could publish the next message's ID
+	// first, and the CHAT stream would then drop the real event as a duplicate
+	return nc.Publish(RoomMessagesSubject(event.RoomID), data)
+}
+
+// MessageEditEvent is published when a stored message's content changes
+type MessageEditEvent struct {
+	ID     int64 `json:"id"`
+	RoomID int64 `json:"roomId"`
+}
+
+// PublishMessageEdit tells the room's subscribers to redraw one message
+func PublishMessageEdit(nc *nats.Conn, event MessageEditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return nc.Publish(RoomEditsSubject(event.RoomID), data)
+}
+
+// JoinEvent is published when a chatter opens a room
+type JoinEvent struct {
+	RoomID    int64  `json:"roomId"`
+	ChatterID int64  `json:"chatterId"`
+	Name      string `json:"name"`
+}
+
+// PublishJoinEvent announces a chatter joining a room
+func PublishJoinEvent(nc *nats.Conn, event JoinEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return nc.Publish(RoomJoinsSubject(event.RoomID), data)
+}
+
+// TypingEvent is published while a chatter is typing in a room
+type TypingEvent struct {
+	RoomID    int64  `json:"roomId"`
+	ChatterID int64  `json:"chatterId"`
+	Name      string `json:"name"`
+}
+
+// PublishTypingEvent tells a room that a chatter is typing
+func PublishTypingEvent(nc *nats.Conn, event TypingEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return nc.Publish(RoomTypingSubject(event.RoomID), data)
+}
+
+// CommandEvent is a slash command handed to the bots installed in a room
+type CommandEvent struct {
+	RoomID    int64    `json:"roomId"`
+	ChatterID int64    `json:"chatterId"`
+	Name      string   `json:"name"`
+	Args      []string `json:"args"`
+}
+
+// PublishCommandEvent hands a command to the room's bots
+func PublishCommandEvent(nc *nats.Conn, event CommandEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return nc.Publish(RoomCommandsSubject(event.RoomID), data)
+}
+
+// NoticeEvent is shown only to the chatter it is sent to, such as a command reply
+type NoticeEvent struct {
+	// RoomID limits the notice to the chatter's view of one room, 0 shows it in any room
+	RoomID int64  `json:"roomId,omitempty"`
+	Text   string `json:"text"`
+	// Link is an optional URL the notice points to
+	Link string `json:"link,omitempty"`
+}
+
+// PublishNotice sends a notice to one chatter's open streams
+func PublishNotice(nc *nats.Conn, chatterID int64, event NoticeEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return nc.Publish(ChatterNoticesSubject(chatterID), data)
+}
+
+// ModerationSubject carries moderation actions so open streams can react to them
+const ModerationSubject = "chat.moderation"
+
+// ReportsSubject notifies moderators of new message reports
+const ReportsSubject = "chat.moderation.reports"
+
+// Moderation actions
+const (
+	ModerationBan     = "ban"
+	ModerationKick    = "kick"
+	ModerationMute    = "mute"
+	ModerationRemove  = "remove"
+	ModerationHide    = "hide"
+	ModerationRestore = "restore"
+)
+
+// ModerationEvent is published on ModerationSubject after a moderation action
+type ModerationEvent struct {
+	Action    string `json:"action"`
+	ChatterID int64  `json:"chatterId,omitempty"`
+	RoomID    int64  `json:"roomId,omitempty"`
+	MessageID int64  `json:"messageId,omitempty"`
+}
+
+// PublishModerationEvent sends a moderation event to all subscribers
+func PublishModerationEvent(nc *nats.Conn, event ModerationEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return nc.Publish(ModerationSubject, data)
+}
+
+// Affects reports whether the event targets the chatter's view of the room
+func (e ModerationEvent) Affects(chatterID, roomID int64) bool {
+	switch e.Action {
+	case ModerationBan:
+		return e.ChatterID == chatterID
+	case ModerationKick:
+		return e.ChatterID == chatterID && e.RoomID == roomID
+	}
+	return false
+}
+
+// ChangesMessages reports whether the event changes which messages a room shows
+func (e ModerationEvent) ChangesMessages() bool {
+	switch e.Action {
+	case ModerationRemove, ModerationHide, ModerationRestore:
+		return true
+	}
+	return false
+}
+
+// BotRemovalsSubject carries the bot replies the bot runner removed. The bots'
+// NATS user can't publish on ModerationSubject, where a forged ban would close
+// anyone's streams, so the web server checks each removal and announces it.
+const BotRemovalsSubject = "chat.bots.removals"
+
+// BotRemovalEvent asks the web server to announce a removed bot reply
+type BotRemovalEvent struct {
+	MessageID int64 `json:"messageId"`
+}
+
+// PublishBotRemoval asks the web server to announce a removed bot reply
+func PublishBotRemoval(nc *nats.Conn, event BotRemovalEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return nc.Publish(BotRemovalsSubject, data)
+}
+
+// ReportEvent is published on ReportsSubject when a chatter reports a message
+type ReportEvent struct {
+	ReportID  int64  `json:"reportId"`
+	MessageID int64  `json:"messageId"`
+	RoomID    int64  `json:"roomId"`
+	Category  string `json:"category"`
+	Reports   int    `json:"reports"`
+	Hidden    bool   `json:"hidden"`
+}
+
+// PublishReportEvent notifies moderators of a new report
+func PublishReportEvent(nc *nats.Conn, event ReportEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return nc.Publish(ReportsSubject, data)
+}
@@ -0,0 +1,26 @@
+package common
+
+import "testing"
+
+func TestModerationEventAffects(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    ModerationEvent
+		expected bool
+	}{
+		{"ban of chatter", ModerationEvent{Action: ModerationBan, ChatterID: 1}, true},
+		{"ban of someone else", ModerationEvent{Action: ModerationBan, ChatterID: 2}, false},
+		{"kick from this room", ModerationEvent{Action: ModerationKick, ChatterID: 1, RoomID: 10}, true},
+		{"kick from another room", ModerationEvent{Action: ModerationKick, ChatterID: 1, RoomID: 11}, false},
+		{"mute keeps the stream open", ModerationEvent{Action: ModerationMute, ChatterID: 1, RoomID: 10}, false},
+		{"removal keeps the stream open", ModerationEvent{Action: ModerationRemove, ChatterID: 1, RoomID: 10}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.event.Affects(1, 10); got != tt.expected {
+				t.Errorf("Expected Affects() = %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// LeaseBucket is the JetStream key-value bucket holding the leases of
+// singleton workers. Its TTL is the lease length: a lease that isn't
+// renewed expires and another instance can take it.
+const LeaseBucket = "CHAT_LEASES"
+
+// EnsureLeaseBucket creates the lease bucket, or updates its TTL to cfg's
+func EnsureLeaseBucket(ctx context.Context, nc *nats.Conn, cfg JetStreamConfig) error {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return err
+	}
+	_, err = js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:   LeaseBucket,
+		TTL:      cfg.LeaseTTL,
+		Storage:  jetstream.FileStorage,
+		Replicas: cfg.Replicas,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create the %s bucket: %w", LeaseBucket, err)
+	}
+	return nil
+}
+
+// Election picks one instance to run a singleton worker, such as the bot
+// runner, when several share a NATS cluster. The leader holds a lease on
+// the worker's name and renews it every third of the TTL.
+type Election struct {
+	kv   jetstream.KeyValue
+	name string
+	id   string
+	ttl  time.Duration
+}
+
+// NewElection joins the election for the worker called name
+func NewElection(ctx context.Context, nc *nats.Conn, name string) (*Election, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.KeyValue(ctx, LeaseBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the %s bucket: %w", LeaseBucket, err)
+	}
+	status, err := kv.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Election{kv: kv, name: name, id: instanceID(), ttl: status.TTL()}, nil
+}
+
+// ID identifies this instance in the election
+func (e *Election) ID() string {
+	return e.id
+}
+
+// Leader returns the ID of the instance holding the lease, or "" if none does
+func (e *Election) Leader(ctx context.Context) (string, error) {
+	entry, err := e.kv.Get(ctx, e.name)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(entry.Value()), nil
+}
+
+// Run calls fn whenever this instance is the leader, until ctx is done. The
+// context fn is given is cancelled if the lease is lost, and once fn has
+// returned the instance campaigns again. If fn returns while still leading,
+// Run resigns and returns fn's error.
+func (e *Election) Run(ctx context.Context, fn func(ctx context.Context) error) error {
+	for {
+		revision, err := e.campaign(ctx)
+		if err != nil {
+			// Only cancelling ctx stops a campaign
+			return nil
+		}
+		log.Printf("%s: %s is the leader", e.name, e.id)
+
+		leading, cancel := context.WithCancel(ctx)
+		var lost bool
+		renewed := make(chan struct{})
+		go func() {
+			defer close(renewed)
+			revision, lost = e.renew(leading, revision)
+			cancel()
+		}()
+		err = fn(leading)
+		cancel()
+		<-renewed
+
+		if !lost {
+			e.resign(revision)
+			return err
+		}
+		log.Printf("%s: %s lost the lease", e.name, e.id)
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// campaign waits until this instance takes the lease, returning its revision
+func (e *Election) campaign(ctx context.Context) (uint64, error) {
+	retry := time.NewTicker(e.ttl / 4)
+	defer retry.Stop()
+	for {
+		revision, err := e.kv.Create(ctx, e.name, []byte(e.id))
+		if err == nil {
+			return revision, nil
+		}
+		if !errors.Is(err, jetstream.ErrKeyExists) && ctx.Err() == nil {
+			log.Printf("%s: failed to take the lease: %v", e.name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-retry.C:
+		}
+	}
+}
+
+// renew keeps the lease until ctx is done, returning the last revision and
+// whether the lease was lost first. A renewal that fails or takes longer
+// than the time between renewals counts as losing the lease, so a leader cut
+// off from NATS stops before another instance can take over.
+func (e *Election) renew(ctx context.Context, revision uint64) (uint64, bool) {
+	interval := e.ttl / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return revision, false
+		case <-ticker.C:
+		}
+
+		updateCtx, cancel := context.WithTimeout(ctx, interval)
+		next, err := e.kv.Update(updateCtx, e.name, []byte(e.id), revision)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return revision, false
+			}
+			log.Printf("%s: failed to renew the lease: %v", e.name, err)
+			return revision, true
+		}
+		revision = next
+	}
+}
+
+// resign gives up the lease so another instance can take it straight away,
+// instead of waiting for it to expire
+func (e *Election) resign(revision uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.ttl/3)
+	defer cancel()
+	if err := e.kv.Delete(ctx, e.name, jetstream.LastRevision(revision)); err != nil {
+		log.Printf("%s: failed to resign: %v", e.name, err)
+	}
+}
+
+// instanceID names this process in elections, unique even for several
+// instances on one host
+func instanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "chat"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return host + "-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,135 @@
+package common
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestElection(t *testing.T) {
+	cfg := testNATS(t)
+	cfg.JetStream.LeaseTTL = time.Second
+	nc, cleanup, err := SetupNATS(cfg)
+	if err != nil {
+		t.Fatalf("SetupNATS() failed: %v", err)
+	}
+	defer cleanup()
+
+	// Two instances campaign for the same worker, and count how many lead at once
+	var leaders, most atomic.Int32
+	type instance struct {
+		election *Election
+		leading  chan struct{}
+		cancel   context.CancelFunc
+		done     chan error
+	}
+	start := func() *instance {
+		election, err := NewElection(context.Background(), nc, "test")
+		if err != nil {
+			t.Fatalf("NewElection() failed: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		in := &instance{election: election, leading: make(chan struct{}, 10), cancel: cancel, done: make(chan error, 1)}
+		go func() {
+			in.done <- election.Run(ctx, func(ctx context.Context) error {
+				n := leaders.Add(1)
+				for {
+					if m := most.Load(); n <= m || most.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				in.leading <- struct{}{}
+				<-ctx.Done()
+				leaders.Add(-1)
+				return nil
+			})
+		}()
+		return in
+	}
+	first, second := start(), start()
+	defer first.cancel()
+	defer second.cancel()
+
+	var leader, follower *instance
+	select {
+	case <-first.leading:
+		leader, follower = first, second
+	case <-second.leading:
+		leader, follower = second, first
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected one instance to lead")
+	}
+	if id, _ := leader.election.Leader(context.Background()); id != leader.election.ID() {
+		t.Errorf("Expected %s to hold the lease, got %q", leader.election.ID(), id)
+	}
+
+	// The follower waits through several renewals
+	select {
+	case <-follower.leading:
+		t.Fatal("Expected the follower to wait while the leader renews")
+	case <-time.After(2 * time.Second):
+	}
+
+	// Once the leader stops, the follower takes over
+	leader.cancel()
+	if err := <-leader.done; err != nil {
+		t.Errorf("Run() failed: %v", err)
+	}
+	select {
+	case <-follower.leading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the follower to take over")
+	}
+	if id, _ := follower.election.Leader(context.Background()); id != follower.election.ID() {
+		t.Errorf("Expected %s to hold the lease, got %q", follower.election.ID(), id)
+	}
+	if n := most.Load(); n != 1 {
+		t.Errorf("Expected one leader at a time, got %d", n)
+	}
+}
+
+func TestElectionLostLease(t *testing.T) {
+	cfg := testNATS(t)
+	cfg.JetStream.LeaseTTL = time.Second
+	nc, cleanup, err := SetupNATS(cfg)
+	if err != nil {
+		t.Fatalf("SetupNATS() failed: %v", err)
+	}
+	defer cleanup()
+
+	election, err := NewElection(context.Background(), nc, "test")
+	if err != nil {
+		t.Fatalf("NewElection() failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runs := make(chan context.Context, 10)
+	go election.Run(ctx, func(ctx context.Context) error {
+		runs <- ctx
+		<-ctx.Done()
+		return nil
+	})
+
+	var leading context.Context
+	select {
+	case leading = <-runs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected to lead")
+	}
+
+	// Another instance steals the lease, so the next renewal fails
+	election.kv.Put(context.Background(), "test", []byte("someone-else"))
+	select {
+	case <-leading.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the worker to be stopped when the lease was lost")
+	}
+
+	// The instance campaigns again, and leads once the other's lease expires
+	select {
+	case <-runs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected to lead again after the lease expired")
+	}
+}
@@ -0,0 +1,137 @@
+package moderation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"go-star/common/dal"
+	"strings"
+	"time"
+)
+
+// Action is what a Moderator decides to do with a message
+type Action string
+
+const (
+	Allow   Action = "allow"
+	Flag    Action = "flag"
+	Reject  Action = "reject"
+	Rewrite Action = "rewrite"
+)
+
+// Message is a message about to be stored, from a chatter or a bot
+type Message struct {
+	ChatterID int64
+	RoomID    int64
+	Content   string
+	IsBot     bool
+	// SenderName and AvatarURL replace the chatter's name and avatar on the
+	// stored message, for webhooks
+	SenderName string
+	AvatarURL  string
+	// SlowMode refuses the message with dal.ErrSlowMode if the chatter
+	// posted in the room within it, zero for no slow mode
+	SlowMode time.Duration
+}
+
+// Decision is a Moderator's verdict. Content holds the text to store,
+// empty leaves the message unchanged.
+type Decision struct {
+	Action  Action
+	Content string
+	Reason  string
+}
+
+// Moderator inspects a message before it is stored
+type Moderator interface {
+	Moderate(ctx context.Context, msg Message) (Decision, error)
+}
+
+// ErrRejected is returned by Post when the pipeline rejects a message
+var ErrRejected = errors.New("message rejected by moderation")
+
+// Pipeline runs moderators in order. A rejection stops the pipeline, rewrites
+// are passed on to later moderators, and flags from any moderator are kept.
+type Pipeline []Moderator
+
+func (p Pipeline) Moderate(ctx context.Context, msg Message) (Decision, error) {
+	var flags []string
+	rewritten := false
+
+	for _, m := range p {
+		decision, err := m.Moderate(ctx, msg)
+		if err != nil {
+			return Decision{}, err
+		}
+
+		if decision.Action == Reject {
+			return decision, nil
+		}
+		if decision.Content != "" && decision.Content != msg.Content {
+			msg.Content = decision.Content
+			rewritten = true
+		}
+		if decision.Action == Flag {
+			flags = append(flags, decision.Reason)
+		}
+	}
+
+	switch {
+	case len(flags) > 0:
+		return Decision{Action: Flag, Content: msg.Content, Reason: strings.Join(flags, "; ")}, nil
+	case rewritten:
+		return Decision{Action: Rewrite, Content: msg.Content}, nil
+	}
+	return Decision{Action: Allow, Content: msg.Content}, nil
+}
+
+// Default returns the pipeline used for all chat and bot messages
+func Default(db *sql.DB) Moderator {
+	return Pipeline{NewWordFilter(db)}
+}
+
+// Post moderates a message and stores it, queueing it for review when flagged.
+// Rejected messages return ErrRejected along with the decision, and messages
+// posted again within msg.SlowMode return dal.ErrSlowMode.
+func Post(ctx context.Context, db *sql.DB, m Moderator, msg Message) (*dal.Message, Decision, error) {
+	decision, err := m.Moderate(ctx, msg)
+	if err != nil {
+		return nil, decision, err
+	}
+	if decision.Action == Reject {
+		return nil, decision, ErrRejected
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, decision, err
+	}
+	defer tx.Rollback()
+
+	content := msg.Content
+	if decision.Content != "" {
+		content = decision.Content
+	}
+
+	var stored *dal.Message
+	if msg.SlowMode > 0 {
+		stored, err = dal.InsertMessageSlowMode(tx, msg.ChatterID, msg.RoomID, content, msg.SlowMode)
+	} else {
+		stored, err = dal.InsertMessageAs(tx, msg.ChatterID, msg.RoomID, content, msg.SenderName, msg.AvatarURL)
+	}
+	if err != nil {
+		return nil, decision, err
+	}
+
+	if decision.Action == Flag {
+		if err := dal.FlagMessage(tx, stored.ID, decision.Reason); err != nil {
+			return nil, decision, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, decision, err
+	}
+
+	return stored, decision, nil
+}
@@ -0,0 +1,125 @@
+package moderation
+
+import (
+	"context"
+	"errors"
+	"go-star/common/dal"
+	"os"
+	"testing"
+)
+
+type fixedModerator Decision
+
+func (f fixedModerator) Moderate(ctx context.Context, msg Message) (Decision, error) {
+	d := Decision(f)
+	if d.Action == Rewrite {
+		d.Content = msg.Content + d.Content
+	}
+	return d, nil
+}
+
+func TestPipeline(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline Pipeline
+		action   Action
+		content  string
+		reason   string
+	}{
+		{"empty allows", Pipeline{}, Allow, "hi", ""},
+		{"reject stops", Pipeline{fixedModerator{Action: Reject, Reason: "no"}, fixedModerator{Action: Flag, Reason: "later"}}, Reject, "", "no"},
+		{"rewrites chain", Pipeline{fixedModerator{Action: Rewrite, Content: "!"}, fixedModerator{Action: Rewrite, Content: "?"}}, Rewrite, "hi!?", ""},
+		{"flags win over rewrites", Pipeline{fixedModerator{Action: Flag, Reason: "a"}, fixedModerator{Action: Rewrite, Content: "!"}, fixedModerator{Action: Flag, Reason: "b"}}, Flag, "hi!", "a; b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := tt.pipeline.Moderate(context.Background(), Message{Content: "hi"})
+			if err != nil {
+				t.Fatalf("Moderate() failed: %v", err)
+			}
+			if d.Action != tt.action || d.Content != tt.content || d.Reason != tt.reason {
+				t.Errorf("Expected %s/%q/%q, got %s/%q/%q", tt.action, tt.content, tt.reason, d.Action, d.Content, d.Reason)
+			}
+		})
+	}
+}
+
+func TestWordFilterAndPost(t *testing.T) {
+	testDBName := "test_word_filter"
+	db, err := dal.SetupDB(testDBName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer os.Remove("./" + testDBName + ".db")
+	defer db.Close()
+
+	alice, _ := dal.InsertChatter(db, "alice", "Alice Smith")
+	other, _ := dal.InsertRoom(db, "Other", "no filters here")
+
+	for _, f := range []struct {
+		pattern string
+		isRegex bool
+		action  string
+	}{
+		{"darn", false, dal.FilterRewrite},
+		{"buy now", false, dal.FilterReject},
+		{`https?://\S+`, true, dal.FilterFlag},
+		{"@everyone", false, dal.FilterRewrite},
+		{"c++", false, dal.FilterReject},
+	} {
+		if _, err := dal.InsertWordFilter(db, 1, f.pattern, f.isRegex, f.action); err != nil {
+			t.Fatalf("InsertWordFilter() failed: %v", err)
+		}
+	}
+
+	m := Default(db)
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		roomID  int64
+		content string
+		action  Action
+		stored  string
+	}{
+		{"clean message", 1, "hello there", Allow, "hello there"},
+		{"rewritten word", 1, "Darn it", Rewrite, "**** it"},
+		{"words match whole words only", 1, "darning socks", Allow, "darning socks"},
+		{"rejected phrase", 1, "BUY NOW cheap", Reject, ""},
+		{"flagged link", 1, "see http://example.com darn", Flag, "see http://example.com ****"},
+		{"punctuation at the start", 1, "hey @everyone now", Rewrite, "hey ********* now"},
+		{"punctuation at the end", 1, "I like C++ a lot", Reject, ""},
+		{"word edges keep their boundary", 1, "abc++ is not it", Allow, "abc++ is not it"},
+		{"other rooms are unfiltered", other.ID, "buy now", Allow, "buy now"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored, d, err := Post(ctx, db, m, Message{ChatterID: alice.ID, RoomID: tt.roomID, Content: tt.content})
+			if d.Action != tt.action {
+				t.Errorf("Expected action %s, got %s", tt.action, d.Action)
+			}
+			if tt.action == Reject {
+				if !errors.Is(err, ErrRejected) {
+					t.Errorf("Expected ErrRejected, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Post() failed: %v", err)
+			}
+			if stored.Content != tt.stored {
+				t.Errorf("Expected stored content %q, got %q", tt.stored, stored.Content)
+			}
+		})
+	}
+
+	flagged, err := dal.ListFlaggedMessages(db, dal.FlagPending)
+	if err != nil {
+		t.Fatalf("ListFlaggedMessages() failed: %v", err)
+	}
+	if len(flagged) != 1 || flagged[0].Content != "see http://example.com ****" {
+		t.Errorf("Expected the link message in the review queue, got %+v", flagged)
+	}
+}
@@ -0,0 +1,112 @@
+package moderation
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-star/common/dal"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// WordFilter applies each room's word and regex rules from the word_filters table
+type WordFilter struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	cache map[string]*regexp.Regexp
+}
+
+func NewWordFilter(db *sql.DB) *WordFilter {
+	return &WordFilter{
+		db:    db,
+		cache: make(map[string]*regexp.Regexp),
+	}
+}
+
+func (f *WordFilter) Moderate(ctx context.Context, msg Message) (Decision, error) {
+	filters, err := dal.ListWordFilters(f.db, msg.RoomID)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	content := msg.Content
+	rewritten := false
+	var flags []string
+
+	for _, filter := range filters {
+		re, err := f.compile(filter)
+		if err != nil {
+			// A bad rule shouldn't stop the room, it's rejected when saved anyway
+			log.Printf("skipping word filter %d: %v", filter.ID, err)
+			continue
+		}
+		if !re.MatchString(content) {
+			continue
+		}
+
+		switch filter.Action {
+		case dal.FilterReject:
+			return Decision{Action: Reject, Reason: fmt.Sprintf("matched filter '%s'", filter.Pattern)}, nil
+		case dal.FilterRewrite:
+			content = re.ReplaceAllStringFunc(content, func(match string) string {
+				return strings.Repeat("*", len([]rune(match)))
+			})
+			rewritten = true
+		case dal.FilterFlag:
+			flags = append(flags, fmt.Sprintf("matched filter '%s'", filter.Pattern))
+		}
+	}
+
+	switch {
+	case len(flags) > 0:
+		return Decision{Action: Flag, Content: content, Reason: strings.Join(flags, "; ")}, nil
+	case rewritten:
+		return Decision{Action: Rewrite, Content: content}, nil
+	}
+	return Decision{Action: Allow, Content: content}, nil
+}
+
+// compile turns a filter into a case-insensitive regex, matching plain words on word boundaries
+func (f *WordFilter) compile(filter dal.WordFilter) (*regexp.Regexp, error) {
+	expr := "(?i)" + wordBoundaries(filter.Pattern)
+	if filter.IsRegex {
+		expr = "(?i)" + filter.Pattern
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if re, ok := f.cache[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	f.cache[expr] = re
+	return re, nil
+}
+
+// wordBoundaries quotes a plain word and puts \b on each edge that is a word
+// character. \b needs a word character on its inside, so "@everyone" or "c++"
+// would never match if every edge got one.
+func wordBoundaries(pattern string) string {
+	expr := regexp.QuoteMeta(pattern)
+	if pattern == "" {
+		return expr
+	}
+	if isWordChar(pattern[0]) {
+		expr = `\b` + expr
+	}
+	if isWordChar(pattern[len(pattern)-1]) {
+		expr += `\b`
+	}
+	return expr
+}
+
+// isWordChar matches regexp's ASCII-only idea of a word character
+func isWordChar(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
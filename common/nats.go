@@ -1,46 +1,262 @@
 package common
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
 )
 
-// SetupNATS creates and starts the embedded NATS server
-// Returns the server, connection, cleanup function, and error
-func SetupNATS() (*nats.Conn, func(), error) {
+// SetupNATS connects to the external NATS server at cfg.URL, or starts the
+// embedded one when no URL is set, and makes sure the CHAT stream exists
+// Returns the connection, cleanup function, and error
+func SetupNATS(cfg NATSConfig) (*nats.Conn, func(), error) {
+	if err := checkCredentials(cfg); err != nil {
+		return nil, nil, err
+	}
+
+	var nc *nats.Conn
+	var cleanup func()
+	var err error
+	if cfg.URL != "" {
+		nc, err = connectNATS(cfg.as(cfg.Users.Web))
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup = nc.Close
+	} else {
+		nc, cleanup, err = startNATS(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := ensureJetStream(nc, cfg.JetStream); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	return nc, cleanup, nil
+}
+
+// ensureJetStream creates the CHAT stream and the lease bucket. A cluster's
+// JetStream isn't available until its servers have found each other and
+// elected a leader, so failures are retried for a while.
+func ensureJetStream(nc *nats.Conn, cfg JetStreamConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for {
+		// Requests go unanswered until there is a leader, so each try is short
+		attempt, cancelAttempt := context.WithTimeout(ctx, 2*time.Second)
+		err := EnsureChatStream(attempt, nc, cfg)
+		if err == nil {
+			err = EnsureLeaseBucket(attempt, nc, cfg)
+		}
+		cancelAttempt()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// startNATS starts the embedded server and connects to it in-process, so the
+// server's own connection needs no TLS even when other clients do
+func startNATS(cfg NATSConfig) (*nats.Conn, func(), error) {
 	opts := &server.Options{
-		Host:   "127.0.0.1",
-		Port:   4223,
-		NoLog:  true,
-		NoSigs: true,
+		ServerName: cfg.ServerName,
+		Host:       cfg.Host,
+		Port:       cfg.Port,
+		NoSigs:     true,
+		// A leaf node uses its hub's JetStream
+		JetStream: len(cfg.Leaf.Remotes) == 0,
+		StoreDir:  cfg.JetStream.StoreDir,
+	}
+	if err := configureAuth(opts, cfg); err != nil {
+		return nil, nil, err
+	}
+	if cfg.Cluster.Port != 0 {
+		if cfg.Cluster.Name == "" {
+			return nil, nil, errors.New("a NATS cluster needs a name")
+		}
+		// JetStream identifies clustered servers by name
+		if opts.ServerName == "" {
+			opts.ServerName, _ = os.Hostname()
+		}
+		opts.Cluster = server.ClusterOpts{Name: cfg.Cluster.Name, Host: cfg.Cluster.Host, Port: cfg.Cluster.Port}
+		if len(cfg.Cluster.Routes) > 0 {
+			opts.Routes = server.RoutesFromStr(strings.Join(cfg.Cluster.Routes, ","))
+			if len(opts.Routes) != len(cfg.Cluster.Routes) {
+				return nil, nil, fmt.Errorf("invalid NATS routes %q", cfg.Cluster.Routes)
+			}
+		}
+	}
+	opts.LeafNode = server.LeafNodeOpts{Host: cfg.Leaf.Host, Port: cfg.Leaf.Port}
+	// Leaf nodes reach the hub's JetStream through its domain
+	opts.JetStreamDomain = cfg.JetStream.Domain
+	if len(cfg.Leaf.Remotes) > 0 {
+		if cfg.JetStream.Domain == "" {
+			return nil, nil, errors.New("a NATS leaf node needs the hub's JetStream domain")
+		}
+		opts.JetStreamDomain = ""
+		remote := &server.RemoteLeafOpts{}
+		for _, raw := range cfg.Leaf.Remotes {
+			u, err := url.Parse(raw)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid NATS leaf remote %q: %w", raw, err)
+			}
+			remote.URLs = append(remote.URLs, u)
+		}
+		opts.LeafNode.Remotes = []*server.RemoteLeafOpts{remote}
+	}
+	switch cfg.LogLevel {
+	case "", "off":
+		opts.NoLog = true
+	case "info":
+	case "debug":
+		opts.Debug = true
+	case "trace":
+		opts.Debug = true
+		opts.Trace = true
+	default:
+		return nil, nil, fmt.Errorf("invalid NATS log level %q, want off, info, debug or trace", cfg.LogLevel)
+	}
+	if cfg.TLS.CertFile != "" {
+		tc, err := server.GenTLSConfig(&server.TLSConfigOpts{
+			CertFile: cfg.TLS.CertFile,
+			KeyFile:  cfg.TLS.KeyFile,
+			CaFile:   cfg.TLS.CAFile,
+			Verify:   cfg.TLS.CAFile != "",
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid NATS TLS settings: %w", err)
+		}
+		opts.TLS = true
+		opts.TLSVerify = cfg.TLS.CAFile != ""
+		opts.TLSConfig = tc
 	}
 
 	ns, err := server.NewServer(opts)
 	if err != nil {
 		return nil, nil, err
 	}
+	ns.ConfigureLogger()
+	if len(cfg.Leaf.Remotes) > 0 {
+		// Leaf nodes only pass on JetStream requests addressed to a domain, so
+		// this instance's requests are sent to the hub's
+		acc := ns.GlobalAccount()
+		prefix := "$JS." + cfg.JetStream.Domain + ".API"
+		err := acc.AddMapping("$JS.API.>", prefix+".>")
+		if err == nil {
+			err = acc.AddMapping("$KV.>", prefix+".$KV.>")
+		}
+		if err != nil {
+			ns.Shutdown()
+			return nil, nil, err
+		}
+	}
 
 	// Start the server
 	go ns.Start()
 
 	// Wait for server to be ready for connections
-	if !ns.ReadyForConnections(4 * time.Second) {
-		panic("NATS Server not ready in time")
+	if !ns.ReadyForConnections(cfg.ReadyTimeout) {
+		ns.Shutdown()
+		return nil, nil, fmt.Errorf("NATS server not ready within %s", cfg.ReadyTimeout)
 	}
 
-	nc, err := nats.Connect(ns.ClientURL())
+	nc, err := connectInProcess(ns, cfg.as(cfg.Users.Web))
 	if err != nil {
 		ns.Shutdown() // Clean up server if connection fails
 		return nil, nil, err
 	}
+	embeddedServers.Store(nc, ns)
 
 	// Return cleanup function that handles both nc.Close() and ns.Shutdown()
 	cleanup := func() {
+		embeddedServers.Delete(nc)
 		nc.Close()
 		ns.Shutdown()
 	}
-
 	return nc, cleanup, nil
 }
+
+// embeddedServers are the servers startNATS started, by the connection
+// SetupNATS returned, so ConnectNATS can connect to them in-process too
+var embeddedServers sync.Map
+
+// ConnectNATS makes another connection to the server nc is connected to as
+// user, so a part of chat such as the bot runner gets its own permissions.
+// An empty user connects as the web user, or with cfg's single user.
+func ConnectNATS(nc *nats.Conn, cfg NATSConfig, user NATSUserConfig) (*nats.Conn, error) {
+	if user == (NATSUserConfig{}) {
+		user = cfg.Users.Web
+	}
+	if ns, ok := embeddedServers.Load(nc); ok {
+		return connectInProcess(ns.(*server.Server), cfg.as(user))
+	}
+	return connectNATS(cfg.as(user))
+}
+
+func connectInProcess(ns *server.Server, cfg NATSConfig) (*nats.Conn, error) {
+	opts, err := clientOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return nats.Connect(ns.ClientURL(), append(opts, nats.InProcessServer(ns))...)
+}
+
+// connectNATS connects to the external server at cfg.URL, reconnecting for
+// as long as the process runs if the connection drops later
+func connectNATS(cfg NATSConfig) (*nats.Conn, error) {
+	opts, err := clientOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, nats.Timeout(cfg.ReadyTimeout), nats.MaxReconnects(-1))
+	if cfg.CredsFile != "" {
+		opts = append(opts, nats.UserCredentials(cfg.CredsFile))
+	}
+	if cfg.TLS.CAFile != "" {
+		opts = append(opts, nats.RootCAs(cfg.TLS.CAFile))
+	}
+	if cfg.TLS.CertFile != "" {
+		opts = append(opts, nats.ClientCert(cfg.TLS.CertFile, cfg.TLS.KeyFile))
+	}
+
+	nc, err := nats.Connect(cfg.URL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS at %s: %w", cfg.URL, err)
+	}
+	return nc, nil
+}
+
+// clientOptions are the connection options shared by both modes
+func clientOptions(cfg NATSConfig) ([]nats.Option, error) {
+	opts := []nats.Option{nats.Name("go-star")}
+	if cfg.User != "" {
+		opts = append(opts, nats.UserInfo(cfg.User, cfg.Password))
+	}
+	if cfg.Token != "" {
+		opts = append(opts, nats.Token(cfg.Token))
+	}
+	if cfg.NKey != "" {
+		nkey, err := nkeyOption(cfg.NKey)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nkey)
+	}
+	return opts, nil
+}
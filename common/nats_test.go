@@ -1,15 +1,32 @@
 package common
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
 )
 
+// testNATS listens on a free port and keeps a test's streams in its own
+// temporary directory, so tests never share a server
+func testNATS(t *testing.T) NATSConfig {
+	cfg := DefaultConfig().NATS
+	cfg.Port = server.RANDOM_PORT
+	cfg.JetStream.StoreDir = t.TempDir()
+	return cfg
+}
+
 func TestSetupNATS(t *testing.T) {
 	// Test basic NATS setup
-	nc, cleanup, err := SetupNATS()
+	nc, cleanup, err := SetupNATS(testNATS(t))
 	if err != nil {
 		t.Fatalf("setupNATS() failed: %v", err)
 	}
@@ -35,7 +52,7 @@ func TestSetupNATS(t *testing.T) {
 
 func TestSetupNATSPublishSubscribe(t *testing.T) {
 	// Test that we can publish and subscribe
-	nc, cleanup, err := SetupNATS()
+	nc, cleanup, err := SetupNATS(testNATS(t))
 	if err != nil {
 		t.Fatalf("setupNATS() failed: %v", err)
 	}
@@ -74,7 +91,7 @@ func TestSetupNATSPublishSubscribe(t *testing.T) {
 }
 
 func TestSetupNATSMultipleConnections(t *testing.T) {
-	nc1, cleanup1, err := SetupNATS()
+	nc1, cleanup1, err := SetupNATS(testNATS(t))
 	if err != nil {
 		t.Fatalf("First setupNATS() failed: %v", err)
 	}
@@ -129,7 +146,7 @@ func TestSetupNATSMultipleConnections(t *testing.T) {
 
 func TestSetupNATSCleanup(t *testing.T) {
 	// Test that cleanup function works properly
-	nc, cleanup, err := SetupNATS()
+	nc, cleanup, err := SetupNATS(testNATS(t))
 	if err != nil {
 		t.Fatalf("setupNATS() failed: %v", err)
 	}
@@ -161,7 +178,7 @@ func TestSetupNATSCleanup(t *testing.T) {
 
 func TestSetupNATSRequestReply(t *testing.T) {
 	// Test request-reply pattern
-	nc, cleanup, err := SetupNATS()
+	nc, cleanup, err := SetupNATS(testNATS(t))
 	if err != nil {
 		t.Fatalf("setupNATS() failed: %v", err)
 	}
@@ -196,7 +213,7 @@ func TestSetupNATSRequestReply(t *testing.T) {
 
 func TestSetupNATSConnectionStatus(t *testing.T) {
 	// Test connection status and server info
-	nc, cleanup, err := SetupNATS()
+	nc, cleanup, err := SetupNATS(testNATS(t))
 	if err != nil {
 		t.Fatalf("setupNATS() failed: %v", err)
 	}
@@ -223,3 +240,338 @@ func TestSetupNATSConnectionStatus(t *testing.T) {
 
 	t.Log("Connection status test completed successfully")
 }
+
+func TestSetupNATSExternal(t *testing.T) {
+	embedded := testNATS(t)
+	embedded.Token = "s3cret"
+	nc1, cleanup1, err := SetupNATS(embedded)
+	if err != nil {
+		t.Fatalf("SetupNATS() failed: %v", err)
+	}
+	defer cleanup1()
+
+	// Other clients must send the token
+	if nc, err := nats.Connect(nc1.ConnectedUrl()); err == nil {
+		nc.Close()
+		t.Error("Expected a connection without the token to be refused")
+	}
+
+	external := DefaultConfig().NATS
+	external.URL = nc1.ConnectedUrl()
+	external.Token = "s3cret"
+	nc2, cleanup2, err := SetupNATS(external)
+	if err != nil {
+		t.Fatalf("SetupNATS() with a URL failed: %v", err)
+	}
+	defer cleanup2()
+
+	received := make(chan string, 1)
+	sub, err := nc1.Subscribe("test.external", func(msg *nats.Msg) {
+		received <- string(msg.Data)
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+	nc1.Flush()
+
+	if err := nc2.Publish("test.external", []byte("hello")); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	select {
+	case msg := <-received:
+		if msg != "hello" {
+			t.Errorf("Expected 'hello', got '%s'", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Timeout waiting for message")
+	}
+}
+
+func TestSetupNATSErrors(t *testing.T) {
+	badLogLevel := testNATS(t)
+	badLogLevel.LogLevel = "loud"
+
+	unreachable := DefaultConfig().NATS
+	unreachable.URL = "nats://127.0.0.1:1"
+	unreachable.ReadyTimeout = 500 * time.Millisecond
+
+	bothCredentials := testNATS(t)
+	bothCredentials.User = "chat"
+	bothCredentials.Token = "s3cret"
+
+	usersAndUser := testNATS(t)
+	usersAndUser.User = "chat"
+	usersAndUser.Users.Web = NATSUserConfig{User: "web", Password: "s3cret"}
+
+	noWebUser := testNATS(t)
+	noWebUser.Users.Bots = NATSUserConfig{User: "bots", Password: "s3cret"}
+
+	badNKey := testNATS(t)
+	badNKey.NKey = "not-a-seed"
+
+	missingCert := testNATS(t)
+	missingCert.TLS.CertFile = "missing.pem"
+	missingCert.TLS.KeyFile = "missing-key.pem"
+
+	for name, cfg := range map[string]NATSConfig{
+		"bad log level":    badLogLevel,
+		"unreachable":      unreachable,
+		"both credentials": bothCredentials,
+		"users and a user": usersAndUser,
+		"no web user":      noWebUser,
+		"bad NKey":         badNKey,
+		"missing cert":     missingCert,
+	} {
+		t.Run(name, func(t *testing.T) {
+			nc, cleanup, err := SetupNATS(cfg)
+			if err == nil {
+				cleanup()
+				t.Fatalf("Expected an error, got a connection to %s", nc.ConnectedUrl())
+			}
+		})
+	}
+}
+
+// freePort finds a port to configure before the server that listens on it starts
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// expectRelayed checks a message published on one connection reaches the other
+func expectRelayed(t *testing.T, from, to *nats.Conn) {
+	t.Helper()
+	received := make(chan string, 1)
+	sub, err := to.Subscribe("test.relay", func(msg *nats.Msg) {
+		received <- string(msg.Data)
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+	to.Flush()
+
+	// Interest takes a moment to propagate between servers
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		from.Publish("test.relay", []byte("hello"))
+		select {
+		case <-received:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	t.Fatal("Expected the message to be relayed")
+}
+
+func TestSetupNATSCluster(t *testing.T) {
+	ports := []int{freePort(t), freePort(t)}
+	configs := make([]NATSConfig, 2)
+	for i := range configs {
+		cfg := testNATS(t)
+		cfg.ServerName = fmt.Sprintf("chat-%d", i)
+		cfg.Cluster = NATSClusterConfig{
+			Name:   "chat",
+			Host:   "127.0.0.1",
+			Port:   ports[i],
+			Routes: []string{fmt.Sprintf("nats-route://127.0.0.1:%d", ports[1-i])},
+		}
+		configs[i] = cfg
+	}
+
+	// JetStream needs both servers up, so they start together
+	conns := make([]*nats.Conn, 2)
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i, cfg := range configs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var cleanup func()
+			conns[i], cleanup, errs[i] = SetupNATS(cfg)
+			if errs[i] == nil {
+				t.Cleanup(cleanup)
+			}
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("SetupNATS() for server %d failed: %v", i, err)
+		}
+	}
+
+	expectRelayed(t, conns[0], conns[1])
+	expectRelayed(t, conns[1], conns[0])
+}
+
+func TestSetupNATSLeafNode(t *testing.T) {
+	hub := testNATS(t)
+	hub.Leaf = NATSLeafConfig{Host: "127.0.0.1", Port: freePort(t)}
+	hub.JetStream.Domain = "hub"
+	hubConn, hubCleanup, err := SetupNATS(hub)
+	if err != nil {
+		t.Fatalf("SetupNATS() for the hub failed: %v", err)
+	}
+	defer hubCleanup()
+
+	leaf := testNATS(t)
+	leaf.JetStream.Domain = "hub"
+	leaf.Leaf.Remotes = []string{fmt.Sprintf("nats-leaf://127.0.0.1:%d", hub.Leaf.Port)}
+	leafConn, leafCleanup, err := SetupNATS(leaf)
+	if err != nil {
+		t.Fatalf("SetupNATS() for the leaf failed: %v", err)
+	}
+	defer leafCleanup()
+
+	expectRelayed(t, leafConn, hubConn)
+	expectRelayed(t, hubConn, leafConn)
+
+	// The leaf's events are kept in the hub's stream
+	if err := PublishMessageEvent(leafConn, MessageEvent{ID: 1, RoomID: 1, Content: "from the leaf"}); err != nil {
+		t.Fatalf("PublishMessageEvent() failed: %v", err)
+	}
+	js, _ := jetstream.New(hubConn)
+	stream, err := js.Stream(context.Background(), ChatStream)
+	if err != nil {
+		t.Fatalf("Failed to find the %s stream: %v", ChatStream, err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		_, err := stream.GetLastMsgForSubject(context.Background(), RoomMessagesSubject(1))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the leaf's message in the hub's stream: %v", err)
+		}
+	}
+
+	// And its elections share the hub's leases
+	election, err := NewElection(context.Background(), leafConn, "test")
+	if err != nil {
+		t.Fatalf("NewElection() on the leaf failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leading := make(chan struct{})
+	go election.Run(ctx, func(ctx context.Context) error {
+		close(leading)
+		<-ctx.Done()
+		return nil
+	})
+	select {
+	case <-leading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the leaf to lead")
+	}
+	hubElection, _ := NewElection(context.Background(), hubConn, "test")
+	if id, _ := hubElection.Leader(context.Background()); id != election.ID() {
+		t.Errorf("Expected the hub to see %s leading, got %q", election.ID(), id)
+	}
+}
+
+func TestSetupNATSUsers(t *testing.T) {
+	kp, _ := nkeys.CreateUser()
+	botsSeed, _ := kp.Seed()
+	cfg := testNATS(t)
+	cfg.Users = NATSUsersConfig{
+		Web:    NATSUserConfig{User: "web", Password: "web-secret"},
+		Bots:   NATSUserConfig{NKey: string(botsSeed)},
+		Client: NATSUserConfig{User: "client", Password: "client-secret"},
+	}
+	// The web user creates the stream and lease bucket
+	nc, cleanup, err := SetupNATS(cfg)
+	if err != nil {
+		t.Fatalf("SetupNATS() failed: %v", err)
+	}
+	defer cleanup()
+	url := nc.ConnectedUrl()
+	if anonymous, err := nats.Connect(url); err == nil {
+		anonymous.Close()
+		t.Fatal("Expected a client without credentials to be refused")
+	}
+
+	// The bot runner reads its consumer and posts into rooms
+	bots, err := ConnectNATS(nc, cfg, cfg.Users.Bots)
+	if err != nil {
+		t.Fatalf("ConnectNATS() failed: %v", err)
+	}
+	defer bots.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan StreamEvent, 10)
+	go ConsumeChatStream(ctx, bots, "bots", ChatStreamSubjects, func(event StreamEvent) error {
+		events <- event
+		return nil
+	})
+	js, _ := jetstream.New(nc)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if _, err := js.Consumer(ctx, ChatStream, "bots"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the bots user to create its consumer")
+		}
+	}
+	room, err := nc.SubscribeSync(RoomMessagesSubject(1))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	PublishMessageEvent(nc, MessageEvent{ID: 1, RoomID: 1, Content: "hello"})
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the bots user to be handed the message")
+	}
+	room.NextMsg(time.Second)
+	PublishMessageEvent(bots, MessageEvent{ID: 2, RoomID: 1, Content: "hi", BotID: 1})
+	if _, err := room.NextMsg(2 * time.Second); err != nil {
+		t.Errorf("Expected the bots user to post into the room: %v", err)
+	}
+
+	// but only asks for removals to be announced, it can't announce a ban
+	moderation, _ := nc.SubscribeSync(ModerationSubject)
+	removals, _ := nc.SubscribeSync(BotRemovalsSubject)
+	nc.Flush()
+	PublishModerationEvent(bots, ModerationEvent{Action: ModerationBan, ChatterID: 1})
+	PublishBotRemoval(bots, BotRemovalEvent{MessageID: 2})
+	if _, err := removals.NextMsg(2 * time.Second); err != nil {
+		t.Errorf("Expected the bots user to ask for a removal: %v", err)
+	}
+	if msg, err := moderation.NextMsg(200 * time.Millisecond); err == nil {
+		t.Errorf("Expected the bots user's ban to be dropped, got %s", msg.Data)
+	}
+
+	// An unprivileged client can call the chat service but not post into rooms
+	violations := make(chan error, 10)
+	client, err := nats.Connect(url, nats.UserInfo("client", "client-secret"), nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		violations <- err
+	}))
+	if err != nil {
+		t.Fatalf("failed to connect as the client user: %v", err)
+	}
+	defer client.Close()
+	nc.Subscribe("chat.rooms.list", func(msg *nats.Msg) { msg.Respond([]byte("{}")) })
+	nc.Flush()
+	if _, err := client.Request("chat.rooms.list", nil, 2*time.Second); err != nil {
+		t.Errorf("Expected the client user to call the chat service: %v", err)
+	}
+
+	client.Publish(RoomMessagesSubject(1), []byte(`{"id":3,"roomId":1,"content":"forged"}`))
+	select {
+	case err := <-violations:
+		if !strings.Contains(strings.ToLower(err.Error()), "permissions violation") {
+			t.Errorf("Expected a permissions violation, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the client user to be refused")
+	}
+	if msg, err := room.NextMsg(200 * time.Millisecond); err == nil {
+		t.Errorf("Expected the client user's message to be dropped, got %s", msg.Data)
+	}
+}
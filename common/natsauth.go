@@ -0,0 +1,186 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// webPermissions lets the web server publish and subscribe to every room
+// event, run the CHAT stream, its consumers and the leases, and answer the
+// chat service's requests
+func webPermissions() *server.Permissions {
+	return &server.Permissions{
+		Publish: &server.SubjectPermission{
+			Allow: []string{"chat.>", "$JS.API.>", "$JS.ACK.>", "$KV." + LeaseBucket + ".>"},
+		},
+		Subscribe: &server.SubjectPermission{
+			Allow: []string{"chat.>", "$SRV.>", "_INBOX.>"},
+		},
+		// Replies to the chat service's callers go to their inboxes
+		Response: &server.ResponsePermission{},
+	}
+}
+
+// botsPermissions lets the bot runner read its consumer of the CHAT stream,
+// post bots' messages and edits and ask for removals to be announced, and
+// nothing else
+func botsPermissions() *server.Permissions {
+	// bots.Consumer, which imports this package
+	consumer := ChatStream + ".bots"
+	return &server.Permissions{
+		Publish: &server.SubjectPermission{
+			Allow: []string{
+				AllRoomMessagesSubject, "chat.rooms.*.edits", BotRemovalsSubject,
+				"$JS.API.INFO",
+				"$JS.API.STREAM.INFO." + ChatStream,
+				"$JS.API.CONSUMER.*." + consumer,
+				"$JS.API.CONSUMER.*." + consumer + ".>",
+				"$JS.API.CONSUMER.MSG.NEXT." + consumer,
+				"$JS.ACK." + consumer + ".>",
+			},
+		},
+		Subscribe: &server.SubjectPermission{
+			Allow: []string{BotsChangedSubject, "_INBOX.>"},
+		},
+	}
+}
+
+// clientPermissions only lets other services call the chat service, whose
+// endpoints are in handlers/service.go, and ask it for its info and stats
+func clientPermissions() *server.Permissions {
+	return &server.Permissions{
+		Publish: &server.SubjectPermission{
+			Allow: []string{"chat.rooms.list", "chat.messages.*", "$SRV.>"},
+		},
+		Subscribe: &server.SubjectPermission{
+			Allow: []string{"_INBOX.>"},
+		},
+	}
+}
+
+// checkCredentials rejects settings that mix up ways of authenticating
+func checkCredentials(cfg NATSConfig) error {
+	set := 0
+	for _, s := range []string{cfg.User, cfg.Token, cfg.NKey} {
+		if s != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return errors.New("NATS takes a user and password, a token or an NKey, not several")
+	}
+	if err := checkNKey("NATS", cfg.NKey); err != nil {
+		return err
+	}
+	if cfg.Users == (NATSUsersConfig{}) {
+		return nil
+	}
+
+	if set > 0 {
+		return errors.New("NATS takes a single user or a user for each part of chat, not both")
+	}
+	for name, user := range map[string]NATSUserConfig{"web": cfg.Users.Web, "bots": cfg.Users.Bots, "client": cfg.Users.Client} {
+		if user.User != "" && user.NKey != "" {
+			return fmt.Errorf("the %s NATS user takes a user and password or an NKey, not both", name)
+		}
+		if err := checkNKey("the "+name+" NATS user", user.NKey); err != nil {
+			return err
+		}
+	}
+	if cfg.URL == "" && cfg.Users.Web.User == "" && cfg.Users.Web.NKey == "" {
+		return errors.New("the embedded NATS server needs a web user when any users are set")
+	}
+	return nil
+}
+
+func checkNKey(whose, seed string) error {
+	if seed == "" {
+		return nil
+	}
+	if _, err := nkeys.FromSeed([]byte(seed)); err != nil {
+		return fmt.Errorf("%s has an invalid NKey seed: %w", whose, err)
+	}
+	return nil
+}
+
+// configureAuth makes the embedded server require cfg's user, or each of
+// cfg.Users with its own permissions
+func configureAuth(opts *server.Options, cfg NATSConfig) error {
+	if cfg.Users == (NATSUsersConfig{}) {
+		opts.Username = cfg.User
+		opts.Password = cfg.Password
+		// Authorization is the token clients must send
+		opts.Authorization = cfg.Token
+		if cfg.NKey != "" {
+			public, err := nkeyPublicKey(cfg.NKey)
+			if err != nil {
+				return err
+			}
+			opts.Nkeys = []*server.NkeyUser{{Nkey: public}}
+		}
+		return nil
+	}
+
+	for _, u := range []struct {
+		user        NATSUserConfig
+		permissions *server.Permissions
+	}{
+		{cfg.Users.Web, webPermissions()},
+		{cfg.Users.Bots, botsPermissions()},
+		{cfg.Users.Client, clientPermissions()},
+	} {
+		switch {
+		case u.user.NKey != "":
+			public, err := nkeyPublicKey(u.user.NKey)
+			if err != nil {
+				return err
+			}
+			opts.Nkeys = append(opts.Nkeys, &server.NkeyUser{Nkey: public, Permissions: u.permissions})
+		case u.user.User != "":
+			opts.Users = append(opts.Users, &server.User{Username: u.user.User, Password: u.user.Password, Permissions: u.permissions})
+		}
+	}
+	return nil
+}
+
+func nkeyPublicKey(seed string) (string, error) {
+	kp, err := nkeys.FromSeed([]byte(seed))
+	if err != nil {
+		return "", err
+	}
+	return kp.PublicKey()
+}
+
+// nkeyOption signs the server's challenge with an NKey seed
+func nkeyOption(seed string) (nats.Option, error) {
+	public, err := nkeyPublicKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	return nats.Nkey(public, func(nonce []byte) ([]byte, error) {
+		kp, err := nkeys.FromSeed([]byte(seed))
+		if err != nil {
+			return nil, err
+		}
+		defer kp.Wipe()
+		return kp.Sign(nonce)
+	}), nil
+}
+
+// as is cfg with user's credentials in place of its own. An empty user
+// leaves them as they are.
+func (cfg NATSConfig) as(user NATSUserConfig) NATSConfig {
+	if user == (NATSUserConfig{}) {
+		return cfg
+	}
+	cfg.User = user.User
+	cfg.Password = user.Password
+	cfg.NKey = user.NKey
+	cfg.CredsFile = user.CredsFile
+	cfg.Token = ""
+	return cfg
+}
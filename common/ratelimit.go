@@ -0,0 +1,107 @@
+package common
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxIdleBuckets is how many buckets are kept before idle ones are pruned
+const maxIdleBuckets = 10000
+
+// RateLimiter is a set of token buckets keyed by an arbitrary string,
+// such as a chatter or room ID
+type RateLimiter struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	burst    float64
+	interval time.Duration
+	now      func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter allowing burst requests at once,
+// refilling one token every interval. A zero burst disables limiting.
+func NewRateLimiter(burst int, interval time.Duration) *RateLimiter {
+	return &RateLimiter{
+		buckets:  make(map[string]*bucket),
+		burst:    float64(burst),
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// WithClock replaces the limiter's time source, for tests
+func (l *RateLimiter) WithClock(now func() time.Time) *RateLimiter {
+	l.now = now
+	return l
+}
+
+// Allow takes a token from the key's bucket. When the bucket is empty it
+// returns false and how long until the next token is available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l.burst <= 0 || l.interval <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(l.burst, b.tokens+float64(now.Sub(b.last))/float64(l.interval))
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) * float64(l.interval))
+	return false, wait
+}
+
+// Refund gives back a token taken by Allow, for when the request it was
+// taken for didn't go ahead after all
+func (l *RateLimiter) Refund(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = min(l.burst, b.tokens+1)
+	}
+}
+
+// prune drops buckets that would be full by now, as they hold no state. If
+// that isn't enough, the least recently used are dropped until half the
+// buckets are free, so a flood of new keys can't grow the map without bound.
+func (l *RateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+float64(now.Sub(b.last))/float64(l.interval) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	if len(l.buckets) < maxIdleBuckets {
+		return
+	}
+
+	keys := slices.SortedFunc(maps.Keys(l.buckets), func(a, b string) int {
+		return l.buckets[a].last.Compare(l.buckets[b].last)
+	})
+	for _, key := range keys[:len(keys)-maxIdleBuckets/2] {
+		delete(l.buckets, key)
+	}
+}
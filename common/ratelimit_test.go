@@ -0,0 +1,155 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(3, time.Second).WithClock(func() time.Time { return now })
+
+	// The full burst is available straight away
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("alice"); !ok {
+			t.Fatalf("Request %d should be allowed within the burst", i)
+		}
+	}
+
+	ok, wait := limiter.Allow("alice")
+	if ok {
+		t.Fatal("Request beyond the burst should be throttled")
+	}
+	if wait != time.Second {
+		t.Errorf("Expected retry after 1s, got %v", wait)
+	}
+
+	// Other keys have their own bucket
+	if ok, _ := limiter.Allow("bob"); !ok {
+		t.Error("A different key should not be throttled")
+	}
+
+	// Half a token is not enough
+	now = now.Add(500 * time.Millisecond)
+	ok, wait = limiter.Allow("alice")
+	if ok {
+		t.Error("Request should still be throttled after half an interval")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected retry after 500ms, got %v", wait)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := limiter.Allow("alice"); !ok {
+		t.Error("Request should be allowed once a token has refilled")
+	}
+
+	// Refill never exceeds the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("alice"); !ok {
+			t.Fatalf("Request %d should be allowed after a long pause", i)
+		}
+	}
+	if ok, _ := limiter.Allow("alice"); ok {
+		t.Error("Bucket should not hold more than the burst")
+	}
+}
+
+func TestRateLimiterPrunesIdleBuckets(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(2, time.Hour).WithClock(func() time.Time { return now })
+
+	// Buckets still refilling aren't full, but the oldest are dropped anyway
+	for i := 0; i < maxIdleBuckets; i++ {
+		limiter.Allow(fmt.Sprintf("chatter-%d", i))
+		now = now.Add(time.Millisecond)
+	}
+	limiter.Allow("newcomer")
+	if len(limiter.buckets) > maxIdleBuckets/2+1 {
+		t.Errorf("Expected the least recently used buckets to be pruned, %d left", len(limiter.buckets))
+	}
+	if _, ok := limiter.buckets["chatter-0"]; ok {
+		t.Error("Expected the longest unused bucket to be dropped")
+	}
+	if _, ok := limiter.buckets[fmt.Sprintf("chatter-%d", maxIdleBuckets-1)]; !ok {
+		t.Error("Expected the most recently used bucket to be kept")
+	}
+	if _, ok := limiter.buckets["newcomer"]; !ok {
+		t.Error("Expected the new key to get a bucket")
+	}
+}
+
+func TestRateLimiterRefund(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(1, time.Minute).WithClock(func() time.Time { return now })
+
+	limiter.Allow("alice")
+	limiter.Refund("alice")
+	if ok, _ := limiter.Allow("alice"); !ok {
+		t.Error("A refunded token should be available again")
+	}
+
+	// Refunds never exceed the burst
+	limiter.Refund("alice")
+	limiter.Refund("alice")
+	limiter.Allow("alice")
+	if ok, _ := limiter.Allow("alice"); ok {
+		t.Error("Expected refunds to be capped at the burst")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := NewRateLimiter(0, time.Second)
+	for i := 0; i < 100; i++ {
+		if ok, _ := limiter.Allow("alice"); !ok {
+			t.Fatal("A zero burst should disable limiting")
+		}
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	t.Setenv("CHAT_PORT", "8080")
+	t.Setenv("CHAT_RATE_CHATTER_BURST", "2")
+	t.Setenv("CHAT_RATE_ROOM_INTERVAL", "1s")
+	t.Setenv("CHAT_RATE_REPORT_BURST", "3")
+	t.Setenv("CHAT_REPORT_MIN_CHATTER_AGE", "24h")
+	t.Setenv("CHAT_BOT_REPLIES_PER_MINUTE", "4")
+	t.Setenv("CHAT_BOT_STATE_KEYS", "10")
+	t.Setenv("CHAT_LLM_BASE_URL", "http://localhost:11434/v1")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() failed: %v", err)
+	}
+	if cfg.Port != 8080 {
+		t.Errorf("Expected port 8080, got %d", cfg.Port)
+	}
+	if cfg.RateLimits.ChatterBurst != 2 {
+		t.Errorf("Expected chatter burst 2, got %d", cfg.RateLimits.ChatterBurst)
+	}
+	if cfg.RateLimits.RoomInterval != time.Second {
+		t.Errorf("Expected room interval 1s, got %v", cfg.RateLimits.RoomInterval)
+	}
+	if cfg.RateLimits.ReportBurst != 3 || cfg.ReportMinChatterAge != 24*time.Hour {
+		t.Errorf("Expected report burst 3 and minimum chatter age 24h, got %d and %v", cfg.RateLimits.ReportBurst, cfg.ReportMinChatterAge)
+	}
+	if cfg.Bots.RepliesPerMinute != 4 {
+		t.Errorf("Expected 4 bot replies per minute, got %d", cfg.Bots.RepliesPerMinute)
+	}
+	if cfg.Bots.StateKeys != 10 || cfg.Bots.StateValueBytes != DefaultConfig().Bots.StateValueBytes {
+		t.Errorf("Expected 10 bot state keys with the default value size, got %+v", cfg.Bots)
+	}
+	if cfg.LLM.BaseURL != "http://localhost:11434/v1" || cfg.LLM.Model != DefaultConfig().LLM.Model {
+		t.Errorf("Expected the LLM base URL with the default model, got %+v", cfg.LLM)
+	}
+	if cfg.RateLimits.ChatterInterval != DefaultConfig().RateLimits.ChatterInterval {
+		t.Error("Unset values should keep their defaults")
+	}
+
+	t.Setenv("CHAT_RATE_ROOM_INTERVAL", "soon")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for an invalid duration")
+	}
+}
@@ -0,0 +1,87 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2024, 1, 10, 9, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 10, 9, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 10, 9, 45, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2024, 1, 11, 9, 0, 0, 0, time.UTC)},
+		{"30 9 * * 1-5", time.Date(2024, 1, 11, 9, 30, 0, 0, time.UTC)},
+		{"0 10 * * 0", time.Date(2024, 1, 14, 10, 0, 0, 0, time.UTC)},
+		{"0 10 * * 7", time.Date(2024, 1, 14, 10, 0, 0, 0, time.UTC)},
+		{"0 0,12 * * *", time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted: the 15th or any Friday
+		{"0 0 15 * 5", time.Date(2024, 1, 12, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 10, 10, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			schedule, err := ParseSchedule(tt.spec)
+			if err != nil {
+				t.Fatalf("ParseSchedule() failed: %v", err)
+			}
+			if got := schedule.Next(from); !got.Equal(tt.want) {
+				t.Errorf("Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "x * * * *", "@fortnightly"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestParseReminder(t *testing.T) {
+	now := time.Date(2024, 1, 10, 9, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		args       []string
+		runAt      time.Time
+		recurrence string
+	}{
+		{[]string{"in", "90m", "stretch"}, now.Add(90 * time.Minute), ""},
+		{[]string{"in", "2d", "stretch"}, now.Add(48 * time.Hour), ""},
+		{[]string{"at", "17:00", "stretch"}, time.Date(2024, 1, 10, 17, 0, 0, 0, time.UTC), ""},
+		{[]string{"at", "08:00", "stretch"}, time.Date(2024, 1, 11, 8, 0, 0, 0, time.UTC), ""},
+		{[]string{"every", "0 9 * * 1-5", "stretch"}, time.Date(2024, 1, 11, 9, 0, 0, 0, time.UTC), "0 9 * * 1-5"},
+		{[]string{"every", "@hourly", "stretch"}, time.Date(2024, 1, 10, 10, 0, 0, 0, time.UTC), "@hourly"},
+		{[]string{"every", "*/15 * * * *", "stretch"}, time.Date(2024, 1, 10, 9, 45, 0, 0, time.UTC), "*/15 * * * *"},
+	}
+	for _, tt := range tests {
+		reminder, err := ParseReminder(tt.args, now)
+		if err != nil {
+			t.Errorf("ParseReminder(%q) failed: %v", tt.args, err)
+			continue
+		}
+		if !reminder.RunAt.Equal(tt.runAt) || reminder.Recurrence != tt.recurrence || reminder.Text != "stretch" {
+			t.Errorf("ParseReminder(%q) = %+v, want runAt %v, recurrence %q", tt.args, reminder, tt.runAt, tt.recurrence)
+		}
+	}
+
+	for _, args := range [][]string{{"in", "10m"}, {"in", "soon", "stretch"}, {"in", "-5m", "stretch"}, {"at", "25:00", "stretch"}, {"every", "often", "stretch"}, {"every", "* * * * *", "stretch"}, {"every", "0,5 9 * * 1", "stretch"}, {"later", "10m", "stretch"}} {
+		if _, err := ParseReminder(args, now); err == nil {
+			t.Errorf("ParseReminder(%q) succeeded, want an error", args)
+		}
+	}
+}
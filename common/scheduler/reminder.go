@@ -0,0 +1,100 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBadReminder is returned for reminders that can't be parsed
+var ErrBadReminder = errors.New("invalid reminder")
+
+// MinRecurrence is the shortest time allowed between runs of a recurring reminder
+const MinRecurrence = 15 * time.Minute
+
+// Reminder is a parsed /remind request
+type Reminder struct {
+	RunAt time.Time
+	// Recurrence is the cron schedule for repeating reminders, empty for one-offs
+	Recurrence string
+	Text       string
+}
+
+// ParseReminder parses the arguments of /remind, one of
+//
+//	in <duration> <text>     e.g. in 90m, in 2h30m, in 3d
+//	at <HH:MM> <text>        today, or tomorrow if that time has passed
+//	every <schedule> <text>  a quoted cron schedule or @daily, @weekly...
+func ParseReminder(args []string, now time.Time) (*Reminder, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("%w: needs a time and some text", ErrBadReminder)
+	}
+	when, text := args[1], strings.Join(args[2:], " ")
+
+	switch args[0] {
+	case "in":
+		d, err := parseDuration(when)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%w: '%s' is not a duration like 10m, 2h or 1d", ErrBadReminder, when)
+		}
+		return &Reminder{RunAt: now.Add(d), Text: text}, nil
+
+	case "at":
+		t, err := time.ParseInLocation("15:04", when, now.Location())
+		if err != nil {
+			return nil, fmt.Errorf("%w: '%s' is not a time like 09:30", ErrBadReminder, when)
+		}
+		runAt := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if !runAt.After(now) {
+			runAt = runAt.AddDate(0, 0, 1)
+		}
+		return &Reminder{RunAt: runAt, Text: text}, nil
+
+	case "every":
+		schedule, err := ParseSchedule(when)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadReminder, err)
+		}
+		runAt := schedule.Next(now)
+		if runAt.IsZero() {
+			return nil, fmt.Errorf("%w: '%s' never runs", ErrBadReminder, when)
+		}
+		if tooOften(schedule, runAt) {
+			return nil, fmt.Errorf("%w: '%s' runs more than once every %d minutes", ErrBadReminder, when, int(MinRecurrence.Minutes()))
+		}
+		return &Reminder{RunAt: runAt, Recurrence: when, Text: text}, nil
+	}
+
+	return nil, fmt.Errorf("%w: expected in, at or every", ErrBadReminder)
+}
+
+// tooOften reports whether any two runs of schedule in the week from first
+// are closer than MinRecurrence
+func tooOften(schedule *Schedule, first time.Time) bool {
+	end := first.AddDate(0, 0, 7)
+	for prev := first; prev.Before(end); {
+		next := schedule.Next(prev)
+		if next.IsZero() {
+			return false
+		}
+		if next.Sub(prev) < MinRecurrence {
+			return true
+		}
+		prev = next
+	}
+	return false
+}
+
+// parseDuration extends time.ParseDuration with a d suffix for days
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
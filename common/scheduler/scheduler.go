@@ -0,0 +1,209 @@
+// Package scheduler posts scheduled and recurring messages, such as the
+// reminders created with /remind
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go-star/common"
+	"go-star/common/dal"
+	"go-star/common/moderation"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// Username is the chatter scheduled messages are posted as
+	Username = "reminders"
+	// displayName is the name shown on scheduled messages
+	displayName = "Reminders"
+	// tickInterval is how often Run checks for due messages
+	tickInterval = 15 * time.Second
+)
+
+// Scheduler posts scheduled messages once they are due. Jobs live in the
+// database, so they survive restarts and fire late rather than never.
+type Scheduler struct {
+	db        *sql.DB
+	nc        *nats.Conn
+	moderator moderation.Moderator
+	now       func() time.Time
+}
+
+func New(db *sql.DB, nc *nats.Conn, moderator moderation.Moderator) *Scheduler {
+	return &Scheduler{db: db, nc: nc, moderator: moderator, now: time.Now}
+}
+
+// WithClock replaces the scheduler's clock, for tests
+func (s *Scheduler) WithClock(now func() time.Time) *Scheduler {
+	s.now = now
+	return s
+}
+
+// Run posts due messages until the context is cancelled
+func (s *Scheduler) Run(ctx context.Context) error {
+	// Mark the poster as a system chatter straight away, not on the first reminder
+	if _, err := s.posterID(); err != nil {
+		log.Printf("failed to set up the reminders chatter: %v", err)
+	}
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.Tick(ctx); err != nil {
+			log.Printf("failed to run scheduled messages: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// errDropped means a job can never be posted, because its owner is banned
+// or its room archived
+var errDropped = errors.New("scheduled message dropped")
+
+// errHeld means a job can't be posted yet, because its owner is muted in
+// the room
+var errHeld = errors.New("scheduled message held")
+
+// Tick posts every message that is due and returns how many were posted.
+// One-off messages are deleted once posted, recurring ones move to their
+// next run. Messages that fail to post stay due and are retried on the next
+// tick. Messages for archived rooms or banned owners are dropped, and while
+// the owner is muted one-off messages wait and recurring ones skip a run.
+func (s *Scheduler) Tick(ctx context.Context) (int, error) {
+	now := s.now()
+	due, err := dal.ListDueScheduledMessages(s.db, now)
+	if err != nil {
+		return 0, err
+	}
+	if len(due) == 0 {
+		return 0, nil
+	}
+
+	posterID, err := s.posterID()
+	if err != nil {
+		return 0, err
+	}
+
+	posted := 0
+	for _, job := range due {
+		ok, err := s.fire(ctx, posterID, job)
+		switch {
+		case errors.Is(err, errDropped):
+			if err := dal.DeleteScheduledMessage(s.db, job.ID); err != nil {
+				return posted, err
+			}
+			continue
+		case errors.Is(err, errHeld):
+			if job.Recurrence == "" {
+				continue
+			}
+		case err != nil:
+			log.Printf("failed to post scheduled message %d, will retry: %v", job.ID, err)
+			continue
+		}
+		if ok {
+			posted++
+		}
+		if err := s.advance(job, now); err != nil {
+			return posted, fmt.Errorf("failed to reschedule message %d: %w", job.ID, err)
+		}
+	}
+	return posted, nil
+}
+
+// fire posts one job into its room through moderation, like any other
+// message, once its owner is still allowed to post there. It returns false
+// without an error when moderation rejects the message.
+func (s *Scheduler) fire(ctx context.Context, posterID int64, job dal.ScheduledMessage) (bool, error) {
+	room, err := dal.GetRoom(s.db, job.RoomID)
+	if err != nil {
+		return false, err
+	}
+	if room.Archived {
+		return false, errDropped
+	}
+
+	owner, err := dal.GetChatter(s.db, job.ChatterID)
+	if err != nil {
+		return false, err
+	}
+	banned, err := dal.IsBanned(s.db, owner.ID)
+	if err != nil {
+		return false, err
+	}
+	if banned {
+		return false, errDropped
+	}
+	if _, muted, err := dal.MutedUntil(s.db, owner.ID, job.RoomID); err != nil {
+		return false, err
+	} else if muted {
+		return false, errHeld
+	}
+
+	stored, decision, err := moderation.Post(ctx, s.db, s.moderator, moderation.Message{
+		ChatterID: posterID,
+		RoomID:    job.RoomID,
+		Content:   fmt.Sprintf("Reminder for %s: %s", owner.Name, job.Content),
+		IsBot:     true,
+	})
+	if errors.Is(err, moderation.ErrRejected) {
+		log.Printf("scheduled message %d rejected by moderation: %s", job.ID, decision.Reason)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = common.PublishMessageEvent(s.nc, common.MessageEvent{
+		ID:        stored.ID,
+		RoomID:    stored.RoomID,
+		ChatterID: posterID,
+		Content:   stored.Content,
+	})
+	if err != nil {
+		// The message is stored, so retrying would post it twice
+		log.Printf("failed to publish scheduled message %d: %v", job.ID, err)
+	}
+	return true, nil
+}
+
+// advance deletes a finished job or moves a recurring one past now, skipping
+// any runs missed while the server was down and any closer than
+// MinRecurrence to this one
+func (s *Scheduler) advance(job dal.ScheduledMessage, now time.Time) error {
+	if job.Recurrence == "" {
+		return dal.DeleteScheduledMessage(s.db, job.ID)
+	}
+
+	schedule, err := ParseSchedule(job.Recurrence)
+	if err != nil {
+		log.Printf("dropping scheduled message %d with bad schedule: %v", job.ID, err)
+		return dal.DeleteScheduledMessage(s.db, job.ID)
+	}
+	next := schedule.Next(now.Add(MinRecurrence - time.Minute))
+	if next.IsZero() {
+		return dal.DeleteScheduledMessage(s.db, job.ID)
+	}
+	return dal.RescheduleMessage(s.db, job.ID, next)
+}
+
+// posterID returns the system chatter scheduled messages are posted as,
+// creating it on first use
+func (s *Scheduler) posterID() (int64, error) {
+	chatter, err := dal.EnsureSystemChatter(s.db, Username, displayName)
+	if err != nil {
+		return 0, err
+	}
+	return chatter.ID, nil
+}
@@ -0,0 +1,189 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"go-star/common"
+	"go-star/common/dal"
+	"go-star/common/moderation"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// startNATS runs an embedded NATS server on a random port for one test
+func startNATS(t *testing.T) *nats.Conn {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("failed to create NATS server: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(4 * time.Second) {
+		t.Fatal("NATS server not ready in time")
+	}
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		ns.Shutdown()
+		t.Fatalf("failed to connect to NATS: %v", err)
+	}
+	t.Cleanup(func() {
+		nc.Close()
+		ns.Shutdown()
+	})
+	return nc
+}
+
+func TestSchedulerTick(t *testing.T) {
+	defer os.Remove("./test_scheduler.db")
+	db, err := dal.SetupDB("test_scheduler")
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+	nc := startNATS(t)
+
+	room, _ := dal.InsertRoom(db, "Reminders", "reminder testing")
+	alice, _ := dal.InsertChatter(db, "alice", "Alice Smith")
+
+	events := make(chan common.MessageEvent, 10)
+	sub, err := nc.Subscribe(common.RoomMessagesSubject(room.ID), func(msg *nats.Msg) {
+		var event common.MessageEvent
+		if err := json.Unmarshal(msg.Data, &event); err == nil {
+			events <- event
+		}
+	})
+	if err != nil {
+		t.Fatalf("Subscribe() failed: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	now := time.Date(2024, 1, 10, 9, 30, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	once, _ := dal.InsertScheduledMessage(db, room.ID, alice.ID, "stretch", now.Add(10*time.Minute), "")
+	daily, _ := dal.InsertScheduledMessage(db, room.ID, alice.ID, "standup", time.Date(2024, 1, 10, 10, 0, 0, 0, time.UTC), "0 10 * * *")
+
+	s := New(db, nc, moderation.Default(db)).WithClock(clock)
+	if n, err := s.Tick(context.Background()); err != nil || n != 0 {
+		t.Fatalf("Tick() = %d, %v before anything is due", n, err)
+	}
+
+	// A new scheduler picks the jobs up from the database, like after a restart
+	now = now.Add(45 * time.Minute)
+	s = New(db, nc, moderation.Default(db)).WithClock(clock)
+	if n, err := s.Tick(context.Background()); err != nil || n != 2 {
+		t.Fatalf("Tick() = %d, %v, want 2 posted", n, err)
+	}
+
+	poster, err := dal.GetChatterByUsername(db, Username)
+	if err != nil {
+		t.Fatalf("GetChatterByUsername() failed: %v", err)
+	}
+	for _, want := range []string{"Reminder for Alice Smith: stretch", "Reminder for Alice Smith: standup"} {
+		select {
+		case event := <-events:
+			if event.Content != want || event.ChatterID != poster.ID {
+				t.Errorf("got %s from chatter %d, want %q from %d", event.Content, event.ChatterID, want, poster.ID)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no message event for %q", want)
+		}
+	}
+
+	remaining, err := dal.ListChatterScheduledMessages(db, alice.ID, room.ID)
+	if err != nil {
+		t.Fatalf("ListChatterScheduledMessages() failed: %v", err)
+	}
+	if len(remaining) != 1 || remaining[0].ID != daily.ID {
+		t.Fatalf("expected only the recurring job to remain, got %+v (one-off was %d)", remaining, once.ID)
+	}
+	if want := time.Date(2024, 1, 11, 10, 0, 0, 0, time.UTC); !remaining[0].RunAt.Equal(want) {
+		t.Errorf("recurring job moved to %v, want %v", remaining[0].RunAt, want)
+	}
+
+	// Nothing fires twice
+	if n, err := s.Tick(context.Background()); err != nil || n != 0 {
+		t.Errorf("Tick() = %d, %v on the same minute again", n, err)
+	}
+
+	// Jobs for archived rooms are dropped without posting
+	dal.ArchiveRoom(db, room.ID)
+	now = now.Add(24 * time.Hour)
+	if n, err := s.Tick(context.Background()); err != nil || n != 0 {
+		t.Errorf("Tick() = %d, %v in an archived room", n, err)
+	}
+	if remaining, _ := dal.ListChatterScheduledMessages(db, alice.ID, room.ID); len(remaining) != 0 {
+		t.Errorf("expected the archived room's jobs to be dropped, got %+v", remaining)
+	}
+}
+
+// failingModerator fails every message, like a moderation service that is down
+type failingModerator struct{}
+
+func (failingModerator) Moderate(context.Context, moderation.Message) (moderation.Decision, error) {
+	return moderation.Decision{}, errors.New("moderation unavailable")
+}
+
+func TestSchedulerChecksOwner(t *testing.T) {
+	defer os.Remove("./test_scheduler_owner.db")
+	db, err := dal.SetupDB("test_scheduler_owner")
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer db.Close()
+	nc := startNATS(t)
+
+	room, _ := dal.InsertRoom(db, "Reminders", "reminder testing")
+	alice, _ := dal.InsertChatter(db, "alice", "Alice Smith")
+	mallory, _ := dal.InsertChatter(db, "mallory", "Mallory")
+
+	now := time.Date(2024, 1, 10, 9, 30, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	once, _ := dal.InsertScheduledMessage(db, room.ID, alice.ID, "stretch", now, "")
+	hourly, _ := dal.InsertScheduledMessage(db, room.ID, alice.ID, "drink water", now, "30 * * * *")
+	dal.InsertScheduledMessage(db, room.ID, mallory.ID, "spam", now, "30 * * * *")
+	dal.BanChatter(db, mallory.ID, alice.ID, "spam")
+
+	// Failed posts stay due for the next tick
+	s := New(db, nc, failingModerator{}).WithClock(clock)
+	if n, err := s.Tick(context.Background()); err != nil || n != 0 {
+		t.Fatalf("Tick() = %d, %v with moderation down", n, err)
+	}
+	if remaining, _ := dal.ListChatterScheduledMessages(db, alice.ID, room.ID); len(remaining) != 2 || !remaining[0].RunAt.Equal(now) || !remaining[1].RunAt.Equal(now) {
+		t.Fatalf("expected failed jobs to be kept as they were, got %+v", remaining)
+	}
+	if remaining, _ := dal.ListChatterScheduledMessages(db, mallory.ID, room.ID); len(remaining) != 0 {
+		t.Errorf("expected a banned chatter's jobs to be dropped, got %+v", remaining)
+	}
+
+	// A muted owner's one-off waits for the mute to end, their recurring job skips a run
+	dal.MuteChatter(db, alice.ID, room.ID, mallory.ID, time.Now().Add(time.Hour), "noise")
+	s = New(db, nc, moderation.Default(db)).WithClock(clock)
+	if n, err := s.Tick(context.Background()); err != nil || n != 0 {
+		t.Fatalf("Tick() = %d, %v while muted", n, err)
+	}
+	remaining, _ := dal.ListChatterScheduledMessages(db, alice.ID, room.ID)
+	for _, job := range remaining {
+		switch {
+		case job.ID == once.ID && !job.RunAt.Equal(now):
+			t.Errorf("expected the one-off to wait, got %v", job.RunAt)
+		case job.ID == hourly.ID && !job.RunAt.Equal(now.Add(time.Hour)):
+			t.Errorf("expected the hourly job to skip a run, got %v", job.RunAt)
+		}
+	}
+
+	dal.UnmuteChatter(db, alice.ID, room.ID)
+	if n, err := s.Tick(context.Background()); err != nil || n != 1 {
+		t.Fatalf("Tick() = %d, %v after the mute, want the one-off posted", n, err)
+	}
+	if remaining, _ := dal.ListChatterScheduledMessages(db, alice.ID, room.ID); len(remaining) != 1 || remaining[0].ID != hourly.ID {
+		t.Errorf("expected only the hourly job to remain, got %+v", remaining)
+	}
+}
@@ -0,0 +1,167 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ChatStream is the JetStream stream that keeps room events, so background
+// workers that were down when an event was published still get it
+const ChatStream = "CHAT"
+
+// ChatStreamSubjects are the room events the CHAT stream keeps. Typing and
+// edits are only of interest to live connections, so they aren't kept.
+var ChatStreamSubjects = []string{AllRoomMessagesSubject, AllRoomJoinsSubject, AllRoomCommandsSubject}
+
+const (
+	// consumerAckWait is how long an event handed to a worker waits for its
+	// ack before it is redelivered. A worker that stops hands back the events
+	// it fetched ahead, but one that crashes leaves them in flight, so this is
+	// kept short and long handlers report progress instead.
+	consumerAckWait = 30 * time.Second
+	// consumerProgress is how often a worker still handling an event says so
+	consumerProgress = 10 * time.Second
+	// consumerPullExpiry bounds how long a stopped worker's pull request can
+	// still be handed events
+	consumerPullExpiry = 5 * time.Second
+	// consumerMaxDeliver is how many times an event is tried before it is given up on
+	consumerMaxDeliver = 10
+	// consumerRetryDelay is the wait before an event that failed is redelivered
+	consumerRetryDelay = 5 * time.Second
+	// consumerBatch is how many events a worker fetches ahead of the one it is handling
+	consumerBatch = 64
+)
+
+// EnsureChatStream creates the CHAT stream, or updates its limits to cfg's
+func EnsureChatStream(ctx context.Context, nc *nats.Conn, cfg JetStreamConfig) error {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return err
+	}
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:       ChatStream,
+		Subjects:   ChatStreamSubjects,
+		Retention:  jetstream.LimitsPolicy,
+		Discard:    jetstream.DiscardOld,
+		Storage:    jetstream.FileStorage,
+		MaxAge:     cfg.MaxAge,
+		MaxBytes:   int64(cfg.MaxBytes),
+		Duplicates: cfg.DuplicateWindow,
+		Replicas:   cfg.Replicas,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create the %s stream: %w", ChatStream, err)
+	}
+	return nil
+}
+
+// StreamEvent is one room event delivered from the CHAT stream
+type StreamEvent struct {
+	Subject string
+	Data    []byte
+	// Key identifies the event across redeliveries by its position in the
+	// stream. Publishers' message IDs aren't used, since the bots' NATS user
+	// can publish on every room's messages subject with any ID it likes.
+	Key string
+}
+
+// ConsumeChatStream hands the CHAT stream's events on subjects to handle,
+// one at a time and in order, until the context is cancelled. The durable
+// consumer remembers where it got to, so events published while the worker
+// is down are handled once it is back. An event is acknowledged when handle
+// returns nil and redelivered after an error or a crash, so handle must
+// skip events it has already handled, using their Key. Events fetched ahead
+// are handed back when ctx is cancelled, for the next worker to pick up.
+func ConsumeChatStream(ctx context.Context, nc *nats.Conn, durable string, subjects []string, handle func(StreamEvent) error) error {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return err
+	}
+	consumer, err := js.CreateOrUpdateConsumer(ctx, ChatStream, jetstream.ConsumerConfig{
+		Durable:        durable,
+		FilterSubjects: subjects,
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		// A new worker starts with what is published from now on, not the whole history
+		DeliverPolicy: jetstream.DeliverNewPolicy,
+		AckWait:       consumerAckWait,
+		MaxDeliver:    consumerMaxDeliver,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create the %s consumer: %w", durable, err)
+	}
+
+	messages, err := consumer.Messages(jetstream.PullMaxMessages(consumerBatch), jetstream.PullExpiry(consumerPullExpiry))
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Hand back what was fetched ahead rather than leave it to the ack wait
+			messages.Drain()
+		case <-done:
+			messages.Stop()
+		}
+	}()
+
+	for {
+		msg, err := messages.Next()
+		if errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+			return nil
+		}
+		if err != nil {
+			log.Printf("%s consumer: %v", durable, err)
+			continue
+		}
+		if ctx.Err() != nil {
+			// Stopping, so the next worker gets it straight away
+			msg.Nak()
+			continue
+		}
+
+		meta, err := msg.Metadata()
+		if err != nil {
+			log.Printf("%s consumer: %v", durable, err)
+			msg.Term()
+			continue
+		}
+		event := StreamEvent{Subject: msg.Subject(), Data: msg.Data(), Key: fmt.Sprintf("seq-%d", meta.Sequence.Stream)}
+
+		if err := handleWithProgress(msg, event, handle); err != nil {
+			log.Printf("%s consumer failed on %s, retrying: %v", durable, event.Subject, err)
+			msg.NakWithDelay(consumerRetryDelay)
+			continue
+		}
+		if err := msg.Ack(); err != nil {
+			log.Printf("%s consumer failed to ack %s: %v", durable, event.Key, err)
+		}
+	}
+}
+
+// handleWithProgress calls handle, telling JetStream the event is still in
+// hand every consumerProgress so it isn't redelivered to another worker
+func handleWithProgress(msg jetstream.Msg, event StreamEvent, handle func(StreamEvent) error) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(consumerProgress)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				msg.InProgress()
+			}
+		}
+	}()
+	return handle(event)
+}
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestConsumeChatStream(t *testing.T) {
+	nc, cleanup, err := SetupNATS(testNATS(t))
+	if err != nil {
+		t.Fatalf("SetupNATS() failed: %v", err)
+	}
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan StreamEvent, 10)
+	failed := false
+	done := make(chan error, 1)
+	go func() {
+		done <- ConsumeChatStream(ctx, nc, "test", ChatStreamSubjects, func(event StreamEvent) error {
+			events <- event
+			// The first message fails once, so it must come round again
+			if event.Key == "seq-1" && !failed {
+				failed = true
+				return errors.New("try again")
+			}
+			return nil
+		})
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// A forged message ID published first doesn't get the real event dropped
+	forged := &nats.Msg{Subject: RoomMessagesSubject(1), Data: []byte(`{"id":1,"roomId":1}`), Header: nats.Header{}}
+	forged.Header.Set(nats.MsgIdHdr, "message-1")
+	nc.PublishMsg(forged)
+	PublishMessageEvent(nc, MessageEvent{ID: 1, RoomID: 1, Content: "hello"})
+	PublishJoinEvent(nc, JoinEvent{RoomID: 1, ChatterID: 2})
+	// Typing isn't kept
+	PublishTypingEvent(nc, TypingEvent{RoomID: 1, ChatterID: 2})
+
+	var keys []string
+	for len(keys) < 4 {
+		select {
+		case event := <-events:
+			keys = append(keys, event.Key)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Expected 4 deliveries, got %v", keys)
+		}
+	}
+	// Events are keyed by their place in the stream, whatever ID they were published with
+	if !slices.Equal(keys, []string{"seq-1", "seq-2", "seq-3", "seq-1"}) {
+		t.Errorf("Expected the forged event, the message, the join, then the forged event again, got %v", keys)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Expected nothing more, got %+v", event)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("ConsumeChatStream() failed: %v", err)
+	}
+}
+
+func TestConsumeChatStreamHandover(t *testing.T) {
+	nc, cleanup, err := SetupNATS(testNATS(t))
+	if err != nil {
+		t.Fatalf("SetupNATS() failed: %v", err)
+	}
+	defer cleanup()
+
+	// The first worker is stopped while handling the first event, with the
+	// rest already fetched
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- ConsumeChatStream(ctx, nc, "test", ChatStreamSubjects, func(event StreamEvent) error {
+			close(started)
+			<-ctx.Done()
+			return nil
+		})
+	}()
+	time.Sleep(200 * time.Millisecond)
+	for id := range int64(3) {
+		PublishMessageEvent(nc, MessageEvent{ID: id + 1, RoomID: 1, Content: "hello"})
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the first worker to be handed an event")
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("ConsumeChatStream() failed: %v", err)
+	}
+
+	// The next worker gets the rest long before the ack wait runs out
+	next, stop := context.WithCancel(context.Background())
+	defer stop()
+	events := make(chan StreamEvent, 10)
+	go ConsumeChatStream(next, nc, "test", ChatStreamSubjects, func(event StreamEvent) error {
+		events <- event
+		return nil
+	})
+	var keys []string
+	for len(keys) < 2 {
+		select {
+		case event := <-events:
+			keys = append(keys, event.Key)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the 2 events the first worker fetched ahead, got %v", keys)
+		}
+	}
+	// Handed back events can come round in any order
+	slices.Sort(keys)
+	if keys[0] != "seq-2" || keys[1] != "seq-3" {
+		t.Errorf("Expected the second and third messages, got %v", keys)
+	}
+}
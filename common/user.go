@@ -6,6 +6,9 @@ import (
 	"github.com/google/uuid"
 )
 
+// UserIDCookie holds the GUID that identifies a chatter's browser
+const UserIDCookie = "chat-userid"
+
 // generateGUID creates a new GUID using the google/uuid package
 func generateGUID() string {
 	return uuid.New().String()
@@ -14,9 +17,8 @@ func generateGUID() string {
 // GetUserID checks for existing userId cookie or creates a new one
 func GetUserID(w http.ResponseWriter, r *http.Request) (string, error) {
 	// Check for existing cookie
-	cookie, err := r.Cookie("chat-userid")
-	if err == nil && cookie.Value != "" {
-		return cookie.Value, nil
+	if userID, ok := SessionUserID(r); ok {
+		return userID, nil
 	}
 
 	// Generate new GUID
@@ -24,12 +26,23 @@ func GetUserID(w http.ResponseWriter, r *http.Request) (string, error) {
 
 	// Set the cookie
 	http.SetCookie(w, &http.Cookie{
-		Name:     "chat-userid",
+		Name:     UserIDCookie,
 		Value:    userID,
 		Path:     "/",
 		HttpOnly: true,
+		Secure:   IsSecureRequest(r),
 		SameSite: http.SameSiteStrictMode,
 	})
 
 	return userID, nil
 }
+
+// SessionUserID returns the user ID from the request's cookie without
+// starting a new session if there isn't one
+func SessionUserID(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(UserIDCookie)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return cookie.Value, true
+}
@@ -0,0 +1,154 @@
+// Package webhooks connects rooms to systems outside the chat over HTTP
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-star/common"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	// MaxPayloadBytes caps the size of an incoming webhook request body
+	MaxPayloadBytes = 64 << 10
+	// maxTextLength caps the text posted by one incoming webhook call
+	maxTextLength = 4000
+	// maxSenderNameLength caps the username a call can post under
+	maxSenderNameLength = 50
+)
+
+var (
+	// ErrInvalidPayload is returned for bodies that aren't a webhook payload
+	ErrInvalidPayload = errors.New("invalid_payload")
+	// ErrNoText is returned for payloads with nothing to post
+	ErrNoText = errors.New("no_text")
+)
+
+// Payload is the JSON body of an incoming webhook call. Slack's incoming
+// webhook shape is accepted too, so tools that can post to Slack can post
+// here: username and icon_url override the sender, and attachments and
+// section blocks are flattened into the text.
+type Payload struct {
+	Text string `json:"text"`
+	// Markdown is used instead of Text when set. Rooms show plain text, so
+	// links and emphasis are flattened.
+	Markdown  string `json:"markdown"`
+	Username  string `json:"username"`
+	AvatarURL string `json:"avatarUrl"`
+
+	IconURL     string       `json:"icon_url"`
+	Attachments []attachment `json:"attachments"`
+	Blocks      []block      `json:"blocks"`
+}
+
+type attachment struct {
+	Fallback string `json:"fallback"`
+	Pretext  string `json:"pretext"`
+	Title    string `json:"title"`
+	Text     string `json:"text"`
+}
+
+type block struct {
+	Type   string      `json:"type"`
+	Text   *blockText  `json:"text"`
+	Fields []blockText `json:"fields"`
+}
+
+type blockText struct {
+	Text string `json:"text"`
+}
+
+// Message is what an incoming webhook call posts
+type Message struct {
+	Content string
+	// SenderName and AvatarURL override the webhook's own name and avatar when set
+	SenderName string
+	AvatarURL  string
+}
+
+// ParseIncoming reads an incoming webhook body, either JSON or a form with
+// the JSON in its payload field as Slack also allows
+func ParseIncoming(contentType string, body []byte) (*Message, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+		}
+		body = []byte(form.Get("payload"))
+	}
+
+	var p Payload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	return p.Message()
+}
+
+// Message flattens the payload into the text and sender to post
+func (p Payload) Message() (*Message, error) {
+	var parts []string
+	if p.Markdown != "" {
+		parts = append(parts, p.Markdown)
+	} else if p.Text != "" {
+		parts = append(parts, p.Text)
+	}
+	for _, b := range p.Blocks {
+		if b.Type != "section" && b.Type != "header" {
+			continue
+		}
+		if b.Text != nil {
+			parts = append(parts, b.Text.Text)
+		}
+		for _, field := range b.Fields {
+			parts = append(parts, field.Text)
+		}
+	}
+	for _, a := range p.Attachments {
+		for _, s := range []string{a.Pretext, a.Title, a.Text} {
+			if s != "" {
+				parts = append(parts, s)
+			}
+		}
+		if a.Pretext == "" && a.Title == "" && a.Text == "" && a.Fallback != "" {
+			parts = append(parts, a.Fallback)
+		}
+	}
+
+	content := strings.TrimSpace(plainText(strings.Join(parts, "\n")))
+	if content == "" {
+		return nil, ErrNoText
+	}
+	msg := &Message{
+		Content:    common.Truncate(content, maxTextLength),
+		SenderName: common.Truncate(strings.TrimSpace(p.Username), maxSenderNameLength),
+	}
+	avatar := p.AvatarURL
+	if avatar == "" {
+		avatar = p.IconURL
+	}
+	if u, err := url.Parse(avatar); err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" {
+		msg.AvatarURL = u.String()
+	}
+	return msg, nil
+}
+
+var (
+	markdownLink = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	slackLink    = regexp.MustCompile(`<((?:https?|mailto):[^|>]+)\|([^>]+)>`)
+	slackURL     = regexp.MustCompile(`<((?:https?|mailto):[^|>]+)>`)
+	emphasis     = strings.NewReplacer("**", "", "__", "")
+)
+
+// plainText flattens Markdown and Slack links to "label (url)" and drops
+// bold markers, since messages are shown as plain text
+func plainText(s string) string {
+	s = markdownLink.ReplaceAllString(s, "$1 ($2)")
+	s = slackLink.ReplaceAllString(s, "$2 ($1)")
+	s = slackURL.ReplaceAllString(s, "$1")
+	return emphasis.Replace(s)
+}
@@ -0,0 +1,80 @@
+package webhooks
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseIncoming(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        Message
+	}{
+		{
+			name:        "text",
+			contentType: "application/json",
+			body:        `{"text": "Build #12 passed"}`,
+			want:        Message{Content: "Build #12 passed"},
+		},
+		{
+			name:        "markdown with overrides",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"markdown": "**Deploy** finished, see [the log](https://ci.example.com/12)", "username": "CI", "avatarUrl": "https://ci.example.com/icon.png"}`,
+			want:        Message{Content: "Deploy finished, see the log (https://ci.example.com/12)", SenderName: "CI", AvatarURL: "https://ci.example.com/icon.png"},
+		},
+		{
+			name:        "slack attachments and blocks",
+			contentType: "application/json",
+			body: `{"text": "Alert <https://alerts.example.com/1|disk full>", "icon_url": "https://alerts.example.com/a.png", "username": "alertmanager",
+				"blocks": [{"type": "section", "text": {"type": "mrkdwn", "text": "host db-1"}}, {"type": "divider"}],
+				"attachments": [{"fallback": "ignored", "title": "90% used"}, {"fallback": "only fallback"}]}`,
+			want: Message{Content: "Alert disk full (https://alerts.example.com/1)\nhost db-1\n90% used\nonly fallback", SenderName: "alertmanager", AvatarURL: "https://alerts.example.com/a.png"},
+		},
+		{
+			name:        "slack form payload",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "payload=" + url.QueryEscape(`{"text": "from a form"}`),
+			want:        Message{Content: "from a form"},
+		},
+		{
+			name:        "unsafe avatar",
+			contentType: "application/json",
+			body:        `{"text": "hi", "avatarUrl": "javascript:alert(1)"}`,
+			want:        Message{Content: "hi"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseIncoming(tt.contentType, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("ParseIncoming() failed: %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("ParseIncoming() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIncomingErrors(t *testing.T) {
+	if _, err := ParseIncoming("application/json", []byte(`not json`)); !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("Expected ErrInvalidPayload, got %v", err)
+	}
+	if _, err := ParseIncoming("application/json", []byte(`{"text": "  ", "attachments": [{}]}`)); !errors.Is(err, ErrNoText) {
+		t.Errorf("Expected ErrNoText, got %v", err)
+	}
+
+	long := `{"text": "` + strings.Repeat("a", maxTextLength+10) + `", "username": "` + strings.Repeat("b", 80) + `"}`
+	msg, err := ParseIncoming("application/json", []byte(long))
+	if err != nil {
+		t.Fatalf("ParseIncoming() failed: %v", err)
+	}
+	if len(msg.Content) != maxTextLength || len(msg.SenderName) != maxSenderNameLength {
+		t.Errorf("Expected long text and names to be cut, got %d and %d", len(msg.Content), len(msg.SenderName))
+	}
+}
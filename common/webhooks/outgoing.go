@@ -0,0 +1,411 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-star/common"
+	"go-star/common/dal"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Event types outgoing webhooks can subscribe to
+const (
+	EventMessage = "message"
+	EventJoin    = "join"
+)
+
+// EventTypes lists the event types in the order they are offered
+var EventTypes = []string{EventMessage, EventJoin}
+
+// Headers sent with each delivery. The signature is "sha256=" and the hex
+// HMAC-SHA256 of the timestamp, a dot and the body, keyed with the webhook's secret.
+const (
+	SignatureHeader = "X-Chat-Signature"
+	TimestampHeader = "X-Chat-Timestamp"
+	EventHeader     = "X-Chat-Event"
+	DeliveryHeader  = "X-Chat-Delivery"
+)
+
+const (
+	// deliveryBatch caps how many deliveries one Flush attempts
+	deliveryBatch = 50
+	// deliveryWorkers is how many deliveries are attempted at once
+	deliveryWorkers = 4
+	// retryInterval is how often Run looks for retries that have come due
+	retryInterval = 5 * time.Second
+	// maxBackoff caps the wait between retries
+	maxBackoff = time.Hour
+	// maxErrorLength caps the error kept for a failed attempt
+	maxErrorLength = 500
+)
+
+// Envelope is the JSON body of a delivery, Data holds a MessageData or JoinData
+type Envelope struct {
+	Type      string          `json:"type"`
+	RoomID    int64           `json:"roomId"`
+	Timestamp time.Time       `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// MessageData is the data of a message event. Room events carry the
+// chatter's username, which is their session cookie, so it is left out of
+// deliveries.
+type MessageData struct {
+	ID        int64  `json:"id"`
+	RoomID    int64  `json:"roomId"`
+	ChatterID int64  `json:"chatterId"`
+	Content   string `json:"content"`
+	// BotID is the installation ID of the bot that posted the message, 0 for chatters
+	BotID int64 `json:"botId,omitempty"`
+}
+
+// JoinData is the data of a join event, without the chatter's username
+type JoinData struct {
+	RoomID    int64  `json:"roomId"`
+	ChatterID int64  `json:"chatterId"`
+	Name      string `json:"name"`
+}
+
+// publicData converts room events into the data deliveries carry
+func publicData(data any) any {
+	switch event := data.(type) {
+	case common.MessageEvent:
+		return MessageData{ID: event.ID, RoomID: event.RoomID, ChatterID: event.ChatterID, Content: event.Content, BotID: event.BotID}
+	case common.JoinEvent:
+		return JoinData{RoomID: event.RoomID, ChatterID: event.ChatterID, Name: event.Name}
+	}
+	return data
+}
+
+// Sign returns the signature header value for a delivery body
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a delivery's signature, for receivers written in Go
+func Verify(secret, timestamp, signature string, body []byte) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// Dispatcher delivers room events to outgoing webhooks. Events are queued in
+// the database before they are sent, so deliveries that fail are retried with
+// exponential backoff, also across restarts, and dead-lettered once they run
+// out of attempts.
+type Dispatcher struct {
+	db     *sql.DB
+	nc     *nats.Conn
+	cfg    common.WebhookConfig
+	client *http.Client
+	now    func() time.Time
+	wake   chan struct{}
+}
+
+func NewDispatcher(db *sql.DB, nc *nats.Conn, cfg common.WebhookConfig) *Dispatcher {
+	return &Dispatcher{
+		db:     db,
+		nc:     nc,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		now:    time.Now,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// WithClock replaces the dispatcher's clock, for tests
+func (d *Dispatcher) WithClock(now func() time.Time) *Dispatcher {
+	d.now = now
+	return d
+}
+
+// Consumer is the name of the dispatcher's durable consumer of the CHAT stream
+const Consumer = "webhooks"
+
+// Run queues room events for their webhooks and delivers them until the
+// context is cancelled. Events published while the dispatcher is down wait
+// in the CHAT stream and are queued once it is back.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	if _, err := dal.DeleteStaleProcessedEvents(d.db, d.now()); err != nil {
+		log.Printf("failed to delete old processed events: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d.deliverLoop(ctx)
+	}()
+	defer wg.Wait()
+
+	subjects := []string{common.AllRoomMessagesSubject, common.AllRoomJoinsSubject}
+	return common.ConsumeChatStream(ctx, d.nc, Consumer, subjects, func(event common.StreamEvent) error {
+		n, err := d.handle(event)
+		if err != nil {
+			return fmt.Errorf("failed to queue webhook deliveries: %w", err)
+		}
+		if n > 0 {
+			d.nudge()
+		}
+		return nil
+	})
+}
+
+// deliverLoop sends deliveries as they are queued and retries as they come due
+func (d *Dispatcher) deliverLoop(ctx context.Context) {
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := d.Flush(ctx); err != nil {
+			log.Printf("failed to deliver webhooks: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) nudge() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// handle queues one room event from the stream, once however often it is delivered
+func (d *Dispatcher) handle(event common.StreamEvent) (int, error) {
+	var (
+		eventType string
+		roomID    int64
+		data      any
+	)
+	key := event.Key
+	switch {
+	case strings.HasSuffix(event.Subject, ".messages"):
+		var msg common.MessageEvent
+		if err := json.Unmarshal(event.Data, &msg); err != nil {
+			log.Printf("failed to decode message event: %v", err)
+			return 0, nil
+		}
+		// Streaming replies are delivered once they are complete
+		if msg.Partial {
+			return 0, nil
+		}
+		stored, ok, err := d.storedMessage(msg.ID, msg.RoomID)
+		if err != nil || !ok {
+			return 0, err
+		}
+		// Keyed by the stored message, so however many events name it it's sent once
+		eventType, roomID, data, key = EventMessage, stored.RoomID, stored, fmt.Sprintf("message-%d", stored.ID)
+
+	case strings.HasSuffix(event.Subject, ".joins"):
+		var join common.JoinEvent
+		if err := json.Unmarshal(event.Data, &join); err != nil {
+			log.Printf("failed to decode join event: %v", err)
+			return 0, nil
+		}
+		eventType, roomID, data = EventJoin, join.RoomID, publicData(join)
+
+	default:
+		return 0, nil
+	}
+
+	hooks, err := dal.ListOutgoingWebhooksFor(d.db, roomID, eventType)
+	if err != nil || len(hooks) == 0 {
+		return 0, err
+	}
+	var n int
+	_, err = dal.ProcessEventOnce(d.db, Consumer, key, func(tx dal.DBTX) error {
+		n, err = d.enqueue(tx, hooks, eventType, roomID, data)
+		return err
+	})
+	return n, err
+}
+
+// storedMessage loads the message an event names. The bots' NATS user can
+// publish on every room's messages subject, so only the message ID is taken
+// from the event, and messages that are gone, hidden or in another room than
+// the event's are skipped.
+func (d *Dispatcher) storedMessage(messageID, roomID int64) (MessageData, bool, error) {
+	message, err := dal.GetMessageWithChatter(d.db, messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return MessageData{}, false, nil
+	}
+	if err != nil {
+		return MessageData{}, false, err
+	}
+	if message.RoomID != roomID {
+		log.Printf("ignoring message event for message %d in room %d, it is in room %d", messageID, roomID, message.RoomID)
+		return MessageData{}, false, nil
+	}
+
+	data := MessageData{ID: message.ID, RoomID: message.RoomID, ChatterID: message.UserID, Content: message.Content}
+	bots, err := dal.ListRoomBots(d.db, message.RoomID)
+	if err != nil {
+		return MessageData{}, false, err
+	}
+	for _, bot := range bots {
+		if bot.Username == message.Username {
+			data.BotID = bot.ID
+		}
+	}
+	return data, true, nil
+}
+
+// Enqueue queues an event for every webhook that wants it and returns how many did
+func (d *Dispatcher) Enqueue(eventType string, roomID int64, data any) (int, error) {
+	hooks, err := dal.ListOutgoingWebhooksFor(d.db, roomID, eventType)
+	if err != nil || len(hooks) == 0 {
+		return 0, err
+	}
+	return d.enqueue(d.db, hooks, eventType, roomID, data)
+}
+
+func (d *Dispatcher) enqueue(db dal.DBTX, hooks []dal.OutgoingWebhook, eventType string, roomID int64, data any) (int, error) {
+	raw, err := json.Marshal(publicData(data))
+	if err != nil {
+		return 0, err
+	}
+	now := d.now()
+	payload, err := json.Marshal(Envelope{Type: eventType, RoomID: roomID, Timestamp: now.UTC(), Data: raw})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, hook := range hooks {
+		if _, err := dal.InsertWebhookDelivery(db, hook.ID, eventType, string(payload), now); err != nil {
+			return 0, err
+		}
+	}
+	return len(hooks), nil
+}
+
+// Flush attempts the deliveries that are due and returns how many it attempted
+func (d *Dispatcher) Flush(ctx context.Context) (int, error) {
+	due, err := dal.ListDueWebhookDeliveries(d.db, d.now(), deliveryBatch)
+	if err != nil || len(due) == 0 {
+		return 0, err
+	}
+
+	hooks := make(map[int64]*dal.OutgoingWebhook)
+	for _, delivery := range due {
+		if _, ok := hooks[delivery.WebhookID]; ok {
+			continue
+		}
+		hook, err := dal.GetOutgoingWebhook(d.db, delivery.WebhookID)
+		if err != nil {
+			return 0, err
+		}
+		hooks[delivery.WebhookID] = hook
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, deliveryWorkers)
+	for _, delivery := range due {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			d.attempt(ctx, hooks[delivery.WebhookID], delivery)
+		}()
+	}
+	wg.Wait()
+	return len(due), nil
+}
+
+// attempt sends one delivery and records how it went
+func (d *Dispatcher) attempt(ctx context.Context, hook *dal.OutgoingWebhook, delivery dal.WebhookDelivery) {
+	status, err := d.send(ctx, hook, delivery)
+	if err == nil {
+		if err := dal.MarkWebhookDelivered(d.db, delivery.ID, status); err != nil {
+			log.Printf("failed to record webhook delivery %d: %v", delivery.ID, err)
+		}
+		return
+	}
+
+	reason := common.Truncate(err.Error(), maxErrorLength)
+	if delivery.Attempts+1 < d.cfg.MaxAttempts {
+		next := d.now().Add(d.backoff(delivery.Attempts))
+		if err := dal.RetryWebhookDelivery(d.db, delivery.ID, status, reason, next); err != nil {
+			log.Printf("failed to reschedule webhook delivery %d: %v", delivery.ID, err)
+		}
+		return
+	}
+
+	log.Printf("webhook delivery %d to %s failed after %d attempts: %s", delivery.ID, hook.URL, delivery.Attempts+1, reason)
+	tx, err := d.db.Begin()
+	if err != nil {
+		log.Printf("failed to dead-letter webhook delivery %d: %v", delivery.ID, err)
+		return
+	}
+	defer tx.Rollback()
+	if err := dal.DeadLetterWebhookDelivery(tx, delivery.ID, status, reason); err != nil {
+		log.Printf("failed to dead-letter webhook delivery %d: %v", delivery.ID, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("failed to dead-letter webhook delivery %d: %v", delivery.ID, err)
+	}
+}
+
+// send POSTs a delivery and returns the response status, with an error for anything but 2xx
+func (d *Dispatcher) send(ctx context.Context, hook *dal.OutgoingWebhook, delivery dal.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return resp.StatusCode, fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(snippet)))
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	return resp.StatusCode, nil
+}
+
+// backoff returns the wait after a delivery's failed attempts, doubling each time
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.cfg.Backoff
+	for i := 0; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxBackoff)
+}
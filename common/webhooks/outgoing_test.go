@@ -0,0 +1,264 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go-star/common"
+	"go-star/common/dal"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// receiver is an httptest endpoint that checks signatures and records deliveries
+type receiver struct {
+	*httptest.Server
+	secret string
+	status int
+
+	mu         sync.Mutex
+	deliveries []Envelope
+	attempts   int
+}
+
+func newReceiver(t *testing.T, secret string, status int) *receiver {
+	t.Helper()
+	rec := &receiver{secret: secret, status: status}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.attempts++
+
+		if !Verify(rec.secret, r.Header.Get(TimestampHeader), r.Header.Get(SignatureHeader), body) {
+			t.Errorf("delivery %s has a bad signature", r.Header.Get(DeliveryHeader))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var envelope Envelope
+		if err := json.Unmarshal(body, &envelope); err != nil {
+			t.Errorf("delivery is not an envelope: %v", err)
+		}
+		if envelope.Type != r.Header.Get(EventHeader) {
+			t.Errorf("event header %s doesn't match the body's %s", r.Header.Get(EventHeader), envelope.Type)
+		}
+		if rec.status != http.StatusOK {
+			http.Error(w, "receiver is down", rec.status)
+			return
+		}
+		rec.deliveries = append(rec.deliveries, envelope)
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+func (rec *receiver) counts() (attempts, delivered int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.attempts, len(rec.deliveries)
+}
+
+func setupDispatcherTest(t *testing.T, name string) (*dal.Room, *dal.Chatter, func() *Dispatcher) {
+	t.Helper()
+	t.Cleanup(func() { os.Remove("./" + name + ".db") })
+	db, err := dal.SetupDB(name)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	room, _ := dal.InsertRoom(db, "Alerts", "webhook testing")
+	admin, _ := dal.InsertChatter(db, "admin", "Admin")
+	return room, admin, func() *Dispatcher { return NewDispatcher(db, nil, common.DefaultConfig().Webhooks) }
+}
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"type":"message"}`)
+	signature := Sign("secret", "1700000000", body)
+	if !Verify("secret", "1700000000", signature, body) {
+		t.Error("Expected the signature to verify")
+	}
+	for _, tampered := range [][3]string{
+		{"other", "1700000000", string(body)},
+		{"secret", "1700000001", string(body)},
+		{"secret", "1700000000", `{"type":"join"}`},
+	} {
+		if Verify(tampered[0], tampered[1], signature, []byte(tampered[2])) {
+			t.Errorf("Expected %v not to verify", tampered)
+		}
+	}
+}
+
+func TestDispatcherDeliversRoomEvents(t *testing.T) {
+	room, admin, newDispatcher := setupDispatcherTest(t, "test_webhook_deliver")
+	d := newDispatcher()
+
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("failed to create NATS server: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(4 * time.Second) {
+		t.Fatal("NATS server not ready in time")
+	}
+	defer ns.Shutdown()
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to NATS: %v", err)
+	}
+	defer nc.Close()
+	if err := common.EnsureChatStream(context.Background(), nc, common.DefaultConfig().NATS.JetStream); err != nil {
+		t.Fatalf("EnsureChatStream() failed: %v", err)
+	}
+	d.nc = nc
+
+	messages := newReceiver(t, "messages-secret", http.StatusOK)
+	everything := newReceiver(t, "all-secret", http.StatusOK)
+	elsewhere := newReceiver(t, "other-secret", http.StatusOK)
+	dal.InsertOutgoingWebhook(d.db, room.ID, EventMessage, messages.URL, messages.secret, admin.ID)
+	dal.InsertOutgoingWebhook(d.db, 0, "", everything.URL, everything.secret, admin.ID)
+	dal.InsertOutgoingWebhook(d.db, room.ID+1, "", elsewhere.URL, elsewhere.secret, admin.ID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := d.Run(ctx); err != nil {
+			t.Errorf("Run() failed: %v", err)
+		}
+	}()
+	defer func() { cancel(); <-done }()
+	js, _ := jetstream.New(nc)
+	for deadline := time.Now().Add(4 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := js.Consumer(ctx, common.ChatStream, Consumer); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("dispatcher never created its consumer")
+		}
+	}
+
+	stored, _ := dal.InsertMessage(d.db, admin.ID, room.ID, "disk full")
+	common.PublishMessageEvent(nc, common.MessageEvent{ID: stored.ID, RoomID: room.ID, ChatterID: admin.ID, Content: "partial", Partial: true})
+	// Forged events: the content and chatter come from the database, and
+	// events for messages that don't exist or are in another room are dropped
+	common.PublishMessageEvent(nc, common.MessageEvent{ID: stored.ID, RoomID: room.ID, ChatterID: admin.ID + 1, Content: "forged"})
+	common.PublishMessageEvent(nc, common.MessageEvent{ID: stored.ID, RoomID: room.ID + 1, Content: "forged"})
+	common.PublishMessageEvent(nc, common.MessageEvent{ID: stored.ID + 1, RoomID: room.ID, Content: "forged"})
+	common.PublishMessageEvent(nc, common.MessageEvent{ID: stored.ID, RoomID: room.ID, ChatterID: admin.ID, Content: "disk full"})
+	common.PublishJoinEvent(nc, common.JoinEvent{RoomID: room.ID, ChatterID: admin.ID, Name: "Admin"})
+
+	for deadline := time.Now().Add(4 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		_, m := messages.counts()
+		_, e := everything.counts()
+		if m == 1 && e == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 1 message delivery and 2 deliveries of everything, got %d and %d", m, e)
+		}
+	}
+	if attempts, _ := elsewhere.counts(); attempts != 0 {
+		t.Errorf("Expected nothing for a webhook on another room, got %d", attempts)
+	}
+
+	var event MessageData
+	if err := json.Unmarshal(messages.deliveries[0].Data, &event); err != nil || event.Content != "disk full" || event.ChatterID != admin.ID || messages.deliveries[0].RoomID != room.ID {
+		t.Errorf("Expected the full message event, got %+v (%v)", messages.deliveries[0], err)
+	}
+
+	// Usernames are session cookies, so no delivery may carry one
+	for _, delivery := range everything.deliveries {
+		var data map[string]any
+		if err := json.Unmarshal(delivery.Data, &data); err != nil {
+			t.Fatalf("failed to decode %s: %v", delivery.Data, err)
+		}
+		if _, ok := data["username"]; ok {
+			t.Errorf("Expected no username in the %s delivery, got %s", delivery.Type, delivery.Data)
+		}
+	}
+}
+
+func TestDispatcherQueuesEachEventOnce(t *testing.T) {
+	room, admin, newDispatcher := setupDispatcherTest(t, "test_webhook_once")
+	d := newDispatcher()
+	dal.InsertOutgoingWebhook(d.db, room.ID, "", "http://example.invalid", "secret", admin.ID)
+
+	stored, _ := dal.InsertMessage(d.db, admin.ID, room.ID, "deploying")
+	data, _ := json.Marshal(common.MessageEvent{ID: stored.ID, RoomID: room.ID, ChatterID: admin.ID, Content: "deploying"})
+
+	// A redelivered event, or another naming the same message, is acknowledged
+	// again without queuing it twice
+	for i, key := range []string{"seq-1", "seq-1", "seq-2"} {
+		want := 0
+		if i == 0 {
+			want = 1
+		}
+		event := common.StreamEvent{Subject: common.RoomMessagesSubject(room.ID), Data: data, Key: key}
+		n, err := d.handle(event)
+		if err != nil {
+			t.Fatalf("handle() failed: %v", err)
+		}
+		if n != want {
+			t.Errorf("Delivery %d: expected %d deliveries queued, got %d", i+1, want, n)
+		}
+	}
+	due, _ := dal.ListDueWebhookDeliveries(d.db, time.Now().Add(time.Minute), 10)
+	if len(due) != 1 {
+		t.Errorf("Expected one queued delivery, got %d", len(due))
+	}
+}
+
+func TestDispatcherRetriesAndDeadLetters(t *testing.T) {
+	room, admin, newDispatcher := setupDispatcherTest(t, "test_webhook_retry")
+	now := time.Date(2024, 1, 10, 9, 30, 0, 0, time.UTC)
+	d := newDispatcher().WithClock(func() time.Time { return now })
+	d.cfg.MaxAttempts = 3
+	d.cfg.Backoff = time.Minute
+
+	down := newReceiver(t, "secret", http.StatusServiceUnavailable)
+	hook, _ := dal.InsertOutgoingWebhook(d.db, room.ID, "", down.URL, down.secret, admin.ID)
+
+	if n, err := d.Enqueue(EventJoin, room.ID, common.JoinEvent{RoomID: room.ID}); err != nil || n != 1 {
+		t.Fatalf("Enqueue() = %d, %v", n, err)
+	}
+
+	flush := func(wantAttempted int) {
+		t.Helper()
+		if n, err := d.Flush(context.Background()); err != nil || n != wantAttempted {
+			t.Fatalf("Flush() = %d, %v at %v, want %d attempted", n, err, now, wantAttempted)
+		}
+	}
+
+	flush(1)
+	flush(0) // not due again until the backoff has passed
+	now = now.Add(time.Minute)
+	flush(1)
+	now = now.Add(time.Minute)
+	flush(0) // the second wait is twice as long
+	now = now.Add(time.Minute)
+	flush(1)
+	now = now.Add(time.Hour)
+	flush(0) // out of attempts
+
+	deliveries, _ := dal.ListWebhookDeliveries(d.db, hook.ID, 10)
+	if len(deliveries) != 1 || deliveries[0].Status != dal.DeliveryFailed || deliveries[0].Attempts != 3 || deliveries[0].LastStatus != http.StatusServiceUnavailable {
+		t.Errorf("Expected one failed delivery after 3 attempts, got %+v", deliveries)
+	}
+	letters, _ := dal.ListWebhookDeadLetters(d.db, hook.ID, 10)
+	if len(letters) != 1 || letters[0].DeliveryID != deliveries[0].ID || letters[0].LastError == "" {
+		t.Errorf("Expected the delivery in the dead-letter table, got %+v", letters)
+	}
+	if attempts, _ := down.counts(); attempts != 3 {
+		t.Errorf("Expected 3 attempts at the receiver, got %d", attempts)
+	}
+}
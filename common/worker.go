@@ -0,0 +1,86 @@
+package common
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Worker is background work that must only run on one instance at a time,
+// such as the bot runner: two runners would answer every message twice
+type Worker interface {
+	// Name identifies the worker's lease, the same on every instance
+	Name() string
+	// Run works until ctx is cancelled
+	Run(ctx context.Context) error
+}
+
+// workerFunc is a Worker made from a function
+type workerFunc struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// NewWorker names a run function as a Worker
+func NewWorker(name string, run func(ctx context.Context) error) Worker {
+	return workerFunc{name: name, run: run}
+}
+
+func (w workerFunc) Name() string                  { return w.name }
+func (w workerFunc) Run(ctx context.Context) error { return w.run(ctx) }
+
+const (
+	// workerRestartDelay is the wait before a worker that failed campaigns again
+	workerRestartDelay = 5 * time.Second
+	// workerStopWarning is how long a worker can take to stop once its lease
+	// is lost before it is reported, since another instance may be running it
+	workerStopWarning = 5 * time.Second
+)
+
+// RunWorker runs w whenever this instance holds its lease, until ctx is
+// done. The context w runs with is cancelled when the lease is lost, and the
+// instance only campaigns again once w has returned. If w fails, it gives
+// up the lease so another instance can try, and campaigns again after a
+// delay.
+func RunWorker(ctx context.Context, nc *nats.Conn, w Worker) error {
+	election, err := NewElection(ctx, nc, w.Name())
+	if err != nil {
+		return err
+	}
+	for {
+		err := election.Run(ctx, func(leading context.Context) error {
+			stopped := make(chan struct{})
+			defer close(stopped)
+			go warnIfSlowToStop(leading, stopped, w.Name())
+			return w.Run(leading)
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Printf("%s failed, restarting in %s: %v", w.Name(), workerRestartDelay, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(workerRestartDelay):
+		}
+	}
+}
+
+// warnIfSlowToStop logs when a worker is still running workerStopWarning
+// after its context was cancelled
+func warnIfSlowToStop(leading context.Context, stopped <-chan struct{}, name string) {
+	select {
+	case <-stopped:
+		return
+	case <-leading.Done():
+	}
+	select {
+	case <-stopped:
+	case <-time.After(workerStopWarning):
+		log.Printf("%s is still running %s after it was told to stop", name, workerStopWarning)
+	}
+}
@@ -0,0 +1,118 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunWorker(t *testing.T) {
+	cfg := testNATS(t)
+	cfg.JetStream.LeaseTTL = time.Second
+	nc, cleanup, err := SetupNATS(cfg)
+	if err != nil {
+		t.Fatalf("SetupNATS() failed: %v", err)
+	}
+	defer cleanup()
+
+	// Each instance's worker reports when it starts and stops
+	type instance struct {
+		started chan int
+		stopped chan int
+		cancel  context.CancelFunc
+		done    chan error
+	}
+	start := func(n int, fail bool) *instance {
+		in := &instance{started: make(chan int, 10), stopped: make(chan int, 10), done: make(chan error, 1)}
+		ctx, cancel := context.WithCancel(context.Background())
+		in.cancel = cancel
+		worker := NewWorker("test", func(ctx context.Context) error {
+			in.started <- n
+			defer func() { in.stopped <- n }()
+			if fail {
+				return errors.New("broken")
+			}
+			<-ctx.Done()
+			return nil
+		})
+		go func() { in.done <- RunWorker(ctx, nc, worker) }()
+		return in
+	}
+
+	// A worker that fails gives up its lease to the other instance
+	broken := start(1, true)
+	select {
+	case <-broken.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the first instance to run the worker")
+	}
+	working := start(2, false)
+	defer working.cancel()
+	select {
+	case <-working.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the second instance to take over from the broken one")
+	}
+	broken.cancel()
+	if err := <-broken.done; err != nil {
+		t.Errorf("RunWorker() failed: %v", err)
+	}
+
+	// Shutting down stops the worker before RunWorker returns
+	working.cancel()
+	if err := <-working.done; err != nil {
+		t.Errorf("RunWorker() failed: %v", err)
+	}
+	select {
+	case <-working.stopped:
+	default:
+		t.Error("Expected the worker to have stopped")
+	}
+}
+
+func TestRunWorkerLostLease(t *testing.T) {
+	cfg := testNATS(t)
+	cfg.JetStream.LeaseTTL = time.Second
+	nc, cleanup, err := SetupNATS(cfg)
+	if err != nil {
+		t.Fatalf("SetupNATS() failed: %v", err)
+	}
+	defer cleanup()
+
+	events := make(chan string, 10)
+	worker := NewWorker("test", func(ctx context.Context) error {
+		events <- "started"
+		<-ctx.Done()
+		// Finishing up takes a moment, and must happen before a restart
+		time.Sleep(100 * time.Millisecond)
+		events <- "stopped"
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go RunWorker(ctx, nc, worker)
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("Expected the worker to have %s, got %s", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the worker to have %s", want)
+		}
+	}
+	expect("started")
+
+	// Another instance takes the lease, so the next renewal fails
+	election, err := NewElection(context.Background(), nc, "test")
+	if err != nil {
+		t.Fatalf("NewElection() failed: %v", err)
+	}
+	election.kv.Put(context.Background(), "test", []byte("someone-else"))
+	expect("stopped")
+	// It runs again once the other's lease expires
+	expect("started")
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"fmt"
+	"go-star/common/dal"
+	"go-star/handlers/components"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/a-h/templ"
+	"github.com/go-chi/chi/v5"
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+func (h *Handlers) AdminPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := h.requireAdmin(w, r); !ok {
+			return
+		}
+
+		rooms, err := dal.ListRooms(h.db)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to list rooms: %w", err))
+			return
+		}
+
+		chatters, err := dal.ListChatters(h.db)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to list chatters: %w", err))
+			return
+		}
+
+		templ.Handler(components.AdminPage(rooms, chatters)).ServeHTTP(w, r)
+	}
+}
+
+func (h *Handlers) CreateRoom() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := h.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+
+		signals := &components.AdminSignals{}
+		if err := datastar.ReadSignals(r, signals); err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to read admin signals: %w", err))
+			return
+		}
+
+		name := strings.TrimSpace(signals.RoomName)
+		if name == "" {
+			http.Error(w, "room name cannot be empty", http.StatusBadRequest)
+			return
+		}
+
+		_, err := dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			room, err := dal.InsertRoom(tx, name, strings.TrimSpace(signals.RoomDescription))
+			if err != nil {
+				return dal.AuditEntry{}, err
+			}
+			return dal.AuditEntry{
+				ActorID:    admin.ID,
+				Action:     dal.AuditRoomCreate,
+				TargetType: dal.TargetRoom,
+				TargetID:   room.ID,
+				Reason:     signals.Reason,
+			}, nil
+		})
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to create room: %w", err))
+			return
+		}
+
+		h.patchAdminRooms(w, r)
+	}
+}
+
+func (h *Handlers) ArchiveRoom() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := h.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+
+		signals := &components.AdminSignals{}
+		if err := datastar.ReadSignals(r, signals); err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to read admin signals: %w", err))
+			return
+		}
+
+		roomID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to parse room ID: %w", err))
+			return
+		}
+
+		_, err = dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			return dal.AuditEntry{
+				ActorID:    admin.ID,
+				Action:     dal.AuditRoomArchive,
+				TargetType: dal.TargetRoom,
+				TargetID:   roomID,
+				Reason:     signals.Reason,
+			}, dal.ArchiveRoom(tx, roomID)
+		})
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to archive room: %w", err))
+			return
+		}
+
+		h.patchAdminRooms(w, r)
+	}
+}
+
+func (h *Handlers) SetChatterRole() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := h.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+
+		signals := &components.AdminSignals{}
+		if err := datastar.ReadSignals(r, signals); err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to read admin signals: %w", err))
+			return
+		}
+
+		chatterID, err := strconv.ParseInt(chi.URLParam(r, "chatterId"), 10, 64)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to parse chatter ID: %w", err))
+			return
+		}
+
+		// Admins can't demote themselves and lock everyone out
+		if chatterID == admin.ID {
+			h.forbidden(w, r)
+			return
+		}
+
+		role := r.URL.Query().Get("role")
+		_, err = dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			return dal.AuditEntry{
+				ActorID:    admin.ID,
+				Action:     dal.AuditChatterRole,
+				TargetType: dal.TargetChatter,
+				TargetID:   chatterID,
+				Reason:     strings.TrimSpace(role + ": " + signals.Reason),
+			}, dal.SetChatterRole(tx, chatterID, role)
+		})
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to set chatter role: %w", err))
+			return
+		}
+
+		chatters, err := dal.ListChatters(h.db)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to list chatters: %w", err))
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		if err := sse.PatchElementTempl(components.AdminChatters(chatters)); err != nil {
+			log.Printf("Failed to send chatters to client: %v", err)
+		}
+	}
+}
+
+func (h *Handlers) AuditLogPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := h.requireAdmin(w, r); !ok {
+			return
+		}
+
+		query := r.URL.Query()
+		filter := dal.AuditFilter{
+			Action:     query.Get("action"),
+			TargetType: query.Get("targetType"),
+			Limit:      200,
+		}
+		filter.ActorID, _ = strconv.ParseInt(query.Get("actor"), 10, 64)
+		filter.TargetID, _ = strconv.ParseInt(query.Get("target"), 10, 64)
+
+		entries, err := dal.ListAuditLog(h.db, filter)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to list audit log: %w", err))
+			return
+		}
+
+		templ.Handler(components.AuditLogPage(entries, filter)).ServeHTTP(w, r)
+	}
+}
+
+func (h *Handlers) patchAdminRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := dal.ListRooms(h.db)
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to list rooms: %w", err))
+		return
+	}
+
+	sse := datastar.NewSSE(w, r)
+	if err := sse.PatchElementTempl(components.AdminRooms(rooms)); err != nil {
+		log.Printf("Failed to send rooms to client: %v", err)
+	}
+}
+
+// requireAdmin returns the current chatter, or responds 403 and returns false if they are not an admin
+func (h *Handlers) requireAdmin(w http.ResponseWriter, r *http.Request) (*dal.Chatter, bool) {
+	chatter, err := h.getChatter(w, r)
+	if err != nil {
+		return nil, false
+	}
+	if chatter.Role != dal.RoleAdmin {
+		h.forbidden(w, r)
+		return nil, false
+	}
+	return chatter, true
+}
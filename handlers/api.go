@@ -0,0 +1,382 @@
+package handlers
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-star/common/dal"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// apiMaxBodyBytes caps JSON request bodies
+	apiMaxBodyBytes = 64 << 10
+	// apiPageSize and apiMaxPageSize bound the messages returned per page of history
+	apiPageSize    = 50
+	apiMaxPageSize = 200
+)
+
+// API error codes, sent in the code field of every error body
+const (
+	APIErrUnauthorized     = "unauthorized"
+	APIErrForbidden        = "forbidden"
+	APIErrNotFound         = "not_found"
+	APIErrMethodNotAllowed = "method_not_allowed"
+	APIErrInvalidRequest   = "invalid_request"
+	APIErrRateLimited      = "rate_limited"
+	APIErrRejected         = "rejected"
+	APIErrInternal         = "internal"
+)
+
+// APIError describes why an API request failed
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// APIErrorBody is the body of every failed API response
+type APIErrorBody struct {
+	Error APIError `json:"error"`
+}
+
+// RoomList is the body of GET /api/v1/rooms
+type RoomList struct {
+	Rooms []dal.Room `json:"rooms"`
+}
+
+// MessagePage is one page of a room's history, newest first. NextBefore is
+// passed as ?before= to get the next, older, page and is 0 on the last page.
+type MessagePage struct {
+	Messages   []dal.MessageWithChatter `json:"messages"`
+	NextBefore int64                    `json:"nextBefore,omitempty"`
+}
+
+// CreateRoomRequest is the body of POST /api/v1/rooms
+type CreateRoomRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// PostMessageRequest is the body of POST /api/v1/rooms/{id}/messages
+type PostMessageRequest struct {
+	Content string `json:"content"`
+}
+
+// CommandResult answers POST /api/v1/rooms/{id}/messages when the content was
+// a slash command, which is run rather than posted
+type CommandResult struct {
+	Command string `json:"command"`
+	Reply   string `json:"reply,omitempty"`
+}
+
+// openAPISpec documents the API, TestOpenAPISpec checks real responses against it
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+type apiChatterKey struct{}
+
+// APIAuth authenticates API requests by their bearer token and puts the
+// token's chatter in the request context
+func (h *Handlers) APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || strings.TrimSpace(token) == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			writeAPIError(w, http.StatusUnauthorized, APIErrUnauthorized, "Send an API token in an Authorization: Bearer header.")
+			return
+		}
+
+		chatter, err := dal.GetChatterByAPIToken(h.db, strings.TrimSpace(token), time.Now())
+		if err != nil {
+			h.logger.Warn("rejected API token", "method", r.Method, "uri", r.URL.RequestURI())
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+			writeAPIError(w, http.StatusUnauthorized, APIErrUnauthorized, "The API token is not valid.")
+			return
+		}
+		banned, err := dal.IsBanned(h.db, chatter.ID)
+		if err != nil {
+			h.apiServerError(w, r, fmt.Errorf("failed to check ban: %w", err))
+			return
+		}
+		if banned {
+			writeAPIError(w, http.StatusForbidden, APIErrForbidden, "You have been banned from this server.")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiChatterKey{}, *chatter)))
+	})
+}
+
+// apiChatter returns the chatter APIAuth authenticated
+func apiChatter(r *http.Request) dal.Chatter {
+	chatter, _ := r.Context().Value(apiChatterKey{}).(dal.Chatter)
+	return chatter
+}
+
+// APINotFound and APIMethodNotAllowed keep unknown API routes answering in JSON
+func (h *Handlers) APINotFound() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, APIErrNotFound, "No such API endpoint.")
+	}
+}
+
+func (h *Handlers) APIMethodNotAllowed() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusMethodNotAllowed, APIErrMethodNotAllowed, fmt.Sprintf("%s is not supported here.", r.Method))
+	}
+}
+
+// OpenAPISpec serves the API's OpenAPI 3 document, which needs no token
+func (h *Handlers) OpenAPISpec() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(openAPISpec); err != nil {
+			log.Printf("failed to write OpenAPI document: %v", err)
+		}
+	}
+}
+
+func (h *Handlers) APIMe() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chatter := apiChatter(r)
+		chatter.Username = ""
+		writeJSON(w, http.StatusOK, chatter)
+	}
+}
+
+func (h *Handlers) APIListRooms() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rooms, err := dal.ListRooms(h.db)
+		if err != nil {
+			h.apiServerError(w, r, fmt.Errorf("failed to list rooms: %w", err))
+			return
+		}
+		if rooms == nil {
+			rooms = []dal.Room{}
+		}
+
+		writeJSON(w, http.StatusOK, RoomList{Rooms: rooms})
+	}
+}
+
+func (h *Handlers) APICreateRoom() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chatter := apiChatter(r)
+		if chatter.Role != dal.RoleAdmin {
+			writeAPIError(w, http.StatusForbidden, APIErrForbidden, "Only admins can create rooms.")
+			return
+		}
+
+		var req CreateRoomRequest
+		if !readAPIRequest(w, r, &req) {
+			return
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" {
+			writeAPIError(w, http.StatusBadRequest, APIErrInvalidRequest, "Rooms need a name.")
+			return
+		}
+
+		var room *dal.Room
+		_, err := dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			var err error
+			room, err = dal.InsertRoom(tx, name, strings.TrimSpace(req.Description))
+			if err != nil {
+				return dal.AuditEntry{}, err
+			}
+			return dal.AuditEntry{
+				ActorID:    chatter.ID,
+				Action:     dal.AuditRoomCreate,
+				TargetType: dal.TargetRoom,
+				TargetID:   room.ID,
+				Reason:     "created through the API",
+			}, nil
+		})
+		if err != nil {
+			h.apiServerError(w, r, fmt.Errorf("failed to create room: %w", err))
+			return
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("/api/v1/rooms/%d", room.ID))
+		writeJSON(w, http.StatusCreated, room)
+	}
+}
+
+func (h *Handlers) APIGetRoom() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, ok := h.apiRoom(w, r)
+		if !ok {
+			return
+		}
+
+		writeJSON(w, http.StatusOK, room)
+	}
+}
+
+func (h *Handlers) APIListMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, ok := h.apiRoom(w, r)
+		if !ok {
+			return
+		}
+
+		before, err := queryInt(r, "before", 0)
+		if err != nil || before < 0 {
+			writeAPIError(w, http.StatusBadRequest, APIErrInvalidRequest, "before must be a message ID.")
+			return
+		}
+		limit, err := queryInt(r, "limit", apiPageSize)
+		if err != nil || limit < 1 || limit > apiMaxPageSize {
+			writeAPIError(w, http.StatusBadRequest, APIErrInvalidRequest, fmt.Sprintf("limit must be between 1 and %d.", apiMaxPageSize))
+			return
+		}
+
+		messages, err := dal.ListMessagesPage(h.db, room.ID, before, int(limit))
+		if err != nil {
+			h.apiServerError(w, r, fmt.Errorf("failed to list messages: %w", err))
+			return
+		}
+
+		page := MessagePage{Messages: []dal.MessageWithChatter{}}
+		for _, msg := range messages {
+			page.Messages = append(page.Messages, publicMessage(msg))
+		}
+		if len(messages) == int(limit) {
+			page.NextBefore = messages[len(messages)-1].ID
+		}
+
+		writeJSON(w, http.StatusOK, page)
+	}
+}
+
+func (h *Handlers) APIPostMessage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, ok := h.apiRoom(w, r)
+		if !ok {
+			return
+		}
+		chatter := apiChatter(r)
+
+		var req PostMessageRequest
+		if !readAPIRequest(w, r, &req) {
+			return
+		}
+
+		result, err := h.send(r.Context(), chatter, *room, req.Content)
+		var refused *refusal
+		if errors.As(err, &refused) {
+			if refused.wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(refused.wait.Seconds()))))
+			}
+			writeAPIError(w, refused.status, refused.code, refused.reason)
+			return
+		}
+		if err != nil {
+			h.apiServerError(w, r, err)
+			return
+		}
+		if result.message == nil {
+			writeJSON(w, http.StatusOK, CommandResult{Command: result.command, Reply: result.reply})
+			return
+		}
+
+		stored := result.message
+		writeJSON(w, http.StatusCreated, dal.MessageWithChatter{
+			ID:          stored.ID,
+			UserID:      stored.UserID,
+			RoomID:      stored.RoomID,
+			Content:     stored.Content,
+			Timestamp:   stored.Timestamp,
+			ChatterName: chatter.Name,
+		})
+	}
+}
+
+func (h *Handlers) APIGetChatter() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chatterID, err := strconv.ParseInt(chi.URLParam(r, "chatterId"), 10, 64)
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, APIErrNotFound, "No such chatter.")
+			return
+		}
+		chatter, err := dal.GetChatter(h.db, chatterID)
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, APIErrNotFound, "No such chatter.")
+			return
+		}
+
+		chatter.Username = ""
+		writeJSON(w, http.StatusOK, chatter)
+	}
+}
+
+// apiRoom returns the room in the URL, or writes a 404 if there isn't one
+func (h *Handlers) apiRoom(w http.ResponseWriter, r *http.Request) (*dal.Room, bool) {
+	roomID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, APIErrNotFound, "No such room.")
+		return nil, false
+	}
+	room, err := dal.GetRoom(h.db, roomID)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, APIErrNotFound, "No such room.")
+		return nil, false
+	}
+	return room, true
+}
+
+// publicMessage drops the poster's username, which for people is their session cookie
+func publicMessage(msg dal.MessageWithChatter) dal.MessageWithChatter {
+	msg.Username = ""
+	return msg
+}
+
+func (h *Handlers) apiServerError(w http.ResponseWriter, r *http.Request, err error) {
+	h.logger.Error(err.Error(), "method", r.Method, "uri", r.URL.RequestURI())
+	writeAPIError(w, http.StatusInternalServerError, APIErrInternal, http.StatusText(http.StatusInternalServerError))
+}
+
+// readAPIRequest decodes a JSON request body into v, writing a 400 if it can't
+func readAPIRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBodyBytes)).Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, APIErrInvalidRequest, "The request body is too large.")
+			return false
+		}
+		writeAPIError(w, http.StatusBadRequest, APIErrInvalidRequest, "The request body must be a JSON object.")
+		return false
+	}
+	return true
+}
+
+func queryInt(r *http.Request, name string, fallback int64) (int64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, APIErrorBody{Error: APIError{Code: code, Message: message}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("failed to write API response: %v", err)
+	}
+}
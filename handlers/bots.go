@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-star/common"
+	"go-star/common/dal"
+	"go-star/handlers/components"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+func (h *Handlers) InstallBot() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, chatter, err := h.getRoomAndChatter(w, r)
+		if err != nil {
+			h.serverError(w, r, err)
+			return
+		}
+		if !chatter.IsModerator() {
+			h.forbidden(w, r)
+			return
+		}
+
+		signals := &components.RoomSettingsSignals{}
+		if err := datastar.ReadSignals(r, signals); err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to read settings signals: %w", err))
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		name := strings.TrimSpace(signals.BotName)
+		username := strings.TrimSpace(signals.BotUsername)
+		if !h.bots.Has(signals.BotKind) {
+			patchSettingsStatus(sse, "Choose a kind of bot to install.", true)
+			return
+		}
+		if name == "" || username == "" {
+			patchSettingsStatus(sse, "Bots need a name and a username.", true)
+			return
+		}
+		if taken, err := h.usernameTakenByChatter(username); err != nil {
+			h.logger.Error("failed to check bot username", "username", username, "error", err)
+			patchSettingsStatus(sse, "Failed to install bot.", true)
+			return
+		} else if taken {
+			patchSettingsStatus(sse, fmt.Sprintf("The username '%s' belongs to a chatter.", username), true)
+			return
+		}
+
+		settings := map[string]any{}
+		if signals.BotHearsBots {
+			settings["listenToBots"] = true
+		}
+		if prompt := strings.TrimSpace(signals.BotPrompt); prompt != "" {
+			settings["systemPrompt"] = prompt
+		}
+		config, err := json.Marshal(settings)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to encode bot config: %w", err))
+			return
+		}
+
+		_, err = dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			if _, err := dal.InstallBot(tx, room.ID, signals.BotKind, name, username, string(config)); err != nil {
+				return dal.AuditEntry{}, err
+			}
+			return dal.AuditEntry{
+				ActorID:    chatter.ID,
+				Action:     dal.AuditRoomBot,
+				TargetType: dal.TargetRoom,
+				TargetID:   room.ID,
+				Reason:     fmt.Sprintf("installed %s bot '%s'", signals.BotKind, username),
+			}, nil
+		})
+		if err != nil {
+			patchSettingsStatus(sse, fmt.Sprintf("Failed to install bot: %v", err), true)
+			return
+		}
+
+		h.botsChanged()
+		h.patchRoomBots(sse, room.ID)
+		patchSettingsStatus(sse, "Bot installed.", false)
+	}
+}
+
+func (h *Handlers) UninstallBot() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, chatter, err := h.getRoomAndChatter(w, r)
+		if err != nil {
+			h.serverError(w, r, err)
+			return
+		}
+		if !chatter.IsModerator() {
+			h.forbidden(w, r)
+			return
+		}
+
+		botID, err := strconv.ParseInt(chi.URLParam(r, "botId"), 10, 64)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to parse bot ID: %w", err))
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		_, err = dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			return dal.AuditEntry{
+				ActorID:    chatter.ID,
+				Action:     dal.AuditRoomBot,
+				TargetType: dal.TargetRoom,
+				TargetID:   room.ID,
+				Reason:     fmt.Sprintf("uninstalled bot %d", botID),
+			}, dal.UninstallBot(tx, botID, room.ID)
+		})
+		if err != nil {
+			patchSettingsStatus(sse, fmt.Sprintf("Failed to uninstall bot: %v", err), true)
+			return
+		}
+
+		h.botsChanged()
+		h.patchRoomBots(sse, room.ID)
+		patchSettingsStatus(sse, "Bot uninstalled.", false)
+	}
+}
+
+// usernameTakenByChatter reports whether a person already chats under the
+// username, bots may share a username across rooms
+func (h *Handlers) usernameTakenByChatter(username string) (bool, error) {
+	if existing, _ := dal.GetChatterByUsername(h.db, username); existing == nil {
+		return false, nil
+	}
+	installations, err := dal.ListBotInstallations(h.db)
+	if err != nil {
+		return false, err
+	}
+	for _, installation := range installations {
+		if installation.Username == username {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// botsChanged tells the bot runner to reload its installations
+func (h *Handlers) botsChanged() {
+	if err := h.nc.Publish(common.BotsChangedSubject, nil); err != nil {
+		log.Printf("failed to publish bots changed: %v", err)
+	}
+}
+
+func (h *Handlers) patchRoomBots(sse *datastar.ServerSentEventGenerator, roomID int64) {
+	installations, err := dal.ListRoomBots(h.db, roomID)
+	if err != nil {
+		log.Printf("Failed to list room bots: %v", err)
+		return
+	}
+	if err := sse.PatchElementTempl(components.RoomBots(roomID, installations)); err != nil {
+		log.Printf("Failed to send room bots to client: %v", err)
+	}
+}
@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-star/common"
+	"go-star/common/commands"
+	"go-star/common/dal"
+	"go-star/common/moderation"
+	"go-star/common/scheduler"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxNameLength caps the names chatters pick with /nick
+	maxNameLength = 50
+	// maxTopicLength caps room topics set with /topic
+	maxTopicLength = 200
+	// defaultMuteMinutes is how long /mute lasts without a duration
+	defaultMuteMinutes = 10
+	// maxReminders caps how many reminders a chatter can have in one room
+	maxReminders = 20
+	// maxReminderLength caps the text of a reminder
+	maxReminderLength = 500
+)
+
+// builtinCommands returns the slash commands every room has
+func (h *Handlers) builtinCommands() *commands.Registry {
+	r := commands.NewRegistry()
+	r.Register(commands.Command{
+		Name: "me", Usage: "/me <action>", Help: "Describes something you're doing",
+		MinArgs: 1, Run: h.meCommand,
+	})
+	r.Register(commands.Command{
+		Name: "nick", Usage: "/nick <name>", Help: "Changes the name you're shown as",
+		MinArgs: 1, Run: h.nickCommand,
+	})
+	r.Register(commands.Command{
+		Name: "topic", Usage: "/topic <text>", Help: "Changes the room's topic",
+		MinArgs: 1, Moderator: true, Run: h.topicCommand,
+	})
+	r.Register(commands.Command{
+		Name: "invite", Usage: "/invite <name or #id>", Help: "Invites a chatter to this room",
+		MinArgs: 1, Run: h.inviteCommand,
+	})
+	r.Register(commands.Command{
+		Name: "mute", Usage: `/mute <name or #id> [minutes] [reason]`, Help: `Mutes a chatter in this room, quote names with spaces like "User No. 3"`,
+		MinArgs: 1, Moderator: true, Run: h.muteCommand,
+	})
+	r.Register(commands.Command{
+		Name: "remind", Usage: "/remind in <duration>|at <HH:MM>|every <schedule> <text>, /remind list, /remind cancel <id>",
+		Help: "Reminds you of something in this room, once or on a cron schedule", MinArgs: 1, Run: h.remindCommand,
+	})
+	r.Register(commands.Command{
+		Name: "help", Usage: "/help", Help: "Lists the commands you can use here",
+		Run: h.helpCommand,
+	})
+	return r
+}
+
+// runCommand dispatches a slash command, sending its reply to the caller's
+// streams as a notice. Bans, mutes and rate limits are checked by send first.
+func (h *Handlers) runCommand(ctx context.Context, chatter dal.Chatter, room dal.Room, invocation commands.Invocation) (string, error) {
+	call := commands.Call{Invocation: invocation, Chatter: chatter, Room: room}
+	reply, err := h.slashCommands.Dispatch(ctx, call)
+	if errors.Is(err, commands.ErrUnknownCommand) {
+		reply, err = h.botCommand(call)
+	}
+
+	var usage *commands.UsageError
+	switch {
+	case errors.Is(err, commands.ErrUnknownCommand):
+		return "", &refusal{status: http.StatusBadRequest, code: APIErrInvalidRequest, reason: fmt.Sprintf("Unknown command /%s, try /help.", invocation.Name)}
+	case errors.Is(err, commands.ErrNotPermitted):
+		return "", &refusal{status: http.StatusForbidden, code: APIErrForbidden, reason: fmt.Sprintf("Only moderators can use /%s.", invocation.Name)}
+	case errors.As(err, &usage):
+		return "", &refusal{status: http.StatusBadRequest, code: APIErrInvalidRequest, reason: "Usage: " + usage.Usage}
+	case err != nil:
+		return "", fmt.Errorf("failed to run /%s: %w", invocation.Name, err)
+	}
+
+	h.logger.Info("command run", "command", invocation.Name, "chatterId", chatter.ID, "roomId", room.ID)
+	if reply != "" {
+		h.notify(chatter.ID, common.NoticeEvent{RoomID: room.ID, Text: reply})
+	}
+	return reply, nil
+}
+
+// botCommand hands a command to the room's bots if one of them answers it
+func (h *Handlers) botCommand(call commands.Call) (string, error) {
+	installations, err := dal.ListRoomBots(h.db, call.Room.ID)
+	if err != nil {
+		return "", err
+	}
+
+	for _, cmd := range h.bots.Commands(installations) {
+		if cmd.Name != call.Name {
+			continue
+		}
+		return "", common.PublishCommandEvent(h.nc, common.CommandEvent{
+			RoomID:    call.Room.ID,
+			ChatterID: call.Chatter.ID,
+			Name:      call.Name,
+			Args:      call.Args,
+		})
+	}
+
+	return "", fmt.Errorf("/%s: %w", call.Name, commands.ErrUnknownCommand)
+}
+
+func (h *Handlers) meCommand(ctx context.Context, call commands.Call) (string, error) {
+	_, err := h.postMessage(ctx, call.Chatter, call.Room, fmt.Sprintf("* %s %s", call.Chatter.Name, call.Text))
+	if errors.Is(err, moderation.ErrRejected) {
+		return "Your message was blocked by this room's filters.", nil
+	}
+	return "", err
+}
+
+func (h *Handlers) nickCommand(ctx context.Context, call commands.Call) (string, error) {
+	name := strings.TrimSpace(call.Text)
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return fmt.Sprintf("Names can be at most %d characters.", maxNameLength), nil
+	}
+	// Names show next to messages in every room, so they get every room's filters
+	rooms, err := dal.ListRooms(h.db)
+	if err != nil {
+		return "", err
+	}
+	for _, room := range rooms {
+		decision, err := h.moderator.Moderate(ctx, moderation.Message{
+			ChatterID: call.Chatter.ID,
+			RoomID:    room.ID,
+			Content:   name,
+		})
+		if err != nil {
+			return "", err
+		}
+		switch decision.Action {
+		case moderation.Reject, moderation.Flag:
+			h.logger.Info("name rejected", "chatterId", call.Chatter.ID, "roomId", room.ID, "reason", decision.Reason)
+			return fmt.Sprintf("That name was blocked by the filters in %s.", room.Name), nil
+		case moderation.Rewrite:
+			name = decision.Content
+		}
+	}
+	if err := dal.SetChatterName(h.db, call.Chatter.ID, name); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("You are now known as %s.", name), nil
+}
+
+func (h *Handlers) topicCommand(ctx context.Context, call commands.Call) (string, error) {
+	topic := strings.TrimSpace(call.Text)
+	if len(topic) > maxTopicLength {
+		return fmt.Sprintf("Topics can be at most %d characters.", maxTopicLength), nil
+	}
+
+	_, err := dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+		return dal.AuditEntry{
+			ActorID:    call.Chatter.ID,
+			Action:     dal.AuditRoomTopic,
+			TargetType: dal.TargetRoom,
+			TargetID:   call.Room.ID,
+			Reason:     topic,
+		}, dal.SetRoomDescription(tx, call.Room.ID, topic)
+	})
+	if err != nil {
+		return "", err
+	}
+	return "Topic changed, it shows for everyone the next time they open the room.", nil
+}
+
+// findChatter resolves a command's target from "#<id>" or the name they are
+// shown as. Usernames are session cookies, so they are never looked up or
+// shown. When no single chatter matches, it returns a reply saying why.
+func (h *Handlers) findChatter(arg string) (*dal.Chatter, string, error) {
+	if id, ok := strings.CutPrefix(arg, "#"); ok {
+		chatterID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, fmt.Sprintf("'%s' is not a chatter ID.", arg), nil
+		}
+		target, err := dal.GetChatter(h.db, chatterID)
+		if err != nil {
+			return nil, fmt.Sprintf("There is no chatter #%d.", chatterID), nil
+		}
+		return target, "", nil
+	}
+
+	matches, err := dal.ListChattersByName(h.db, arg)
+	if err != nil {
+		return nil, "", err
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Sprintf("No one is called %s.", arg), nil
+	case 1:
+		return &matches[0], "", nil
+	}
+	ids := make([]string, len(matches))
+	for i, m := range matches {
+		ids[i] = fmt.Sprintf("#%d", m.ID)
+	}
+	return nil, fmt.Sprintf("Several chatters are called %s, use one of %s instead.", arg, strings.Join(ids, ", ")), nil
+}
+
+func (h *Handlers) inviteCommand(ctx context.Context, call commands.Call) (string, error) {
+	target, reply, err := h.findChatter(strings.Join(call.Args, " "))
+	if target == nil {
+		return reply, err
+	}
+	if target.ID == call.Chatter.ID {
+		return "You're already here!", nil
+	}
+	if target.System {
+		return fmt.Sprintf("%s can't be invited.", target.Name), nil
+	}
+
+	h.notify(target.ID, common.NoticeEvent{
+		Text: fmt.Sprintf("%s invited you to %s.", call.Chatter.Name, call.Room.Name),
+		Link: fmt.Sprintf("/room/%d", call.Room.ID),
+	})
+	return fmt.Sprintf("Invited %s to %s.", target.Name, call.Room.Name), nil
+}
+
+func (h *Handlers) muteCommand(ctx context.Context, call commands.Call) (string, error) {
+	target, reply, err := h.findChatter(call.Args[0])
+	if target == nil {
+		return reply, err
+	}
+	if !canModerate(call.Chatter, *target) {
+		return fmt.Sprintf("You can't mute %s.", target.Name), nil
+	}
+
+	minutes, reason := defaultMuteMinutes, call.Args[1:]
+	if len(call.Args) > 1 {
+		if n, err := strconv.Atoi(call.Args[1]); err == nil {
+			minutes, reason = n, call.Args[2:]
+		}
+	}
+	if minutes <= 0 || minutes > maxMuteMinutes {
+		return fmt.Sprintf("Mutes must be between 1 and %d minutes.", maxMuteMinutes), nil
+	}
+
+	if err := h.muteChatter(call.Chatter, *target, call.Room.ID, minutes, strings.Join(reason, " ")); err != nil {
+		return "", err
+	}
+	err = common.PublishModerationEvent(h.nc, common.ModerationEvent{
+		Action:    common.ModerationMute,
+		ChatterID: target.ID,
+		RoomID:    call.Room.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Muted %s for %d minutes.", target.Name, minutes), nil
+}
+
+func (h *Handlers) remindCommand(ctx context.Context, call commands.Call) (string, error) {
+	switch call.Args[0] {
+	case "list":
+		return h.listReminders(call)
+	case "cancel":
+		if len(call.Args) < 2 {
+			return "", &commands.UsageError{Usage: "/remind cancel <id>"}
+		}
+		id, err := strconv.ParseInt(call.Args[1], 10, 64)
+		if err != nil {
+			return fmt.Sprintf("'%s' is not a reminder ID, see /remind list.", call.Args[1]), nil
+		}
+		err = dal.CancelScheduledMessage(h.db, id, call.Chatter.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Sprintf("You have no reminder %d.", id), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Cancelled reminder %d.", id), nil
+	}
+
+	reminder, err := scheduler.ParseReminder(call.Args, time.Now())
+	if errors.Is(err, scheduler.ErrBadReminder) {
+		return err.Error() + ".", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(reminder.Text) > maxReminderLength {
+		return fmt.Sprintf("Reminders can be at most %d characters.", maxReminderLength), nil
+	}
+
+	existing, err := dal.ListChatterScheduledMessages(h.db, call.Chatter.ID, call.Room.ID)
+	if err != nil {
+		return "", err
+	}
+	if len(existing) >= maxReminders {
+		return fmt.Sprintf("You can have at most %d reminders in a room, cancel one first.", maxReminders), nil
+	}
+
+	scheduled, err := dal.InsertScheduledMessage(h.db, call.Room.ID, call.Chatter.ID, reminder.Text, reminder.RunAt, reminder.Recurrence)
+	if err != nil {
+		return "", err
+	}
+	if reminder.Recurrence != "" {
+		return fmt.Sprintf("Reminder %d set for %s, first at %s.", scheduled.ID, reminder.Recurrence, reminder.RunAt.Format(time.DateTime)), nil
+	}
+	return fmt.Sprintf("Reminder %d set for %s.", scheduled.ID, reminder.RunAt.Format(time.DateTime)), nil
+}
+
+func (h *Handlers) listReminders(call commands.Call) (string, error) {
+	reminders, err := dal.ListChatterScheduledMessages(h.db, call.Chatter.ID, call.Room.ID)
+	if err != nil {
+		return "", err
+	}
+	if len(reminders) == 0 {
+		return "You have no reminders in this room.", nil
+	}
+
+	lines := []string{"Your reminders:"}
+	for _, r := range reminders {
+		line := fmt.Sprintf("%d. %s - %s", r.ID, r.RunAt.Local().Format(time.DateTime), r.Content)
+		if r.Recurrence != "" {
+			line += fmt.Sprintf(" (every %s)", r.Recurrence)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (h *Handlers) helpCommand(ctx context.Context, call commands.Call) (string, error) {
+	var lines []string
+	for _, cmd := range h.slashCommands.Commands() {
+		if cmd.Moderator && !call.Chatter.IsModerator() {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s - %s", cmd.Usage, cmd.Help))
+	}
+
+	installations, err := dal.ListRoomBots(h.db, call.Room.ID)
+	if err != nil {
+		return "", err
+	}
+	for _, cmd := range h.bots.Commands(installations) {
+		lines = append(lines, fmt.Sprintf("%s - %s (bot)", cmd.Usage, cmd.Help))
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// checkPost returns why the chatter can't post in the room, or how long they
+// have to wait before they can
+func (h *Handlers) checkPost(chatter dal.Chatter, room dal.Room) (string, time.Duration, error) {
+	reason, err := h.checkCanPost(chatter, room)
+	if err != nil || reason != "" {
+		return reason, 0, err
+	}
+	wait, err := h.checkRateLimits(chatter, room)
+	return "", wait, err
+}
+
+// notify sends a notice to one chatter's open streams
+func (h *Handlers) notify(chatterID int64, notice common.NoticeEvent) {
+	if err := common.PublishNotice(h.nc, chatterID, notice); err != nil {
+		log.Printf("failed to publish notice: %v", err)
+	}
+}
@@ -0,0 +1,432 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-star/common"
+	"go-star/common/dal"
+	"go-star/handlers/components"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+const (
+	// maxMuteMinutes caps a single mute at one week
+	maxMuteMinutes = 7 * 24 * 60
+	// kickCooldown is how long a kicked chatter is muted in the room
+	kickCooldown = 5 * time.Minute
+)
+
+// ModerationSignals are the page signals sent with moderator actions
+type ModerationSignals struct {
+	Reason string `json:"modReason"`
+}
+
+func (h *Handlers) RemoveMessage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		moderator, signals, ok := h.requireModerator(w, r)
+		if !ok {
+			return
+		}
+
+		messageID, err := strconv.ParseInt(chi.URLParam(r, "messageId"), 10, 64)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to parse message ID: %w", err))
+			return
+		}
+
+		message, err := dal.GetMessage(h.db, messageID)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to get message: %w", err))
+			return
+		}
+
+		_, err = dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			return dal.AuditEntry{
+				ActorID:    moderator.ID,
+				Action:     dal.AuditMessageRemove,
+				TargetType: dal.TargetMessage,
+				TargetID:   message.ID,
+				Reason:     signals.Reason,
+			}, dal.RemoveMessage(tx, message.ID)
+		})
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to remove message: %w", err))
+			return
+		}
+
+		h.logger.Info("message removed", "messageId", message.ID, "by", moderator.ID)
+		h.publishModeration(w, r, common.ModerationEvent{
+			Action:    common.ModerationRemove,
+			RoomID:    message.RoomID,
+			MessageID: message.ID,
+			ChatterID: message.UserID,
+		})
+	}
+}
+
+func (h *Handlers) MuteChatter() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		moderator, signals, ok := h.requireModerator(w, r)
+		if !ok {
+			return
+		}
+
+		target, ok := h.moderationTarget(w, r, *moderator)
+		if !ok {
+			return
+		}
+
+		room, ok := h.moderationRoom(w, r)
+		if !ok {
+			return
+		}
+		roomID := room.ID
+
+		minutes, err := strconv.Atoi(r.URL.Query().Get("minutes"))
+		if err != nil || minutes <= 0 || minutes > maxMuteMinutes {
+			http.Error(w, fmt.Sprintf("minutes must be between 1 and %d", maxMuteMinutes), http.StatusBadRequest)
+			return
+		}
+
+		if err := h.muteChatter(*moderator, *target, roomID, minutes, signals.Reason); err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to mute chatter: %w", err))
+			return
+		}
+
+		h.publishModeration(w, r, common.ModerationEvent{
+			Action:    common.ModerationMute,
+			ChatterID: target.ID,
+			RoomID:    roomID,
+		})
+	}
+}
+
+func (h *Handlers) KickChatter() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		moderator, signals, ok := h.requireModerator(w, r)
+		if !ok {
+			return
+		}
+
+		target, ok := h.moderationTarget(w, r, *moderator)
+		if !ok {
+			return
+		}
+
+		room, ok := h.moderationRoom(w, r)
+		if !ok {
+			return
+		}
+		roomID := room.ID
+
+		// Kicks close the chatter's stream, and a short mute stops them
+		// coming straight back to post. A longer mute already in place stays.
+		until := time.Now().Add(kickCooldown)
+		mutedUntil, muted, err := dal.MutedUntil(h.db, target.ID, roomID)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to check mutes: %w", err))
+			return
+		}
+		_, err = dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			entry := dal.AuditEntry{
+				ActorID:    moderator.ID,
+				Action:     dal.AuditChatterKick,
+				TargetType: dal.TargetChatter,
+				TargetID:   target.ID,
+				Reason:     fmt.Sprintf("room %d: %s", roomID, signals.Reason),
+			}
+			if muted && mutedUntil.After(until) {
+				return entry, nil
+			}
+			_, err := dal.MuteChatter(tx, target.ID, roomID, moderator.ID, until, "Kicked: "+signals.Reason)
+			return entry, err
+		})
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to record kick: %w", err))
+			return
+		}
+
+		h.logger.Info("chatter kicked", "chatterId", target.ID, "roomId", roomID, "by", moderator.ID)
+		h.publishModeration(w, r, common.ModerationEvent{
+			Action:    common.ModerationKick,
+			ChatterID: target.ID,
+			RoomID:    roomID,
+		})
+	}
+}
+
+func (h *Handlers) BanChatter() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		moderator, signals, ok := h.requireModerator(w, r)
+		if !ok {
+			return
+		}
+
+		target, ok := h.moderationTarget(w, r, *moderator)
+		if !ok {
+			return
+		}
+
+		_, err := dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			_, err := dal.BanChatter(tx, target.ID, moderator.ID, signals.Reason)
+			return dal.AuditEntry{
+				ActorID:    moderator.ID,
+				Action:     dal.AuditChatterBan,
+				TargetType: dal.TargetChatter,
+				TargetID:   target.ID,
+				Reason:     signals.Reason,
+			}, err
+		})
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to ban chatter: %w", err))
+			return
+		}
+
+		h.logger.Info("chatter banned", "chatterId", target.ID, "by", moderator.ID)
+		h.publishModeration(w, r, common.ModerationEvent{
+			Action:    common.ModerationBan,
+			ChatterID: target.ID,
+		})
+	}
+}
+
+// requireModerator returns the current chatter and the moderation signals,
+// or responds 403 and returns false if the chatter is not a moderator
+func (h *Handlers) requireModerator(w http.ResponseWriter, r *http.Request) (*dal.Chatter, *ModerationSignals, bool) {
+	chatter, err := h.getChatter(w, r)
+	if err != nil {
+		return nil, nil, false
+	}
+	if !chatter.IsModerator() {
+		h.forbidden(w, r)
+		return nil, nil, false
+	}
+
+	signals := &ModerationSignals{}
+	if err := datastar.ReadSignals(r, signals); err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to read moderation signals: %w", err))
+		return nil, nil, false
+	}
+
+	return chatter, signals, true
+}
+
+// moderationTarget loads the chatter from the {chatterId} URL parameter,
+// responding 404 if there is no such chatter. Moderators can't act on
+// themselves, and only admins can act on other moderators.
+func (h *Handlers) moderationTarget(w http.ResponseWriter, r *http.Request, moderator dal.Chatter) (*dal.Chatter, bool) {
+	chatterID, err := strconv.ParseInt(chi.URLParam(r, "chatterId"), 10, 64)
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to parse chatter ID: %w", err))
+		return nil, false
+	}
+
+	target, err := dal.GetChatter(h.db, chatterID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to get chatter: %w", err))
+		return nil, false
+	}
+
+	if !canModerate(moderator, *target) {
+		h.forbidden(w, r)
+		return nil, false
+	}
+
+	return target, true
+}
+
+// moderationRoom loads the room from the {roomId} URL parameter, responding
+// 404 if there is no such room
+func (h *Handlers) moderationRoom(w http.ResponseWriter, r *http.Request) (*dal.Room, bool) {
+	roomID, err := strconv.ParseInt(chi.URLParam(r, "roomId"), 10, 64)
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to parse room ID: %w", err))
+		return nil, false
+	}
+
+	room, err := dal.GetRoom(h.db, roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to get room: %w", err))
+		return nil, false
+	}
+
+	return room, true
+}
+
+// canModerate reports whether the moderator may act on the target
+func canModerate(moderator, target dal.Chatter) bool {
+	return target.ID != moderator.ID && (!target.IsModerator() || moderator.Role == dal.RoleAdmin)
+}
+
+// muteChatter mutes the target in the room and records it in the audit log
+func (h *Handlers) muteChatter(moderator, target dal.Chatter, roomID int64, minutes int, reason string) error {
+	until := time.Now().Add(time.Duration(minutes) * time.Minute)
+	_, err := dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+		_, err := dal.MuteChatter(tx, target.ID, roomID, moderator.ID, until, reason)
+		return dal.AuditEntry{
+			ActorID:    moderator.ID,
+			Action:     dal.AuditChatterMute,
+			TargetType: dal.TargetChatter,
+			TargetID:   target.ID,
+			Reason:     fmt.Sprintf("%d minutes in room %d: %s", minutes, roomID, reason),
+		}, err
+	})
+	if err != nil {
+		return err
+	}
+
+	h.logger.Info("chatter muted", "chatterId", target.ID, "roomId", roomID, "minutes", minutes, "by", moderator.ID)
+	return nil
+}
+
+func (h *Handlers) publishModeration(w http.ResponseWriter, r *http.Request, event common.ModerationEvent) {
+	if err := common.PublishModerationEvent(h.nc, event); err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to publish moderation event: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handlers) FlaggedQueuePage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := h.requireModerator(w, r); !ok {
+			return
+		}
+
+		flagged, err := dal.ListFlaggedMessages(h.db, dal.FlagPending)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to list flagged messages: %w", err))
+			return
+		}
+
+		templ.Handler(components.FlaggedQueuePage(flagged)).ServeHTTP(w, r)
+	}
+}
+
+// ReviewFlaggedMessage approves or removes a flagged message, depending on {decision}
+func (h *Handlers) ReviewFlaggedMessage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		moderator, signals, ok := h.requireModerator(w, r)
+		if !ok {
+			return
+		}
+
+		flagID, err := strconv.ParseInt(chi.URLParam(r, "flagId"), 10, 64)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to parse flag ID: %w", err))
+			return
+		}
+
+		flagged, err := dal.GetFlaggedMessage(h.db, flagID)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to get flagged message: %w", err))
+			return
+		}
+		// A second moderator's decision mustn't undo the first one's
+		if flagged.Status != dal.FlagPending {
+			http.Error(w, "This message has already been reviewed.", http.StatusConflict)
+			return
+		}
+
+		status := chi.URLParam(r, "decision")
+		_, err = dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			entry := dal.AuditEntry{
+				ActorID:    moderator.ID,
+				Action:     dal.AuditMessageReview,
+				TargetType: dal.TargetMessage,
+				TargetID:   flagged.MessageID,
+				Reason:     strings.TrimSpace(status + ": " + signals.Reason),
+			}
+			if status == dal.FlagRemoved {
+				entry.Action = dal.AuditMessageRemove
+				if err := dal.RemoveMessage(tx, flagged.MessageID); err != nil {
+					return entry, err
+				}
+			} else if err := dal.RestoreMessage(tx, flagged.MessageID); err != nil {
+				return entry, err
+			}
+			if err := dal.ResolveReports(tx, flagged.MessageID); err != nil {
+				return entry, err
+			}
+			return entry, dal.ReviewFlaggedMessage(tx, flagged.ID, moderator.ID, status)
+		})
+		// Another moderator got there between the check above and the update
+		if errors.Is(err, dal.ErrAlreadyReviewed) {
+			http.Error(w, "This message has already been reviewed.", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to review flagged message: %w", err))
+			return
+		}
+
+		event := common.ModerationEvent{Action: common.ModerationRestore, RoomID: flagged.RoomID, MessageID: flagged.MessageID}
+		if status == dal.FlagRemoved {
+			event.Action = common.ModerationRemove
+		}
+		if err := common.PublishModerationEvent(h.nc, event); err != nil {
+			h.logger.Error("failed to publish moderation event", "error", err)
+		}
+
+		pending, err := dal.ListFlaggedMessages(h.db, dal.FlagPending)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to list flagged messages: %w", err))
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		if err := sse.PatchElementTempl(components.FlaggedMessages(pending)); err != nil {
+			h.logger.Error("failed to send flagged messages to client", "error", err)
+		}
+	}
+}
+
+// RelayBotRemovals announces the bot replies the bot runner removed, which it
+// isn't allowed to do itself. Only removed messages from bots installed in
+// their room are announced, so the bots' NATS user can't hide anything else.
+// Every instance joins one queue group so each removal is announced once.
+func (h *Handlers) RelayBotRemovals(nc *nats.Conn) (*nats.Subscription, error) {
+	return nc.QueueSubscribe(common.BotRemovalsSubject, "web", func(msg *nats.Msg) {
+		var removal common.BotRemovalEvent
+		if err := json.Unmarshal(msg.Data, &removal); err != nil {
+			h.logger.Error("invalid bot removal event", "error", err)
+			return
+		}
+		message, err := dal.GetRemovedBotMessage(h.db, removal.MessageID)
+		if err != nil {
+			h.logger.Warn("ignoring bot removal", "messageId", removal.MessageID, "error", err)
+			return
+		}
+
+		event := common.ModerationEvent{Action: common.ModerationRemove, ChatterID: message.UserID, RoomID: message.RoomID, MessageID: message.ID}
+		if err := common.PublishModerationEvent(nc, event); err != nil {
+			h.logger.Error("failed to publish moderation event", "error", err)
+		}
+	})
+}
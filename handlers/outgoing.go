@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"fmt"
+	"go-star/common/dal"
+	"go-star/common/webhooks"
+	"go-star/handlers/components"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/a-h/templ"
+	"github.com/go-chi/chi/v5"
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// deliveryLogLimit is how many deliveries and dead letters the log page shows
+const deliveryLogLimit = 100
+
+func (h *Handlers) OutgoingWebhooksPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := h.requireAdmin(w, r); !ok {
+			return
+		}
+
+		hooks, err := dal.ListOutgoingWebhooks(h.db)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to list outgoing webhooks: %w", err))
+			return
+		}
+		rooms, err := dal.ListRooms(h.db)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to list rooms: %w", err))
+			return
+		}
+
+		templ.Handler(components.OutgoingWebhooksPage(hooks, rooms, webhooks.EventTypes)).ServeHTTP(w, r)
+	}
+}
+
+func (h *Handlers) CreateOutgoingWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := h.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+
+		signals := &components.OutgoingWebhookSignals{}
+		if err := datastar.ReadSignals(r, signals); err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to read webhook signals: %w", err))
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		target, err := url.Parse(strings.TrimSpace(signals.WebhookURL))
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			patchOutgoingStatus(sse, "Webhooks need an http or https URL.", true)
+			return
+		}
+		if signals.WebhookEvent != "" && !slices.Contains(webhooks.EventTypes, signals.WebhookEvent) {
+			patchOutgoingStatus(sse, fmt.Sprintf("Unknown event type '%s'.", signals.WebhookEvent), true)
+			return
+		}
+		roomID, err := strconv.ParseInt(signals.WebhookRoom, 10, 64)
+		if err != nil && signals.WebhookRoom != "" {
+			patchOutgoingStatus(sse, "Choose a room.", true)
+			return
+		}
+
+		secret, err := randomHex(32)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to generate webhook secret: %w", err))
+			return
+		}
+
+		_, err = dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			hook, err := dal.InsertOutgoingWebhook(tx, roomID, signals.WebhookEvent, target.String(), secret, admin.ID)
+			if err != nil {
+				return dal.AuditEntry{}, err
+			}
+			return dal.AuditEntry{
+				ActorID:    admin.ID,
+				Action:     dal.AuditWebhook,
+				TargetType: dal.TargetWebhook,
+				TargetID:   hook.ID,
+				Reason:     "created for " + target.Redacted(),
+			}, nil
+		})
+		if err != nil {
+			patchOutgoingStatus(sse, fmt.Sprintf("Failed to create webhook: %v", err), true)
+			return
+		}
+
+		h.patchOutgoingWebhooks(sse)
+		patchOutgoingStatus(sse, fmt.Sprintf("Webhook created. Copy its signing secret now, it won't be shown again: %s", secret), false)
+	}
+}
+
+func (h *Handlers) DeleteOutgoingWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := h.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+
+		hookID, err := strconv.ParseInt(chi.URLParam(r, "hookId"), 10, 64)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to parse webhook ID: %w", err))
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		_, err = dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			return dal.AuditEntry{
+				ActorID:    admin.ID,
+				Action:     dal.AuditWebhook,
+				TargetType: dal.TargetWebhook,
+				TargetID:   hookID,
+				Reason:     "deleted",
+			}, dal.DeleteOutgoingWebhook(tx, hookID)
+		})
+		if err != nil {
+			patchOutgoingStatus(sse, fmt.Sprintf("Failed to delete webhook: %v", err), true)
+			return
+		}
+
+		h.patchOutgoingWebhooks(sse)
+		patchOutgoingStatus(sse, "Webhook deleted.", false)
+	}
+}
+
+func (h *Handlers) WebhookDeliveriesPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := h.requireAdmin(w, r); !ok {
+			return
+		}
+
+		hookID, err := strconv.ParseInt(chi.URLParam(r, "hookId"), 10, 64)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to parse webhook ID: %w", err))
+			return
+		}
+		hook, err := dal.GetOutgoingWebhook(h.db, hookID)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		deliveries, err := dal.ListWebhookDeliveries(h.db, hook.ID, deliveryLogLimit)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to list webhook deliveries: %w", err))
+			return
+		}
+		letters, err := dal.ListWebhookDeadLetters(h.db, hook.ID, deliveryLogLimit)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to list webhook dead letters: %w", err))
+			return
+		}
+
+		templ.Handler(components.WebhookDeliveriesPage(*hook, deliveries, letters)).ServeHTTP(w, r)
+	}
+}
+
+func (h *Handlers) patchOutgoingWebhooks(sse *datastar.ServerSentEventGenerator) {
+	hooks, err := dal.ListOutgoingWebhooks(h.db)
+	if err != nil {
+		log.Printf("Failed to list outgoing webhooks: %v", err)
+		return
+	}
+	if err := sse.PatchElementTempl(components.OutgoingWebhooks(hooks)); err != nil {
+		log.Printf("Failed to send outgoing webhooks to client: %v", err)
+	}
+}
+
+func patchOutgoingStatus(sse *datastar.ServerSentEventGenerator, message string, isError bool) {
+	if err := sse.PatchElementTempl(components.OutgoingWebhookStatus(message, isError)); err != nil {
+		log.Printf("Failed to send webhook status to client: %v", err)
+	}
+}
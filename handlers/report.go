@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-star/common"
+	"go-star/common/dal"
+	"go-star/handlers/components"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// ReportSignals are the page signals sent with a message report
+type ReportSignals struct {
+	Category string `json:"reportCategory"`
+	Details  string `json:"reportDetails"`
+}
+
+// maxReportDetails caps the free text of a report
+const maxReportDetails = 1000
+
+func (h *Handlers) ReportMessage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chatter, err := h.getChatter(w, r)
+		if err != nil {
+			return
+		}
+
+		messageID, err := strconv.ParseInt(chi.URLParam(r, "messageId"), 10, 64)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to parse message ID: %w", err))
+			return
+		}
+
+		message, err := dal.GetMessage(h.db, messageID)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to get message: %w", err))
+			return
+		}
+
+		signals := &ReportSignals{}
+		if err := datastar.ReadSignals(r, signals); err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to read report signals: %w", err))
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		if message.UserID == chatter.ID {
+			patchReportStatus(sse, "You can't report your own messages.")
+			return
+		}
+		if !h.allowReport(chatter.ID, r) {
+			patchReportStatus(sse, "You're sending reports too quickly, please try again later.")
+			return
+		}
+		signals.Details = common.Truncate(signals.Details, maxReportDetails)
+
+		report, created, hidden, err := dal.ReportMessage(h.db, message.ID, chatter.ID, signals.Category, signals.Details, h.reportHideThreshold, h.reportMinChatterAge)
+		if err != nil {
+			h.logger.Error("failed to report message", "messageId", message.ID, "error", err)
+			patchReportStatus(sse, "Sorry, your report could not be saved.")
+			return
+		}
+		if !created {
+			patchReportStatus(sse, "You have already reported this message.")
+			return
+		}
+
+		count, err := dal.CountPendingReports(h.db, message.ID)
+		if err != nil {
+			h.logger.Error("failed to count reports", "messageId", message.ID, "error", err)
+		}
+
+		err = common.PublishReportEvent(h.nc, common.ReportEvent{
+			ReportID:  report.ID,
+			MessageID: message.ID,
+			RoomID:    message.RoomID,
+			Category:  report.Category,
+			Reports:   count,
+			Hidden:    hidden,
+		})
+		if err != nil {
+			h.logger.Error("failed to publish report event", "error", err)
+		}
+
+		if hidden {
+			h.logger.Info("message hidden after reports", "messageId", message.ID, "reports", count)
+			event := common.ModerationEvent{Action: common.ModerationHide, RoomID: message.RoomID, MessageID: message.ID}
+			if err := common.PublishModerationEvent(h.nc, event); err != nil {
+				h.logger.Error("failed to publish moderation event", "error", err)
+			}
+		}
+
+		patchReportStatus(sse, "Thanks, the moderators have been notified.")
+	}
+}
+
+func patchReportStatus(sse *datastar.ServerSentEventGenerator, message string) {
+	if err := sse.PatchElementTempl(components.ReportStatus(message)); err != nil {
+		log.Printf("Failed to send report status to client: %v", err)
+	}
+}
+
+// allowReport takes a token from both the chatter's and the IP address's
+// report buckets, so clearing the session cookie doesn't get around the limit
+func (h *Handlers) allowReport(chatterID int64, r *http.Request) bool {
+	chatterKey := strconv.FormatInt(chatterID, 10)
+	if ok, _ := h.reportLimiter.Allow(chatterKey); !ok {
+		return false
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if ok, _ := h.reportIPLimiter.Allow(ip); !ok {
+		h.reportLimiter.Refund(chatterKey)
+		return false
+	}
+	return true
+}
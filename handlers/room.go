@@ -1,15 +1,24 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go-star/common"
+	"go-star/common/bots"
+	"go-star/common/commands"
 	"go-star/common/dal"
+	"go-star/common/moderation"
 	"go-star/handlers/components"
 	"log"
 	"log/slog"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/a-h/templ"
 	"github.com/go-chi/chi/v5"
@@ -18,24 +27,54 @@ import (
 )
 
 type Handlers struct {
-	logger *slog.Logger
-	db     *sql.DB
-	nc     *nats.Conn
+	logger         *slog.Logger
+	db             *sql.DB
+	nc             *nats.Conn
+	chatterLimiter *common.RateLimiter
+	roomLimiter    *common.RateLimiter
+	hookLimiter    *common.RateLimiter
+	// reportLimiter and reportIPLimiter limit reports by chatter and by IP address
+	reportLimiter   *common.RateLimiter
+	reportIPLimiter *common.RateLimiter
+	moderator       moderation.Moderator
+	bots            *bots.Registry
+	slashCommands   *commands.Registry
+	// reportHideThreshold is how many reports hide a message, 0 never hides
+	reportHideThreshold int
+	// reportMinChatterAge is how long ago a reporter must have first posted to count toward it
+	reportMinChatterAge time.Duration
+	wsConfig            common.WebSocketConfig
+	streamConfig        common.StreamConfig
+	streams             *streamRegistry
 }
 
 type ChatItem struct {
 	Message  string `json:"message"`
 	Username string `json:"username"`
+	RoomId   int64  `json:"roomId"`
 }
 
-var subject = "chat-messages"
+func NewHandlers(logger *slog.Logger, db *sql.DB, nc *nats.Conn, registry *bots.Registry, cfg common.Config) *Handlers {
+	h := &Handlers{
+		logger:          logger,
+		db:              db,
+		nc:              nc,
+		chatterLimiter:  common.NewRateLimiter(cfg.RateLimits.ChatterBurst, cfg.RateLimits.ChatterInterval),
+		roomLimiter:     common.NewRateLimiter(cfg.RateLimits.RoomBurst, cfg.RateLimits.RoomInterval),
+		hookLimiter:     common.NewRateLimiter(cfg.RateLimits.HookBurst, cfg.RateLimits.HookInterval),
+		reportLimiter:   common.NewRateLimiter(cfg.RateLimits.ReportBurst, cfg.RateLimits.ReportInterval),
+		reportIPLimiter: common.NewRateLimiter(cfg.RateLimits.ReportBurst, cfg.RateLimits.ReportInterval),
+		moderator:       moderation.Default(db),
+		bots:            registry,
 
-func NewHandlers(logger *slog.Logger, db *sql.DB, nc *nats.Conn) *Handlers {
-	return &Handlers{
-		logger: logger,
-		db:     db,
-		nc:     nc,
+		reportHideThreshold: cfg.ReportHideThreshold,
+		reportMinChatterAge: cfg.ReportMinChatterAge,
+		wsConfig:            cfg.WebSocket,
+		streamConfig:        cfg.Streams,
+		streams:             newStreamRegistry(),
 	}
+	h.slashCommands = h.builtinCommands()
+	return h
 }
 func (app *Handlers) serverError(w http.ResponseWriter, r *http.Request, err error) {
 	var (
@@ -46,6 +85,39 @@ func (app *Handlers) serverError(w http.ResponseWriter, r *http.Request, err err
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
+func (app *Handlers) forbidden(w http.ResponseWriter, r *http.Request) {
+	app.logger.Warn("forbidden", "method", r.Method, "uri", r.URL.RequestURI())
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+// tooManyRequests rejects a throttled message with a Retry-After header
+// and an inline error patched into the room page
+func (app *Handlers) tooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	app.logger.Info("message throttled", "uri", r.URL.RequestURI(), "retryAfter", seconds)
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	app.rejectMessage(w, r, http.StatusTooManyRequests, throttledReply(wait.Seconds()))
+}
+
+// throttledReply tells a chatter how long to wait before posting again
+func throttledReply(seconds float64) string {
+	return fmt.Sprintf("You're sending messages too quickly, try again in %d seconds.", int(math.Ceil(seconds)))
+}
+
+// rejectMessage responds with the status and patches the reason under the message input
+func (app *Handlers) rejectMessage(w http.ResponseWriter, r *http.Request, status int, reason string) {
+	// NewSSE sets these too, but only headers written before the status count
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+
+	sse := datastar.NewSSE(w, r)
+	if err := sse.PatchElementTempl(components.MessageError(reason)); err != nil {
+		log.Printf("Failed to send message error to client: %v", err)
+	}
+}
+
 func (h *Handlers) ListRooms() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		roomList, err := dal.ListRooms(h.db)
@@ -75,7 +147,6 @@ func (h *Handlers) RoomPage() http.HandlerFunc {
 
 		chatter, err := h.getChatter(w, r)
 		if err != nil {
-			h.serverError(w, r, err)
 			return
 		}
 
@@ -95,27 +166,41 @@ func (h *Handlers) ListMessages() http.HandlerFunc {
 			return
 		}
 
-		userID, err := common.GetUserID(w, r)
+		chatter, err := h.getChatter(w, r)
 		if err != nil {
-			h.serverError(w, r, fmt.Errorf("failed to get or generate user ID: %w", err))
 			return
 		}
 
-		log.Printf("Client connected to messages stream with userID: %s", userID)
-		sse := datastar.NewSSE(w, r)
-		patchMessages(h, sse, userID, roomSignals.RoomId)
-		// Create a channel to receive messages from NATS
-		messageChan := make(chan string, 10)
-		// Subscribe to NATS and forward messages to the channel
-		sub, err := h.nc.Subscribe(subject, func(msg *nats.Msg) {
-			log.Println("message received from NATS")
-			data := string(msg.Data)
-			select {
-			case messageChan <- data:
-			default:
-				// Channel is full, drop the message
-				log.Printf("Message channel full, dropping message: %s", data)
+		banned, err := dal.IsBanned(h.db, chatter.ID)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to check ban: %w", err))
+			return
+		}
+		if banned {
+			h.forbidden(w, r)
+			return
+		}
+
+		log.Printf("Chatter %d connected to messages stream", chatter.ID)
+		sse := datastar.NewSSE(newDeadlineWriter(w, h.streamConfig.WriteTimeout), r)
+		stats := h.streams.open("sse", chatter.ID, roomSignals.RoomId)
+		defer h.streams.close(stats)
+
+		// Every message is sent with its ID as the event ID, so a client
+		// reconnecting after a dropped stream tells us the last one it has
+		lastSent, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+		resuming := lastSent > 0
+
+		// New messages and edits are only redrawn from the database, so they
+		// can wait in the backlog for as long as the client takes to read
+		backlog := newStreamBacklog(stats)
+		sub, err := h.nc.Subscribe(common.RoomMessagesSubject(roomSignals.RoomId), func(msg *nats.Msg) {
+			var event common.MessageEvent
+			if err := json.Unmarshal(msg.Data, &event); err != nil {
+				log.Printf("Invalid message event: %v", err)
+				return
 			}
+			backlog.add(event.ID, time.Now())
 		})
 		if err != nil {
 			h.serverError(w, r, fmt.Errorf("failed to subscribe to messages: %w", err))
@@ -123,26 +208,188 @@ func (h *Handlers) ListMessages() http.HandlerFunc {
 		}
 		defer sub.Unsubscribe()
 
+		// Streaming bot replies are redrawn one message at a time as they grow
+		editSub, err := h.nc.Subscribe(common.RoomEditsSubject(roomSignals.RoomId), func(msg *nats.Msg) {
+			var edit common.MessageEditEvent
+			if err := json.Unmarshal(msg.Data, &edit); err != nil {
+				log.Printf("Invalid message edit event: %v", err)
+				return
+			}
+			backlog.add(edit.ID, time.Now())
+		})
+		if err != nil {
+			log.Printf("Failed to subscribe to message edits: %v", err)
+			return
+		}
+		defer editSub.Unsubscribe()
+
+		// Other events can't be read back later, so a client too far behind
+		// for them is disconnected to reconnect and redraw the room
+		overflowed := make(chan string, 1)
+		overflow := func(kind string) {
+			select {
+			case overflowed <- kind:
+			default:
+			}
+		}
+
+		// Moderation events can remove messages or end this stream
+		moderationChan := make(chan common.ModerationEvent, 10)
+		modSub, err := h.nc.Subscribe(common.ModerationSubject, func(msg *nats.Msg) {
+			var event common.ModerationEvent
+			if err := json.Unmarshal(msg.Data, &event); err != nil {
+				log.Printf("Invalid moderation event: %v", err)
+				return
+			}
+			select {
+			case moderationChan <- event:
+			default:
+				overflow("moderation")
+			}
+		})
+		if err != nil {
+			log.Printf("Failed to subscribe to moderation events: %v", err)
+			return
+		}
+		defer modSub.Unsubscribe()
+
+		// Moderators are told about new reports as they come in
+		reportChan := make(chan common.ReportEvent, 10)
+		if chatter.IsModerator() {
+			reportSub, err := h.nc.Subscribe(common.ReportsSubject, func(msg *nats.Msg) {
+				var report common.ReportEvent
+				if err := json.Unmarshal(msg.Data, &report); err != nil {
+					log.Printf("Invalid report event: %v", err)
+					return
+				}
+				select {
+				case reportChan <- report:
+				default:
+					overflow("report")
+				}
+			})
+			if err != nil {
+				log.Printf("Failed to subscribe to report events: %v", err)
+				return
+			}
+			defer reportSub.Unsubscribe()
+		}
+
+		// Command replies and invites are sent to this chatter alone
+		noticeChan := make(chan common.NoticeEvent, 10)
+		noticeSub, err := h.nc.Subscribe(common.ChatterNoticesSubject(chatter.ID), func(msg *nats.Msg) {
+			var notice common.NoticeEvent
+			if err := json.Unmarshal(msg.Data, &notice); err != nil {
+				log.Printf("Invalid notice event: %v", err)
+				return
+			}
+			select {
+			case noticeChan <- notice:
+			default:
+				overflow("notice")
+			}
+		})
+		if err != nil {
+			log.Printf("Failed to subscribe to notices: %v", err)
+			return
+		}
+		defer noticeSub.Unsubscribe()
+
+		// Only sent after subscribing, so nothing posted in between is missed
+		if resuming {
+			lastSent, err = catchUpMessages(h, sse, *chatter, roomSignals.RoomId, lastSent)
+		} else {
+			lastSent, err = patchMessages(h, sse, *chatter, roomSignals.RoomId)
+
+			// Reconnects aren't announced, or bots would greet the chatter again
+			join := common.JoinEvent{RoomID: roomSignals.RoomId, ChatterID: chatter.ID, Name: chatter.Name}
+			if err := common.PublishJoinEvent(h.nc, join); err != nil {
+				log.Printf("Failed to publish join event: %v", err)
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to send messages to client: %v", err)
+			return
+		}
+
 		for {
 			select {
 			case <-r.Context().Done():
 				log.Println("Client disconnected from messages stream")
 				return
-			case message := <-messageChan:
-				log.Printf("Sending message to client: %s", message)
-				if message == "" {
+			case kind := <-overflowed:
+				h.logger.Warn("disconnecting slow messages stream", "chatterId", chatter.ID, "roomId", roomSignals.RoomId, "events", kind)
+				return
+			case <-backlog.ready:
+				batch := backlog.take()
+				if batch.events == 0 {
 					continue
 				}
-				ctrl := patchMessages(h, sse, userID, roomSignals.RoomId)
-				switch ctrl {
-				case 1:
+				if lastSent, err = h.sendBacklog(sse, *chatter, roomSignals.RoomId, lastSent, batch); err != nil {
+					h.logger.Warn("disconnecting stuck messages stream", "chatterId", chatter.ID, "roomId", roomSignals.RoomId, "error", err)
+					return
+				}
+				stats.delivered(time.Now(), batch.since, batch.events)
+			case event := <-moderationChan:
+				if event.Affects(chatter.ID, roomSignals.RoomId) {
+					log.Printf("Closing messages stream for chatter %d after %s", chatter.ID, event.Action)
+					sse.PatchElementTempl(components.MessageError("You have been removed from this room by a moderator."))
+					return
+				}
+				if event.ChangesMessages() && event.RoomID == roomSignals.RoomId {
+					newest, err := patchMessages(h, sse, *chatter, roomSignals.RoomId)
+					if err != nil {
+						log.Printf("Failed to send messages to client: %v", err)
+						return
+					}
+					lastSent = max(lastSent, newest)
+				}
+			case report := <-reportChan:
+				if err := sse.PatchElementTempl(components.ModeratorNotice(report)); err != nil {
+					log.Printf("Failed to send report notice to client: %v", err)
+					return
+				}
+			case notice := <-noticeChan:
+				if notice.RoomID != 0 && notice.RoomID != roomSignals.RoomId {
 					continue
 				}
+				err := sse.PatchElementTempl(components.CommandNotice(notice), datastar.WithSelectorID("command-notices"), datastar.WithModeAppend())
+				if err != nil {
+					log.Printf("Failed to send notice to client: %v", err)
+					return
+				}
 			}
 		}
 	}
 }
 
+// sendBacklog brings a client up to date with the messages posted or changed
+// since the last patch: changed ones it already has are redrawn in place and
+// new ones go out together. It returns the newest message ID sent.
+func (h *Handlers) sendBacklog(sse *datastar.ServerSentEventGenerator, viewer dal.Chatter, roomId, lastSent int64, batch backlogBatch) (int64, error) {
+	if batch.overflowed {
+		newest, err := patchMessages(h, sse, viewer, roomId)
+		return max(lastSent, newest), err
+	}
+
+	newer := false
+	for _, id := range batch.ids {
+		if id > lastSent {
+			// Edits to messages not sent yet are picked up by the catch-up
+			newer = true
+			continue
+		}
+		// Edits and streamed bot replies finishing
+		if err := patchMessage(h, sse, viewer, roomId, id); err != nil {
+			return lastSent, err
+		}
+	}
+	if !newer {
+		return lastSent, nil
+	}
+	return catchUpMessages(h, sse, viewer, roomId, lastSent)
+}
+
 func (h *Handlers) SendMessage() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
@@ -154,42 +401,263 @@ func (h *Handlers) SendMessage() http.HandlerFunc {
 
 		chatter, err := h.getChatter(w, r)
 		if err != nil {
-			h.serverError(w, r, err)
 			return
 		}
-		
-		message.Username = chatter.Username
 
-		_, err = dal.InsertMessage(h.db, chatter.ID, 1, message.Message)
+		room, err := dal.GetRoom(h.db, message.RoomId)
 		if err != nil {
-			h.serverError(w, r, fmt.Errorf("failed to insert message: %w", err))
+			h.serverError(w, r, fmt.Errorf("failed to get room: %w", err))
 			return
 		}
 
-		formattedMessage := fmt.Sprintf("%s:%s", message.Username, message.Message)
-		err = h.nc.Publish(subject, []byte(formattedMessage))
+		_, err = h.send(r.Context(), *chatter, *room, message.Message)
+		var refused *refusal
+		if errors.As(err, &refused) {
+			if refused.wait > 0 {
+				h.tooManyRequests(w, r, refused.wait)
+			} else {
+				h.rejectMessage(w, r, refused.status, refused.reason)
+			}
+			return
+		}
 		if err != nil {
-			h.serverError(w, r, fmt.Errorf("failed to publish message: %w", err))
+			h.serverError(w, r, err)
 			return
 		}
-		w.WriteHeader(http.StatusNoContent)
+
+		// Clear any earlier throttle error
+		sse := datastar.NewSSE(w, r)
+		if err := sse.PatchElementTempl(components.MessageError("")); err != nil {
+			log.Printf("Failed to send message to client: %v", err)
+		}
+	}
+}
+
+// refusal is why send turned down what a chatter sent, in terms every
+// transport can report
+type refusal struct {
+	status int
+	code   string
+	reason string
+	// wait is how long a rate limited chatter has to wait
+	wait time.Duration
+}
+
+func (r *refusal) Error() string { return r.reason }
+
+// sent is what came of a chatter sending something to a room
+type sent struct {
+	// message is the stored message, nil when a command was run
+	message *dal.Message
+	// command is the name of the command run, and reply its answer
+	command string
+	reply   string
+}
+
+// send handles what a chatter sent to a room over any transport, so the page,
+// /ws, the JSON API and the NATS service all behave alike. Slash commands are
+// run and anything else is posted, both held to the room's bans, mutes and
+// rate limits. Command replies also go to the chatter's streams as a notice.
+// Anything the chatter is turned down for comes back as a *refusal.
+func (h *Handlers) send(ctx context.Context, chatter dal.Chatter, room dal.Room, content string) (sent, error) {
+	if strings.TrimSpace(content) == "" {
+		return sent{}, &refusal{status: http.StatusBadRequest, code: APIErrInvalidRequest, reason: "Messages need some content."}
+	}
+
+	reason, wait, err := h.checkPost(chatter, room)
+	if err != nil {
+		return sent{}, fmt.Errorf("failed to check bans, mutes and rate limits: %w", err)
+	}
+	if reason != "" {
+		return sent{}, &refusal{status: http.StatusForbidden, code: APIErrForbidden, reason: reason}
+	}
+	if wait > 0 {
+		return sent{}, &refusal{status: http.StatusTooManyRequests, code: APIErrRateLimited, reason: throttledReply(wait.Seconds()), wait: wait}
+	}
+
+	if invocation, ok := commands.Parse(content); ok {
+		reply, err := h.runCommand(ctx, chatter, room, invocation)
+		return sent{command: invocation.Name, reply: reply}, err
+	}
+
+	stored, err := h.postMessage(ctx, chatter, room, content)
+	if errors.Is(err, moderation.ErrRejected) {
+		return sent{}, &refusal{status: http.StatusUnprocessableEntity, code: APIErrRejected, reason: "Your message was blocked by this room's filters."}
+	}
+	return sent{message: stored}, err
+}
+
+// postMessage stores a chatter's message after moderation and publishes it to the room
+func (h *Handlers) postMessage(ctx context.Context, chatter dal.Chatter, room dal.Room, content string) (*dal.Message, error) {
+	slowMode := slowModeInterval(chatter, room)
+	stored, decision, err := moderation.Post(ctx, h.db, h.moderator, moderation.Message{
+		ChatterID: chatter.ID,
+		RoomID:    room.ID,
+		Content:   content,
+		SlowMode:  slowMode,
+	})
+	if errors.Is(err, moderation.ErrRejected) {
+		h.logger.Info("message rejected", "chatterId", chatter.ID, "roomId", room.ID, "reason", decision.Reason)
+		return nil, err
+	}
+	if errors.Is(err, dal.ErrSlowMode) {
+		// Another post from the chatter landed after checkRateLimits let this one through
+		return nil, &refusal{status: http.StatusTooManyRequests, code: APIErrRateLimited, reason: throttledReply(slowMode.Seconds()), wait: slowMode}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert message: %w", err)
+	}
+
+	err = common.PublishMessageEvent(h.nc, common.MessageEvent{
+		ID:        stored.ID,
+		RoomID:    room.ID,
+		ChatterID: chatter.ID,
+		Content:   stored.Content,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish message: %w", err)
+	}
+	return stored, nil
+}
+
+// checkCanPost returns why the chatter may not post in the room, or an empty string if they can
+func (h *Handlers) checkCanPost(chatter dal.Chatter, room dal.Room) (string, error) {
+	if room.Archived {
+		return "This room has been archived.", nil
+	}
+
+	banned, err := dal.IsBanned(h.db, chatter.ID)
+	if err != nil {
+		return "", err
+	}
+	if banned {
+		return "You have been banned from this server.", nil
+	}
+
+	until, muted, err := dal.MutedUntil(h.db, chatter.ID, room.ID)
+	if err != nil {
+		return "", err
+	}
+	if muted {
+		return fmt.Sprintf("You have been muted in this room until %s UTC.", until.UTC().Format("15:04 on 2 Jan")), nil
+	}
+
+	return "", nil
+}
+
+// checkRateLimits returns how long the chatter has to wait before posting
+// in the room, or zero if they can post now. Moderators are exempt from slow
+// mode. A token is only spent when both the chatter and the room have one.
+// Slow mode is checked again as the message is stored, for posts that race
+// past this check together.
+func (h *Handlers) checkRateLimits(chatter dal.Chatter, room dal.Room) (time.Duration, error) {
+	if slowMode := slowModeInterval(chatter, room); slowMode > 0 {
+		last, ok, err := dal.LastMessageTime(h.db, chatter.ID, room.ID)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			if wait := slowMode - time.Since(last); wait > 0 {
+				return wait, nil
+			}
+		}
+	}
+
+	chatterKey := strconv.FormatInt(chatter.ID, 10)
+	if ok, wait := h.chatterLimiter.Allow(chatterKey); !ok {
+		return wait, nil
+	}
+	if ok, wait := h.roomLimiter.Allow(strconv.FormatInt(room.ID, 10)); !ok {
+		// The message isn't sent, so the chatter shouldn't pay for it
+		h.chatterLimiter.Refund(chatterKey)
+		return wait, nil
+	}
+
+	return 0, nil
+}
+
+// slowModeInterval is how long the chatter has to wait between posts in the
+// room, zero when the room has no slow mode or the chatter is a moderator
+func slowModeInterval(chatter dal.Chatter, room dal.Room) time.Duration {
+	if chatter.IsModerator() {
+		return 0
 	}
+	return time.Duration(room.SlowModeSeconds) * time.Second
 }
 
-func patchMessages(h *Handlers, sse *datastar.ServerSentEventGenerator, username string, roomId int64) int {
+// maxCatchUp is the most messages sent in one catch-up patch, a longer gap
+// redraws the whole list
+const maxCatchUp = 200
+
+// The patch helpers log database errors and carry on, and only return an
+// error when the client couldn't be written to, which ends its stream.
+
+// patchMessages redraws a room's whole message list and returns the newest
+// message ID sent, or 0 if there was none
+func patchMessages(h *Handlers, sse *datastar.ServerSentEventGenerator, viewer dal.Chatter, roomId int64) (int64, error) {
 	allMessages, err := dal.ListMessagesForRoom(h.db, roomId)
 	if err != nil {
 		log.Printf("Failed to list messages: %v", err)
-		return 1
+		return 0, nil
+	}
+
+	var newest int64
+	for _, msg := range allMessages {
+		newest = max(newest, msg.ID)
+	}
+	var opts []datastar.PatchElementOption
+	if newest > 0 {
+		opts = append(opts, datastar.WithPatchElementsEventID(strconv.FormatInt(newest, 10)))
+	}
+	if err := sse.PatchElementTempl(components.Messages(allMessages, viewer), opts...); err != nil {
+		return 0, err
+	}
+	return newest, nil
+}
+
+// catchUpMessages prepends the room's messages newer than afterID in one
+// patch and returns the newest message ID sent
+func catchUpMessages(h *Handlers, sse *datastar.ServerSentEventGenerator, viewer dal.Chatter, roomId, afterID int64) (int64, error) {
+	missed, err := dal.ListMessagesAfter(h.db, roomId, afterID, maxCatchUp+1)
+	if err != nil {
+		log.Printf("Failed to list missed messages: %v", err)
+		return afterID, nil
 	}
-	err = sse.PatchElementTempl(components.Messages(allMessages, username))
+	if len(missed) > maxCatchUp {
+		newest, err := patchMessages(h, sse, viewer, roomId)
+		return max(afterID, newest), err
+	}
+	if len(missed) == 0 {
+		return afterID, nil
+	}
+
+	newest := missed[len(missed)-1].ID
+	err = sse.PatchElementTempl(components.NewMessages(missed, viewer),
+		datastar.WithSelectorID("messages"),
+		datastar.WithModePrepend(),
+		datastar.WithPatchElementsEventID(strconv.FormatInt(newest, 10)))
 	if err != nil {
-		log.Printf("Failed to send message to client: %v", err)
-		return 0
+		return afterID, err
+	}
+	return newest, nil
+}
+
+// patchMessage redraws one message of the room the client already has
+func patchMessage(h *Handlers, sse *datastar.ServerSentEventGenerator, viewer dal.Chatter, roomId, messageID int64) error {
+	message, err := dal.GetMessageWithChatter(h.db, messageID)
+	if err != nil {
+		log.Printf("Failed to get message %d: %v", messageID, err)
+		return nil
 	}
-	return 0
+	if message.RoomID != roomId {
+		// Events name their room, but anyone who can publish them could name another's message
+		return nil
+	}
+	return sse.PatchElementTempl(components.Message(*message, message.Username == viewer.Username, viewer.IsModerator()))
 }
 
+// getChatter returns the chatter for the request's session, starting one if
+// needed. When it fails it has already answered the request.
 func (app *Handlers) getChatter(w http.ResponseWriter, r *http.Request) (*dal.Chatter, error) {
 	userID, err := common.GetUserID(w, r)
 	if err != nil {
@@ -197,17 +665,37 @@ func (app *Handlers) getChatter(w http.ResponseWriter, r *http.Request) (*dal.Ch
 		return nil, err
 	}
 
+	chatter, err := app.sessionChatter(userID)
+	if errors.Is(err, errSystemChatter) {
+		app.forbidden(w, r)
+		return nil, err
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return nil, err
+	}
+	return chatter, nil
+}
+
+// errSystemChatter is returned for session cookies naming a system chatter
+var errSystemChatter = errors.New("cannot sign in as a system chatter")
+
+// sessionChatter returns the chatter for a session's user ID, creating them
+// on their first visit. System chatters' usernames are known, so a cookie
+// holding one is refused.
+func (app *Handlers) sessionChatter(userID string) (*dal.Chatter, error) {
 	chatter, _ := dal.GetChatterByUsername(app.db, userID)
+	if chatter != nil && chatter.System {
+		return nil, errSystemChatter
+	}
 	if chatter == nil {
 		totalChatters, err := dal.TotalChatters(app.db)
 		if err != nil {
-			app.serverError(w, r, fmt.Errorf("failed to get total chatters: %w", err))
-			return nil, err
+			return nil, fmt.Errorf("failed to get total chatters: %w", err)
 		}
 		chatter, err = dal.InsertChatter(app.db, userID, fmt.Sprintf("User No. %d", totalChatters+1))
 		if err != nil {
-			app.serverError(w, r, fmt.Errorf("failed to create new chatter: %w", err))
-			return nil, err
+			return nil, fmt.Errorf("failed to create new chatter: %w", err)
 		}
 	}
 	return chatter, nil
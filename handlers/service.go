@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-star/common/dal"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// The chat service answers NATS requests for internal services and bots
+// that would rather not go through HTTP. It is a NATS micro service, so
+// $SRV.PING, $SRV.INFO and $SRV.STATS describe it, and every instance joins
+// the same queue group so each request is answered once.
+//
+// Requests carry the same API token as the JSON API, in an Authorization:
+// Bearer header. Replies are the JSON API's bodies; failures set the
+// Nats-Service-Error-Code header to the HTTP status the API would have sent,
+// with an APIErrorBody as the data.
+const (
+	ServiceName    = "chat"
+	ServiceVersion = "1.0.0"
+
+	// ServiceRoomsList takes an empty body and answers with a RoomList
+	ServiceRoomsList = "chat.rooms.list"
+	// ServiceMessagesHistory takes a MessageHistoryRequest and answers with a MessagePage
+	ServiceMessagesHistory = "chat.messages.history"
+	// ServiceMessagesSend takes a SendMessageRequest and answers with the posted
+	// message, or a CommandResult when the content was a slash command
+	ServiceMessagesSend = "chat.messages.send"
+)
+
+// serviceTimeout bounds the work done for one request
+const serviceTimeout = 10 * time.Second
+
+// MessageHistoryRequest is the body of a chat.messages.history request.
+// Before and Limit work like GET /api/v1/rooms/{id}/messages' query.
+type MessageHistoryRequest struct {
+	RoomID int64 `json:"roomId"`
+	Before int64 `json:"before,omitempty"`
+	Limit  int   `json:"limit,omitempty"`
+}
+
+// SendMessageRequest is the body of a chat.messages.send request
+type SendMessageRequest struct {
+	RoomID  int64  `json:"roomId"`
+	Content string `json:"content"`
+}
+
+// AddService registers the chat service on nc. Stop the returned service
+// to stop answering.
+func (h *Handlers) AddService(nc *nats.Conn) (micro.Service, error) {
+	svc, err := micro.AddService(nc, micro.Config{
+		Name:        ServiceName,
+		Version:     ServiceVersion,
+		Description: "Rooms and messages over NATS",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add the chat service: %w", err)
+	}
+
+	endpoints := []struct {
+		name, subject string
+		handle        func(context.Context, micro.Request, dal.Chatter)
+	}{
+		{"rooms_list", ServiceRoomsList, h.serviceListRooms},
+		{"messages_history", ServiceMessagesHistory, h.serviceMessageHistory},
+		{"messages_send", ServiceMessagesSend, h.serviceSendMessage},
+	}
+	for _, e := range endpoints {
+		err := svc.AddEndpoint(e.name, h.serviceAuth(e.handle), micro.WithEndpointSubject(e.subject))
+		if err != nil {
+			svc.Stop()
+			return nil, fmt.Errorf("failed to add %s to the chat service: %w", e.subject, err)
+		}
+	}
+	return svc, nil
+}
+
+// serviceAuth authenticates a request by its bearer token, as APIAuth does
+func (h *Handlers) serviceAuth(handle func(context.Context, micro.Request, dal.Chatter)) micro.Handler {
+	return micro.HandlerFunc(func(req micro.Request) {
+		token, ok := strings.CutPrefix(req.Headers().Get("Authorization"), "Bearer ")
+		if !ok || strings.TrimSpace(token) == "" {
+			serviceError(req, http.StatusUnauthorized, APIErrUnauthorized, "Send an API token in an Authorization: Bearer header.")
+			return
+		}
+		chatter, err := dal.GetChatterByAPIToken(h.db, strings.TrimSpace(token), time.Now())
+		if err != nil {
+			h.logger.Warn("rejected API token", "subject", req.Subject())
+			serviceError(req, http.StatusUnauthorized, APIErrUnauthorized, "The API token is not valid.")
+			return
+		}
+		banned, err := dal.IsBanned(h.db, chatter.ID)
+		if err != nil {
+			h.serviceServerError(req, fmt.Errorf("failed to check ban: %w", err))
+			return
+		}
+		if banned {
+			serviceError(req, http.StatusForbidden, APIErrForbidden, "You have been banned from this server.")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), serviceTimeout)
+		defer cancel()
+		handle(ctx, req, *chatter)
+	})
+}
+
+func (h *Handlers) serviceListRooms(ctx context.Context, req micro.Request, chatter dal.Chatter) {
+	rooms, err := dal.ListRooms(h.db)
+	if err != nil {
+		h.serviceServerError(req, fmt.Errorf("failed to list rooms: %w", err))
+		return
+	}
+	if rooms == nil {
+		rooms = []dal.Room{}
+	}
+
+	serviceReply(req, RoomList{Rooms: rooms})
+}
+
+func (h *Handlers) serviceMessageHistory(ctx context.Context, req micro.Request, chatter dal.Chatter) {
+	var body MessageHistoryRequest
+	if !readServiceRequest(req, &body) {
+		return
+	}
+	room, err := dal.GetRoom(h.db, body.RoomID)
+	if err != nil {
+		serviceError(req, http.StatusNotFound, APIErrNotFound, "No such room.")
+		return
+	}
+	if body.Before < 0 {
+		serviceError(req, http.StatusBadRequest, APIErrInvalidRequest, "before must be a message ID.")
+		return
+	}
+	limit := body.Limit
+	if limit == 0 {
+		limit = apiPageSize
+	}
+	if limit < 1 || limit > apiMaxPageSize {
+		serviceError(req, http.StatusBadRequest, APIErrInvalidRequest, fmt.Sprintf("limit must be between 1 and %d.", apiMaxPageSize))
+		return
+	}
+
+	messages, err := dal.ListMessagesPage(h.db, room.ID, body.Before, limit)
+	if err != nil {
+		h.serviceServerError(req, fmt.Errorf("failed to list messages: %w", err))
+		return
+	}
+
+	page := MessagePage{Messages: []dal.MessageWithChatter{}}
+	for _, msg := range messages {
+		page.Messages = append(page.Messages, publicMessage(msg))
+	}
+	if len(messages) == limit {
+		page.NextBefore = messages[len(messages)-1].ID
+	}
+
+	serviceReply(req, page)
+}
+
+func (h *Handlers) serviceSendMessage(ctx context.Context, req micro.Request, chatter dal.Chatter) {
+	var body SendMessageRequest
+	if !readServiceRequest(req, &body) {
+		return
+	}
+	room, err := dal.GetRoom(h.db, body.RoomID)
+	if err != nil {
+		serviceError(req, http.StatusNotFound, APIErrNotFound, "No such room.")
+		return
+	}
+
+	result, err := h.send(ctx, chatter, *room, body.Content)
+	var refused *refusal
+	if errors.As(err, &refused) {
+		var opts []micro.RespondOpt
+		if refused.wait > 0 {
+			opts = append(opts, micro.WithHeaders(micro.Headers{"Retry-After": {strconv.Itoa(int(math.Ceil(refused.wait.Seconds())))}}))
+		}
+		serviceError(req, refused.status, refused.code, refused.reason, opts...)
+		return
+	}
+	if err != nil {
+		h.serviceServerError(req, err)
+		return
+	}
+	if result.message == nil {
+		serviceReply(req, CommandResult{Command: result.command, Reply: result.reply})
+		return
+	}
+
+	stored := result.message
+	serviceReply(req, dal.MessageWithChatter{
+		ID:          stored.ID,
+		UserID:      stored.UserID,
+		RoomID:      stored.RoomID,
+		Content:     stored.Content,
+		Timestamp:   stored.Timestamp,
+		ChatterName: chatter.Name,
+	})
+}
+
+func (h *Handlers) serviceServerError(req micro.Request, err error) {
+	h.logger.Error(err.Error(), "subject", req.Subject())
+	serviceError(req, http.StatusInternalServerError, APIErrInternal, http.StatusText(http.StatusInternalServerError))
+}
+
+// readServiceRequest decodes a JSON request body into v, answering with a 400 if it can't
+func readServiceRequest(req micro.Request, v any) bool {
+	if len(req.Data()) > apiMaxBodyBytes {
+		serviceError(req, http.StatusRequestEntityTooLarge, APIErrInvalidRequest, "The request body is too large.")
+		return false
+	}
+	if err := json.Unmarshal(req.Data(), v); err != nil {
+		serviceError(req, http.StatusBadRequest, APIErrInvalidRequest, "The request body must be a JSON object.")
+		return false
+	}
+	return true
+}
+
+func serviceError(req micro.Request, status int, code, message string, opts ...micro.RespondOpt) {
+	body, _ := json.Marshal(APIErrorBody{Error: APIError{Code: code, Message: message}})
+	if err := req.Error(strconv.Itoa(status), message, body, opts...); err != nil {
+		log.Printf("failed to answer %s: %v", req.Subject(), err)
+	}
+}
+
+func serviceReply(req micro.Request, body any) {
+	if err := req.RespondJSON(body); err != nil {
+		log.Printf("failed to answer %s: %v", req.Subject(), err)
+	}
+}
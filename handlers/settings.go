@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"fmt"
+	"go-star/common/dal"
+	"go-star/handlers/components"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/a-h/templ"
+	"github.com/go-chi/chi/v5"
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// maxSlowModeSeconds caps slow mode at one message per hour
+const maxSlowModeSeconds = 3600
+
+func (h *Handlers) RoomSettingsPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, chatter, err := h.getRoomAndChatter(w, r)
+		if err != nil {
+			h.serverError(w, r, err)
+			return
+		}
+		if !chatter.IsModerator() {
+			h.forbidden(w, r)
+			return
+		}
+
+		filters, err := dal.ListWordFilters(h.db, room.ID)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to list word filters: %w", err))
+			return
+		}
+
+		installations, err := dal.ListRoomBots(h.db, room.ID)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to list room bots: %w", err))
+			return
+		}
+
+		hooks, err := dal.ListIncomingWebhooks(h.db, room.ID)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to list incoming webhooks: %w", err))
+			return
+		}
+
+		templ.Handler(components.RoomSettingsPage(*room, filters, installations, h.bots.Kinds(), hooks, components.RoomSettingsSignals{
+			SlowModeSeconds: room.SlowModeSeconds,
+			FilterAction:    dal.FilterReject,
+		})).ServeHTTP(w, r)
+	}
+}
+
+func (h *Handlers) SetSlowMode() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, chatter, err := h.getRoomAndChatter(w, r)
+		if err != nil {
+			h.serverError(w, r, err)
+			return
+		}
+		if !chatter.IsModerator() {
+			h.forbidden(w, r)
+			return
+		}
+
+		signals := &components.RoomSettingsSignals{}
+		if err := datastar.ReadSignals(r, signals); err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to read settings signals: %w", err))
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		if signals.SlowModeSeconds < 0 || signals.SlowModeSeconds > maxSlowModeSeconds {
+			patchSettingsStatus(sse, fmt.Sprintf("Slow mode must be between 0 and %d seconds.", maxSlowModeSeconds), true)
+			return
+		}
+
+		_, err = dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			return dal.AuditEntry{
+				ActorID:    chatter.ID,
+				Action:     dal.AuditRoomSlowMode,
+				TargetType: dal.TargetRoom,
+				TargetID:   room.ID,
+				Reason:     fmt.Sprintf("%d seconds", signals.SlowModeSeconds),
+			}, dal.SetRoomSlowMode(tx, room.ID, signals.SlowModeSeconds)
+		})
+		if err != nil {
+			h.logger.Error("failed to set slow mode", "roomId", room.ID, "error", err)
+			patchSettingsStatus(sse, "Failed to save slow mode.", true)
+			return
+		}
+
+		h.logger.Info("slow mode changed", "roomId", room.ID, "seconds", signals.SlowModeSeconds, "by", chatter.ID)
+		patchSettingsStatus(sse, "Slow mode saved.", false)
+	}
+}
+
+func (h *Handlers) AddWordFilter() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, chatter, err := h.getRoomAndChatter(w, r)
+		if err != nil {
+			h.serverError(w, r, err)
+			return
+		}
+		if !chatter.IsModerator() {
+			h.forbidden(w, r)
+			return
+		}
+
+		signals := &components.RoomSettingsSignals{}
+		if err := datastar.ReadSignals(r, signals); err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to read settings signals: %w", err))
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		_, err = dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			filter, err := dal.InsertWordFilter(tx, room.ID, signals.FilterPattern, signals.FilterIsRegex, signals.FilterAction)
+			if err != nil {
+				return dal.AuditEntry{}, err
+			}
+			return dal.AuditEntry{
+				ActorID:    chatter.ID,
+				Action:     dal.AuditRoomFilter,
+				TargetType: dal.TargetRoom,
+				TargetID:   room.ID,
+				Reason:     fmt.Sprintf("added %s filter '%s'", filter.Action, filter.Pattern),
+			}, nil
+		})
+		if err != nil {
+			patchSettingsStatus(sse, fmt.Sprintf("Failed to add filter: %v", err), true)
+			return
+		}
+
+		h.patchWordFilters(sse, room.ID)
+		patchSettingsStatus(sse, "Filter added.", false)
+	}
+}
+
+func (h *Handlers) DeleteWordFilter() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, chatter, err := h.getRoomAndChatter(w, r)
+		if err != nil {
+			h.serverError(w, r, err)
+			return
+		}
+		if !chatter.IsModerator() {
+			h.forbidden(w, r)
+			return
+		}
+
+		filterID, err := strconv.ParseInt(chi.URLParam(r, "filterId"), 10, 64)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to parse filter ID: %w", err))
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		_, err = dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			return dal.AuditEntry{
+				ActorID:    chatter.ID,
+				Action:     dal.AuditRoomFilter,
+				TargetType: dal.TargetRoom,
+				TargetID:   room.ID,
+				Reason:     fmt.Sprintf("deleted filter %d", filterID),
+			}, dal.DeleteWordFilter(tx, filterID, room.ID)
+		})
+		if err != nil {
+			patchSettingsStatus(sse, fmt.Sprintf("Failed to delete filter: %v", err), true)
+			return
+		}
+
+		h.patchWordFilters(sse, room.ID)
+		patchSettingsStatus(sse, "Filter deleted.", false)
+	}
+}
+
+func (h *Handlers) patchWordFilters(sse *datastar.ServerSentEventGenerator, roomID int64) {
+	filters, err := dal.ListWordFilters(h.db, roomID)
+	if err != nil {
+		log.Printf("Failed to list word filters: %v", err)
+		return
+	}
+	if err := sse.PatchElementTempl(components.WordFilters(roomID, filters)); err != nil {
+		log.Printf("Failed to send word filters to client: %v", err)
+	}
+}
+
+func patchSettingsStatus(sse *datastar.ServerSentEventGenerator, message string, isError bool) {
+	if err := sse.PatchElementTempl(components.SettingsStatus(message, isError)); err != nil {
+		log.Printf("Failed to send settings status to client: %v", err)
+	}
+}
+
+// getRoomAndChatter loads the room from the {id} URL parameter and the current chatter
+func (h *Handlers) getRoomAndChatter(w http.ResponseWriter, r *http.Request) (*dal.Room, *dal.Chatter, error) {
+	roomId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse room ID: %w", err)
+	}
+
+	room, err := dal.GetRoom(h.db, roomId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get room: %w", err)
+	}
+
+	chatter, err := h.getChatter(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return room, chatter, nil
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Live connections never drop events silently when a client reads slowly.
+// Room streams coalesce the message events they haven't sent into one
+// catch-up patch read from the database, WebSockets queue up to their send
+// buffer, and a client whose writes block for longer than the configured
+// write timeout is disconnected so it can reconnect and resume.
+
+// StreamStats is one live connection's backlog, as listed at /admin/streams
+type StreamStats struct {
+	Transport   string    `json:"transport"`
+	ChatterID   int64     `json:"chatterId"`
+	RoomID      int64     `json:"roomId,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	// Pending is how many events are waiting to be written
+	Pending int64 `json:"pending"`
+	// Sent is how many events have been written
+	Sent int64 `json:"sent"`
+	// Coalesced is how many events were folded into another event's patch
+	Coalesced int64 `json:"coalesced"`
+	// LagMillis is how long the oldest waiting event has waited, or how late
+	// the last one was written if nothing is waiting
+	LagMillis    int64 `json:"lagMs"`
+	MaxLagMillis int64 `json:"maxLagMs"`
+}
+
+// StreamList is the body of /admin/streams
+type StreamList struct {
+	Connections []StreamStats `json:"connections"`
+}
+
+// connStats counts one connection's events. It is updated by the
+// connection's goroutines and read by /admin/streams.
+type connStats struct {
+	transport   string
+	chatterID   int64
+	roomID      int64
+	connectedAt time.Time
+
+	pending   atomic.Int64
+	sent      atomic.Int64
+	coalesced atomic.Int64
+	// waitingSince is when the oldest waiting event arrived, in Unix nanoseconds, 0 when none is
+	waitingSince atomic.Int64
+	lastLag      atomic.Int64
+	maxLag       atomic.Int64
+}
+
+// queued records an event waiting to be written
+func (s *connStats) queued(now time.Time) {
+	s.pending.Add(1)
+	s.waitingSince.CompareAndSwap(0, now.UnixNano())
+}
+
+// delivered records events written together, the oldest of which arrived at since
+func (s *connStats) delivered(now, since time.Time, events int64) {
+	if s.pending.Add(-events) <= 0 {
+		s.waitingSince.Store(0)
+	} else {
+		// Whatever is left arrived no earlier than now
+		s.waitingSince.Store(now.UnixNano())
+	}
+	s.sent.Add(events)
+	s.coalesced.Add(events - 1)
+
+	lag := int64(now.Sub(since))
+	s.lastLag.Store(lag)
+	for {
+		longest := s.maxLag.Load()
+		if lag <= longest || s.maxLag.CompareAndSwap(longest, lag) {
+			break
+		}
+	}
+}
+
+func (s *connStats) snapshot(now time.Time) StreamStats {
+	lag := s.lastLag.Load()
+	if since := s.waitingSince.Load(); since != 0 {
+		lag = max(lag, now.UnixNano()-since)
+	}
+	return StreamStats{
+		Transport:    s.transport,
+		ChatterID:    s.chatterID,
+		RoomID:       s.roomID,
+		ConnectedAt:  s.connectedAt,
+		Pending:      max(s.pending.Load(), 0),
+		Sent:         s.sent.Load(),
+		Coalesced:    s.coalesced.Load(),
+		LagMillis:    time.Duration(lag).Milliseconds(),
+		MaxLagMillis: time.Duration(max(s.maxLag.Load(), lag)).Milliseconds(),
+	}
+}
+
+// streamRegistry holds the stats of every live connection
+type streamRegistry struct {
+	mu    sync.Mutex
+	conns map[*connStats]struct{}
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{conns: make(map[*connStats]struct{})}
+}
+
+// open starts tracking a connection, which must be closed when it ends
+func (r *streamRegistry) open(transport string, chatterID, roomID int64) *connStats {
+	s := &connStats{transport: transport, chatterID: chatterID, roomID: roomID, connectedAt: time.Now().UTC()}
+	r.mu.Lock()
+	r.conns[s] = struct{}{}
+	r.mu.Unlock()
+	return s
+}
+
+func (r *streamRegistry) close(s *connStats) {
+	r.mu.Lock()
+	delete(r.conns, s)
+	r.mu.Unlock()
+}
+
+// list returns the live connections, longest connected first
+func (r *streamRegistry) list(now time.Time) []StreamStats {
+	r.mu.Lock()
+	stats := make([]StreamStats, 0, len(r.conns))
+	for s := range r.conns {
+		stats = append(stats, s.snapshot(now))
+	}
+	r.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ConnectedAt.Before(stats[j].ConnectedAt) })
+	return stats
+}
+
+// streamBacklog collects the message events a room stream hasn't sent yet.
+// They are only message IDs, so however many pile up while the client is
+// slow they go out as one catch-up patch read from the database.
+type streamBacklog struct {
+	stats *connStats
+
+	mu      sync.Mutex
+	pending backlogBatch
+	// ready has a value waiting whenever the backlog isn't empty
+	ready chan struct{}
+}
+
+// backlogBatch is the events taken from a backlog in one go
+type backlogBatch struct {
+	// ids are the messages posted or changed, in order
+	ids []int64
+	// overflowed is set when too many messages changed to patch one by one
+	overflowed bool
+	// events is how many events arrived, counting repeats of the same message
+	events int64
+	// since is when the oldest event arrived
+	since time.Time
+}
+
+func newStreamBacklog(stats *connStats) *streamBacklog {
+	return &streamBacklog{stats: stats, ready: make(chan struct{}, 1)}
+}
+
+// add records that a message was posted or changed. It never blocks, so it
+// is safe in a NATS callback.
+func (b *streamBacklog) add(messageID int64, now time.Time) {
+	b.mu.Lock()
+	batch := &b.pending
+	if batch.events == 0 {
+		batch.since = now
+	}
+	batch.events++
+	if !slices.Contains(batch.ids, messageID) {
+		if len(batch.ids) >= maxCatchUp {
+			batch.overflowed = true
+		} else {
+			batch.ids = append(batch.ids, messageID)
+		}
+	}
+	b.mu.Unlock()
+	b.stats.queued(now)
+
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take empties the backlog
+func (b *streamBacklog) take() backlogBatch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	batch := b.pending
+	b.pending = backlogBatch{}
+	slices.Sort(batch.ids)
+	return batch
+}
+
+// deadlineWriter bounds every write to a streaming response, so a client
+// that stops reading is disconnected instead of holding its stream open
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func newDeadlineWriter(w http.ResponseWriter, timeout time.Duration) deadlineWriter {
+	return deadlineWriter{ResponseWriter: w, rc: http.NewResponseController(w), timeout: timeout}
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	// Writers without deadlines, like test recorders, can't get stuck
+	w.rc.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer's Flush
+func (w deadlineWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// AdminStreams lists the live SSE and WebSocket connections and how far behind each is
+func (h *Handlers) AdminStreams() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := h.requireAdmin(w, r); !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, StreamList{Connections: h.streams.list(time.Now())})
+	}
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"fmt"
+	"go-star/common/dal"
+	"go-star/handlers/components"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/a-h/templ"
+	"github.com/go-chi/chi/v5"
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// maxAPITokens is how many API tokens a chatter can hold at once
+const maxAPITokens = 10
+
+func (h *Handlers) APITokensPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chatter, err := h.getChatter(w, r)
+		if err != nil {
+			return
+		}
+
+		tokens, err := dal.ListAPITokens(h.db, chatter.ID)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to list API tokens: %w", err))
+			return
+		}
+
+		templ.Handler(components.APITokensPage(*chatter, tokens)).ServeHTTP(w, r)
+	}
+}
+
+func (h *Handlers) CreateAPIToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chatter, err := h.getChatter(w, r)
+		if err != nil {
+			return
+		}
+
+		signals := &components.APITokenSignals{}
+		if err := datastar.ReadSignals(r, signals); err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to read token signals: %w", err))
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		name := strings.TrimSpace(signals.TokenName)
+		if name == "" {
+			patchAPITokenStatus(sse, "Give the token a name.", true)
+			return
+		}
+
+		tokens, err := dal.ListAPITokens(h.db, chatter.ID)
+		if err != nil {
+			h.logger.Error("failed to list API tokens", "error", err)
+			patchAPITokenStatus(sse, "Failed to create token.", true)
+			return
+		}
+		if len(tokens) >= maxAPITokens {
+			patchAPITokenStatus(sse, fmt.Sprintf("You can have at most %d tokens, revoke one first.", maxAPITokens), true)
+			return
+		}
+
+		token, err := randomHex(32)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to generate API token: %w", err))
+			return
+		}
+		if _, err := dal.InsertAPIToken(h.db, chatter.ID, name, token); err != nil {
+			patchAPITokenStatus(sse, fmt.Sprintf("Failed to create token: %v", err), true)
+			return
+		}
+
+		h.patchAPITokens(sse, chatter.ID)
+		patchAPITokenStatus(sse, fmt.Sprintf("Token created. Copy it now, it won't be shown again: %s", token), false)
+	}
+}
+
+func (h *Handlers) DeleteAPIToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chatter, err := h.getChatter(w, r)
+		if err != nil {
+			return
+		}
+
+		tokenID, err := strconv.ParseInt(chi.URLParam(r, "tokenId"), 10, 64)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to parse token ID: %w", err))
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		if err := dal.DeleteAPIToken(h.db, tokenID, chatter.ID); err != nil {
+			patchAPITokenStatus(sse, fmt.Sprintf("Failed to revoke token: %v", err), true)
+			return
+		}
+
+		h.patchAPITokens(sse, chatter.ID)
+		patchAPITokenStatus(sse, "Token revoked.", false)
+	}
+}
+
+func (h *Handlers) patchAPITokens(sse *datastar.ServerSentEventGenerator, chatterID int64) {
+	tokens, err := dal.ListAPITokens(h.db, chatterID)
+	if err != nil {
+		log.Printf("Failed to list API tokens: %v", err)
+		return
+	}
+	if err := sse.PatchElementTempl(components.APITokens(tokens)); err != nil {
+		log.Printf("Failed to send API tokens to client: %v", err)
+	}
+}
+
+func patchAPITokenStatus(sse *datastar.ServerSentEventGenerator, message string, isError bool) {
+	if err := sse.PatchElementTempl(components.APITokenStatus(message, isError)); err != nil {
+		log.Printf("Failed to send token status to client: %v", err)
+	}
+}
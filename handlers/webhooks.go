@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-star/common"
+	"go-star/common/dal"
+	"go-star/common/moderation"
+	"go-star/common/webhooks"
+	"go-star/handlers/components"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// maxHookNameLength caps the names of incoming webhooks, which are also their chatters' names
+const maxHookNameLength = 50
+
+func (h *Handlers) CreateIncomingWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, chatter, err := h.getRoomAndChatter(w, r)
+		if err != nil {
+			h.serverError(w, r, err)
+			return
+		}
+		if !chatter.IsModerator() {
+			h.forbidden(w, r)
+			return
+		}
+
+		signals := &components.RoomSettingsSignals{}
+		if err := datastar.ReadSignals(r, signals); err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to read settings signals: %w", err))
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		name := strings.TrimSpace(signals.HookName)
+		if name == "" || len(name) > maxHookNameLength {
+			patchSettingsStatus(sse, fmt.Sprintf("Webhooks need a name of at most %d characters.", maxHookNameLength), true)
+			return
+		}
+
+		token, err := randomHex(32)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to generate webhook token: %w", err))
+			return
+		}
+		// Each webhook posts as its own chatter, so moderators can mute or ban it
+		suffix, err := randomHex(4)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to generate webhook username: %w", err))
+			return
+		}
+		hookChatter, err := dal.InsertSystemChatter(h.db, "webhook-"+suffix, name)
+		if err != nil {
+			h.logger.Error("failed to create webhook chatter", "roomId", room.ID, "error", err)
+			patchSettingsStatus(sse, "Failed to create webhook.", true)
+			return
+		}
+
+		_, err = dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			if _, err := dal.InsertIncomingWebhook(tx, room.ID, hookChatter.ID, chatter.ID, name, token); err != nil {
+				return dal.AuditEntry{}, err
+			}
+			return dal.AuditEntry{
+				ActorID:    chatter.ID,
+				Action:     dal.AuditRoomWebhook,
+				TargetType: dal.TargetRoom,
+				TargetID:   room.ID,
+				Reason:     fmt.Sprintf("created incoming webhook '%s'", name),
+			}, nil
+		})
+		if err != nil {
+			patchSettingsStatus(sse, fmt.Sprintf("Failed to create webhook: %v", err), true)
+			return
+		}
+
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		h.patchIncomingWebhooks(sse, room.ID)
+		patchSettingsStatus(sse, fmt.Sprintf("Webhook created. Copy its URL now, it won't be shown again: %s://%s/hooks/%s", scheme, r.Host, token), false)
+	}
+}
+
+func (h *Handlers) DeleteIncomingWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, chatter, err := h.getRoomAndChatter(w, r)
+		if err != nil {
+			h.serverError(w, r, err)
+			return
+		}
+		if !chatter.IsModerator() {
+			h.forbidden(w, r)
+			return
+		}
+
+		hookID, err := strconv.ParseInt(chi.URLParam(r, "hookId"), 10, 64)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to parse webhook ID: %w", err))
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		_, err = dal.Audited(h.db, func(tx dal.DBTX) (dal.AuditEntry, error) {
+			return dal.AuditEntry{
+				ActorID:    chatter.ID,
+				Action:     dal.AuditRoomWebhook,
+				TargetType: dal.TargetRoom,
+				TargetID:   room.ID,
+				Reason:     fmt.Sprintf("deleted incoming webhook %d", hookID),
+			}, dal.DeleteIncomingWebhook(tx, hookID, room.ID)
+		})
+		if err != nil {
+			patchSettingsStatus(sse, fmt.Sprintf("Failed to delete webhook: %v", err), true)
+			return
+		}
+
+		h.patchIncomingWebhooks(sse, room.ID)
+		patchSettingsStatus(sse, "Webhook deleted.", false)
+	}
+}
+
+// IncomingWebhook posts a message from an external system into the webhook's
+// room. It is called by tools rather than browsers, so it answers in JSON.
+func (h *Handlers) IncomingWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hook, err := dal.GetIncomingWebhookByToken(h.db, chi.URLParam(r, "token"))
+		if err != nil {
+			writeHookResponse(w, http.StatusNotFound, "no_service")
+			return
+		}
+
+		if ok, wait := h.hookLimiter.Allow(strconv.FormatInt(hook.ID, 10)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeHookResponse(w, http.StatusTooManyRequests, "rate_limited")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, webhooks.MaxPayloadBytes))
+		if err != nil {
+			writeHookResponse(w, http.StatusRequestEntityTooLarge, "payload_too_large")
+			return
+		}
+		msg, err := webhooks.ParseIncoming(r.Header.Get("Content-Type"), body)
+		if err != nil {
+			code := webhooks.ErrInvalidPayload.Error()
+			if errors.Is(err, webhooks.ErrNoText) {
+				code = webhooks.ErrNoText.Error()
+			}
+			writeHookResponse(w, http.StatusBadRequest, code)
+			return
+		}
+
+		room, err := dal.GetRoom(h.db, hook.RoomID)
+		if err != nil {
+			h.serverError(w, r, err)
+			return
+		}
+		hookChatter, err := dal.GetChatter(h.db, hook.ChatterID)
+		if err != nil {
+			h.serverError(w, r, err)
+			return
+		}
+		if reason, err := h.checkCanPost(*hookChatter, *room); err != nil {
+			h.serverError(w, r, err)
+			return
+		} else if reason != "" {
+			h.logger.Info("webhook message refused", "hookId", hook.ID, "reason", reason)
+			writeHookResponse(w, http.StatusForbidden, "posting_disabled")
+			return
+		}
+
+		stored, decision, err := moderation.Post(r.Context(), h.db, h.moderator, moderation.Message{
+			ChatterID:  hookChatter.ID,
+			RoomID:     room.ID,
+			Content:    msg.Content,
+			IsBot:      true,
+			SenderName: msg.SenderName,
+			AvatarURL:  msg.AvatarURL,
+		})
+		if errors.Is(err, moderation.ErrRejected) {
+			h.logger.Info("webhook message rejected", "hookId", hook.ID, "reason", decision.Reason)
+			writeHookResponse(w, http.StatusUnprocessableEntity, "rejected")
+			return
+		}
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to insert webhook message: %w", err))
+			return
+		}
+
+		err = common.PublishMessageEvent(h.nc, common.MessageEvent{
+			ID:        stored.ID,
+			RoomID:    room.ID,
+			ChatterID: hookChatter.ID,
+			Content:   stored.Content,
+		})
+		if err != nil {
+			log.Printf("failed to publish webhook message: %v", err)
+		}
+
+		writeHookResponse(w, http.StatusOK, "")
+	}
+}
+
+// writeHookResponse answers a webhook call with {"ok": true}, or with false
+// and an error code in the style of Slack's webhooks
+func writeHookResponse(w http.ResponseWriter, status int, errorCode string) {
+	body := map[string]any{"ok": errorCode == ""}
+	if errorCode != "" {
+		body["error"] = errorCode
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("failed to write webhook response: %v", err)
+	}
+}
+
+func (h *Handlers) patchIncomingWebhooks(sse *datastar.ServerSentEventGenerator, roomID int64) {
+	hooks, err := dal.ListIncomingWebhooks(h.db, roomID)
+	if err != nil {
+		log.Printf("Failed to list incoming webhooks: %v", err)
+		return
+	}
+	if err := sse.PatchElementTempl(components.IncomingWebhooks(roomID, hooks)); err != nil {
+		log.Printf("Failed to send incoming webhooks to client: %v", err)
+	}
+}
+
+// randomHex returns n random bytes as hex
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
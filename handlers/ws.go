@@ -0,0 +1,577 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-star/common"
+	"go-star/common/dal"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"golang.org/x/net/websocket"
+)
+
+// The /ws endpoint speaks a JSON protocol for clients that can't use the
+// Datastar pages, such as CLI tools. Each WebSocket text frame holds one
+// WSFrame, told apart by its type.
+//
+// Client frames:
+//
+//	subscribe   {id, roomId}           receive the room's events, answered with an ack then its history
+//	unsubscribe {id, roomId}           stop receiving the room's events
+//	send        {id, roomId, content}  post a message, acked with its messageId, or run a /command
+//	typing      {roomId}               tell a subscribed room you are typing
+//	ping        {id}                   answered with a pong
+//	pong        {}                     answers a server ping
+//
+// Server frames:
+//
+//	ack        {id, messageId?}                 a client frame with an id succeeded
+//	error      {id?, code, text, retryAfter?}   a client frame failed, or the connection is closing
+//	history    {roomId, messages}               the newest messages after subscribing, newest first
+//	message    {roomId, message, partial?}      a new message; partial marks a bot reply still streaming in
+//	edit       {roomId, message}                a message's content changed
+//	typing     {roomId, chatterId, name}        another chatter is typing
+//	moderation {roomId, action, messageId}      a message was removed, hidden or restored
+//	kicked     {roomId}                         a moderator removed you from the room, which is unsubscribed
+//	notice     {roomId?, text, link?}           a notice for you alone
+//	ping, pong
+//
+// Every client frame with an id gets exactly one ack or error with that id.
+// Error codes are those of the JSON API plus not_subscribed, unknown_type,
+// banned and slow_consumer.
+//
+// The server pings every PingInterval, and closes connections it hasn't
+// heard anything from for two and a half intervals, so clients only need to
+// answer pings. Frames queue for each client up to SendBuffer; a client that
+// falls further behind is sent a slow_consumer error and disconnected
+// rather than silently missing events. It can reconnect and page through
+// GET /api/v1/rooms/{id}/messages for what it missed.
+
+// WebSocket frame types
+const (
+	WSSubscribe   = "subscribe"
+	WSUnsubscribe = "unsubscribe"
+	WSSend        = "send"
+	WSTyping      = "typing"
+	WSPing        = "ping"
+	WSPong        = "pong"
+	WSAck         = "ack"
+	WSError       = "error"
+	WSHistory     = "history"
+	WSMessage     = "message"
+	WSEdit        = "edit"
+	WSModeration  = "moderation"
+	WSKicked      = "kicked"
+	WSNotice      = "notice"
+)
+
+// WebSocket error codes, alongside the API's
+const (
+	WSErrNotSubscribed = "not_subscribed"
+	WSErrUnknownType   = "unknown_type"
+	WSErrBanned        = "banned"
+	WSErrSlowConsumer  = "slow_consumer"
+)
+
+const (
+	// wsMaxFrameBytes caps frames sent by clients
+	wsMaxFrameBytes = 64 << 10
+	// wsMaxRooms caps how many rooms one connection can subscribe to
+	wsMaxRooms = 20
+	// wsTypingInterval is how often a connection's typing frames are passed on per room
+	wsTypingInterval = 3 * time.Second
+)
+
+// WSFrame is one message of the /ws protocol, in either direction
+type WSFrame struct {
+	Type       string                   `json:"type"`
+	ID         string                   `json:"id,omitempty"`
+	RoomID     int64                    `json:"roomId,omitempty"`
+	Content    string                   `json:"content,omitempty"`
+	MessageID  int64                    `json:"messageId,omitempty"`
+	Message    *dal.MessageWithChatter  `json:"message,omitempty"`
+	Messages   []dal.MessageWithChatter `json:"messages,omitempty"`
+	Partial    bool                     `json:"partial,omitempty"`
+	ChatterID  int64                    `json:"chatterId,omitempty"`
+	Name       string                   `json:"name,omitempty"`
+	Action     string                   `json:"action,omitempty"`
+	Code       string                   `json:"code,omitempty"`
+	Text       string                   `json:"text,omitempty"`
+	Link       string                   `json:"link,omitempty"`
+	RetryAfter int                      `json:"retryAfter,omitempty"`
+}
+
+// WebSocket upgrades to the /ws protocol. Browsers are authenticated by
+// their session cookie, other clients can send an API token instead.
+func (h *Handlers) WebSocket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chatter, err := h.wsChatter(r)
+		if err != nil {
+			h.logger.Warn("rejected websocket", "uri", r.URL.RequestURI(), "error", err)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		banned, err := dal.IsBanned(h.db, chatter.ID)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to check ban: %w", err))
+			return
+		}
+		if banned {
+			h.forbidden(w, r)
+			return
+		}
+
+		server := websocket.Server{
+			Handshake: checkSameOrigin,
+			Handler: func(ws *websocket.Conn) {
+				ws.MaxPayloadBytes = wsMaxFrameBytes
+				h.serveWebSocket(r.Context(), ws, *chatter)
+			},
+		}
+		server.ServeHTTP(w, r)
+	}
+}
+
+// wsChatter returns the chatter for an API token or a session cookie. Unlike
+// the pages, a WebSocket can't set the cookie, though a chatter is created
+// for a new one as on the pages.
+func (h *Handlers) wsChatter(r *http.Request) (*dal.Chatter, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return dal.GetChatterByAPIToken(h.db, strings.TrimSpace(token), time.Now())
+	}
+	userID, ok := common.SessionUserID(r)
+	if !ok {
+		return nil, errors.New("no session cookie or API token")
+	}
+	return h.sessionChatter(userID)
+}
+
+// checkSameOrigin refuses browsers on other sites, which would otherwise
+// connect with the chatter's cookie. Clients that send no Origin are not browsers.
+func checkSameOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return fmt.Errorf("cross-origin websocket from %q", origin)
+	}
+	config.Origin = u
+	return nil
+}
+
+// wsConn is one client's connection. Only writeLoop writes to the socket,
+// everything else queues frames with send.
+type wsConn struct {
+	h       *Handlers
+	ws      *websocket.Conn
+	ctx     context.Context
+	chatter dal.Chatter
+	out     chan queuedFrame
+	stats   *connStats
+
+	done      chan struct{}
+	closeOnce sync.Once
+	// last is written before the socket closes, if set
+	last *WSFrame
+
+	mu     sync.Mutex
+	rooms  map[int64][]*nats.Subscription
+	typing map[int64]time.Time
+}
+
+// queuedFrame is a frame waiting in a connection's send buffer
+type queuedFrame struct {
+	frame WSFrame
+	at    time.Time
+}
+
+func (h *Handlers) serveWebSocket(ctx context.Context, ws *websocket.Conn, chatter dal.Chatter) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := &wsConn{
+		h:       h,
+		ws:      ws,
+		ctx:     ctx,
+		chatter: chatter,
+		out:     make(chan queuedFrame, h.wsConfig.SendBuffer),
+		stats:   h.streams.open("ws", chatter.ID, 0),
+		done:    make(chan struct{}),
+		rooms:   map[int64][]*nats.Subscription{},
+		typing:  map[int64]time.Time{},
+	}
+	defer h.streams.close(c.stats)
+	h.logger.Info("websocket connected", "chatterId", chatter.ID)
+
+	var subs []*nats.Subscription
+	defer func() {
+		for _, sub := range subs {
+			sub.Unsubscribe()
+		}
+		c.unsubscribeAll()
+	}()
+	modSub, err := h.nc.Subscribe(common.ModerationSubject, c.onModeration)
+	if err != nil {
+		h.logger.Error("failed to subscribe to moderation events", "error", err)
+		return
+	}
+	noticeSub, err := h.nc.Subscribe(common.ChatterNoticesSubject(chatter.ID), c.onNotice)
+	if err != nil {
+		h.logger.Error("failed to subscribe to notices", "error", err)
+		return
+	}
+	subs = append(subs, modSub, noticeSub)
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		c.writeLoop()
+	}()
+	c.readLoop()
+	c.close(nil)
+	<-written
+	h.logger.Info("websocket disconnected", "chatterId", chatter.ID)
+}
+
+// close ends the connection once, writing last first if it is set
+func (c *wsConn) close(last *WSFrame) {
+	c.closeOnce.Do(func() {
+		c.last = last
+		close(c.done)
+	})
+}
+
+// send queues a frame for the client, disconnecting it if its queue is full
+func (c *wsConn) send(frame WSFrame) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	// Counted first, so the write loop can't deliver it before it is queued
+	now := time.Now()
+	c.stats.queued(now)
+	select {
+	case c.out <- queuedFrame{frame, now}:
+	default:
+		c.h.logger.Warn("disconnecting slow websocket client", "chatterId", c.chatter.ID, "queued", len(c.out))
+		c.close(&WSFrame{Type: WSError, Code: WSErrSlowConsumer, Text: "You fell too far behind, reconnect and fetch the history you missed."})
+	}
+}
+
+func (c *wsConn) writeLoop() {
+	defer c.ws.Close()
+	ticker := time.NewTicker(c.h.wsConfig.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case queued := <-c.out:
+			if err := c.write(queued.frame); err != nil {
+				c.close(nil)
+				return
+			}
+			c.stats.delivered(time.Now(), queued.at, 1)
+		case <-ticker.C:
+			if err := c.write(WSFrame{Type: WSPing}); err != nil {
+				c.close(nil)
+				return
+			}
+		case <-c.done:
+			if c.last != nil {
+				c.write(*c.last)
+			}
+			return
+		}
+	}
+}
+
+func (c *wsConn) write(frame WSFrame) error {
+	c.ws.SetWriteDeadline(time.Now().Add(c.h.streamConfig.WriteTimeout))
+	return websocket.JSON.Send(c.ws, frame)
+}
+
+func (c *wsConn) readLoop() {
+	idle := c.h.wsConfig.PingInterval * 5 / 2
+	for {
+		c.ws.SetReadDeadline(time.Now().Add(idle))
+		var frame WSFrame
+		if err := websocket.JSON.Receive(c.ws, &frame); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				c.send(WSFrame{Type: WSError, Code: APIErrInvalidRequest, Text: "Frames must be JSON objects."})
+				continue
+			}
+			return
+		}
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		c.handle(frame)
+	}
+}
+
+func (c *wsConn) handle(frame WSFrame) {
+	switch frame.Type {
+	case WSSubscribe:
+		c.subscribe(frame)
+	case WSUnsubscribe:
+		c.unsubscribe(frame.RoomID)
+		c.ack(frame, 0)
+	case WSSend:
+		c.sendMessage(frame)
+	case WSTyping:
+		c.sendTyping(frame)
+	case WSPing:
+		c.send(WSFrame{Type: WSPong, ID: frame.ID})
+	case WSPong:
+	default:
+		c.fail(frame, WSErrUnknownType, fmt.Sprintf("Unknown frame type %q.", frame.Type))
+	}
+}
+
+// ack answers a client frame that succeeded, if it asked for an answer
+func (c *wsConn) ack(frame WSFrame, messageID int64) {
+	if frame.ID != "" {
+		c.send(WSFrame{Type: WSAck, ID: frame.ID, MessageID: messageID})
+	}
+}
+
+// fail answers a client frame that failed
+func (c *wsConn) fail(frame WSFrame, code, text string) {
+	c.send(WSFrame{Type: WSError, ID: frame.ID, RoomID: frame.RoomID, Code: code, Text: text})
+}
+
+func (c *wsConn) internalError(frame WSFrame, err error) {
+	c.h.logger.Error(err.Error(), "chatterId", c.chatter.ID, "frame", frame.Type)
+	c.fail(frame, APIErrInternal, http.StatusText(http.StatusInternalServerError))
+}
+
+func (c *wsConn) subscribe(frame WSFrame) {
+	room, err := dal.GetRoom(c.h.db, frame.RoomID)
+	if err != nil {
+		c.fail(frame, APIErrNotFound, "No such room.")
+		return
+	}
+
+	c.mu.Lock()
+	_, subscribed := c.rooms[room.ID]
+	full := len(c.rooms) >= wsMaxRooms
+	c.mu.Unlock()
+	if subscribed {
+		c.ack(frame, 0)
+		return
+	}
+	if full {
+		c.fail(frame, APIErrInvalidRequest, fmt.Sprintf("You can subscribe to at most %d rooms.", wsMaxRooms))
+		return
+	}
+
+	// Subscribe before reading the history so nothing falls between the two
+	var subs []*nats.Subscription
+	for subject, handler := range map[string]nats.MsgHandler{
+		common.RoomMessagesSubject(room.ID): c.onMessage,
+		common.RoomEditsSubject(room.ID):    c.onEdit,
+		common.RoomTypingSubject(room.ID):   c.onTyping,
+	} {
+		sub, err := c.h.nc.Subscribe(subject, handler)
+		if err != nil {
+			for _, s := range subs {
+				s.Unsubscribe()
+			}
+			c.internalError(frame, fmt.Errorf("failed to subscribe to %s: %w", subject, err))
+			return
+		}
+		subs = append(subs, sub)
+	}
+	c.mu.Lock()
+	c.rooms[room.ID] = subs
+	c.mu.Unlock()
+
+	history, err := dal.ListMessagesPage(c.h.db, room.ID, 0, apiPageSize)
+	if err != nil {
+		c.internalError(frame, fmt.Errorf("failed to list messages: %w", err))
+		return
+	}
+	messages := []dal.MessageWithChatter{}
+	for _, msg := range history {
+		messages = append(messages, publicMessage(msg))
+	}
+
+	c.ack(frame, 0)
+	c.send(WSFrame{Type: WSHistory, RoomID: room.ID, Messages: messages})
+
+	join := common.JoinEvent{RoomID: room.ID, ChatterID: c.chatter.ID, Name: c.chatter.Name}
+	if err := common.PublishJoinEvent(c.h.nc, join); err != nil {
+		c.h.logger.Error("failed to publish join event", "error", err)
+	}
+}
+
+func (c *wsConn) unsubscribe(roomID int64) {
+	c.mu.Lock()
+	subs := c.rooms[roomID]
+	delete(c.rooms, roomID)
+	delete(c.typing, roomID)
+	c.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+}
+
+func (c *wsConn) unsubscribeAll() {
+	c.mu.Lock()
+	var roomIDs []int64
+	for roomID := range c.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	c.mu.Unlock()
+
+	for _, roomID := range roomIDs {
+		c.unsubscribe(roomID)
+	}
+}
+
+func (c *wsConn) subscribed(roomID int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.rooms[roomID]
+	return ok
+}
+
+// sendMessage posts a message or runs a slash command, whose reply arrives as
+// a notice. Commands are acked without a messageId.
+func (c *wsConn) sendMessage(frame WSFrame) {
+	room, err := dal.GetRoom(c.h.db, frame.RoomID)
+	if err != nil {
+		c.fail(frame, APIErrNotFound, "No such room.")
+		return
+	}
+
+	result, err := c.h.send(c.ctx, c.chatter, *room, frame.Content)
+	var refused *refusal
+	if errors.As(err, &refused) {
+		c.send(WSFrame{Type: WSError, ID: frame.ID, RoomID: room.ID, Code: refused.code, Text: refused.reason, RetryAfter: int(math.Ceil(refused.wait.Seconds()))})
+		return
+	}
+	if err != nil {
+		c.internalError(frame, err)
+		return
+	}
+	if result.message == nil {
+		c.ack(frame, 0)
+		return
+	}
+	c.ack(frame, result.message.ID)
+}
+
+func (c *wsConn) sendTyping(frame WSFrame) {
+	if !c.subscribed(frame.RoomID) {
+		c.fail(frame, WSErrNotSubscribed, "Subscribe to the room first.")
+		return
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	throttled := now.Sub(c.typing[frame.RoomID]) < wsTypingInterval
+	if !throttled {
+		c.typing[frame.RoomID] = now
+	}
+	c.mu.Unlock()
+
+	if !throttled {
+		event := common.TypingEvent{RoomID: frame.RoomID, ChatterID: c.chatter.ID, Name: c.chatter.Name}
+		if err := common.PublishTypingEvent(c.h.nc, event); err != nil {
+			c.internalError(frame, fmt.Errorf("failed to publish typing event: %w", err))
+			return
+		}
+	}
+	c.ack(frame, 0)
+}
+
+func (c *wsConn) onMessage(msg *nats.Msg) {
+	var event common.MessageEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		c.h.logger.Error("invalid message event", "error", err)
+		return
+	}
+	message, err := dal.GetMessageWithChatter(c.h.db, event.ID)
+	if err != nil || message.RoomID != event.RoomID {
+		// Removed or hidden before it reached us, or not this room's
+		return
+	}
+
+	// The stored content, not the event's, since the bots' NATS user can
+	// publish on every room's subject
+	public := publicMessage(*message)
+	c.send(WSFrame{Type: WSMessage, RoomID: message.RoomID, Message: &public, Partial: event.Partial})
+}
+
+func (c *wsConn) onEdit(msg *nats.Msg) {
+	var edit common.MessageEditEvent
+	if err := json.Unmarshal(msg.Data, &edit); err != nil {
+		c.h.logger.Error("invalid message edit event", "error", err)
+		return
+	}
+	message, err := dal.GetMessageWithChatter(c.h.db, edit.ID)
+	if err != nil || message.RoomID != edit.RoomID {
+		return
+	}
+
+	public := publicMessage(*message)
+	c.send(WSFrame{Type: WSEdit, RoomID: message.RoomID, Message: &public})
+}
+
+func (c *wsConn) onTyping(msg *nats.Msg) {
+	var event common.TypingEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		c.h.logger.Error("invalid typing event", "error", err)
+		return
+	}
+	if event.ChatterID == c.chatter.ID {
+		return
+	}
+	c.send(WSFrame{Type: WSTyping, RoomID: event.RoomID, ChatterID: event.ChatterID, Name: event.Name})
+}
+
+func (c *wsConn) onModeration(msg *nats.Msg) {
+	var event common.ModerationEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		c.h.logger.Error("invalid moderation event", "error", err)
+		return
+	}
+
+	switch {
+	case event.Action == common.ModerationBan && event.ChatterID == c.chatter.ID:
+		c.close(&WSFrame{Type: WSError, Code: WSErrBanned, Text: "You have been banned from this server."})
+	case event.Affects(c.chatter.ID, event.RoomID) && c.subscribed(event.RoomID):
+		c.unsubscribe(event.RoomID)
+		c.send(WSFrame{Type: WSKicked, RoomID: event.RoomID})
+	case event.ChangesMessages() && c.subscribed(event.RoomID):
+		c.send(WSFrame{Type: WSModeration, RoomID: event.RoomID, Action: event.Action, MessageID: event.MessageID})
+	}
+}
+
+func (c *wsConn) onNotice(msg *nats.Msg) {
+	var notice common.NoticeEvent
+	if err := json.Unmarshal(msg.Data, &notice); err != nil {
+		c.h.logger.Error("invalid notice event", "error", err)
+		return
+	}
+	c.send(WSFrame{Type: WSNotice, RoomID: notice.RoomID, Text: notice.Text, Link: notice.Link})
+}
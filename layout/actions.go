@@ -0,0 +1,14 @@
+package layout
+
+import (
+	"fmt"
+
+	"go-star/common"
+)
+
+// PostSSE returns a Datastar @post action that sends the page's CSRF token
+// in the request header checked by the CSRF middleware
+func PostSSE(urlFormat string, args ...any) string {
+	url := fmt.Sprintf(urlFormat, args...)
+	return fmt.Sprintf("@post('%s', {headers: {'%s': $_csrf}})", url, common.CSRFHeaderName)
+}
@@ -0,0 +1,6 @@
+package layout
+
+// BulmaURL is the pinned Bulma stylesheet, the only asset pages load from
+// another origin. The CSP names it in full. Datastar is served from
+// /static/.
+const BulmaURL = "https://cdn.jsdelivr.net/npm/bulma@1.0.2/css/bulma.min.css"
@@ -1,41 +1,109 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"go-star/common"
 	"go-star/common/bots"
 	"go-star/common/dal"
+	"go-star/common/moderation"
+	"go-star/common/scheduler"
+	"go-star/common/webhooks"
+	"go-star/handlers"
 	"go-star/routes"
 )
 
 func main() {
-	const port = 3000
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
+	cfg, err := common.LoadConfig()
+	if err != nil {
+		panic(err)
+	}
+
 	// Setup NATS
-	nc, cleanup, err := common.SetupNATS()
+	nc, cleanup, err := common.SetupNATS(cfg.NATS)
 	if err != nil {
 		panic(err)
 	}
 	defer cleanup()
 
-	db, err := dal.SetupDB("chat-db")
+	db, err := dal.SetupDB(cfg.DBName)
 
 	if err != nil {
 		panic(err)
 	}
-	bot := bots.NewPosiBot(db, "PosiBot", "posibot", 1)
-	go bot.Listen(db, nc)
+	if cfg.AdminID != 0 {
+		promoted, err := dal.MakeAdmin(db, cfg.AdminID)
+		if err != nil {
+			panic(err)
+		}
+		if promoted {
+			logger.Info("Made chatter an admin", "chatterId", cfg.AdminID)
+		}
+	}
+	registry := bots.DefaultRegistry()
+	if cfg.LLM.BaseURL != "" {
+		registry.Register("llm", "Answers @mentions using "+cfg.LLM.Model, bots.NewLLMBotFactory(db, bots.NewOpenAIBackend(cfg.LLM)))
+	}
+	// The bot runner connects as its own NATS user, which may only touch bots' subjects
+	botsNC, err := common.ConnectNATS(nc, cfg.NATS, cfg.NATS.Users.Bots)
+	if err != nil {
+		panic(err)
+	}
+	defer botsNC.Close()
+	// Only one instance in a cluster runs each of these, the others wait to take over
+	workers := []common.Worker{
+		bots.NewRunner(db, botsNC, registry, moderation.Default(db), cfg.Bots),
+		common.NewWorker("scheduler", scheduler.New(db, nc, moderation.Default(db)).Run),
+		common.NewWorker("webhooks", webhooks.NewDispatcher(db, nc, cfg.Webhooks).Run),
+	}
 
-	r := routes.Register(logger, db, nc)
-	logger.Info("Starting server", "host","http://localhost", "port", port)
+	// Stopping hands the workers' leases over straight away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := common.RunWorker(ctx, nc, w); err != nil {
+				logger.Error(w.Name()+" stopped", "error", err)
+			}
+		}()
+	}
 
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), r); err != nil {
+	rh := handlers.NewHandlers(logger, db, nc, registry, cfg)
+	r := routes.RegisterHandlers(logger, rh)
+	// Internal services and bots can call chat over NATS instead of HTTP
+	svc, err := routes.RegisterService(rh, nc)
+	if err != nil {
+		panic(err)
+	}
+	defer svc.Stop()
+	// The bot runner may not publish moderation events, so its removals are announced here
+	removals, err := routes.RelayBotRemovals(rh, nc)
+	if err != nil {
 		panic(err)
 	}
+	defer removals.Unsubscribe()
+	server := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: r}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	logger.Info("Starting server", "host", "http://localhost", "port", cfg.Port)
 
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		panic(err)
+	}
+	wg.Wait()
 }
@@ -0,0 +1,313 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go-star/common"
+	"go-star/common/bots"
+	"go-star/common/dal"
+	"go-star/handlers"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func startNATS(t *testing.T) *nats.Conn {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("failed to create NATS server: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(4 * time.Second) {
+		t.Fatal("NATS server not ready in time")
+	}
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		ns.Shutdown()
+		t.Fatalf("failed to connect to NATS: %v", err)
+	}
+	t.Cleanup(func() {
+		nc.Close()
+		ns.Shutdown()
+	})
+	return nc
+}
+
+// apiClient calls the API through the router with a bearer token
+type apiClient struct {
+	t      *testing.T
+	router http.Handler
+	token  string
+}
+
+func (c apiClient) do(method, path, body string, into any) *httptest.ResponseRecorder {
+	c.t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	c.router.ServeHTTP(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		c.t.Errorf("%s %s: expected a JSON response, got %q", method, path, ct)
+	}
+	if into != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), into); err != nil {
+			c.t.Fatalf("%s %s: failed to decode %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec
+}
+
+// errorCode returns the code from an API error body
+func errorCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body handlers.APIErrorBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode error body %q: %v", rec.Body.String(), err)
+	}
+	if body.Error.Message == "" {
+		t.Errorf("Expected a message with error %q", body.Error.Code)
+	}
+	return body.Error.Code
+}
+
+// apiTest is a router with a room, a member called Alice and an admin, each with an API token
+type apiTest struct {
+	db       *sql.DB
+	nc       *nats.Conn
+	handlers *handlers.Handlers
+	room     *dal.Room
+	alice    apiClient
+	admin    apiClient
+}
+
+func setupAPITest(t *testing.T, name string, cfg common.Config) apiTest {
+	t.Helper()
+	t.Cleanup(func() { os.Remove("./" + name + ".db") })
+	db, err := dal.SetupDB(name)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	nc := startNATS(t)
+	rh := handlers.NewHandlers(logger, db, nc, bots.DefaultRegistry(), cfg)
+	r := RegisterHandlers(logger, rh)
+
+	room, _ := dal.InsertRoom(db, "General", "Talk about anything")
+	alice, _ := dal.InsertChatter(db, "alice-session", "Alice")
+	admin, _ := dal.InsertChatter(db, "admin-session", "Admin")
+	dal.SetChatterRole(db, admin.ID, dal.RoleAdmin)
+	if _, err := dal.InsertAPIToken(db, alice.ID, "script", "alice-token"); err != nil {
+		t.Fatalf("InsertAPIToken() failed: %v", err)
+	}
+	dal.InsertAPIToken(db, admin.ID, "ops", "admin-token")
+
+	return apiTest{db, nc, rh, room, apiClient{t, r, "alice-token"}, apiClient{t, r, "admin-token"}}
+}
+
+func TestAPIAuthentication(t *testing.T) {
+	test := setupAPITest(t, "test-api-auth", common.DefaultConfig())
+	alice := test.alice
+
+	anonymous := apiClient{alice.t, alice.router, ""}
+	rec := anonymous.do(http.MethodGet, "/api/v1/rooms", "", nil)
+	if rec.Code != http.StatusUnauthorized || errorCode(t, rec) != handlers.APIErrUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("Expected a WWW-Authenticate challenge")
+	}
+
+	forged := apiClient{alice.t, alice.router, "not-a-token"}
+	if rec := forged.do(http.MethodGet, "/api/v1/me", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown token, got %d", rec.Code)
+	}
+
+	// No CSRF token is needed either
+	var me dal.Chatter
+	rec = alice.do(http.MethodGet, "/api/v1/me", "", &me)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", rec.Code, rec.Body.String())
+	}
+	if me.Name != "Alice" || me.Role != dal.RoleMember {
+		t.Errorf("Expected Alice's own chatter, got %+v", me)
+	}
+	if strings.Contains(rec.Body.String(), "username") {
+		t.Errorf("Expected the username (the session cookie) to be left out, got %s", rec.Body.String())
+	}
+
+	if rec := alice.do(http.MethodGet, "/api/v1/nothing", "", nil); rec.Code != http.StatusNotFound || errorCode(t, rec) != handlers.APIErrNotFound {
+		t.Errorf("Expected a JSON 404 for an unknown endpoint, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := alice.do(http.MethodDelete, "/api/v1/rooms", "", nil); rec.Code != http.StatusMethodNotAllowed || errorCode(t, rec) != handlers.APIErrMethodNotAllowed {
+		t.Errorf("Expected a JSON 405, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// A ban stops the chatter's tokens working too
+	dal.BanChatter(test.db, me.ID, me.ID, "spam")
+	if rec := alice.do(http.MethodGet, "/api/v1/rooms", "", nil); rec.Code != http.StatusForbidden || errorCode(t, rec) != handlers.APIErrForbidden {
+		t.Errorf("Expected 403 for a banned chatter, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAPIRooms(t *testing.T) {
+	test := setupAPITest(t, "test-api-rooms", common.DefaultConfig())
+	room := test.room
+	alice := test.alice
+	admin := test.admin
+
+	var list handlers.RoomList
+	alice.do(http.MethodGet, "/api/v1/rooms", "", &list)
+	// Alongside the Watercooler every database starts with
+	if len(list.Rooms) != 2 || list.Rooms[0].ID != room.ID || list.Rooms[0].Name != "General" {
+		t.Errorf("Expected the General room first, got %+v", list.Rooms)
+	}
+
+	rec := alice.do(http.MethodPost, "/api/v1/rooms", `{"name": "Secret"}`, nil)
+	if rec.Code != http.StatusForbidden || errorCode(t, rec) != handlers.APIErrForbidden {
+		t.Errorf("Expected members to be forbidden from creating rooms, got %d", rec.Code)
+	}
+	if rec := admin.do(http.MethodPost, "/api/v1/rooms", `{"name": " "}`, nil); rec.Code != http.StatusBadRequest || errorCode(t, rec) != handlers.APIErrInvalidRequest {
+		t.Errorf("Expected 400 for a blank name, got %d", rec.Code)
+	}
+	if rec := admin.do(http.MethodPost, "/api/v1/rooms", `not json`, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a body that isn't JSON, got %d", rec.Code)
+	}
+
+	var created dal.Room
+	rec = admin.do(http.MethodPost, "/api/v1/rooms", `{"name": "Releases", "description": "Ship it"}`, &created)
+	if rec.Code != http.StatusCreated || created.Name != "Releases" || created.Description != "Ship it" {
+		t.Fatalf("Expected the created room, got %d %+v", rec.Code, created)
+	}
+	if rec.Header().Get("Location") != fmt.Sprintf("/api/v1/rooms/%d", created.ID) {
+		t.Errorf("Expected a Location header, got %q", rec.Header().Get("Location"))
+	}
+
+	var fetched dal.Room
+	alice.do(http.MethodGet, fmt.Sprintf("/api/v1/rooms/%d", created.ID), "", &fetched)
+	if fetched != created {
+		t.Errorf("Expected %+v, got %+v", created, fetched)
+	}
+	if rec := alice.do(http.MethodGet, "/api/v1/rooms/999", "", nil); rec.Code != http.StatusNotFound || errorCode(t, rec) != handlers.APIErrNotFound {
+		t.Errorf("Expected 404 for an unknown room, got %d", rec.Code)
+	}
+}
+
+func TestAPIRoomLimitKeepsChatterTokens(t *testing.T) {
+	cfg := common.DefaultConfig()
+	cfg.RateLimits.ChatterBurst = 2
+	cfg.RateLimits.ChatterInterval = time.Hour
+	cfg.RateLimits.RoomBurst = 1
+	cfg.RateLimits.RoomInterval = 200 * time.Millisecond
+	test := setupAPITest(t, "test-api-room-limit", cfg)
+	messagesURL := fmt.Sprintf("/api/v1/rooms/%d/messages", test.room.ID)
+
+	if rec := test.alice.do(http.MethodPost, messagesURL, `{"content": "one"}`, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := test.alice.do(http.MethodPost, messagesURL, `{"content": "room is busy"}`, nil); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the room limit to refuse, got %d", rec.Code)
+	}
+
+	// The refused message didn't cost alice a token
+	time.Sleep(250 * time.Millisecond)
+	if rec := test.alice.do(http.MethodPost, messagesURL, `{"content": "two"}`, nil); rec.Code != http.StatusCreated {
+		t.Errorf("Expected alice to have a token left, got %d", rec.Code)
+	}
+}
+
+func TestAPIMessages(t *testing.T) {
+	cfg := common.DefaultConfig()
+	cfg.RateLimits.ChatterBurst = 3
+	test := setupAPITest(t, "test-api-messages", cfg)
+	room := test.room
+	alice := test.alice
+	messagesURL := fmt.Sprintf("/api/v1/rooms/%d/messages", room.ID)
+
+	var posted []dal.MessageWithChatter
+	for i := 1; i <= 3; i++ {
+		var msg dal.MessageWithChatter
+		rec := alice.do(http.MethodPost, messagesURL, fmt.Sprintf(`{"content": "message %d"}`, i), &msg)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d %s", rec.Code, rec.Body.String())
+		}
+		if msg.Content != fmt.Sprintf("message %d", i) || msg.ChatterName != "Alice" || msg.RoomID != room.ID || msg.ID == 0 {
+			t.Errorf("Unexpected posted message: %+v", msg)
+		}
+		posted = append(posted, msg)
+	}
+
+	// The burst of 3 is used up
+	rec := alice.do(http.MethodPost, messagesURL, `{"content": "one more"}`, nil)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" || errorCode(t, rec) != handlers.APIErrRateLimited {
+		t.Errorf("Expected 429 with Retry-After, got %d", rec.Code)
+	}
+	if rec := alice.do(http.MethodPost, messagesURL, `{"content": ""}`, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an empty message, got %d", rec.Code)
+	}
+
+	var page handlers.MessagePage
+	alice.do(http.MethodGet, messagesURL+"?limit=2", "", &page)
+	if len(page.Messages) != 2 || page.Messages[0].ID != posted[2].ID || page.Messages[1].ID != posted[1].ID {
+		t.Fatalf("Expected the two newest messages, newest first, got %+v", page.Messages)
+	}
+	if page.NextBefore != posted[1].ID {
+		t.Errorf("Expected the next page before message %d, got %d", posted[1].ID, page.NextBefore)
+	}
+	// Usernames are session cookies, so are never shown to other chatters
+	if page.Messages[0].Username != "" || strings.Contains(fmt.Sprint(page), "alice-session") {
+		t.Errorf("Expected usernames to be left out, got %+v", page.Messages[0])
+	}
+
+	next := page.NextBefore
+	page = handlers.MessagePage{}
+	alice.do(http.MethodGet, fmt.Sprintf("%s?limit=2&before=%d", messagesURL, next), "", &page)
+	if len(page.Messages) != 1 || page.Messages[0].ID != posted[0].ID || page.NextBefore != 0 {
+		t.Errorf("Expected the oldest message on the last page, got %+v", page)
+	}
+
+	if rec := alice.do(http.MethodGet, messagesURL+"?limit=1000", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a limit that's too big, got %d", rec.Code)
+	}
+}
+
+func TestAPIChatters(t *testing.T) {
+	test := setupAPITest(t, "test-api-chatters", common.DefaultConfig())
+	alice := test.alice
+	admin := test.admin
+
+	var me dal.Chatter
+	admin.do(http.MethodGet, "/api/v1/me", "", &me)
+
+	var chatter dal.Chatter
+	rec := alice.do(http.MethodGet, fmt.Sprintf("/api/v1/chatters/%d", me.ID), "", &chatter)
+	if rec.Code != http.StatusOK || chatter.Name != "Admin" || chatter.Role != dal.RoleAdmin {
+		t.Errorf("Expected the admin chatter, got %d %+v", rec.Code, chatter)
+	}
+	if strings.Contains(rec.Body.String(), "username") {
+		t.Errorf("Expected the username to be left out, got %s", rec.Body.String())
+	}
+
+	if rec := alice.do(http.MethodGet, "/api/v1/chatters/999", "", nil); rec.Code != http.StatusNotFound || errorCode(t, rec) != handlers.APIErrNotFound {
+		t.Errorf("Expected 404 for an unknown chatter, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,226 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-star/common"
+	"go-star/common/bots"
+	"go-star/common/dal"
+	"go-star/common/moderation"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// freePort finds a port to configure before the server that listens on it starts
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// instance is one chat server in a cluster: its router, served over HTTP,
+// and its bot runner, which only runs while the instance leads
+type instance struct {
+	nc     *nats.Conn
+	router http.Handler
+	server *httptest.Server
+	// leading is set while this instance's bot runner runs
+	leading atomic.Bool
+	// stop shuts down the bot runner, as if the process had exited
+	stop func()
+}
+
+// startCluster runs n instances against one database, their embedded NATS
+// servers clustered together the way they would be behind a load balancer
+func startCluster(t *testing.T, db *sql.DB, n int) []*instance {
+	t.Helper()
+	ports := make([]int, n)
+	for i := range ports {
+		ports[i] = freePort(t)
+	}
+
+	// A cluster's JetStream waits for its servers to find each other, so
+	// they start together
+	conns := make([]*nats.Conn, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		cfg := common.DefaultConfig().NATS
+		cfg.Port = -1
+		cfg.ServerName = fmt.Sprintf("chat-%d", i)
+		cfg.Cluster = common.NATSClusterConfig{Name: "chat", Host: "127.0.0.1", Port: ports[i]}
+		for j, port := range ports {
+			if j != i {
+				cfg.Cluster.Routes = append(cfg.Cluster.Routes, fmt.Sprintf("nats-route://127.0.0.1:%d", port))
+			}
+		}
+		cfg.JetStream.StoreDir = t.TempDir()
+		cfg.JetStream.LeaseTTL = time.Second
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var cleanup func()
+			conns[i], cleanup, errs[i] = common.SetupNATS(cfg)
+			if errs[i] == nil {
+				t.Cleanup(cleanup)
+			}
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("SetupNATS() for instance %d failed: %v", i, err)
+		}
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	instances := make([]*instance, n)
+	for i, nc := range conns {
+		router := Register(logger, db, nc, bots.DefaultRegistry(), common.DefaultConfig())
+		server := httptest.NewServer(router)
+		t.Cleanup(server.Close)
+
+		runner := bots.NewRunner(db, nc, bots.DefaultRegistry(), moderation.Default(db), common.DefaultConfig().Bots)
+		in := &instance{nc: nc, router: router, server: server}
+		worker := common.NewWorker(runner.Name(), func(ctx context.Context) error {
+			in.leading.Store(true)
+			defer in.leading.Store(false)
+			return runner.Run(ctx)
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if err := common.RunWorker(ctx, nc, worker); err != nil {
+				t.Errorf("RunWorker() failed: %v", err)
+			}
+		}()
+		stop := sync.OnceFunc(func() {
+			cancel()
+			<-done
+		})
+		t.Cleanup(stop)
+
+		in.stop = stop
+		instances[i] = in
+	}
+
+	// Wait for one of them to win and start its runner
+	js, _ := jetstream.New(conns[0])
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		_, err := js.Consumer(ctx, common.ChatStream, bots.Consumer)
+		cancel()
+		if err == nil {
+			return instances
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no instance started the bot runner: %v", err)
+		}
+	}
+}
+
+// waitForMessages waits until the room holds exactly want messages, and
+// stays that way for long enough that a duplicate would have shown up
+func waitForMessages(t *testing.T, db *sql.DB, roomID int64, want int, within time.Duration) {
+	t.Helper()
+	got := 0
+	for deadline := time.Now().Add(within); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		messages, err := dal.ListMessagesForRoom(db, roomID)
+		if err != nil {
+			continue
+		}
+		if got = len(messages); got == want {
+			time.Sleep(500 * time.Millisecond)
+			messages, _ = dal.ListMessagesForRoom(db, roomID)
+			if got = len(messages); got == want {
+				return
+			}
+			break
+		}
+	}
+	t.Fatalf("Expected %d messages in room %d, got %d", want, roomID, got)
+}
+
+func TestTwoInstances(t *testing.T) {
+	name := "test-cluster"
+	t.Cleanup(func() { os.Remove("./" + name + ".db") })
+	db, err := dal.SetupDB(name)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	room, _ := dal.InsertRoom(db, "General", "Talk about anything")
+	dal.InsertChatter(db, "alice-session", "Alice")
+	bob, _ := dal.InsertChatter(db, "bob-session", "Bob")
+	dal.InsertAPIToken(db, bob.ID, "script", "bob-token")
+	dal.InstallBot(db, room.ID, "sarky", "Sarky", "sarky", "")
+
+	instances := startCluster(t, db, 2)
+	first, second := instances[0], instances[1]
+
+	// Alice is connected to the second instance and Bob posts through the first
+	events := openMessageStream(t, second.server, room.ID, "")
+	nextEvent(t, events)
+	bobOnFirst := apiClient{t, first.router, "bob-token"}
+	var posted dal.MessageWithChatter
+	if rec := bobOnFirst.do(http.MethodPost, fmt.Sprintf("/api/v1/rooms/%d/messages", room.ID), `{"content":"hello from the first"}`, &posted); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected the message to be posted, got %d %s", rec.Code, rec.Body.String())
+	}
+	for {
+		event := nextEvent(t, events)
+		if strings.Contains(event.data, "hello from the first") {
+			break
+		}
+	}
+
+	// Only the leading instance's runner answers, so Sarky replies once
+	waitForMessages(t, db, room.ID, 2, 10*time.Second)
+
+	// When the leader goes away the other instance takes over the bots
+	var leader, follower *instance
+	for _, in := range instances {
+		if in.leading.Load() {
+			leader = in
+		} else {
+			follower = in
+		}
+	}
+	if leader == nil || follower == nil {
+		t.Fatal("Expected exactly one instance to run the bots")
+	}
+	leader.stop()
+	for deadline := time.Now().Add(5 * time.Second); !follower.leading.Load(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the other instance to take over")
+		}
+	}
+
+	bobOnSecond := apiClient{t, second.router, "bob-token"}
+	if rec := bobOnSecond.do(http.MethodPost, fmt.Sprintf("/api/v1/rooms/%d/messages", room.ID), `{"content":"anyone there?"}`, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected the message to be posted, got %d %s", rec.Code, rec.Body.String())
+	}
+	// Events the old leader fetched ahead are handed back when it stops, so
+	// nothing waits for the ack wait to run out
+	waitForMessages(t, db, room.ID, 4, 10*time.Second)
+}
@@ -0,0 +1,185 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-star/common"
+	"go-star/common/dal"
+
+	"github.com/nats-io/nats.go"
+)
+
+// sendChat posts text to a room from the page, as a chatter's browser would
+func sendChat(t *testing.T, router http.Handler, session string, roomID int64, text string) *httptest.ResponseRecorder {
+	t.Helper()
+	body := fmt.Sprintf(`{"roomId":%d,"message":%q}`, roomID, text)
+	req := httptest.NewRequest(http.MethodPost, "/room/message", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Datastar-Request", "true")
+	req.Header.Set(common.CSRFHeaderName, "test-token")
+	req.AddCookie(&http.Cookie{Name: common.CSRFCookieName, Value: "test-token"})
+	req.AddCookie(&http.Cookie{Name: common.UserIDCookie, Value: session})
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCommandsWhenMuted(t *testing.T) {
+	test := setupAPITest(t, "test-commands-muted", common.DefaultConfig())
+	alice, _ := dal.GetChatterByUsername(test.db, "alice-session")
+	admin, _ := dal.GetChatterByUsername(test.db, "admin-session")
+	dal.MuteChatter(test.db, alice.ID, test.room.ID, admin.ID, time.Now().Add(time.Hour), "spam")
+
+	for _, command := range []string{"/nick Mallory", "/invite Admin", "/remind in 1m spam", "/me waves"} {
+		if rec := sendChat(t, test.alice.router, "alice-session", test.room.ID, command); rec.Code != http.StatusForbidden {
+			t.Errorf("%s: expected a muted chatter to be refused, got %d", command, rec.Code)
+		}
+	}
+	if chatter, _ := dal.GetChatterByUsername(test.db, "alice-session"); chatter.Name != "Alice" {
+		t.Errorf("Expected a muted chatter to keep their name, got %q", chatter.Name)
+	}
+	if reminders, _ := dal.ListChatterScheduledMessages(test.db, alice.ID, test.room.ID); len(reminders) != 0 {
+		t.Errorf("Expected a muted chatter to set no reminders, got %d", len(reminders))
+	}
+}
+
+func TestCommandsInArchivedRoom(t *testing.T) {
+	test := setupAPITest(t, "test-commands-archived", common.DefaultConfig())
+	alice, _ := dal.GetChatterByUsername(test.db, "alice-session")
+	dal.ArchiveRoom(test.db, test.room.ID)
+
+	for _, command := range []string{"/nick Mallory", "/remind every 1h spam"} {
+		if rec := sendChat(t, test.alice.router, "alice-session", test.room.ID, command); rec.Code != http.StatusForbidden {
+			t.Errorf("%s: expected commands in an archived room to be refused, got %d", command, rec.Code)
+		}
+	}
+	if chatter, _ := dal.GetChatterByUsername(test.db, "alice-session"); chatter.Name != "Alice" {
+		t.Errorf("Expected the name to be unchanged, got %q", chatter.Name)
+	}
+	if reminders, _ := dal.ListChatterScheduledMessages(test.db, alice.ID, test.room.ID); len(reminders) != 0 {
+		t.Errorf("Expected no reminders in an archived room, got %d", len(reminders))
+	}
+}
+
+func TestCommandsRateLimitedAndModerated(t *testing.T) {
+	cfg := common.DefaultConfig()
+	cfg.RateLimits.ChatterBurst = 2
+	cfg.RateLimits.ChatterInterval = time.Minute
+	test := setupAPITest(t, "test-commands-limits", cfg)
+	dal.InsertWordFilter(test.db, test.room.ID, "mallory", false, "reject")
+
+	// New names go through the room's filters
+	if rec := sendChat(t, test.alice.router, "alice-session", test.room.ID, "/nick Mallory"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the command to run, got %d", rec.Code)
+	}
+	if chatter, _ := dal.GetChatterByUsername(test.db, "alice-session"); chatter.Name != "Alice" {
+		t.Errorf("Expected a filtered name to be refused, got %q", chatter.Name)
+	}
+
+	// Commands count towards the same limits as messages
+	sendChat(t, test.alice.router, "alice-session", test.room.ID, "/help")
+	rec := sendChat(t, test.alice.router, "alice-session", test.room.ID, "/invite Admin")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the third command to be throttled, got %d", rec.Code)
+	}
+}
+
+func TestCommandTargets(t *testing.T) {
+	test := setupAPITest(t, "test-command-targets", common.DefaultConfig())
+	alice, _ := dal.GetChatterByUsername(test.db, "alice-session")
+	admin, _ := dal.GetChatterByUsername(test.db, "admin-session")
+	bob, _ := dal.InsertChatter(test.db, "bob-session", "Bob")
+	dal.InsertChatter(test.db, "other-bob-session", "Bob")
+
+	notices := make(chan common.NoticeEvent, 10)
+	sub, err := test.nc.Subscribe(common.ChatterNoticesSubject(admin.ID), func(msg *nats.Msg) {
+		var notice common.NoticeEvent
+		if err := json.Unmarshal(msg.Data, &notice); err == nil {
+			notices <- notice
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	tests := []struct {
+		command, reply string
+	}{
+		{"/mute alice 5 spam", "Muted Alice for 5 minutes."},
+		{fmt.Sprintf("/invite #%d", bob.ID), "Invited Bob to General."},
+		{"/invite Bob", fmt.Sprintf("Several chatters are called Bob, use one of #%d, #%d instead.", bob.ID, bob.ID+1)},
+		// Usernames are session cookies, so they don't name anyone
+		{"/invite bob-session", "No one is called bob-session."},
+		{"/mute #999 5", "There is no chatter #999."},
+	}
+	for _, tt := range tests {
+		if rec := sendChat(t, test.admin.router, "admin-session", test.room.ID, tt.command); rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected the command to run, got %d", tt.command, rec.Code)
+		}
+		select {
+		case notice := <-notices:
+			if notice.Text != tt.reply {
+				t.Errorf("%s: expected %q, got %q", tt.command, tt.reply, notice.Text)
+			}
+			if strings.Contains(notice.Text, "-session") && !strings.Contains(tt.command, "-session") {
+				t.Errorf("%s: a reply gave away a session: %q", tt.command, notice.Text)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: no reply", tt.command)
+		}
+	}
+	if _, muted, _ := dal.MutedUntil(test.db, alice.ID, test.room.ID); !muted {
+		t.Error("Expected Alice to be muted by name")
+	}
+}
+
+func TestNickAndRemindReplies(t *testing.T) {
+	test := setupAPITest(t, "test-nick-remind", common.DefaultConfig())
+	admin, _ := dal.GetChatterByUsername(test.db, "admin-session")
+	other, _ := dal.InsertRoom(test.db, "Other", "")
+	dal.InsertWordFilter(test.db, other.ID, "mallory", false, "reject")
+
+	notices := make(chan common.NoticeEvent, 10)
+	sub, err := test.nc.Subscribe(common.ChatterNoticesSubject(admin.ID), func(msg *nats.Msg) {
+		var notice common.NoticeEvent
+		if err := json.Unmarshal(msg.Data, &notice); err == nil {
+			notices <- notice
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	accented := strings.Repeat("é", 40)
+	tests := []struct {
+		command, reply string
+	}{
+		// A name shows in every room, so every room's filters apply
+		{"/nick Mallory", "That name was blocked by the filters in Other."},
+		// Lengths are in characters, not bytes
+		{"/nick " + accented, "You are now known as " + accented + "."},
+		{"/nick " + strings.Repeat("é", 51), "Names can be at most 50 characters."},
+		{"/remind cancel 999", "You have no reminder 999."},
+	}
+	for _, tt := range tests {
+		if rec := sendChat(t, test.admin.router, "admin-session", test.room.ID, tt.command); rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected the command to run, got %d", tt.command, rec.Code)
+		}
+		select {
+		case notice := <-notices:
+			if notice.Text != tt.reply {
+				t.Errorf("%s: expected %q, got %q", tt.command, tt.reply, notice.Text)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: no reply", tt.command)
+		}
+	}
+}
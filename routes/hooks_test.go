@@ -0,0 +1,101 @@
+package routes
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"go-star/common"
+	"go-star/common/bots"
+	"go-star/common/dal"
+	"go-star/common/scheduler"
+)
+
+func TestIncomingWebhook(t *testing.T) {
+	dbName := "test-incoming-webhook"
+	db, err := dal.SetupDB(dbName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	defer os.Remove("./" + dbName + ".db")
+	defer db.Close()
+
+	cfg := common.DefaultConfig()
+	cfg.RateLimits.HookBurst = 2
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	r := Register(logger, db, nil, bots.DefaultRegistry(), cfg)
+
+	room, _ := dal.InsertRoom(db, "Deploys", "CI posts here")
+	moderator, _ := dal.InsertChatter(db, "mod", "Moderator")
+	ci, _ := dal.InsertSystemChatter(db, "webhook-ci", "CI")
+	token := "0123456789abcdef"
+	if _, err := dal.InsertIncomingWebhook(db, room.ID, ci.ID, moderator.ID, "CI", token); err != nil {
+		t.Fatalf("InsertIncomingWebhook() failed: %v", err)
+	}
+
+	post := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/hooks/"+token, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// No session or CSRF token is needed, the webhook token is the credential
+	rec := post(token, `{"text": "Build passed", "username": "Jenkins"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"ok":true`) {
+		t.Fatalf("Expected 200 ok, got %d %s", rec.Code, rec.Body.String())
+	}
+	messages, err := dal.ListMessagesForRoom(db, room.ID)
+	if err != nil {
+		t.Fatalf("ListMessagesForRoom() failed: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Content != "Build passed" || messages[0].ChatterName != "Jenkins" || messages[0].UserID != ci.ID {
+		t.Errorf("Expected the message posted as the webhook under its override name, got %+v", messages)
+	}
+
+	if rec := post(token, `{"text": ""}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "no_text") {
+		t.Errorf("Expected 400 no_text, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := post("ffff", `{"text": "hi"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown token, got %d", rec.Code)
+	}
+
+	// The burst of 2 is used up
+	rec = post(token, `{"text": "again"}`)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After, got %d", rec.Code)
+	}
+}
+
+func TestSystemChattersCannotSignIn(t *testing.T) {
+	test := setupAPITest(t, "test-system-sessions", common.DefaultConfig())
+	dal.InsertSystemChatter(test.db, "webhook-ci", "CI")
+	dal.EnsureSystemChatter(test.db, scheduler.Username, "Reminders")
+	server := httptest.NewServer(test.alice.router)
+	defer server.Close()
+
+	for _, username := range []string{"webhook-ci", scheduler.Username} {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/room/%d", test.room.ID), nil)
+		req.AddCookie(&http.Cookie{Name: common.UserIDCookie, Value: username})
+		rec := httptest.NewRecorder()
+		test.alice.router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: expected the room page to be refused, got %d", username, rec.Code)
+		}
+		if rec := sendChat(t, test.alice.router, username, test.room.ID, "hello"); rec.Code != http.StatusForbidden {
+			t.Errorf("%s: expected posting to be refused, got %d", username, rec.Code)
+		}
+		if _, err := dialWS(t, server, http.Header{"Cookie": {common.UserIDCookie + "=" + username}}); err == nil {
+			t.Errorf("%s: expected the WebSocket to be refused", username)
+		}
+	}
+	if messages, _ := dal.ListMessagesForRoom(test.db, test.room.ID); len(messages) != 0 {
+		t.Errorf("Expected nothing posted as a system chatter, got %+v", messages)
+	}
+}
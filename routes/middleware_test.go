@@ -0,0 +1,273 @@
+package routes
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"go-star/common"
+	"go-star/common/bots"
+	"go-star/common/dal"
+	"go-star/static"
+
+	"golang.org/x/net/html"
+)
+
+func newTestRouter(t *testing.T, dbName string) http.Handler {
+	t.Helper()
+	db, err := dal.SetupDB(dbName)
+	if err != nil {
+		t.Fatalf("SetupDB() failed: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.Remove("./" + dbName + ".db")
+	})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return Register(logger, db, nil, bots.DefaultRegistry(), common.DefaultConfig())
+}
+
+func TestSecurityHeadersOnPages(t *testing.T) {
+	r := newTestRouter(t, "test-security-headers")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+
+	expected := map[string]string{
+		"Content-Security-Policy": ContentSecurityPolicy,
+		"X-Content-Type-Options":  "nosniff",
+		"Referrer-Policy":         "same-origin",
+		"X-Frame-Options":         "DENY",
+	}
+	for header, value := range expected {
+		if got := rec.Header().Get(header); got != value {
+			t.Errorf("Expected %s '%s', got '%s'", header, value, got)
+		}
+	}
+	if rec.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("HSTS should not be set for plain HTTP requests")
+	}
+
+	csp := rec.Header().Get("Content-Security-Policy")
+	for _, directive := range []string{"default-src 'self'", "frame-ancestors 'none'", "object-src 'none'"} {
+		if !strings.Contains(csp, directive) {
+			t.Errorf("Expected CSP to contain %q, got %q", directive, csp)
+		}
+	}
+}
+
+// cspSources parses a Content-Security-Policy header into each directive's sources
+func cspSources(header string) map[string][]string {
+	directives := map[string][]string{}
+	for _, directive := range strings.Split(header, ";") {
+		fields := strings.Fields(directive)
+		if len(fields) > 0 {
+			directives[fields[0]] = fields[1:]
+		}
+	}
+	return directives
+}
+
+// cspAllows reports whether directive, or default-src in its absence, lets
+// the page load src. An empty src is an inline element.
+func cspAllows(directives map[string][]string, directive, src string) bool {
+	sources, ok := directives[directive]
+	if !ok {
+		sources = directives["default-src"]
+	}
+	for _, source := range sources {
+		switch {
+		case src == "":
+			if source == "'unsafe-inline'" {
+				return true
+			}
+		case source == "'self'":
+			if strings.HasPrefix(src, "/") && !strings.HasPrefix(src, "//") {
+				return true
+			}
+		case strings.HasPrefix(source, "https://"):
+			if src == source || strings.HasPrefix(src, source+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestCSPAllowsPageAssets(t *testing.T) {
+	r := newTestRouter(t, "test-csp-assets")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	directives := cspSources(rec.Header().Get("Content-Security-Policy"))
+	doc, err := html.Parse(rec.Body)
+	if err != nil {
+		t.Fatalf("failed to parse the page: %v", err)
+	}
+
+	// Every script and style the layout loads, or has inline, must be allowed by the CSP
+	attr := func(n *html.Node, key string) string {
+		for _, a := range n.Attr {
+			if a.Key == key {
+				return a.Val
+			}
+		}
+		return ""
+	}
+	var scripts, styles int
+	var local []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			for _, key := range []string{"src", "href"} {
+				if v := attr(n, key); strings.HasPrefix(v, static.Prefix) {
+					local = append(local, v)
+				}
+			}
+			switch {
+			case n.Data == "script":
+				scripts++
+				if src := attr(n, "src"); !cspAllows(directives, "script-src", src) {
+					t.Errorf("The CSP blocks the script %q", src)
+				}
+			case n.Data == "style":
+				styles++
+				if !cspAllows(directives, "style-src", "") {
+					t.Error("The CSP blocks inline <style> elements, use /static/css instead")
+				}
+			case n.Data == "link" && attr(n, "rel") == "stylesheet":
+				styles++
+				if href := attr(n, "href"); !cspAllows(directives, "style-src", href) {
+					t.Errorf("The CSP blocks the stylesheet %q", href)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	if scripts == 0 || styles == 0 {
+		t.Errorf("Expected the layout's scripts and stylesheets, got %d and %d", scripts, styles)
+	}
+
+	// Scripts and fonts only come from our own origin, whatever else a CDN hosts
+	for _, directive := range []string{"script-src", "font-src", "connect-src"} {
+		for _, source := range directives[directive] {
+			if strings.Contains(source, "://") {
+				t.Errorf("Expected %s to allow no other origins, got %q", directive, source)
+			}
+		}
+	}
+
+	// Datastar and the app's stylesheet are served from the embedded assets
+	if len(local) < 2 {
+		t.Errorf("Expected the layout to load its assets from %s, got %q", static.Prefix, local)
+	}
+	for _, path := range local {
+		rec = httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected static asset status 200, got %d", path, rec.Code)
+		}
+		if rec.Header().Get("Content-Security-Policy") == "" {
+			t.Errorf("%s: expected CSP on static assets", path)
+		}
+	}
+}
+
+func TestCSRFTokenRenderedInPage(t *testing.T) {
+	r := newTestRouter(t, "test-csrf-render")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var token string
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == common.CSRFCookieName {
+			token = c.Value
+			if !c.HttpOnly {
+				t.Error("Expected CSRF cookie to be HttpOnly")
+			}
+			if c.Secure {
+				t.Error("CSRF cookie should not be Secure over plain HTTP")
+			}
+		}
+	}
+	if token == "" {
+		t.Fatal("Expected CSRF cookie to be set")
+	}
+	if !strings.Contains(rec.Body.String(), token) {
+		t.Error("Expected CSRF token to be rendered into the page signals")
+	}
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := CSRF(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	token := "test-token"
+	tests := []struct {
+		name     string
+		method   string
+		cookie   string
+		header   string
+		expected int
+	}{
+		{"get without token", http.MethodGet, "", "", http.StatusNoContent},
+		{"post without token", http.MethodPost, token, "", http.StatusForbidden},
+		{"post without cookie", http.MethodPost, "", token, http.StatusForbidden},
+		{"post with wrong token", http.MethodPost, token, "wrong", http.StatusForbidden},
+		{"post with token", http.MethodPost, token, token, http.StatusNoContent},
+		{"delete with token", http.MethodDelete, token, token, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/room/message", nil)
+			req.Header.Set("Datastar-Request", "true")
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: common.CSRFCookieName, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				req.Header.Set(common.CSRFHeaderName, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.expected {
+				t.Errorf("Expected status %d, got %d", tt.expected, rec.Code)
+			}
+		})
+	}
+}
+
+func TestSecureCookiesOverTLS(t *testing.T) {
+	r := newTestRouter(t, "test-secure-cookies")
+
+	req := httptest.NewRequest(http.MethodGet, "https://localhost/", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	if rec.Header().Get("Strict-Transport-Security") == "" {
+		t.Error("Expected HSTS header over TLS")
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("Expected cookies to be set")
+	}
+	for _, c := range cookies {
+		if !c.Secure {
+			t.Errorf("Expected cookie %s to be Secure over TLS", c.Name)
+		}
+	}
+}
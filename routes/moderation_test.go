@@ -0,0 +1,205 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"go-star/common"
+	"go-star/common/dal"
+)
+
+func TestRelayBotRemovals(t *testing.T) {
+	test := setupAPITest(t, "test-relay-bot-removals", common.DefaultConfig())
+	sub, err := RelayBotRemovals(test.handlers, test.nc)
+	if err != nil {
+		t.Fatalf("RelayBotRemovals() failed: %v", err)
+	}
+	defer sub.Unsubscribe()
+	events, err := test.nc.SubscribeSync(common.ModerationSubject)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	if _, err := dal.InstallBot(test.db, test.room.ID, "sarky", "Echo", "echo-bot", ""); err != nil {
+		t.Fatalf("InstallBot() failed: %v", err)
+	}
+	bot, _ := dal.EnsureSystemChatter(test.db, "echo-bot", "Echo")
+	alice, _ := dal.GetChatterByUsername(test.db, "alice-session")
+	reply, _ := dal.InsertMessage(test.db, bot.ID, test.room.ID, "rejected reply")
+	shown, _ := dal.InsertMessage(test.db, bot.ID, test.room.ID, "fine reply")
+	human, _ := dal.InsertMessage(test.db, alice.ID, test.room.ID, "hello")
+	dal.RemoveMessage(test.db, reply.ID)
+	dal.RemoveMessage(test.db, human.ID)
+
+	// Only removed replies of the room's bots are announced
+	for _, id := range []int64{shown.ID, human.ID, reply.ID} {
+		common.PublishBotRemoval(test.nc, common.BotRemovalEvent{MessageID: id})
+	}
+	msg, err := events.NextMsg(2 * time.Second)
+	if err != nil {
+		t.Fatalf("Expected the removal to be announced: %v", err)
+	}
+	var event common.ModerationEvent
+	json.Unmarshal(msg.Data, &event)
+	want := common.ModerationEvent{Action: common.ModerationRemove, ChatterID: bot.ID, RoomID: test.room.ID, MessageID: reply.ID}
+	if event != want {
+		t.Errorf("Expected %+v, got %+v", want, event)
+	}
+	if msg, err := events.NextMsg(200 * time.Millisecond); err == nil {
+		t.Errorf("Expected nothing else to be announced, got %s", msg.Data)
+	}
+}
+
+// moderate posts a moderator action from the page, as a moderator's browser would
+func moderate(t *testing.T, router http.Handler, session, path, reason string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(fmt.Sprintf(`{"modReason":%q}`, reason)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Datastar-Request", "true")
+	req.Header.Set(common.CSRFHeaderName, "test-token")
+	req.AddCookie(&http.Cookie{Name: common.CSRFCookieName, Value: "test-token"})
+	req.AddCookie(&http.Cookie{Name: common.UserIDCookie, Value: session})
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestKickChatter(t *testing.T) {
+	test := setupAPITest(t, "test-kick", common.DefaultConfig())
+	router := test.alice.router
+	alice, _ := dal.GetChatterByUsername(test.db, "alice-session")
+	admin, _ := dal.GetChatterByUsername(test.db, "admin-session")
+
+	// A kicked chatter can't come straight back to post
+	kick := fmt.Sprintf("/moderation/rooms/%d/chatters/%d/kick", test.room.ID, alice.ID)
+	if rec := moderate(t, router, "admin-session", kick, "cool off"); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected the kick to succeed, got %d %s", rec.Code, rec.Body.String())
+	}
+	until, muted, err := dal.MutedUntil(test.db, alice.ID, test.room.ID)
+	if err != nil || !muted || time.Until(until) > 5*time.Minute || time.Until(until) < 4*time.Minute {
+		t.Errorf("Expected a five minute mute, got %v, %v, %v", until, muted, err)
+	}
+	if rec := sendChat(t, router, "alice-session", test.room.ID, "I'm back"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a kicked chatter to be refused, got %d", rec.Code)
+	}
+
+	// but a longer mute isn't cut short
+	dal.MuteChatter(test.db, alice.ID, test.room.ID, admin.ID, time.Now().Add(time.Hour), "spam")
+	moderate(t, router, "admin-session", kick, "again")
+	if until, _, _ := dal.MutedUntil(test.db, alice.ID, test.room.ID); time.Until(until) < 50*time.Minute {
+		t.Errorf("Expected the hour long mute to stay, got %v", until)
+	}
+}
+
+func TestModerateMissingRoom(t *testing.T) {
+	test := setupAPITest(t, "test-moderate-missing-room", common.DefaultConfig())
+	alice, _ := dal.GetChatterByUsername(test.db, "alice-session")
+
+	for _, path := range []string{
+		fmt.Sprintf("/moderation/rooms/999/chatters/%d/kick", alice.ID),
+		fmt.Sprintf("/moderation/rooms/999/chatters/%d/mute?minutes=10", alice.ID),
+		fmt.Sprintf("/moderation/rooms/%d/chatters/999/kick", test.room.ID),
+		"/moderation/chatters/999/ban",
+		"/moderation/messages/999/remove",
+	} {
+		if rec := moderate(t, test.alice.router, "admin-session", path, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, rec.Code)
+		}
+	}
+	if _, muted, _ := dal.MutedUntil(test.db, alice.ID, 999); muted {
+		t.Error("Expected no mute in a room that doesn't exist")
+	}
+}
+
+func TestReviewFlaggedMessageOnce(t *testing.T) {
+	test := setupAPITest(t, "test-review-flagged", common.DefaultConfig())
+	alice, _ := dal.GetChatterByUsername(test.db, "alice-session")
+	message, _ := dal.InsertMessage(test.db, alice.ID, test.room.ID, "borderline")
+	dal.FlagMessage(test.db, message.ID, "matched a filter")
+	pending, _ := dal.ListFlaggedMessages(test.db, dal.FlagPending)
+	if len(pending) != 1 {
+		t.Fatalf("Expected one flagged message, got %d", len(pending))
+	}
+
+	approve := fmt.Sprintf("/moderation/flagged/%d/%s", pending[0].ID, dal.FlagApproved)
+	if rec := moderate(t, test.alice.router, "admin-session", approve, ""); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the review to succeed, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// A second review is refused rather than overriding the first
+	remove := fmt.Sprintf("/moderation/flagged/%d/%s", pending[0].ID, dal.FlagRemoved)
+	if rec := moderate(t, test.alice.router, "admin-session", remove, ""); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a reviewed message, got %d", rec.Code)
+	}
+	if _, err := dal.GetMessageWithChatter(test.db, message.ID); err != nil {
+		t.Errorf("Expected the approved message to stay up: %v", err)
+	}
+	missing := fmt.Sprintf("/moderation/flagged/999/%s", dal.FlagApproved)
+	if rec := moderate(t, test.alice.router, "admin-session", missing, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown flag, got %d", rec.Code)
+	}
+}
+
+func TestReportMessage(t *testing.T) {
+	cfg := common.DefaultConfig()
+	cfg.RateLimits.ReportBurst = 2
+	cfg.RateLimits.ReportInterval = time.Hour
+	test := setupAPITest(t, "test-report-message", cfg)
+	alice, _ := dal.GetChatterByUsername(test.db, "alice-session")
+	message, _ := dal.InsertMessage(test.db, alice.ID, test.room.ID, "rude")
+
+	report := func(path, details string) *httptest.ResponseRecorder {
+		return reportAs(test, "admin-session", path, details)
+	}
+
+	if rec := report("/room/messages/999/report", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing message, got %d", rec.Code)
+	}
+
+	// Over-long details are cut back to a whole character
+	path := fmt.Sprintf("/room/messages/%d/report", message.ID)
+	if rec := report(path, "x"+strings.Repeat("é", 1000)); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the report to succeed, got %d %s", rec.Code, rec.Body.String())
+	}
+	var details string
+	if err := test.db.QueryRow(`SELECT details FROM reports WHERE messageId = ?`, message.ID).Scan(&details); err != nil {
+		t.Fatalf("Expected a stored report: %v", err)
+	}
+	if !utf8.ValidString(details) || len(details) > 1000 || len(details) < 999 {
+		t.Errorf("Expected about 1000 bytes of valid UTF-8, got %d bytes", len(details))
+	}
+
+	// Fresh sessions from the same address share its limit, and can't hide anything
+	if rec := reportAs(test, "fresh-1", path, ""); !strings.Contains(rec.Body.String(), "Thanks") {
+		t.Errorf("Expected the second report from the address to be taken, got %s", rec.Body.String())
+	}
+	if rec := reportAs(test, "fresh-2", path, ""); !strings.Contains(rec.Body.String(), "too quickly") {
+		t.Errorf("Expected the third report from the address to be refused, got %s", rec.Body.String())
+	}
+	if count, _ := dal.CountPendingReports(test.db, message.ID); count != 2 {
+		t.Errorf("Expected 2 reports, got %d", count)
+	}
+	if _, err := dal.GetMessageWithChatter(test.db, message.ID); err != nil {
+		t.Errorf("Expected reports from chatters who never posted not to hide the message: %v", err)
+	}
+}
+
+// reportAs posts a report of a message from the session's chatter
+func reportAs(test apiTest, session, path, details string) *httptest.ResponseRecorder {
+	body := fmt.Sprintf(`{"reportCategory":%q,"reportDetails":%q}`, dal.ReportCategories[0], details)
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Datastar-Request", "true")
+	req.Header.Set(common.CSRFHeaderName, "test-token")
+	req.AddCookie(&http.Cookie{Name: common.CSRFCookieName, Value: "test-token"})
+	req.AddCookie(&http.Cookie{Name: common.UserIDCookie, Value: session})
+	rec := httptest.NewRecorder()
+	test.alice.router.ServeHTTP(rec, req)
+	return rec
+}
@@ -0,0 +1,407 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"go-star/client"
+	"go-star/common"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// openAPISpec is the parts of an OpenAPI 3 document the test checks against
+type openAPISpec struct {
+	Servers []struct {
+		URL string `json:"url"`
+	} `json:"servers"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components map[string]map[string]any             `json:"components"`
+}
+
+type openAPIOperation struct {
+	OperationID string `json:"operationId"`
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema any `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]any `json:"responses"`
+}
+
+// operation finds the documented operation for a request path, without the server prefix
+func (s *openAPISpec) operation(method, path string) (string, *openAPIOperation, error) {
+	for template, item := range s.Paths {
+		if !matchPathTemplate(template, path) {
+			continue
+		}
+		raw, ok := item[strings.ToLower(method)]
+		if !ok {
+			return "", nil, fmt.Errorf("%s %s is not documented", method, template)
+		}
+		var op openAPIOperation
+		if err := json.Unmarshal(raw, &op); err != nil {
+			return "", nil, err
+		}
+		return template, &op, nil
+	}
+	return "", nil, fmt.Errorf("no documented path matches %s", path)
+}
+
+func matchPathTemplate(template, path string) bool {
+	want, got := strings.Split(template, "/"), strings.Split(path, "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if strings.HasPrefix(want[i], "{") {
+			if got[i] == "" {
+				return false
+			}
+			continue
+		}
+		if want[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve follows a local $ref such as #/components/schemas/Room
+func (s *openAPISpec) resolve(node any) any {
+	for {
+		obj, ok := node.(map[string]any)
+		if !ok {
+			return node
+		}
+		ref, ok := obj["$ref"].(string)
+		if !ok {
+			return node
+		}
+		parts := strings.Split(strings.TrimPrefix(ref, "#/components/"), "/")
+		node = s.Components[parts[0]][parts[1]]
+	}
+}
+
+// responseSchema returns the application/json schema of a documented response
+func (s *openAPISpec) responseSchema(op *openAPIOperation, status int) (any, error) {
+	response, ok := op.Responses[strconv.Itoa(status)]
+	if !ok {
+		response, ok = op.Responses["default"]
+	}
+	if !ok {
+		return nil, fmt.Errorf("status %d is not documented", status)
+	}
+	content, _ := s.resolve(response).(map[string]any)["content"].(map[string]any)
+	media, ok := content["application/json"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("status %d has no JSON body documented", status)
+	}
+	return media["schema"], nil
+}
+
+// validate checks a decoded JSON value against the subset of JSON Schema the
+// document uses, returning every mismatch
+func (s *openAPISpec) validate(schema, value any, at string) []string {
+	obj, _ := s.resolve(schema).(map[string]any)
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, at+": "+fmt.Sprintf(format, args...))
+	}
+
+	if enum, ok := obj["enum"].([]any); ok && !slices.Contains(enum, value) {
+		fail("%v is not one of %v", value, enum)
+	}
+
+	switch obj["type"] {
+	case "object":
+		fields, ok := value.(map[string]any)
+		if !ok {
+			fail("expected an object, got %T", value)
+			break
+		}
+		properties, _ := obj["properties"].(map[string]any)
+		required, _ := obj["required"].([]any)
+		for _, name := range required {
+			if _, ok := fields[name.(string)]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		for name, field := range fields {
+			property, ok := properties[name]
+			if !ok {
+				if obj["additionalProperties"] == false {
+					fail("undocumented property %q", name)
+				}
+				continue
+			}
+			problems = append(problems, s.validate(property, field, at+"."+name)...)
+		}
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			fail("expected an array, got %T", value)
+			break
+		}
+		for i, item := range items {
+			problems = append(problems, s.validate(obj["items"], item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			fail("expected a string, got %T", value)
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != float64(int64(n)) {
+			fail("expected an integer, got %v", value)
+			break
+		}
+		if min, ok := obj["minimum"].(float64); ok && n < min {
+			fail("%v is below the minimum %v", n, min)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("expected a boolean, got %T", value)
+		}
+	}
+	return problems
+}
+
+// validatingTransport checks every request and response that passes through
+// it against the document, recording which operations and statuses were seen
+type validatingTransport struct {
+	t    *testing.T
+	spec *openAPISpec
+	base string
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (v *validatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := strings.TrimPrefix(req.URL.Path, v.base)
+	template, op, err := v.spec.operation(req.Method, path)
+	if err != nil {
+		v.t.Errorf("%s %s: %v", req.Method, req.URL.Path, err)
+		return http.DefaultTransport.RoundTrip(req)
+	}
+
+	if req.Body != nil {
+		body, _ := io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if op.RequestBody == nil {
+			v.t.Errorf("%s %s: sent a body to an operation without one", req.Method, template)
+		} else {
+			var decoded any
+			json.Unmarshal(body, &decoded)
+			for _, problem := range v.spec.validate(op.RequestBody.Content["application/json"].Schema, decoded, "request") {
+				v.t.Errorf("%s %s: %s", req.Method, template, problem)
+			}
+		}
+	}
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	schema, err := v.spec.responseSchema(op, resp.StatusCode)
+	if err != nil {
+		v.t.Errorf("%s %s: %v", req.Method, template, err)
+		return resp, nil
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		v.t.Errorf("%s %s: expected a JSON response, got %q", req.Method, template, ct)
+	}
+	var decoded any
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		v.t.Errorf("%s %s: response is not JSON: %v", req.Method, template, err)
+	}
+	for _, problem := range v.spec.validate(schema, decoded, "response") {
+		v.t.Errorf("%s %s %d: %s", req.Method, template, resp.StatusCode, problem)
+	}
+
+	v.mu.Lock()
+	v.seen[fmt.Sprintf("%s %s %d", req.Method, template, resp.StatusCode)] = true
+	v.mu.Unlock()
+	return resp, nil
+}
+
+func loadOpenAPISpec(t *testing.T, router http.Handler) *openAPISpec {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected the document without a token, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	var spec openAPISpec
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("OpenAPI document is not valid JSON: %v", err)
+	}
+	if len(spec.Servers) != 1 || spec.Servers[0].URL != "/api/v1" {
+		t.Fatalf("Expected the /api/v1 server, got %+v", spec.Servers)
+	}
+	return &spec
+}
+
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	test := setupAPITest(t, "test-openapi-routes", common.DefaultConfig())
+	alice := test.alice
+	spec := loadOpenAPISpec(t, alice.router)
+
+	// Route patterns with their regexps dropped, as the document writes them
+	params := regexp.MustCompile(`\{(\w+):[^}]+\}`)
+	var routed []string
+	chi.Walk(alice.router.(chi.Routes), func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if path, ok := strings.CutPrefix(route, "/api/v1"); ok && path != "/*" {
+			routed = append(routed, method+" "+params.ReplaceAllString(path, "{$1}"))
+		}
+		return nil
+	})
+
+	var documented []string
+	for path, item := range spec.Paths {
+		for method := range item {
+			if method != "parameters" {
+				documented = append(documented, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+
+	sort.Strings(routed)
+	sort.Strings(documented)
+	if !slices.Equal(routed, documented) {
+		t.Errorf("Routes and document disagree:\n   routed %v\ndocumented %v", routed, documented)
+	}
+}
+
+func TestOpenAPISpecMatchesResponses(t *testing.T) {
+	cfg := common.DefaultConfig()
+	cfg.RateLimits.ChatterBurst = 2
+	test := setupAPITest(t, "test-openapi-responses", cfg)
+	room := test.room
+	alice := test.alice
+	admin := test.admin
+	spec := loadOpenAPISpec(t, alice.router)
+
+	server := httptest.NewServer(alice.router)
+	defer server.Close()
+	transport := &validatingTransport{t: t, spec: spec, base: "/api/v1", seen: map[string]bool{}}
+	newClient := func(token string) *client.Client {
+		return client.New(server.URL, token).WithHTTPClient(&http.Client{Transport: transport})
+	}
+	aliceClient, adminClient := newClient(alice.token), newClient(admin.token)
+	ctx := context.Background()
+
+	me, err := aliceClient.Me(ctx)
+	if err != nil || me.Name != "Alice" {
+		t.Fatalf("Me() = %+v, %v", me, err)
+	}
+	if _, err := newClient("nope").Me(ctx); !isAPIError(err, http.StatusUnauthorized, "unauthorized") {
+		t.Errorf("Expected unauthorized, got %v", err)
+	}
+
+	rooms, err := aliceClient.ListRooms(ctx)
+	if err != nil || len(rooms) == 0 {
+		t.Fatalf("ListRooms() = %+v, %v", rooms, err)
+	}
+	if _, err := aliceClient.CreateRoom(ctx, "Nope", ""); !isAPIError(err, http.StatusForbidden, "forbidden") {
+		t.Errorf("Expected forbidden, got %v", err)
+	}
+	if _, err := adminClient.CreateRoom(ctx, "", ""); !isAPIError(err, http.StatusBadRequest, "invalid_request") {
+		t.Errorf("Expected invalid_request, got %v", err)
+	}
+	created, err := adminClient.CreateRoom(ctx, "Releases", "Ship it")
+	if err != nil || created.Name != "Releases" {
+		t.Fatalf("CreateRoom() = %+v, %v", created, err)
+	}
+	if fetched, err := aliceClient.GetRoom(ctx, created.ID); err != nil || *fetched != *created {
+		t.Errorf("GetRoom() = %+v, %v", fetched, err)
+	}
+	if _, err := aliceClient.GetRoom(ctx, 999); !isAPIError(err, http.StatusNotFound, "not_found") {
+		t.Errorf("Expected not_found, got %v", err)
+	}
+
+	for _, content := range []string{"first", "second"} {
+		if _, err := aliceClient.PostMessage(ctx, room.ID, content); err != nil {
+			t.Fatalf("PostMessage() failed: %v", err)
+		}
+	}
+	var apiErr *client.Error
+	if _, err := aliceClient.PostMessage(ctx, room.ID, "third"); !errors.As(err, &apiErr) || apiErr.Code != "rate_limited" || apiErr.RetryAfter <= 0 {
+		t.Errorf("Expected rate_limited with a retry delay, got %v", err)
+	}
+	if _, err := adminClient.PostMessage(ctx, room.ID, ""); !isAPIError(err, http.StatusBadRequest, "invalid_request") {
+		t.Errorf("Expected invalid_request, got %v", err)
+	}
+
+	// Slash commands are run rather than posted
+	result, err := adminClient.RunCommand(ctx, room.ID, "/nick Boss")
+	if err != nil || result.Command != "nick" || result.Reply != "You are now known as Boss." {
+		t.Errorf("RunCommand() = %+v, %v", result, err)
+	}
+	if _, err := adminClient.RunCommand(ctx, room.ID, "/nope"); !isAPIError(err, http.StatusBadRequest, "invalid_request") {
+		t.Errorf("Expected invalid_request, got %v", err)
+	}
+
+	page, err := aliceClient.ListMessages(ctx, room.ID, 0, 1)
+	if err != nil || len(page.Messages) != 1 || page.Messages[0].Content != "second" || page.NextBefore == 0 {
+		t.Fatalf("ListMessages() = %+v, %v", page, err)
+	}
+	page, err = aliceClient.ListMessages(ctx, room.ID, page.NextBefore, 0)
+	if err != nil || len(page.Messages) != 1 || page.Messages[0].Content != "first" || page.NextBefore != 0 {
+		t.Errorf("ListMessages() = %+v, %v", page, err)
+	}
+	if _, err := aliceClient.ListMessages(ctx, room.ID, 0, 500); !isAPIError(err, http.StatusBadRequest, "invalid_request") {
+		t.Errorf("Expected invalid_request, got %v", err)
+	}
+
+	if chatter, err := adminClient.GetChatter(ctx, me.ID); err != nil || chatter.Name != "Alice" {
+		t.Errorf("GetChatter() = %+v, %v", chatter, err)
+	}
+	if _, err := adminClient.GetChatter(ctx, 999); !isAPIError(err, http.StatusNotFound, "not_found") {
+		t.Errorf("Expected not_found, got %v", err)
+	}
+
+	// Every operation was seen succeeding at least once
+	for path, item := range spec.Paths {
+		for method, raw := range item {
+			if method == "parameters" {
+				continue
+			}
+			var op openAPIOperation
+			json.Unmarshal(raw, &op)
+			succeeded := false
+			for status := range op.Responses {
+				if strings.HasPrefix(status, "2") && transport.seen[fmt.Sprintf("%s %s %s", strings.ToUpper(method), path, status)] {
+					succeeded = true
+				}
+			}
+			if !succeeded {
+				t.Errorf("%s %s (%s) was never called successfully", strings.ToUpper(method), path, op.OperationID)
+			}
+		}
+	}
+}
+
+func isAPIError(err error, status int, code string) bool {
+	var apiErr *client.Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status && apiErr.Code == code
+}
@@ -2,24 +2,101 @@ package routes
 
 import (
 	"database/sql"
+	"go-star/common"
+	"go-star/common/bots"
 	"go-star/handlers"
+	"go-star/static"
 	"log/slog"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
 
 	"github.com/go-chi/chi/v5"
 )
 
-func Register(logger *slog.Logger, db *sql.DB, nc *nats.Conn) *chi.Mux {
+func Register(logger *slog.Logger, db *sql.DB, nc *nats.Conn, registry *bots.Registry, cfg common.Config) *chi.Mux {
+	return RegisterHandlers(logger, handlers.NewHandlers(logger, db, nc, registry, cfg))
+}
+
+// RegisterHandlers routes requests to rh, which can be shared with
+// RegisterService so both count against the same rate limits
+func RegisterHandlers(logger *slog.Logger, rh *handlers.Handlers) *chi.Mux {
 
 	r := chi.NewRouter()
+	r.Use(SecurityHeaders)
+
+	r.Handle(static.Prefix+"*", static.Handler())
+	// Webhooks are called by other systems, the token in the URL stands in for a session and CSRF token
+	r.Post("/hooks/{token:[0-9a-f]+}", rh.IncomingWebhook())
+	// WebSockets check their Origin instead of a CSRF token
+	r.Get("/ws", rh.WebSocket())
+	r.Get("/api/openapi.json", rh.OpenAPISpec())
+	// The API authenticates with bearer tokens rather than cookies, so needs no CSRF token either
+	r.Route("/api/v1", func(r chi.Router) {
+		r.Use(rh.APIAuth)
+		r.NotFound(rh.APINotFound())
+		r.MethodNotAllowed(rh.APIMethodNotAllowed())
+
+		r.Get("/me", rh.APIMe())
+		r.Get("/rooms", rh.APIListRooms())
+		r.Post("/rooms", rh.APICreateRoom())
+		r.Get("/rooms/{id:\\d+}", rh.APIGetRoom())
+		r.Get("/rooms/{id:\\d+}/messages", rh.APIListMessages())
+		r.Post("/rooms/{id:\\d+}/messages", rh.APIPostMessage())
+		r.Get("/chatters/{chatterId:\\d+}", rh.APIGetChatter())
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(CSRF(logger))
+
+		r.Get("/", rh.ListRooms())
+		r.Get("/room/{id:\\d+}", rh.RoomPage())
+		r.Get("/room/messages", rh.ListMessages())
+		r.Post("/room/message", rh.SendMessage())
+		r.Post("/room/messages/{messageId:\\d+}/report", rh.ReportMessage())
+		r.Get("/room/{id:\\d+}/settings", rh.RoomSettingsPage())
+		r.Post("/room/{id:\\d+}/settings/slowmode", rh.SetSlowMode())
+		r.Post("/room/{id:\\d+}/settings/filters", rh.AddWordFilter())
+		r.Post("/room/{id:\\d+}/settings/filters/{filterId:\\d+}/delete", rh.DeleteWordFilter())
+		r.Post("/room/{id:\\d+}/settings/bots", rh.InstallBot())
+		r.Post("/room/{id:\\d+}/settings/bots/{botId:\\d+}/delete", rh.UninstallBot())
+		r.Post("/room/{id:\\d+}/settings/hooks", rh.CreateIncomingWebhook())
+		r.Post("/room/{id:\\d+}/settings/hooks/{hookId:\\d+}/delete", rh.DeleteIncomingWebhook())
 
-	rh := handlers.NewHandlers(logger, db, nc)
+		r.Get("/account/tokens", rh.APITokensPage())
+		r.Post("/account/tokens", rh.CreateAPIToken())
+		r.Post("/account/tokens/{tokenId:\\d+}/delete", rh.DeleteAPIToken())
 
-	r.Get("/", rh.ListRooms())
-	r.Get("/room/{id:\\d+}", rh.RoomPage())
-	r.Get("/room/messages", rh.ListMessages())
-	r.Post("/room/message", rh.SendMessage())
+		r.Post("/moderation/messages/{messageId:\\d+}/remove", rh.RemoveMessage())
+		r.Post("/moderation/rooms/{roomId:\\d+}/chatters/{chatterId:\\d+}/mute", rh.MuteChatter())
+		r.Post("/moderation/rooms/{roomId:\\d+}/chatters/{chatterId:\\d+}/kick", rh.KickChatter())
+		r.Post("/moderation/chatters/{chatterId:\\d+}/ban", rh.BanChatter())
+		r.Get("/moderation/flagged", rh.FlaggedQueuePage())
+		r.Post("/moderation/flagged/{flagId:\\d+}/{decision:approved|removed}", rh.ReviewFlaggedMessage())
+
+		r.Get("/admin", rh.AdminPage())
+		r.Get("/admin/audit", rh.AuditLogPage())
+		r.Get("/admin/streams", rh.AdminStreams())
+		r.Post("/admin/rooms", rh.CreateRoom())
+		r.Post("/admin/rooms/{id:\\d+}/archive", rh.ArchiveRoom())
+		r.Post("/admin/chatters/{chatterId:\\d+}/role", rh.SetChatterRole())
+		r.Get("/admin/webhooks", rh.OutgoingWebhooksPage())
+		r.Post("/admin/webhooks", rh.CreateOutgoingWebhook())
+		r.Get("/admin/webhooks/{hookId:\\d+}", rh.WebhookDeliveriesPage())
+		r.Post("/admin/webhooks/{hookId:\\d+}/delete", rh.DeleteOutgoingWebhook())
+	})
 
 	return r
 }
+
+// RegisterService answers the chat service's NATS requests, described in
+// handlers/service.go, with the router's handlers
+func RegisterService(rh *handlers.Handlers, nc *nats.Conn) (micro.Service, error) {
+	return rh.AddService(nc)
+}
+
+// RelayBotRemovals announces the replies the bot runner removed, see
+// handlers.RelayBotRemovals. Unsubscribe to stop.
+func RelayBotRemovals(rh *handlers.Handlers, nc *nats.Conn) (*nats.Subscription, error) {
+	return rh.RelayBotRemovals(nc)
+}
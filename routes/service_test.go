@@ -0,0 +1,223 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"go-star/common"
+	"go-star/common/dal"
+	"go-star/handlers"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// serviceClient calls the chat service over NATS with a bearer token
+type serviceClient struct {
+	t     *testing.T
+	nc    *nats.Conn
+	token string
+}
+
+// call sends body to subject and decodes the reply into into, returning
+// the error code the service answered with, or "" if it succeeded
+func (c serviceClient) call(subject, body string, into any) (string, *nats.Msg) {
+	c.t.Helper()
+	req := nats.NewMsg(subject)
+	req.Data = []byte(body)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	reply, err := c.nc.RequestMsg(req, 2*time.Second)
+	if err != nil {
+		c.t.Fatalf("%s: request failed: %v", subject, err)
+	}
+
+	if code := reply.Header.Get(micro.ErrorCodeHeader); code != "" {
+		var body handlers.APIErrorBody
+		if err := json.Unmarshal(reply.Data, &body); err != nil || body.Error.Code == "" {
+			c.t.Errorf("%s: expected an error body, got %q", subject, reply.Data)
+		}
+		return code, reply
+	}
+	if into != nil {
+		if err := json.Unmarshal(reply.Data, into); err != nil {
+			c.t.Fatalf("%s: failed to decode %q: %v", subject, reply.Data, err)
+		}
+	}
+	return "", reply
+}
+
+func setupServiceTest(t *testing.T, name string, cfg common.Config) (apiTest, serviceClient) {
+	t.Helper()
+	test := setupAPITest(t, name, cfg)
+	svc, err := RegisterService(test.handlers, test.nc)
+	if err != nil {
+		t.Fatalf("RegisterService() failed: %v", err)
+	}
+	t.Cleanup(func() { svc.Stop() })
+	return test, serviceClient{t, test.nc, "alice-token"}
+}
+
+func TestServiceMessages(t *testing.T) {
+	test, alice := setupServiceTest(t, "test-service-messages", common.DefaultConfig())
+
+	var rooms handlers.RoomList
+	if code, _ := alice.call(handlers.ServiceRoomsList, "", &rooms); code != "" {
+		t.Fatalf("Expected the rooms, got %s", code)
+	}
+	found := false
+	for _, room := range rooms.Rooms {
+		found = found || room.ID == test.room.ID
+	}
+	if !found {
+		t.Errorf("Expected the General room, got %+v", rooms.Rooms)
+	}
+
+	// Sent messages reach the room's live subscribers like any other
+	sub, err := test.nc.SubscribeSync(common.RoomMessagesSubject(test.room.ID))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	for i := range 3 {
+		var sent dal.MessageWithChatter
+		body := fmt.Sprintf(`{"roomId":%d,"content":"message %d"}`, test.room.ID, i)
+		if code, _ := alice.call(handlers.ServiceMessagesSend, body, &sent); code != "" {
+			t.Fatalf("Expected the message to be sent, got %s", code)
+		}
+		if sent.ID == 0 || sent.ChatterName != "Alice" || sent.Username != "" {
+			t.Errorf("Expected Alice's new message without the username, got %+v", sent)
+		}
+	}
+	if _, err := sub.NextMsg(2 * time.Second); err != nil {
+		t.Errorf("Expected the message to be published: %v", err)
+	}
+
+	// Slash commands are run rather than posted, like on the web page
+	var result handlers.CommandResult
+	body := fmt.Sprintf(`{"roomId":%d,"content":"/nick Alicia"}`, test.room.ID)
+	if code, _ := alice.call(handlers.ServiceMessagesSend, body, &result); code != "" {
+		t.Fatalf("Expected the command to run, got %s", code)
+	}
+	if result.Command != "nick" || result.Reply != "You are now known as Alicia." {
+		t.Errorf("Expected the command's reply, got %+v", result)
+	}
+
+	// History pages newest first and hides usernames, like the API
+	var page handlers.MessagePage
+	if code, _ := alice.call(handlers.ServiceMessagesHistory, fmt.Sprintf(`{"roomId":%d,"limit":2}`, test.room.ID), &page); code != "" {
+		t.Fatalf("Expected the history, got %s", code)
+	}
+	if len(page.Messages) != 2 || page.Messages[0].Content != "message 2" || page.NextBefore == 0 {
+		t.Fatalf("Expected the newest two messages and a next page, got %+v", page)
+	}
+	for _, msg := range page.Messages {
+		if msg.Username != "" {
+			t.Errorf("Expected usernames to be hidden, got %q", msg.Username)
+		}
+	}
+	body = fmt.Sprintf(`{"roomId":%d,"before":%d,"limit":2}`, test.room.ID, page.NextBefore)
+	var last handlers.MessagePage
+	if code, _ := alice.call(handlers.ServiceMessagesHistory, body, &last); code != "" {
+		t.Fatalf("Expected the next page, got %s", code)
+	}
+	if len(last.Messages) != 1 || last.Messages[0].Content != "message 0" || last.NextBefore != 0 {
+		t.Errorf("Expected the oldest message on the last page, got %+v", last)
+	}
+}
+
+func TestServiceErrors(t *testing.T) {
+	cfg := common.DefaultConfig()
+	cfg.RateLimits.ChatterBurst = 1
+	cfg.RateLimits.ChatterInterval = time.Minute
+	test, alice := setupServiceTest(t, "test-service-errors", cfg)
+
+	anonymous := serviceClient{t, test.nc, ""}
+	if code, _ := anonymous.call(handlers.ServiceRoomsList, "", nil); code != strconv.Itoa(http.StatusUnauthorized) {
+		t.Errorf("Expected 401 without a token, got %q", code)
+	}
+	forged := serviceClient{t, test.nc, "not-a-token"}
+	if code, _ := forged.call(handlers.ServiceRoomsList, "", nil); code != strconv.Itoa(http.StatusUnauthorized) {
+		t.Errorf("Expected 401 for an unknown token, got %q", code)
+	}
+
+	tests := []struct {
+		subject, body string
+		want          int
+	}{
+		{handlers.ServiceMessagesHistory, `not json`, http.StatusBadRequest},
+		{handlers.ServiceMessagesHistory, `{"roomId":999}`, http.StatusNotFound},
+		{handlers.ServiceMessagesHistory, fmt.Sprintf(`{"roomId":%d,"limit":1000}`, test.room.ID), http.StatusBadRequest},
+		{handlers.ServiceMessagesSend, fmt.Sprintf(`{"roomId":%d,"content":"  "}`, test.room.ID), http.StatusBadRequest},
+		{handlers.ServiceMessagesSend, fmt.Sprintf(`{"roomId":%d,"content":"first"}`, test.room.ID), 0},
+		{handlers.ServiceMessagesSend, fmt.Sprintf(`{"roomId":%d,"content":"too soon"}`, test.room.ID), http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		want := ""
+		if tt.want != 0 {
+			want = strconv.Itoa(tt.want)
+		}
+		code, reply := alice.call(tt.subject, tt.body, nil)
+		if code != want {
+			t.Errorf("%s %s: expected %q, got %q", tt.subject, tt.body, want, code)
+		}
+		if tt.want == http.StatusTooManyRequests && reply.Header.Get("Retry-After") == "" {
+			t.Error("Expected a Retry-After header when rate limited")
+		}
+	}
+
+	// The API and the service count against the same limits
+	rec := test.alice.do(http.MethodPost, fmt.Sprintf("/api/v1/rooms/%d/messages", test.room.ID), `{"content":"over HTTP"}`, nil)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the API to be rate limited after the service, got %d", rec.Code)
+	}
+
+	chatter, _ := dal.GetChatterByUsername(test.db, "alice-session")
+	dal.BanChatter(test.db, chatter.ID, chatter.ID, "spam")
+	if code, _ := alice.call(handlers.ServiceRoomsList, "", nil); code != strconv.Itoa(http.StatusForbidden) {
+		t.Errorf("Expected 403 for a banned chatter, got %q", code)
+	}
+}
+
+func TestServiceDiscovery(t *testing.T) {
+	test, alice := setupServiceTest(t, "test-service-discovery", common.DefaultConfig())
+	alice.call(handlers.ServiceRoomsList, "", nil)
+
+	subject, _ := micro.ControlSubject(micro.InfoVerb, handlers.ServiceName, "")
+	reply, err := test.nc.Request(subject, nil, 2*time.Second)
+	if err != nil {
+		t.Fatalf("INFO request failed: %v", err)
+	}
+	var info micro.Info
+	if err := json.Unmarshal(reply.Data, &info); err != nil {
+		t.Fatalf("failed to decode %q: %v", reply.Data, err)
+	}
+	subjects := map[string]bool{}
+	for _, e := range info.Endpoints {
+		subjects[e.Subject] = true
+	}
+	for _, want := range []string{handlers.ServiceRoomsList, handlers.ServiceMessagesHistory, handlers.ServiceMessagesSend} {
+		if !subjects[want] {
+			t.Errorf("Expected INFO to list %s, got %+v", want, info.Endpoints)
+		}
+	}
+
+	subject, _ = micro.ControlSubject(micro.StatsVerb, handlers.ServiceName, "")
+	reply, err = test.nc.Request(subject, nil, 2*time.Second)
+	if err != nil {
+		t.Fatalf("STATS request failed: %v", err)
+	}
+	var stats micro.Stats
+	if err := json.Unmarshal(reply.Data, &stats); err != nil {
+		t.Fatalf("failed to decode %q: %v", reply.Data, err)
+	}
+	for _, e := range stats.Endpoints {
+		if e.Subject == handlers.ServiceRoomsList && e.NumRequests != 1 {
+			t.Errorf("Expected one rooms request, got %d", e.NumRequests)
+		}
+	}
+}
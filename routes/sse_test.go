@@ -0,0 +1,325 @@
+package routes
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-star/common"
+	"go-star/common/dal"
+	"go-star/handlers"
+)
+
+// sseEvent is one server-sent event, with its data lines joined
+type sseEvent struct {
+	id   string
+	data string
+}
+
+// openMessageStream opens a room's message stream as Alice, resuming after
+// lastEventID unless it is empty, and returns its events as they arrive
+func openMessageStream(t *testing.T, server *httptest.Server, roomID int64, lastEventID string) <-chan sseEvent {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	signals := url.QueryEscape(fmt.Sprintf(`{"roomId":%d}`, roomID))
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/room/messages?datastar="+signals, nil)
+	req.Header.Set("Cookie", common.UserIDCookie+"=alice-session")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /room/messages failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		t.Fatalf("Expected the stream to open, got %d", resp.StatusCode)
+	}
+
+	events := make(chan sseEvent, 100)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		var event sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event.data != "" {
+					events <- event
+				}
+				event = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data += strings.TrimPrefix(line, "data: ") + "\n"
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("Expected another event, the stream closed")
+		}
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected another event, got none")
+	}
+	return sseEvent{}
+}
+
+func TestMessageStreamResumes(t *testing.T) {
+	test := setupAPITest(t, "test-sse-resume", common.DefaultConfig())
+	room := test.room
+	server := httptest.NewServer(test.alice.router)
+	// Registered before the streams, so they're closed first
+	t.Cleanup(server.Close)
+
+	alice, _ := dal.GetChatterByUsername(test.db, "alice-session")
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		msg, _ := dal.InsertMessage(test.db, alice.ID, room.ID, fmt.Sprintf("message %d", i))
+		ids = append(ids, msg.ID)
+	}
+
+	// A fresh stream draws the whole list, tagged with the newest message
+	fresh := nextEvent(t, openMessageStream(t, server, room.ID, ""))
+	if fresh.id != strconv.FormatInt(ids[2], 10) {
+		t.Errorf("Expected the list to carry ID %d, got %q", ids[2], fresh.id)
+	}
+	for _, id := range ids {
+		if !strings.Contains(fresh.data, fmt.Sprintf("message-%d", id)) {
+			t.Errorf("Expected message %d in the list", id)
+		}
+	}
+
+	// A reconnect only gets what it missed, in one patch
+	events := openMessageStream(t, server, room.ID, strconv.FormatInt(ids[0], 10))
+	missed := nextEvent(t, events)
+	if missed.id != strconv.FormatInt(ids[2], 10) || !strings.Contains(missed.data, "mode prepend") {
+		t.Fatalf("Expected the missed messages prepended up to %d, got %+v", ids[2], missed)
+	}
+	if !strings.Contains(missed.data, fmt.Sprintf("message-%d", ids[1])) || strings.Contains(missed.data, fmt.Sprintf("message-%d", ids[0])) {
+		t.Errorf("Expected only the messages after %d, got %q", ids[0], missed.data)
+	}
+	// Prepended as a block, so still newest first
+	if strings.Index(missed.data, fmt.Sprintf("message-%d", ids[2])) > strings.Index(missed.data, fmt.Sprintf("message-%d", ids[1])) {
+		t.Errorf("Expected message %d above %d, got %q", ids[2], ids[1], missed.data)
+	}
+
+	// New messages follow on from the replay
+	var posted dal.MessageWithChatter
+	test.alice.do(http.MethodPost, fmt.Sprintf("/api/v1/rooms/%d/messages", room.ID), `{"content":"live"}`, &posted)
+	event := nextEvent(t, events)
+	if event.id != strconv.FormatInt(posted.ID, 10) || !strings.Contains(event.data, "live") {
+		t.Fatalf("Expected the new message %d, got %+v", posted.ID, event)
+	}
+	if strings.Contains(event.data, fmt.Sprintf("message-%d", ids[2])) {
+		t.Errorf("Expected only the new message, got %q", event.data)
+	}
+}
+
+// slowWriter is a response writer for a client that stops reading. While it
+// is paused writes block, failing once the handler's write deadline passes.
+type slowWriter struct {
+	header http.Header
+
+	mu       sync.Mutex
+	body     strings.Builder
+	stall    chan struct{}
+	deadline time.Time
+	// blocked is sent to when a write starts waiting
+	blocked chan struct{}
+}
+
+func (w *slowWriter) Header() http.Header { return w.header }
+func (w *slowWriter) WriteHeader(int)     {}
+func (w *slowWriter) Flush()              {}
+
+func (w *slowWriter) SetWriteDeadline(deadline time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.deadline = deadline
+	return nil
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	stall, deadline := w.stall, w.deadline
+	w.mu.Unlock()
+
+	if stall != nil {
+		select {
+		case w.blocked <- struct{}{}:
+		default:
+		}
+		select {
+		case <-stall:
+		case <-time.After(time.Until(deadline)):
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.body.Write(p)
+}
+
+func (w *slowWriter) pause() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stall = make(chan struct{})
+}
+
+func (w *slowWriter) resume() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	close(w.stall)
+	w.stall = nil
+}
+
+// events returns the events written so far
+func (w *slowWriter) events() []sseEvent {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var events []sseEvent
+	for _, block := range strings.Split(w.body.String(), "\n\n") {
+		var event sseEvent
+		for _, line := range strings.Split(block, "\n") {
+			if id, ok := strings.CutPrefix(line, "id: "); ok {
+				event.id = id
+			} else if data, ok := strings.CutPrefix(line, "data: "); ok {
+				event.data += data + "\n"
+			}
+		}
+		if event.data != "" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// waitForEvents waits until the writer has at least n events
+func (w *slowWriter) waitForEvents(t *testing.T, n int) []sseEvent {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if events := w.events(); len(events) >= n {
+			return events
+		}
+	}
+	t.Fatalf("Expected %d events, got %+v", n, w.events())
+	return nil
+}
+
+// streams returns the live connections listed at /admin/streams
+func streams(t *testing.T, router http.Handler) []handlers.StreamStats {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/admin/streams", nil)
+	req.Header.Set("Cookie", common.UserIDCookie+"=admin-session")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	var list handlers.StreamList
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("GET /admin/streams: failed to decode %q: %v", rec.Body.String(), err)
+	}
+	return list.Connections
+}
+
+func TestSlowMessageStream(t *testing.T) {
+	cfg := common.DefaultConfig()
+	cfg.Streams.WriteTimeout = time.Second
+	test := setupAPITest(t, "test-sse-slow", cfg)
+	room := test.room
+	router := test.alice.router
+	alice, _ := dal.GetChatterByUsername(test.db, "alice-session")
+
+	signals := url.QueryEscape(fmt.Sprintf(`{"roomId":%d}`, room.ID))
+	req := httptest.NewRequest(http.MethodGet, "/room/messages?datastar="+signals, nil)
+	req.Header.Set("Cookie", common.UserIDCookie+"=alice-session")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &slowWriter{header: http.Header{}, blocked: make(chan struct{}, 1)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeHTTP(w, req.WithContext(ctx))
+	}()
+	w.waitForEvents(t, 1)
+
+	post := func(content string) int64 {
+		msg, _ := dal.InsertMessage(test.db, alice.ID, room.ID, content)
+		common.PublishMessageEvent(test.nc, common.MessageEvent{ID: msg.ID, RoomID: room.ID, ChatterID: alice.ID, Content: content})
+		test.nc.Flush()
+		return msg.ID
+	}
+
+	// The first message gets stuck on its way out, and the rest pile up behind it
+	w.pause()
+	first := post("first")
+	select {
+	case <-w.blocked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the first message to be written")
+	}
+	var last int64
+	for i := 0; i < 9; i++ {
+		last = post(fmt.Sprintf("queued %d", i))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	live := streams(t, router)
+	if len(live) != 1 || live[0].Transport != "sse" || live[0].ChatterID != alice.ID {
+		t.Fatalf("Expected Alice's stream, got %+v", live)
+	}
+	if live[0].Pending != 10 || live[0].LagMillis < 100 {
+		t.Errorf("Expected 10 events waiting at least 100ms, got %+v", live[0])
+	}
+
+	// Nothing was dropped, the backlog went out as one catch-up patch
+	w.resume()
+	events := w.waitForEvents(t, 3)
+	if len(events) != 3 {
+		t.Fatalf("Expected the first message and one catch-up, got %+v", events)
+	}
+	if events[1].id != strconv.FormatInt(first, 10) {
+		t.Errorf("Expected message %d, got %+v", first, events[1])
+	}
+	if events[2].id != strconv.FormatInt(last, 10) || strings.Count(events[2].data, "<article") != 9 {
+		t.Errorf("Expected the 9 queued messages up to %d, got %+v", last, events[2])
+	}
+	stats := streams(t, router)[0]
+	if stats.Pending != 0 || stats.Sent != 10 || stats.Coalesced != 8 || stats.MaxLagMillis < 100 {
+		t.Errorf("Expected 10 events sent, 8 of them coalesced, got %+v", stats)
+	}
+
+	// A client that stops reading altogether is disconnected once the write times out
+	w.pause()
+	post("into the void")
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the stuck stream to be disconnected")
+	}
+	if live := streams(t, router); len(live) != 0 {
+		t.Errorf("Expected no live streams, got %+v", live)
+	}
+}
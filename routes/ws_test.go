@@ -0,0 +1,247 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-star/common"
+	"go-star/common/dal"
+	"go-star/handlers"
+
+	"golang.org/x/net/websocket"
+)
+
+// dialWS opens a /ws connection with the given request headers
+func dialWS(t *testing.T, server *httptest.Server, header http.Header) (*websocket.Conn, error) {
+	t.Helper()
+	origin := server.URL
+	if header.Get("Origin") != "" {
+		origin = header.Get("Origin")
+		header.Del("Origin")
+	}
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", origin)
+	if err != nil {
+		t.Fatalf("NewConfig() failed: %v", err)
+	}
+	for key, values := range header {
+		config.Header[key] = values
+	}
+	ws, err := websocket.DialConfig(config)
+	if err == nil {
+		t.Cleanup(func() { ws.Close() })
+	}
+	return ws, err
+}
+
+func mustDialWS(t *testing.T, server *httptest.Server, header http.Header) *websocket.Conn {
+	t.Helper()
+	ws, err := dialWS(t, server, header)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	return ws
+}
+
+func sendWS(t *testing.T, ws *websocket.Conn, frame handlers.WSFrame) {
+	t.Helper()
+	if err := websocket.JSON.Send(ws, frame); err != nil {
+		t.Fatalf("Send(%+v) failed: %v", frame, err)
+	}
+}
+
+// expectWS reads frames until one of the given type arrives, skipping pings
+func expectWS(t *testing.T, ws *websocket.Conn, frameType string) handlers.WSFrame {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var frame handlers.WSFrame
+		if err := websocket.JSON.Receive(ws, &frame); err != nil {
+			t.Fatalf("Expected a %s frame, got %v", frameType, err)
+		}
+		if frame.Type == frameType {
+			return frame
+		}
+		if frame.Type != handlers.WSPing {
+			t.Fatalf("Expected a %s frame, got %+v", frameType, frame)
+		}
+	}
+}
+
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+func TestWebSocketAuthentication(t *testing.T) {
+	test := setupAPITest(t, "test-ws-auth", common.DefaultConfig())
+	alice := test.alice
+	server := httptest.NewServer(alice.router)
+	defer server.Close()
+
+	// A WebSocket can't start a session, so it needs a cookie or token
+	resp, err := http.Get(server.URL + "/ws")
+	if err != nil {
+		t.Fatalf("GET /ws failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", resp.StatusCode)
+	}
+	if _, err := dialWS(t, server, bearer("not-a-token")); err == nil {
+		t.Error("Expected an unknown token to be refused")
+	}
+
+	// Pages from other sites can't use the chatter's cookie
+	cookie := http.Header{"Cookie": {common.UserIDCookie + "=alice-session"}}
+	evil := http.Header{"Cookie": cookie["Cookie"], "Origin": {"https://evil.example"}}
+	if _, err := dialWS(t, server, evil); err == nil {
+		t.Error("Expected a cross-origin WebSocket to be refused")
+	}
+
+	ws := mustDialWS(t, server, cookie)
+	sendWS(t, ws, handlers.WSFrame{Type: handlers.WSPing, ID: "1"})
+	if pong := expectWS(t, ws, handlers.WSPong); pong.ID != "1" {
+		t.Errorf("Expected the pong to echo the ping's ID, got %+v", pong)
+	}
+}
+
+func TestWebSocketProtocol(t *testing.T) {
+	test := setupAPITest(t, "test-ws-protocol", common.DefaultConfig())
+	room := test.room
+	alice := test.alice
+	server := httptest.NewServer(alice.router)
+	defer server.Close()
+
+	aliceWS := mustDialWS(t, server, bearer(alice.token))
+	bobWS := mustDialWS(t, server, http.Header{"Cookie": {common.UserIDCookie + "=bob-session"}})
+
+	for _, ws := range []*websocket.Conn{aliceWS, bobWS} {
+		sendWS(t, ws, handlers.WSFrame{Type: handlers.WSSubscribe, ID: "sub", RoomID: room.ID})
+		if ack := expectWS(t, ws, handlers.WSAck); ack.ID != "sub" {
+			t.Errorf("Expected the subscribe to be acked, got %+v", ack)
+		}
+		if history := expectWS(t, ws, handlers.WSHistory); history.RoomID != room.ID || len(history.Messages) != 0 {
+			t.Errorf("Expected the empty room's history, got %+v", history)
+		}
+	}
+
+	sendWS(t, aliceWS, handlers.WSFrame{Type: handlers.WSSend, ID: "m1", RoomID: room.ID, Content: "hello over ws"})
+	ack := expectWS(t, aliceWS, handlers.WSAck)
+	if ack.ID != "m1" || ack.MessageID == 0 {
+		t.Errorf("Expected the message ID in the ack, got %+v", ack)
+	}
+	for _, ws := range []*websocket.Conn{aliceWS, bobWS} {
+		got := expectWS(t, ws, handlers.WSMessage)
+		if got.Message == nil || got.Message.ID != ack.MessageID || got.Message.Content != "hello over ws" || got.Message.ChatterName != "Alice" {
+			t.Errorf("Expected Alice's message, got %+v", got)
+		}
+		if got.Message != nil && got.Message.Username != "" {
+			t.Errorf("Expected the username to be left out, got %+v", got.Message)
+		}
+	}
+
+	// Typing reaches everyone else in the room
+	sendWS(t, aliceWS, handlers.WSFrame{Type: handlers.WSTyping, RoomID: room.ID})
+	if typing := expectWS(t, bobWS, handlers.WSTyping); typing.Name != "Alice" || typing.RoomID != room.ID {
+		t.Errorf("Expected Alice to be typing, got %+v", typing)
+	}
+	sendWS(t, aliceWS, handlers.WSFrame{Type: handlers.WSTyping, ID: "t", RoomID: 999})
+	if failed := expectWS(t, aliceWS, handlers.WSError); failed.ID != "t" || failed.Code != handlers.WSErrNotSubscribed {
+		t.Errorf("Expected not_subscribed, got %+v", failed)
+	}
+
+	sendWS(t, aliceWS, handlers.WSFrame{Type: handlers.WSSend, ID: "m2", RoomID: 999, Content: "hi"})
+	if failed := expectWS(t, aliceWS, handlers.WSError); failed.ID != "m2" || failed.Code != handlers.APIErrNotFound {
+		t.Errorf("Expected not_found, got %+v", failed)
+	}
+	sendWS(t, aliceWS, handlers.WSFrame{Type: "shout", ID: "x"})
+	if failed := expectWS(t, aliceWS, handlers.WSError); failed.ID != "x" || failed.Code != handlers.WSErrUnknownType {
+		t.Errorf("Expected unknown_type, got %+v", failed)
+	}
+
+	// Slash commands are run rather than posted, their reply comes as a notice
+	sendWS(t, aliceWS, handlers.WSFrame{Type: handlers.WSSend, ID: "c1", RoomID: room.ID, Content: "/nick Alicia"})
+	got := map[string]handlers.WSFrame{}
+	for len(got) < 2 {
+		aliceWS.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var frame handlers.WSFrame
+		if err := websocket.JSON.Receive(aliceWS, &frame); err != nil {
+			t.Fatalf("Expected an ack and a notice, got %v", err)
+		}
+		if frame.Type != handlers.WSPing {
+			got[frame.Type] = frame
+		}
+	}
+	if ack := got[handlers.WSAck]; ack.ID != "c1" || ack.MessageID != 0 {
+		t.Errorf("Expected the command acked without a message, got %+v", ack)
+	}
+	if notice := got[handlers.WSNotice]; notice.Text != "You are now known as Alicia." {
+		t.Errorf("Expected the command's reply, got %+v", notice)
+	}
+	sendWS(t, aliceWS, handlers.WSFrame{Type: handlers.WSSend, ID: "c2", RoomID: room.ID, Content: "/nope"})
+	if failed := expectWS(t, aliceWS, handlers.WSError); failed.ID != "c2" || failed.Code != handlers.APIErrInvalidRequest {
+		t.Errorf("Expected unknown commands to fail, got %+v", failed)
+	}
+
+	// Events naming another room's message aren't passed on
+	other, _ := dal.InsertRoom(test.db, "Private", "")
+	alicia, _ := dal.GetChatterByUsername(test.db, "alice-session")
+	secret, _ := dal.InsertMessage(test.db, alicia.ID, other.ID, "secret")
+	common.PublishMessageEvent(test.nc, common.MessageEvent{ID: secret.ID, RoomID: room.ID, ChatterID: alicia.ID, Content: "forged"})
+	time.Sleep(100 * time.Millisecond)
+	sendWS(t, aliceWS, handlers.WSFrame{Type: handlers.WSPing, ID: "p"})
+	expectWS(t, aliceWS, handlers.WSPong)
+
+	// Resubscribing sends the history so far
+	sendWS(t, bobWS, handlers.WSFrame{Type: handlers.WSUnsubscribe, ID: "u", RoomID: room.ID})
+	expectWS(t, bobWS, handlers.WSAck)
+	sendWS(t, bobWS, handlers.WSFrame{Type: handlers.WSSubscribe, ID: "s", RoomID: room.ID})
+	expectWS(t, bobWS, handlers.WSAck)
+	if history := expectWS(t, bobWS, handlers.WSHistory); len(history.Messages) != 1 || history.Messages[0].ID != ack.MessageID {
+		t.Errorf("Expected Alice's message in the history, got %+v", history)
+	}
+
+	// Kicks unsubscribe the room
+	bob, err := dal.GetChatterByUsername(test.db, "bob-session")
+	if err != nil {
+		t.Fatalf("Expected the cookie to have started a chatter: %v", err)
+	}
+	common.PublishModerationEvent(test.nc, common.ModerationEvent{Action: common.ModerationKick, ChatterID: bob.ID, RoomID: room.ID})
+	if kicked := expectWS(t, bobWS, handlers.WSKicked); kicked.RoomID != room.ID {
+		t.Errorf("Expected a kick from room %d, got %+v", room.ID, kicked)
+	}
+}
+
+func TestWebSocketKeepalive(t *testing.T) {
+	cfg := common.DefaultConfig()
+	cfg.WebSocket.PingInterval = 50 * time.Millisecond
+	test := setupAPITest(t, "test-ws-keepalive", cfg)
+	alice := test.alice
+	server := httptest.NewServer(alice.router)
+	defer server.Close()
+
+	silent := mustDialWS(t, server, bearer(alice.token))
+	answering := mustDialWS(t, server, bearer(alice.token))
+
+	// A client that answers pings stays connected, one that doesn't is dropped
+	deadline := time.Now().Add(400 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		expectWS(t, answering, handlers.WSPing)
+		sendWS(t, answering, handlers.WSFrame{Type: handlers.WSPong})
+	}
+	sendWS(t, answering, handlers.WSFrame{Type: handlers.WSPing, ID: "still here"})
+	expectWS(t, answering, handlers.WSPong)
+
+	silent.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var frame handlers.WSFrame
+		if err := websocket.JSON.Receive(silent, &frame); err != nil {
+			break
+		}
+		if frame.Type != handlers.WSPing {
+			t.Fatalf("Expected only pings, got %+v", frame)
+		}
+	}
+}
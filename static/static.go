@@ -0,0 +1,20 @@
+package static
+
+import (
+	"embed"
+	"net/http"
+)
+
+// vendor holds a pinned copy of Datastar (v1.0.0-RC.1), so pages load no
+// scripts from third parties
+//
+//go:embed css vendor
+var files embed.FS
+
+// Prefix is the URL path the embedded assets are served under
+const Prefix = "/static/"
+
+// Handler serves the embedded assets, expected to be mounted at Prefix
+func Handler() http.Handler {
+	return http.StripPrefix(Prefix, http.FileServer(http.FS(files)))
+}